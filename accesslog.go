@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log/slog"
+	mathrand "math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// logged logs each request next serves when ACCESS_LOG is set, along with
+// its status, duration and the size of its response. Tracking requests are
+// sampled, as there's one per pageview, except for those failing.
+// Addresses and user agents are left out, as they are from the stats.
+func (s *server) logged(next http.Handler) http.Handler {
+	if !s.cfg.AccessLog {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+
+		if r.URL.Path == "/track" && rec.code < 500 && mathrand.Float64() >= s.cfg.AccessLogTrackSample {
+			return
+		}
+		s.logger.Info("Request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("route", r.Pattern),
+			slog.Int("status", rec.code),
+			slog.Duration("duration", time.Since(start)),
+			slog.Int("bytes", rec.bytes),
+		)
+	})
+}
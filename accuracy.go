@@ -0,0 +1,222 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// The day checked is the day before yesterday, over in every time zone, so
+// the raw event log has to be kept for three days
+const (
+	accuracyMinEventsDays = 3
+	// How many rows of the day's pages are compared, at random
+	accuracySampleRows = 1000
+	// How many reports /admin/accuracy returns, the last ones first
+	accuracyReportsListed = 30
+)
+
+// accuracyReport compares the visitors the sketches of a day's pages
+// estimate with the exact counts of the raw event log. Errors are relative
+// to the exact counts, the expected error being the standard error of the
+// sketches' parameters.
+type accuracyReport struct {
+	Day            time.Time `json:"day"`
+	CheckedAt      time.Time `json:"checked_at"`
+	Rows           int       `json:"sampled_rows"`
+	ExpectedError  float64   `json:"expected_error"`
+	MeanError      float64   `json:"mean_error"`
+	P95Error       float64   `json:"p95_error"`
+	MaxError       float64   `json:"max_error"`
+	WithinExpected float64   `json:"within_expected"`
+}
+
+// The columns of a report
+const accuracyReportColumns = `day, checked_at, sampled_rows, expected_error, mean_error, p95_error, max_error, within_expected`
+
+// scanAccuracyReport scans the columns of a report.
+func scanAccuracyReport(row interface{ Scan(...any) error }) (accuracyReport, error) {
+	var report accuracyReport
+	err := row.Scan(&report.Day, &report.CheckedAt, &report.Rows, &report.ExpectedError, &report.MeanError, &report.P95Error, &report.MaxError, &report.WithinExpected)
+	return report, err
+}
+
+// newAccuracyReport summarizes the errors of the estimates of the visitors
+// of rows, by their exact counts, the rows without any raw event being left
+// out. It returns nil when none is left.
+func newAccuracyReport(day time.Time, estimates []float64, exact []int, expected float64) *accuracyReport {
+	var relative []float64
+	for i, count := range exact {
+		if count > 0 {
+			relative = append(relative, math.Abs(estimates[i]-float64(count))/float64(count))
+		}
+	}
+	if len(relative) == 0 {
+		return nil
+	}
+	slices.Sort(relative)
+
+	report := &accuracyReport{Day: day, Rows: len(relative), ExpectedError: expected, MaxError: relative[len(relative)-1]}
+	within := 0
+	for _, e := range relative {
+		report.MeanError += e / float64(len(relative))
+		if e <= expected {
+			within++
+		}
+	}
+	report.P95Error = relative[int(math.Ceil(0.95*float64(len(relative))))-1]
+	report.WithinExpected = float64(within) / float64(len(relative))
+	return report
+}
+
+// checkAccuracy compares the estimates of a sample of the pages of the day
+// before yesterday with their exact counts, and stores the report. Days
+// already reported on, or that began before the raw event log did, aren't
+// checked.
+func (s *server) checkAccuracy(now time.Time) (*accuracyReport, error) {
+	day := dayIn(now, time.UTC).AddDate(0, 0, -2)
+
+	// Sites are a day ahead of UTC at most
+	var reported, logged bool
+	err := s.db.QueryRow(`
+	SELECT EXISTS (SELECT 1 FROM accuracy_reports WHERE day = $1),
+	COALESCE((SELECT MIN(recorded_at) FROM events_raw) < $2, false)
+	`, day, day.AddDate(0, 0, -1)).Scan(&reported, &logged)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query accuracy reports: %w", err)
+	}
+	if reported || !logged {
+		return nil, nil
+	}
+
+	estimate := "COALESCE(#(sample.visitor_hll), 0)"
+	if s.sketches.goHLL {
+		// Cardinalities are computed here
+		estimate = "sample.visitor_hll"
+	}
+	rows, err := s.db.Query(`
+	WITH sample AS (
+		SELECT sites.domain, pages.path, pages.visitor_hll FROM pages
+		JOIN sites ON sites.id = pages.site_id
+		WHERE pages.day = $1
+		ORDER BY random()
+		LIMIT $2
+	)
+	SELECT `+estimate+`, (
+		SELECT COUNT(DISTINCT visitor) FROM events_raw
+		WHERE events_raw.domain = sample.domain AND events_raw.day = $1 AND events_raw.path = sample.path
+		AND events_raw.environment <> 'preview' AND events_raw.event = 'pageview'
+	)
+	FROM sample
+	`, day, accuracySampleRows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sample pages: %w", err)
+	}
+	defer rows.Close()
+
+	var estimates []float64
+	var exact []int
+	for rows.Next() {
+		var estimated float64
+		var sketch []byte
+		var count int
+		if s.sketches.goHLL {
+			err = rows.Scan(&sketch, &count)
+			estimated = float64(hllCardinality(sketch))
+		} else {
+			err = rows.Scan(&estimated, &count)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan sampled page: %w", err)
+		}
+		estimates = append(estimates, estimated)
+		exact = append(exact, count)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to sample pages: %w", err)
+	}
+
+	report := newAccuracyReport(day, estimates, exact, s.sketches.relativeError())
+	if report == nil {
+		return nil, nil
+	}
+	err = s.db.QueryRow(`
+	INSERT INTO accuracy_reports (day, sampled_rows, expected_error, mean_error, p95_error, max_error, within_expected)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	ON CONFLICT (day) DO NOTHING
+	RETURNING checked_at
+	`, report.Day, report.Rows, report.ExpectedError, report.MeanError, report.P95Error, report.MaxError, report.WithinExpected).Scan(&report.CheckedAt)
+	if err == sql.ErrNoRows {
+		// Another instance reported on the day first
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to store accuracy report: %w", err)
+	}
+	return report, nil
+}
+
+// checkAccuracyEvery checks the accuracy of the sketches periodically. It
+// never returns.
+func (s *server) checkAccuracyEvery(interval time.Duration) {
+	for {
+		report, err := s.checkAccuracy(time.Now())
+		if err != nil {
+			s.logger.Error("Failed to check the accuracy of the sketches", slog.String("error", err.Error()))
+		} else if report != nil {
+			s.logger.Info("Checked the accuracy of the sketches",
+				slog.String("day", report.Day.Format(time.DateOnly)),
+				slog.Int("sampled_rows", report.Rows),
+				slog.Float64("expected_error", report.ExpectedError),
+				slog.Float64("mean_error", report.MeanError),
+				slog.Float64("p95_error", report.P95Error))
+		}
+		time.Sleep(interval)
+	}
+}
+
+// handleAccuracy returns the last accuracy reports, along with the error the
+// sketches are expected to have.
+func (s *server) handleAccuracy(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.RawEventsDays < accuracyMinEventsDays {
+		writeError(w, http.StatusInternalServerError, errNotConfigured, fmt.Sprintf("The accuracy check requires RAW_EVENTS_DAYS of %d or more", accuracyMinEventsDays))
+		return
+	}
+
+	rows, err := s.db.Query(`SELECT `+accuracyReportColumns+` FROM accuracy_reports ORDER BY day DESC LIMIT $1`, accuracyReportsListed)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to query accuracy reports", slog.String("error", err.Error()))
+		writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+		return
+	}
+	defer rows.Close()
+
+	reports := []accuracyReport{}
+	for rows.Next() {
+		report, err := scanAccuracyReport(rows)
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to scan accuracy report", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+		reports = append(reports, report)
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to query accuracy reports", slog.String("error", err.Error()))
+		writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		ExpectedError float64          `json:"expected_error"`
+		Reports       []accuracyReport `json:"reports"`
+	}{s.sketches.relativeError(), reports})
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestNewAccuracyReport(t *testing.T) {
+	day := time.Date(2024, 11, 5, 0, 0, 0, 0, time.UTC)
+
+	// The last row has no raw event, as when its pageviews were imported
+	estimates := []float64{100, 98, 110, 50, 7}
+	exact := []int{100, 100, 100, 50, 0}
+	report := newAccuracyReport(day, estimates, exact, 0.05)
+	if report == nil {
+		t.Fatal("newAccuracyReport() returned nil")
+	}
+
+	want := accuracyReport{Day: day, Rows: 4, ExpectedError: 0.05, MeanError: 0.03, P95Error: 0.1, MaxError: 0.1, WithinExpected: 0.75}
+	for name, values := range map[string][2]float64{
+		"mean_error":      {report.MeanError, want.MeanError},
+		"p95_error":       {report.P95Error, want.P95Error},
+		"max_error":       {report.MaxError, want.MaxError},
+		"within_expected": {report.WithinExpected, want.WithinExpected},
+	} {
+		if math.Abs(values[0]-values[1]) > 1e-9 {
+			t.Errorf("%s = %g, want %g", name, values[0], values[1])
+		}
+	}
+	if report.Rows != want.Rows || !report.Day.Equal(want.Day) || report.ExpectedError != want.ExpectedError {
+		t.Errorf("newAccuracyReport() = %+v, want %+v", *report, want)
+	}
+
+	if report := newAccuracyReport(day, []float64{3}, []int{0}, 0.05); report != nil {
+		t.Errorf("newAccuracyReport() reported on rows without raw events: %+v", *report)
+	}
+}
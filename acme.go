@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Let's Encrypt's production directory, used unless ACME_DIRECTORY_URL
+// says otherwise
+const letsEncryptDirectory = "https://acme-v02.api.letsencrypt.org/directory"
+
+// How long the ACME server is given to validate a challenge or issue a
+// certificate
+const acmePollTimeout = 2 * time.Minute
+
+// How often the status of a challenge or an order is checked, a variable so
+// that tests don't wait
+var acmePollInterval = 2 * time.Second
+
+// acmeClient obtains certificates from an ACME server (RFC 8555), proving
+// control of the domains with HTTP-01 challenges. Requests are signed with
+// the ES256 account key.
+type acmeClient struct {
+	directoryURL string
+	key          *ecdsa.PrivateKey
+	client       *http.Client
+
+	directory struct {
+		NewNonce   string `json:"newNonce"`
+		NewAccount string `json:"newAccount"`
+		NewOrder   string `json:"newOrder"`
+	}
+	// The URL of the account, identifying it in requests once registered
+	account string
+	nonce   string
+}
+
+// acmeProblem is an error returned by the ACME server.
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	status int
+}
+
+func (p *acmeProblem) Error() string {
+	return fmt.Sprintf("ACME server responded with %d: %s (%s)", p.status, p.Detail, p.Type)
+}
+
+func newACMEClient(directoryURL string, key *ecdsa.PrivateKey) *acmeClient {
+	return &acmeClient{directoryURL: directoryURL, key: key, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// register fetches the directory and creates the account of the key, or
+// finds it if it already exists.
+func (c *acmeClient) register(email string) error {
+	resp, err := c.client.Get(c.directoryURL)
+	if err != nil {
+		return fmt.Errorf("failed to fetch the ACME directory: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ACME directory responded with %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&c.directory); err != nil {
+		return fmt.Errorf("failed to decode the ACME directory: %w", err)
+	}
+
+	account := map[string]any{"termsOfServiceAgreed": true}
+	if email != "" {
+		account["contact"] = []string{"mailto:" + email}
+	}
+	header, _, err := c.post(c.directory.NewAccount, account, nil)
+	if err != nil {
+		return fmt.Errorf("failed to register the ACME account: %w", err)
+	}
+	c.account = header.Get("Location")
+	if c.account == "" {
+		return errors.New("ACME server didn't return the URL of the account")
+	}
+	return nil
+}
+
+// acmeOrder is an order of a certificate.
+type acmeOrder struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+}
+
+// acmeAuthorization is the proof of control of a domain an order waits for.
+type acmeAuthorization struct {
+	Status     string `json:"status"`
+	Challenges []struct {
+		Type  string `json:"type"`
+		URL   string `json:"url"`
+		Token string `json:"token"`
+	} `json:"challenges"`
+}
+
+// obtain orders a certificate for domain, returning its chain and its
+// private key as PEM. accept is called with the token and the key
+// authorization of each HTTP-01 challenge, to be served at
+// /.well-known/acme-challenge/{token} before the server checks it.
+func (c *acmeClient) obtain(domain string, accept func(token string, keyAuthorization string) error) ([]byte, []byte, error) {
+	var order acmeOrder
+	header, _, err := c.post(c.directory.NewOrder, map[string]any{
+		"identifiers": []map[string]string{{"type": "dns", "value": domain}},
+	}, &order)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create the order: %w", err)
+	}
+	orderURL := header.Get("Location")
+
+	for _, authorizationURL := range order.Authorizations {
+		if err := c.authorize(authorizationURL, accept); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate the certificate key: %w", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: []string{domain},
+	}, certKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create the certificate request: %w", err)
+	}
+	if _, _, err := c.post(order.Finalize, map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csr)}, &order); err != nil {
+		return nil, nil, fmt.Errorf("failed to finalize the order: %w", err)
+	}
+
+	// The certificate may take a moment to be issued
+	deadline := time.Now().Add(acmePollTimeout)
+	for order.Status != "valid" {
+		if order.Status == "invalid" || time.Now().After(deadline) {
+			return nil, nil, fmt.Errorf("order is %s", order.Status)
+		}
+		time.Sleep(acmePollInterval)
+		if _, _, err := c.post(orderURL, nil, &order); err != nil {
+			return nil, nil, fmt.Errorf("failed to fetch the order: %w", err)
+		}
+	}
+
+	_, chain, err := c.post(order.Certificate, nil, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to download the certificate: %w", err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return chain, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// authorize completes the HTTP-01 challenge of an authorization, unless it's
+// valid already, and waits for the server to validate it.
+func (c *acmeClient) authorize(authorizationURL string, accept func(token string, keyAuthorization string) error) error {
+	var authorization acmeAuthorization
+	if _, _, err := c.post(authorizationURL, nil, &authorization); err != nil {
+		return fmt.Errorf("failed to fetch the authorization: %w", err)
+	}
+	if authorization.Status == "valid" {
+		return nil
+	}
+
+	challenge := -1
+	for i, ch := range authorization.Challenges {
+		if ch.Type == "http-01" {
+			challenge = i
+		}
+	}
+	if challenge < 0 {
+		return errors.New("ACME server offered no HTTP-01 challenge")
+	}
+	ch := authorization.Challenges[challenge]
+	if err := accept(ch.Token, ch.Token+"."+c.thumbprint()); err != nil {
+		return err
+	}
+	if _, _, err := c.post(ch.URL, map[string]any{}, nil); err != nil {
+		return fmt.Errorf("failed to accept the challenge: %w", err)
+	}
+
+	deadline := time.Now().Add(acmePollTimeout)
+	for authorization.Status != "valid" {
+		if authorization.Status == "invalid" || time.Now().After(deadline) {
+			return fmt.Errorf("authorization is %s", authorization.Status)
+		}
+		time.Sleep(acmePollInterval)
+		if _, _, err := c.post(authorizationURL, nil, &authorization); err != nil {
+			return fmt.Errorf("failed to fetch the authorization: %w", err)
+		}
+	}
+	return nil
+}
+
+// The largest response of the ACME server read, certificate chains being a
+// few kilobytes
+const acmeMaxResponse = 1 << 20
+
+// post sends a signed request to url, returning the headers and the body of
+// the response, also decoded into out if it isn't nil. A nil payload makes
+// it a POST-as-GET. Requests refused for an expired nonce are retried once
+// with the new one.
+func (c *acmeClient) post(url string, payload any, out any) (http.Header, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := c.postOnce(url, payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, acmeMaxResponse))
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read the response: %w", err)
+		}
+
+		if resp.StatusCode/100 != 2 {
+			problem := &acmeProblem{status: resp.StatusCode}
+			json.Unmarshal(body, problem)
+			if problem.Type == "urn:ietf:params:acme:error:badNonce" && attempt == 0 {
+				continue
+			}
+			return nil, nil, problem
+		}
+		if out != nil {
+			if err := json.Unmarshal(body, out); err != nil {
+				return nil, nil, fmt.Errorf("failed to decode the response: %w", err)
+			}
+		}
+		return resp.Header, body, nil
+	}
+}
+
+func (c *acmeClient) postOnce(url string, payload any) (*http.Response, error) {
+	if c.nonce == "" {
+		resp, err := c.client.Head(c.directory.NewNonce)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get a nonce: %w", err)
+		}
+		resp.Body.Close()
+		c.nonce = resp.Header.Get("Replay-Nonce")
+	}
+
+	body, err := c.sign(url, payload)
+	if err != nil {
+		return nil, err
+	}
+	c.nonce = ""
+	resp, err := c.client.Post(url, "application/jose+json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	c.nonce = resp.Header.Get("Replay-Nonce")
+	return resp, nil
+}
+
+// sign returns the JWS of a request to url, identifying the account by its
+// URL once it's registered and by its key before.
+func (c *acmeClient) sign(url string, payload any) ([]byte, error) {
+	protected := map[string]any{"alg": "ES256", "nonce": c.nonce, "url": url}
+	if c.account != "" {
+		protected["kid"] = c.account
+	} else {
+		protected["jwk"] = c.jwk()
+	}
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+
+	// POST-as-GET requests have an empty payload
+	var encodedPayload string
+	if payload != nil {
+		p, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		encodedPayload = base64.RawURLEncoding.EncodeToString(p)
+	}
+
+	encodedHeader := base64.RawURLEncoding.EncodeToString(header)
+	digest := sha256.Sum256([]byte(encodedHeader + "." + encodedPayload))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	// ES256 signatures are r and s as 32 bytes each
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return json.Marshal(map[string]string{
+		"protected": encodedHeader,
+		"payload":   encodedPayload,
+		"signature": base64.RawURLEncoding.EncodeToString(signature),
+	})
+}
+
+// jwk returns the public account key as a JSON Web Key, its members in
+// the lexicographic order its thumbprint requires.
+func (c *acmeClient) jwk() json.RawMessage {
+	// The uncompressed point is 0x04 followed by its coordinates
+	public, _ := c.key.PublicKey.ECDH()
+	point := public.Bytes()
+	x := base64.RawURLEncoding.EncodeToString(point[1:33])
+	y := base64.RawURLEncoding.EncodeToString(point[33:])
+	return json.RawMessage(`{"crv":"P-256","kty":"EC","x":"` + x + `","y":"` + y + `"}`)
+}
+
+// thumbprint returns the JWK thumbprint of the account key (RFC 7638), part
+// of the key authorizations of challenges.
+func (c *acmeClient) thumbprint() string {
+	digest := sha256.Sum256(c.jwk())
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+// parseECKey parses an EC private key encoded as PEM.
+func parseECKey(encoded string) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil || !strings.HasSuffix(block.Type, "PRIVATE KEY") {
+		return nil, errors.New("invalid private key")
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
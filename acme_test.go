@@ -0,0 +1,363 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testACMEServer is an ACME server checking the requests of the client as
+// Let's Encrypt would: their signature by the account key, their single-use
+// nonce and their URL. It issues certificates signed by a test CA once the
+// HTTP-01 challenge is accepted with the right key authorization.
+type testACMEServer struct {
+	*httptest.Server
+	t *testing.T
+
+	ca    *x509.Certificate
+	caKey *ecdsa.PrivateKey
+
+	mu         sync.Mutex
+	nonces     map[string]bool
+	nextNonce  int
+	accountKey *ecdsa.PublicKey
+	// Refuses the first request with badNonce, as when a nonce expires
+	expireNonce bool
+	// The key authorization expected for the challenge, and whether it was
+	// served
+	token      string
+	accepted   bool
+	authorized bool
+	// Invalidates the authorization rather than validating it
+	failChallenge bool
+	certificate   []byte
+}
+
+func newTestACMEServer(t *testing.T) *testACMEServer {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+
+	acme := &testACMEServer{t: t, ca: ca, caKey: caKey, nonces: map[string]bool{}, token: "challenge-token"}
+	acme.Server = httptest.NewServer(http.HandlerFunc(acme.serve))
+	t.Cleanup(acme.Close)
+	return acme
+}
+
+func (acme *testACMEServer) newNonce() string {
+	acme.nextNonce++
+	nonce := fmt.Sprintf("nonce-%d", acme.nextNonce)
+	acme.nonces[nonce] = true
+	return nonce
+}
+
+func (acme *testACMEServer) problem(w http.ResponseWriter, status int, kind string, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"type": "urn:ietf:params:acme:error:" + kind, "detail": detail})
+}
+
+func (acme *testACMEServer) serve(w http.ResponseWriter, r *http.Request) {
+	acme.mu.Lock()
+	defer acme.mu.Unlock()
+
+	w.Header().Set("Replay-Nonce", acme.newNonce())
+	if r.URL.Path == "/directory" {
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   acme.URL + "/new-nonce",
+			"newAccount": acme.URL + "/new-account",
+			"newOrder":   acme.URL + "/new-order",
+		})
+		return
+	}
+	if r.URL.Path == "/new-nonce" {
+		return
+	}
+
+	payload, ok := acme.verify(w, r)
+	if !ok {
+		return
+	}
+	switch r.URL.Path {
+	case "/new-account":
+		w.Header().Set("Location", acme.URL+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"status": "valid"})
+	case "/new-order":
+		w.Header().Set("Location", acme.URL+"/order/1")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(acme.order())
+	case "/order/1":
+		json.NewEncoder(w).Encode(acme.order())
+	case "/authz/1":
+		status := "pending"
+		switch {
+		case acme.accepted && acme.failChallenge:
+			status = "invalid"
+		case acme.accepted:
+			status, acme.authorized = "valid", true
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"status":     status,
+			"challenges": []map[string]string{{"type": "dns-01", "url": acme.URL + "/challenge/dns", "token": "dns"}, {"type": "http-01", "url": acme.URL + "/challenge/1", "token": acme.token}},
+		})
+	case "/challenge/1":
+		acme.accepted = true
+		json.NewEncoder(w).Encode(map[string]string{"status": "processing"})
+	case "/finalize/1":
+		if !acme.authorized {
+			acme.problem(w, http.StatusForbidden, "orderNotReady", "The order is not ready")
+			return
+		}
+		var request struct {
+			CSR string `json:"csr"`
+		}
+		json.Unmarshal(payload, &request)
+		der, _ := base64.RawURLEncoding.DecodeString(request.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil || csr.CheckSignature() != nil {
+			acme.problem(w, http.StatusBadRequest, "badCSR", "Invalid CSR")
+			return
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      csr.Subject,
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		cert, err := x509.CreateCertificate(rand.Reader, template, acme.ca, csr.PublicKey, acme.caKey)
+		if err != nil {
+			acme.t.Errorf("CreateCertificate: %v", err)
+		}
+		acme.certificate = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+		json.NewEncoder(w).Encode(acme.order())
+	case "/certificate/1":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(acme.certificate)
+		w.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: acme.ca.Raw}))
+	default:
+		acme.problem(w, http.StatusNotFound, "malformed", "Unknown URL")
+	}
+}
+
+func (acme *testACMEServer) order() map[string]any {
+	order := map[string]any{"status": "pending", "authorizations": []string{acme.URL + "/authz/1"}, "finalize": acme.URL + "/finalize/1"}
+	if acme.certificate != nil {
+		order["status"], order["certificate"] = "valid", acme.URL+"/certificate/1"
+	}
+	return order
+}
+
+// verify checks the JWS of a request, returning its payload.
+func (acme *testACMEServer) verify(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}
+	body, _ := io.ReadAll(r.Body)
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/jose+json" || json.Unmarshal(body, &jws) != nil {
+		acme.problem(w, http.StatusBadRequest, "malformed", "Expected a JWS")
+		return nil, false
+	}
+
+	var protected struct {
+		Alg   string          `json:"alg"`
+		Nonce string          `json:"nonce"`
+		URL   string          `json:"url"`
+		KID   string          `json:"kid"`
+		JWK   json.RawMessage `json:"jwk"`
+	}
+	header, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	json.Unmarshal(header, &protected)
+	if acme.expireNonce {
+		acme.expireNonce = false
+		acme.problem(w, http.StatusBadRequest, "badNonce", "The nonce expired")
+		return nil, false
+	}
+	if !acme.nonces[protected.Nonce] {
+		acme.problem(w, http.StatusBadRequest, "badNonce", "Unknown nonce "+protected.Nonce)
+		return nil, false
+	}
+	delete(acme.nonces, protected.Nonce)
+	if protected.Alg != "ES256" || protected.URL != acme.URL+r.URL.Path {
+		acme.problem(w, http.StatusBadRequest, "malformed", "Invalid protected header")
+		return nil, false
+	}
+
+	// The account is identified by its key when it registers, and by its URL
+	// afterwards
+	key := acme.accountKey
+	switch {
+	case r.URL.Path == "/new-account" && protected.JWK != nil && protected.KID == "":
+		var jwk struct {
+			Crv, Kty, X, Y string
+		}
+		json.Unmarshal(protected.JWK, &jwk)
+		x, _ := base64.RawURLEncoding.DecodeString(jwk.X)
+		y, _ := base64.RawURLEncoding.DecodeString(jwk.Y)
+		key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		acme.accountKey = key
+	case r.URL.Path != "/new-account" && protected.KID == acme.URL+"/account/1" && protected.JWK == nil:
+	default:
+		acme.problem(w, http.StatusBadRequest, "malformed", "Expected the jwk to register and the kid afterwards")
+		return nil, false
+	}
+
+	signature, _ := base64.RawURLEncoding.DecodeString(jws.Signature)
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if key == nil || len(signature) != 64 || !ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		acme.problem(w, http.StatusUnauthorized, "unauthorized", "Invalid signature")
+		return nil, false
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	return payload, true
+}
+
+func newTestACMEClient(t *testing.T, acme *testACMEServer) *acmeClient {
+	t.Helper()
+	interval := acmePollInterval
+	acmePollInterval = time.Millisecond
+	t.Cleanup(func() { acmePollInterval = interval })
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newACMEClient(acme.URL+"/directory", key)
+}
+
+func TestACMEObtain(t *testing.T) {
+	acme := newTestACMEServer(t)
+	acme.expireNonce = true
+	client := newTestACMEClient(t, acme)
+
+	if err := client.register("admin@example.com"); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if client.account != acme.URL+"/account/1" {
+		t.Errorf("account = %q, want the URL of the account", client.account)
+	}
+
+	var served []string
+	chain, keyPEM, err := client.obtain("stats.example.com", func(token string, keyAuthorization string) error {
+		served = append(served, token)
+		// The key authorization is the token and the thumbprint of the
+		// account key (RFC 8555 section 8.1)
+		public, _ := client.key.PublicKey.ECDH()
+		point := public.Bytes()
+		jwk := fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, base64.RawURLEncoding.EncodeToString(point[1:33]), base64.RawURLEncoding.EncodeToString(point[33:]))
+		digest := sha256.Sum256([]byte(jwk))
+		if want := token + "." + base64.RawURLEncoding.EncodeToString(digest[:]); keyAuthorization != want {
+			t.Errorf("key authorization = %q, want %q", keyAuthorization, want)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("obtain: %v", err)
+	}
+	if len(served) != 1 || served[0] != acme.token {
+		t.Errorf("served the challenges %q, want the HTTP-01 one only", served)
+	}
+
+	block, rest := pem.Decode(chain)
+	if block == nil || !strings.Contains(string(rest), "CERTIFICATE") {
+		t.Fatalf("the chain doesn't have the certificate and its issuer: %s", chain)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.VerifyHostname("stats.example.com"); err != nil {
+		t.Errorf("the certificate isn't for the domain: %v", err)
+	}
+	key, err := parseECKey(string(keyPEM))
+	if err != nil {
+		t.Fatalf("parseECKey: %v", err)
+	}
+	if !key.PublicKey.Equal(cert.PublicKey) {
+		t.Errorf("the key returned isn't the key of the certificate")
+	}
+}
+
+func TestACMEObtainFailures(t *testing.T) {
+	t.Run("invalid challenge", func(t *testing.T) {
+		acme := newTestACMEServer(t)
+		acme.failChallenge = true
+		client := newTestACMEClient(t, acme)
+		if err := client.register(""); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+		_, _, err := client.obtain("stats.example.com", func(string, string) error { return nil })
+		if err == nil || !strings.Contains(err.Error(), "authorization is invalid") {
+			t.Errorf("obtain() = %v, want the authorization to be invalid", err)
+		}
+	})
+
+	t.Run("challenge not served", func(t *testing.T) {
+		acme := newTestACMEServer(t)
+		client := newTestACMEClient(t, acme)
+		if err := client.register(""); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+		_, _, err := client.obtain("stats.example.com", func(string, string) error { return fmt.Errorf("no listener") })
+		if err == nil || acme.accepted {
+			t.Errorf("obtain() = %v with the challenge accepted %v, want the error of accept", err, acme.accepted)
+		}
+	})
+
+	t.Run("problem", func(t *testing.T) {
+		acme := newTestACMEServer(t)
+		client := newTestACMEClient(t, acme)
+		if err := client.register(""); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+		_, _, err := client.post(acme.URL+"/unknown", nil, nil)
+		problem, ok := err.(*acmeProblem)
+		if !ok || problem.status != http.StatusNotFound || problem.Type != "urn:ietf:params:acme:error:malformed" {
+			t.Errorf("post() = %v, want the problem of the server", err)
+		}
+	})
+}
+
+func TestParseECKey(t *testing.T) {
+	if _, err := parseECKey("not a key"); err == nil {
+		t.Errorf("parseECKey accepted an invalid key")
+	}
+	block := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("x")})
+	if _, err := parseECKey(string(block)); err == nil {
+		t.Errorf("parseECKey accepted a certificate")
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Key of the advisory lock held while evaluating alerts, so that a single
+// instance notifies each of them
+const alertsLock = 7108307
+
+// Traffic alerts compare the hours they look at with the day before them, so
+// the raw event log has to be kept for two days
+const (
+	alertTrailingHours = 24
+	alertMinEventsDays = 2
+)
+
+// alert watches a domain's traffic for a spike or a drop.
+type alert struct {
+	ID     int64  `json:"id"`
+	Domain string `json:"domain"`
+	// "spike" or "drop"
+	Kind string `json:"kind"`
+	// How many times the trailing average the last hour's visitors must be
+	// for a spike
+	Factor float64 `json:"factor,omitempty"`
+	// How many hours without a pageview make a drop
+	Hours     int        `json:"hours,omitempty"`
+	Email     string     `json:"email,omitempty"`
+	Webhook   string     `json:"webhook_url,omitempty"`
+	Firing    bool       `json:"firing"`
+	FiredAt   *time.Time `json:"fired_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// The columns of an alert, in the order of its fields
+const alertColumns = `id, domain, kind, factor, hours, COALESCE(email, ''), COALESCE(webhook_url, ''), firing, fired_at, created_at`
+
+// scanAlert scans the columns of an alert.
+func scanAlert(row interface{ Scan(...any) error }) (alert, error) {
+	var a alert
+	err := row.Scan(&a.ID, &a.Domain, &a.Kind, &a.Factor, &a.Hours, &a.Email, &a.Webhook, &a.Firing, &a.FiredAt, &a.CreatedAt)
+	if a.Kind == "spike" {
+		a.Hours = 0
+	} else {
+		a.Factor = 0
+	}
+	return a, err
+}
+
+// checkAlert reports whether the alert's condition is met, with the
+// notification describing it.
+func (s *server) checkAlert(a alert, now time.Time) (bool, notification, error) {
+	n := notification{Domain: a.Domain, Event: "alerts", Time: now}
+
+	switch a.Kind {
+	case "spike":
+		// The trailing average is of the hours before the last one, those
+		// without visitors included
+		var visitors int
+		var average float64
+		err := s.db.QueryRow(`
+		SELECT
+			(SELECT COUNT(DISTINCT visitor) FROM events_raw WHERE domain = $1 AND recorded_at >= $2),
+			(SELECT COALESCE(SUM(visitors), 0)::float8 / $4 FROM (
+				SELECT COUNT(DISTINCT visitor) AS visitors FROM events_raw
+				WHERE domain = $1 AND recorded_at >= $3 AND recorded_at < $2
+				GROUP BY floor(extract(epoch FROM $2::timestamptz - recorded_at) / 3600)
+			) AS hours)
+		`, a.Domain, now.Add(-time.Hour), now.Add(-(alertTrailingHours+1)*time.Hour), alertTrailingHours).Scan(&visitors, &average)
+		if err != nil {
+			return false, n, fmt.Errorf("failed to query the hourly visitors of %s: %w", a.Domain, err)
+		}
+		if average == 0 || float64(visitors) <= a.Factor*average {
+			return false, n, nil
+		}
+		n.Title = "Traffic spike on " + a.Domain
+		n.Text = fmt.Sprintf("%d visitors in the last hour, %.1f times the hourly average of the previous %d hours (%.1f).", visitors, float64(visitors)/average, alertTrailingHours, average)
+		return true, n, nil
+
+	case "drop":
+		// A domain that was already quiet the day before hasn't dropped
+		var recent, before bool
+		since := now.Add(-time.Duration(a.Hours) * time.Hour)
+		err := s.db.QueryRow(`
+		SELECT
+			EXISTS (SELECT 1 FROM events_raw WHERE domain = $1 AND recorded_at >= $2),
+			EXISTS (SELECT 1 FROM events_raw WHERE domain = $1 AND recorded_at >= $3 AND recorded_at < $2)
+		`, a.Domain, since, since.Add(-alertTrailingHours*time.Hour)).Scan(&recent, &before)
+		if err != nil {
+			return false, n, fmt.Errorf("failed to query the recent pageviews of %s: %w", a.Domain, err)
+		}
+		if recent || !before {
+			return false, n, nil
+		}
+		n.Title = "Traffic drop on " + a.Domain
+		n.Text = fmt.Sprintf("No pageviews in the last %d hours.", a.Hours)
+		return true, n, nil
+	}
+	return false, n, fmt.Errorf("unknown alert kind %q", a.Kind)
+}
+
+// evaluateAlerts checks every alert, notifying those that start firing, and
+// the channels of their sites. An alert fires once until its condition is
+// over. It does nothing when another
+// instance is already at it.
+func (s *server) evaluateAlerts(now time.Time) error {
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get a connection: %w", err)
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, alertsLock).Scan(&locked); err != nil {
+		return fmt.Errorf("failed to lock alerts: %w", err)
+	}
+	if !locked {
+		return nil
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, alertsLock)
+
+	alerts, err := s.listAlerts("")
+	if err != nil {
+		return err
+	}
+	for _, a := range alerts {
+		firing, n, err := s.checkAlert(a, now)
+		if err != nil {
+			return err
+		}
+		if firing == a.Firing {
+			continue
+		}
+
+		if _, err := s.db.Exec(`UPDATE alerts SET firing = $2, fired_at = CASE WHEN $2 THEN $3 ELSE fired_at END WHERE id = $1`, a.ID, firing, now); err != nil {
+			return fmt.Errorf("failed to update alert: %w", err)
+		}
+		if firing {
+			if err := s.notifyAlert(a, n); err != nil {
+				s.logger.Error("Failed to notify alert", slog.String("domain", a.Domain), slog.Int64("alert", a.ID), slog.String("error", err.Error()))
+			}
+			if err := s.notifySite(n); err != nil {
+				s.logger.Error("Failed to notify site", slog.String("domain", a.Domain), slog.String("error", err.Error()))
+			}
+		}
+	}
+	return nil
+}
+
+// notifyAlert delivers a firing alert by email, or to its webhook.
+func (s *server) notifyAlert(a alert, n notification) error {
+	kind, target := "email", a.Email
+	if a.Webhook != "" {
+		kind, target = "webhook", a.Webhook
+	}
+	channel, err := s.newNotifier(kind, target)
+	if err != nil {
+		return err
+	}
+	return channel.notify(n)
+}
+
+// listAlerts returns the alerts of a domain, or all of them.
+func (s *server) listAlerts(domain string) ([]alert, error) {
+	rows, err := s.db.Query(`SELECT `+alertColumns+` FROM alerts WHERE $1 = '' OR domain = $1 ORDER BY domain, id`, domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query alerts: %w", err)
+	}
+	defer rows.Close()
+
+	alerts := []alert{}
+	for rows.Next() {
+		a, err := scanAlert(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan alert: %w", err)
+		}
+		alerts = append(alerts, a)
+	}
+	return alerts, rows.Err()
+}
+
+// evaluateAlertsEvery evaluates the alerts periodically. It never returns.
+func (s *server) evaluateAlertsEvery(interval time.Duration) {
+	for {
+		if err := s.evaluateAlerts(time.Now()); err != nil {
+			s.logger.Error("Failed to evaluate alerts", slog.String("error", err.Error()))
+		}
+		time.Sleep(interval)
+	}
+}
+
+// handleAlerts lists the alerts (GET), creates one (POST) or deletes one
+// (DELETE).
+func (s *server) handleAlerts(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	switch r.Method {
+	case http.MethodGet:
+		alerts, err := s.listAlerts(query.Get("domain"))
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to query alerts", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(alerts)
+
+	case http.MethodPost:
+		if s.cfg.RawEventsDays < alertMinEventsDays {
+			writeError(w, http.StatusInternalServerError, errNotConfigured, "Alerts require RAW_EVENTS_DAYS of 2 or more")
+			return
+		}
+		a, ok := parseAlert(w, query)
+		if !ok {
+			return
+		}
+		if a.Email != "" && s.cfg.SMTPURL == nil {
+			writeError(w, http.StatusInternalServerError, errNotConfigured, "SMTP_URL is not set")
+			return
+		}
+
+		a, err := scanAlert(s.db.QueryRow(`
+		INSERT INTO alerts (domain, kind, factor, hours, email, webhook_url)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, ''))
+		RETURNING `+alertColumns, a.Domain, a.Kind, a.Factor, a.Hours, a.Email, a.Webhook))
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to create alert", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(a)
+
+	case http.MethodDelete:
+		id, err := strconv.ParseInt(query.Get("id"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid id parameter, expected the id of an alert")
+			return
+		}
+
+		if _, err := s.db.Exec(`DELETE FROM alerts WHERE id = $1`, id); err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to delete alert", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// parseAlert returns the alert described by the query parameters, replying
+// with an error and returning false when they're invalid.
+func parseAlert(w http.ResponseWriter, query url.Values) (alert, bool) {
+	a := alert{Domain: query.Get("domain"), Kind: query.Get("kind"), Factor: 3, Hours: 2}
+	if a.Domain == "" {
+		writeError(w, http.StatusBadRequest, errMissingParameter, "Missing domain parameter")
+		return a, false
+	}
+
+	switch a.Kind {
+	case "spike":
+		if value := query.Get("factor"); value != "" {
+			factor, err := strconv.ParseFloat(value, 64)
+			if err != nil || factor <= 1 {
+				writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid factor parameter, expected a number greater than 1")
+				return a, false
+			}
+			a.Factor = factor
+		}
+	case "drop":
+		if value := query.Get("hours"); value != "" {
+			hours, err := strconv.Atoi(value)
+			if err != nil || hours < 1 || hours > alertTrailingHours {
+				writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid hours parameter, expected a number between 1 and 24")
+				return a, false
+			}
+			a.Hours = hours
+		}
+	default:
+		writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid kind parameter, expected spike or drop")
+		return a, false
+	}
+
+	email, webhook := query.Get("email"), query.Get("webhook_url")
+	switch {
+	case (email == "") == (webhook == ""):
+		writeError(w, http.StatusBadRequest, errMissingParameter, "Expected either an email or a webhook_url parameter")
+		return a, false
+	case email != "":
+		address, err := mail.ParseAddress(email)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid email parameter, expected an email address")
+			return a, false
+		}
+		a.Email = address.Address
+	default:
+		u, err := url.Parse(webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid webhook_url parameter, expected an HTTP URL")
+			return a, false
+		}
+		a.Webhook = webhook
+	}
+	return a, true
+}
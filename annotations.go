@@ -0,0 +1,229 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The longest text an annotation can have, in characters
+const annotationMaxLength = 500
+
+// annotation marks days of a domain's stats, like a deploy, a campaign or an
+// incident. Annotations of a single day start and end on it.
+type annotation struct {
+	ID        int64     `json:"id"`
+	Domain    string    `json:"domain"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// The columns of an annotation, in the order of its fields
+const annotationColumns = `id, domain, start_day, end_day, text, created_at`
+
+// scanAnnotation scans the columns of an annotation.
+func scanAnnotation(row interface{ Scan(...any) error }) (annotation, error) {
+	var a annotation
+	err := row.Scan(&a.ID, &a.Domain, &a.Start, &a.End, &a.Text, &a.CreatedAt)
+	return a, err
+}
+
+// listAnnotations returns the annotations of a domain, or of all of them,
+// overlapping the range from start to end, oldest first.
+func (s *server) listAnnotations(domain string, start time.Time, end time.Time) ([]annotation, error) {
+	rows, err := s.db.Query(`
+	SELECT `+annotationColumns+` FROM annotations
+	WHERE ($1 = '' OR domain = $1) AND start_day <= $3 AND end_day >= $2
+	ORDER BY start_day, id
+	`, domain, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query annotations: %w", err)
+	}
+	defer rows.Close()
+
+	annotations := []annotation{}
+	for rows.Next() {
+		a, err := scanAnnotation(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan annotation: %w", err)
+		}
+		annotations = append(annotations, a)
+	}
+	return annotations, rows.Err()
+}
+
+// handleAnnotations lists the annotations overlapping a range (GET), adds one
+// (POST), changes one (PATCH) or deletes one (DELETE).
+func (s *server) handleAnnotations(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	switch r.Method {
+	case http.MethodGet:
+		start, end, err := s.parseDateRange(query)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidParameter, err.Error())
+			return
+		}
+		annotations, err := s.listAnnotations(query.Get("domain"), start, end)
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to query annotations", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(annotations)
+
+	case http.MethodPost:
+		a := annotation{Domain: strings.ToLower(query.Get("domain"))}
+		if a.Domain == "" {
+			writeError(w, http.StatusBadRequest, errMissingParameter, "Missing domain parameter")
+			return
+		}
+		if query.Get("start") == "" {
+			writeError(w, http.StatusBadRequest, errMissingParameter, "Missing start parameter")
+			return
+		}
+		if query.Get("text") == "" {
+			writeError(w, http.StatusBadRequest, errMissingParameter, "Missing text parameter")
+			return
+		}
+		a, ok := parseAnnotation(w, query, a)
+		if !ok {
+			return
+		}
+
+		a, err := scanAnnotation(s.db.QueryRow(`
+		INSERT INTO annotations (domain, start_day, end_day, text)
+		VALUES ($1, $2, $3, $4)
+		RETURNING `+annotationColumns, a.Domain, a.Start, a.End, a.Text))
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to create annotation", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+		// The cached stats of the domain have its previous annotations
+		s.cache.forget(a.Domain)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(a)
+
+	case http.MethodPatch:
+		id, err := strconv.ParseInt(query.Get("id"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid id parameter, expected the id of an annotation")
+			return
+		}
+
+		a, err := scanAnnotation(s.db.QueryRow(`SELECT `+annotationColumns+` FROM annotations WHERE id = $1`, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errNotFound, "No annotation with this id")
+			return
+		}
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to query annotation", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+		a, ok := parseAnnotation(w, query, a)
+		if !ok {
+			return
+		}
+
+		a, err = scanAnnotation(s.db.QueryRow(`
+		UPDATE annotations SET start_day = $2, end_day = $3, text = $4
+		WHERE id = $1
+		RETURNING `+annotationColumns, id, a.Start, a.End, a.Text))
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errNotFound, "No annotation with this id")
+			return
+		}
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to update annotation", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+		s.cache.forget(a.Domain)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(a)
+
+	case http.MethodDelete:
+		id, err := strconv.ParseInt(query.Get("id"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid id parameter, expected the id of an annotation")
+			return
+		}
+
+		var domain string
+		err = s.db.QueryRow(`DELETE FROM annotations WHERE id = $1 RETURNING domain`, id).Scan(&domain)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			s.logger.ErrorContext(r.Context(), "Failed to delete annotation", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+		if err == nil {
+			s.cache.forget(domain)
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, PATCH, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// parseAnnotation returns a with the start, end and text given by the query
+// parameters, replying with an error and returning false when they're
+// invalid. Moving the start of an annotation past its end makes it a single
+// day.
+func parseAnnotation(w http.ResponseWriter, query url.Values, a annotation) (annotation, bool) {
+	if value := query.Get("start"); value != "" {
+		start, err := time.Parse(time.DateOnly, value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid start parameter, expected YYYY-MM-DD")
+			return a, false
+		}
+		a.Start = start
+		if a.End.Before(start) {
+			a.End = start
+		}
+	}
+	if value := query.Get("end"); value != "" {
+		end, err := time.Parse(time.DateOnly, value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid end parameter, expected YYYY-MM-DD")
+			return a, false
+		}
+		if end.Before(a.Start) {
+			writeError(w, http.StatusBadRequest, errInvalidParameter, "The start parameter must be before the end parameter")
+			return a, false
+		}
+		a.End = end
+	}
+
+	if query.Has("text") {
+		a.Text = strings.TrimSpace(query.Get("text"))
+		if a.Text == "" || utf8.RuneCountInString(a.Text) > annotationMaxLength {
+			writeError(w, http.StatusBadRequest, errInvalidParameter, fmt.Sprintf("Invalid text parameter, expected 1 to %d characters", annotationMaxLength))
+			return a, false
+		}
+	}
+	return a, true
+}
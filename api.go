@@ -0,0 +1,601 @@
+package main
+
+import (
+	"net/http"
+)
+
+// routeAuth is how the requests to a route are authenticated.
+type routeAuth int
+
+const (
+	// Anyone can call the route
+	authNone routeAuth = iota
+	// The route requires the API key
+	authAPIKey
+	// The route is a read-only stats endpoint: it accepts the API key or a
+	// signed URL, is also served under share links and for public sites, and
+	// its responses are cached
+	authStats
+	// The route is served under a share link
+	authShare
+	// The route is served for a public site, under its domain
+	authPublic
+)
+
+// apiParam is a parameter a route accepts, in its query unless it's part of
+// its path.
+type apiParam struct {
+	name        string
+	description string
+	// "string", "integer" or "boolean"
+	kind     string
+	enum     []string
+	required bool
+	inPath   bool
+}
+
+// apiRoute declares an endpoint: how it's served, and how it's described in
+// the OpenAPI document.
+type apiRoute struct {
+	path string
+	// The methods the route answers, GET only when empty
+	methods     []string
+	summary     string
+	auth        routeAuth
+	params      []apiParam
+	handler     http.HandlerFunc
+	contentType string
+	// The component schema of the response body, a free-form object when
+	// empty
+	schema string
+
+	// Whether the route is an ingestion endpoint, served where the sites
+	// send their pageviews rather than with the API
+	ingestion bool
+
+	// The scope keys issued through /admin/keys need for the route, over the
+	// domain queried: read-stats for the stats endpoints, admin by default
+	scope string
+}
+
+// rangeParams are the parameters selecting a domain and a range of days.
+var rangeParams = []apiParam{
+	{name: "domain", description: "The domain to query", kind: "string", required: true},
+	{name: "period", description: "A range ending today, instead of start and end", kind: "string", enum: periodNames()},
+	{name: "start", description: "The first day of the range (YYYY-MM-DD), 30 days before end by default", kind: "string"},
+	{name: "end", description: "The last day of the range (YYYY-MM-DD), today by default", kind: "string"},
+	{name: "tz", description: "The IANA time zone relative periods are resolved in, the domain's by default", kind: "string"},
+}
+
+// statsEndpointParams returns the parameters of the stats endpoints: the
+// range, the comparison, the page and format of the results, and extra ones.
+func statsEndpointParams(extra ...apiParam) []apiParam {
+	params := append([]apiParam{}, rangeParams...)
+	params = append(params,
+		apiParam{name: "compare", description: "Also returns the totals of the previous period", kind: "string", enum: []string{"previous_period"}},
+		apiParam{name: "interval", description: "The interval days are grouped by in time series", kind: "string", enum: []string{"day", "week", "month"}},
+		apiParam{name: "limit", description: "The number of results returned, 100 by default and 1000 at most", kind: "integer"},
+		apiParam{name: "offset", description: "The number of results skipped", kind: "integer"},
+		apiParam{name: "format", description: "Returns the results as CSV rather than JSON", kind: "string", enum: []string{"json", "csv"}},
+	)
+	return append(params, extra...)
+}
+
+// sortParams returns the sort and order parameters of results sortable by
+// columns.
+func sortParams(columns ...string) []apiParam {
+	return []apiParam{
+		{name: "sort", description: "The column results are sorted by", kind: "string", enum: columns},
+		{name: "order", description: "The order results are sorted in, descending for counts and days by default", kind: "string", enum: []string{"asc", "desc"}},
+	}
+}
+
+// aggregateParam merges the rows of a breakdown into the domain's daily
+// series.
+var aggregateParam = apiParam{name: "aggregate", description: "Returns the domain's series instead of a breakdown", kind: "boolean"}
+
+// shareTokenParam is the token of the share link stats are requested through.
+var shareTokenParam = apiParam{name: "token", description: "The token of the share link", kind: "string", required: true, inPath: true}
+
+// publicDomainParam is the domain of the public site stats are requested for.
+var publicDomainParam = apiParam{name: "domain", description: "The domain of the public site", kind: "string", required: true, inPath: true}
+
+// apiRoutes returns the endpoints served besides the index page.
+func (s *server) apiRoutes() []apiRoute {
+	routes := []apiRoute{
+		{
+			path:    "/track",
+			methods: []string{http.MethodGet, http.MethodPost},
+			summary: "Tracks a pageview, or a custom event",
+			params: []apiParam{
+				{name: "url", description: "The URL of the page viewed", kind: "string", required: true},
+				{name: "eventType", description: "pageview, the default, or the name of a custom event of the page, recorded in the raw event log", kind: "string"},
+			},
+			handler:   s.handleTrack,
+			ingestion: true,
+		},
+		{
+			path:        "/analytics.js",
+			summary:     "The tracking script",
+			handler:     s.handleScript,
+			contentType: "application/javascript",
+			ingestion:   true,
+		},
+		{
+			path:        "/snippet",
+			summary:     "The HTML tracking a website",
+			handler:     s.handleSnippet,
+			contentType: "application/json",
+			ingestion:   true,
+		},
+
+		{
+			path:        "/reports/unsubscribe",
+			methods:     []string{http.MethodGet, http.MethodPost},
+			summary:     "Unsubscribes the recipient of email reports a link was sent to",
+			params:      []apiParam{{name: "token", description: "The token of the unsubscribe link", kind: "string", required: true}},
+			handler:     s.handleUnsubscribe,
+			contentType: "text/plain",
+			ingestion:   true,
+		},
+
+		{
+			path:    "/stats/pages",
+			summary: "The visitors and pageviews of each page",
+			auth:    authStats,
+			params: statsEndpointParams(append([]apiParam{
+				{name: "path", description: "Only the page with this path", kind: "string"},
+				{name: "path_prefix", description: "Only the pages whose path starts with this prefix", kind: "string"},
+				{name: "country", description: "Only the visitors from this country", kind: "string"},
+				{name: "source", description: "Only the visitors from this referrer", kind: "string"},
+				aggregateParam,
+			}, sortParams("visitors", "pageviews", "path", "day")...)...),
+			handler:     s.serveStats("pages", s.pagesView),
+			contentType: "application/json",
+			schema:      "StatsResponse",
+		},
+		{
+			path:    "/stats/sources",
+			summary: "The visitors and pageviews of each referrer",
+			auth:    authStats,
+			params: statsEndpointParams(append([]apiParam{
+				{name: "page", description: "Only the visitors of this page", kind: "string"},
+				{name: "referrer", description: "Only this referrer", kind: "string"},
+				{name: "search", description: "Only the referrers containing this text, case-insensitively", kind: "string"},
+				aggregateParam,
+			}, sortParams("visitors", "pageviews", "referrer", "day")...)...),
+			handler:     s.serveStats("sources", s.sourcesView),
+			contentType: "application/json",
+			schema:      "StatsResponse",
+		},
+		{
+			path:    "/stats/sources/tree",
+			summary: "The visitors of each channel, and of its referrers",
+			auth:    authStats,
+			params: statsEndpointParams(
+				apiParam{name: "paths", description: "Also breaks down each referrer by landing page", kind: "boolean"},
+			),
+			handler:     s.handleSourcesTree,
+			contentType: "application/json",
+		},
+		{
+			path:    "/stats/countries",
+			summary: "The visitors and pageviews of each country",
+			auth:    authStats,
+			params: statsEndpointParams(append([]apiParam{
+				{name: "page", description: "Only the visitors of this page", kind: "string"},
+				{name: "aggregate", description: "Returns the top countries of the range, or with true every country and its share of the visitors, for a map", kind: "string", enum: []string{"true", "range"}},
+			}, sortParams("visitors", "pageviews", "country", "day")...)...),
+			handler:     s.serveStats("countries", s.countriesView),
+			contentType: "application/json",
+			schema:      "StatsResponse",
+		},
+		{
+			path:        "/stats/environments",
+			summary:     "The visitors and pageviews of production and preview deployments",
+			auth:        authStats,
+			params:      statsEndpointParams(append([]apiParam{aggregateParam}, sortParams("visitors", "pageviews", "environment", "day")...)...),
+			handler:     s.serveStats("environments", s.environmentsView),
+			contentType: "application/json",
+			schema:      "StatsResponse",
+		},
+		{
+			path:        "/stats/returning",
+			summary:     "The visitors and pageviews of new and returning visitors",
+			auth:        authStats,
+			params:      statsEndpointParams(append([]apiParam{aggregateParam}, sortParams("visitors", "pageviews", "visitor_type", "day")...)...),
+			handler:     s.serveStats("returning", s.returningView),
+			contentType: "application/json",
+			schema:      "StatsResponse",
+		},
+		{
+			path:    "/stats/page",
+			summary: "The daily visitors and pageviews of a page",
+			auth:    authStats,
+			params: statsEndpointParams(append([]apiParam{
+				{name: "path", description: "The path of the page", kind: "string", required: true},
+			}, sortParams("day", "visitors", "pageviews")...)...),
+			handler:     s.serveStats("page", s.pageView),
+			contentType: "application/json",
+			schema:      "StatsResponse",
+		},
+		{
+			path:        "/stats/goals",
+			summary:     "The completions and conversion rate of each goal",
+			auth:        authStats,
+			params:      rangeParams,
+			handler:     s.handleGoalsStats,
+			contentType: "application/json",
+		},
+		{
+			path:    "/stats/summary",
+			summary: "The totals, top page and top source of a range",
+			auth:    authStats,
+			params: append(append([]apiParam{}, rangeParams...),
+				apiParam{name: "compare", description: "Also returns the totals of the previous period", kind: "string", enum: []string{"previous_period"}},
+			),
+			handler:     s.handleSummary,
+			contentType: "application/json",
+		},
+
+		{
+			path:    "/graphql",
+			methods: []string{http.MethodGet, http.MethodPost},
+			summary: "Answers GraphQL queries",
+			auth:    authAPIKey,
+			params: []apiParam{
+				{name: "query", description: "The GraphQL query, when using GET", kind: "string"},
+				{name: "variables", description: "The variables of the query as JSON, when using GET", kind: "string"},
+				{name: "operationName", description: "The operation to run, when using GET", kind: "string"},
+			},
+			handler:     s.handleGraphQL,
+			contentType: "application/json",
+		},
+		{
+			path:        "/stats/domains",
+			summary:     "The domains with recorded pageviews, and their last 30 days",
+			auth:        authAPIKey,
+			handler:     s.handleDomains,
+			contentType: "application/json",
+		},
+		{
+			path:        "/stats/realtime",
+			summary:     "The visitors of the last 5 minutes and the pages they're on, and those of each of the last 30 minutes",
+			auth:        authAPIKey,
+			scope:       scopeReadStats,
+			params:      []apiParam{rangeParams[0]},
+			handler:     s.handleRealtime,
+			contentType: "application/json",
+		},
+		{
+			path:        "/stats/stream",
+			summary:     "Streams pageviews as Server-Sent Events",
+			auth:        authAPIKey,
+			scope:       scopeReadStats,
+			params:      []apiParam{rangeParams[0]},
+			handler:     s.handleStream,
+			contentType: "text/event-stream",
+		},
+		{
+			path:    "/stats/digest",
+			summary: "A snapshot of a day's stats",
+			auth:    authAPIKey,
+			scope:   scopeReadStats,
+			params: []apiParam{
+				rangeParams[0],
+				{name: "date", description: "The day (YYYY-MM-DD), today by default", kind: "string"},
+			},
+			handler:     s.handleDigest,
+			contentType: "application/json",
+		},
+		{
+			path:        "/login",
+			methods:     []string{http.MethodPost},
+			summary:     "Starts a browser session when the posted password form field is the API key, returning its CSRF token",
+			handler:     s.handleLogin,
+			contentType: "application/json",
+		},
+		{
+			path:        "/logout",
+			methods:     []string{http.MethodPost},
+			summary:     "Ends the browser session",
+			handler:     s.handleLogout,
+			contentType: "application/json",
+		},
+		{
+			path:        "/session",
+			summary:     "The CSRF token and expiry of the browser session",
+			handler:     s.handleSession,
+			contentType: "application/json",
+		},
+		{
+			path:    "/stats/sign",
+			summary: "Signs a stats query, granting temporary access to it",
+			auth:    authAPIKey,
+			scope:   scopeReadStats,
+			params: append(append([]apiParam{}, rangeParams...),
+				apiParam{name: "endpoint", description: "The path of the stats endpoint the signature grants access to, e.g. /stats/pages", kind: "string", required: true},
+				apiParam{name: "ttl", description: "How long the signature is valid for in seconds, an hour by default", kind: "integer"},
+			),
+			handler:     s.handleSign,
+			contentType: "application/json",
+		},
+		{
+			path:    "/rewrites/test",
+			summary: "Shows how the rewrite rules rewrite a path",
+			auth:    authAPIKey,
+			params: []apiParam{
+				rangeParams[0],
+				{name: "path", description: "The path to rewrite", kind: "string", required: true},
+			},
+			handler:     s.handleRewriteTest,
+			contentType: "application/json",
+		},
+		{
+			path:    "/export",
+			summary: "Streams a domain's daily stats of every dimension",
+			auth:    authAPIKey,
+			scope:   scopeReadStats,
+			params: append(append([]apiParam{}, rangeParams...),
+				apiParam{name: "format", description: "JSON Lines by default, or CSV", kind: "string", enum: []string{"jsonl", "csv"}},
+			),
+			handler:     s.handleExport,
+			contentType: "application/x-ndjson",
+		},
+		{
+			path:        "/internal/metrics",
+			summary:     "The operational metrics of the server, in the Prometheus text format",
+			auth:        authAPIKey,
+			handler:     s.handleInternalMetrics,
+			contentType: "text/plain",
+		},
+		{
+			path:        pprofPrefix,
+			summary:     "The profiles of the running server, for go tool pprof",
+			auth:        authAPIKey,
+			handler:     s.handlePprof,
+			contentType: "application/octet-stream",
+		},
+		{
+			path:    "/internal/debug/vars",
+			summary: "The runtime's memory statistics and other expvar variables",
+			auth:    authAPIKey,
+			handler: s.handleDebugVars,
+		},
+		{
+			path:        "/admin/memory",
+			summary:     "The memory used by in-memory data",
+			auth:        authAPIKey,
+			handler:     s.handleMemory,
+			contentType: "application/json",
+		},
+		{
+			path:        "/admin/accuracy",
+			summary:     "The last nightly comparisons of the visitors the sketches estimate with the exact counts of the raw event log",
+			auth:        authAPIKey,
+			handler:     s.handleAccuracy,
+			contentType: "application/json",
+		},
+		{
+			path:        "/admin/reload",
+			methods:     []string{http.MethodPost},
+			summary:     "Reloads the log level, excluded IPs, production hosts, goals and retentions of the instance from its configuration",
+			auth:        authAPIKey,
+			handler:     s.handleReload,
+			contentType: "application/json",
+		},
+		{
+			path:    "/admin/shares",
+			methods: []string{http.MethodGet, http.MethodPost, http.MethodDelete},
+			summary: "Lists, creates or revokes share links",
+			auth:    authAPIKey,
+			params: []apiParam{
+				{name: "domain", description: "The domain to share, or to list the links of", kind: "string"},
+				{name: "token", description: "The token of the link to revoke", kind: "string"},
+			},
+			handler:     s.handleShares,
+			contentType: "application/json",
+		},
+		{
+			path:    "/admin/sites",
+			methods: []string{http.MethodGet, http.MethodPost, http.MethodPatch},
+			summary: "Lists the sites, adds one and returns the snippet to install on it, or changes its owner and settings",
+			auth:    authAPIKey,
+			params: []apiParam{
+				{name: "domain", description: "The domain of the site to add or update", kind: "string"},
+				{name: "owner", description: "Who the site belongs to", kind: "string"},
+				{name: "public", description: "Whether the site's stats can be read by anyone", kind: "boolean"},
+				{name: "timezone", description: "The time zone the site's days are bucketed in, overriding SITE_TIMEZONES, or empty to unset it", kind: "string"},
+				{name: "retention_days", description: "How many days the site's stats are kept for, overriding SITE_RETENTION_DAYS, or empty to unset it", kind: "integer"},
+				{name: "goals", description: "The comma-separated goals of the site, as name:/path, name:event, name:/path&event or /path, overriding GOALS, or empty to unset them", kind: "string"},
+			},
+			handler:     s.handleSites,
+			contentType: "application/json",
+		},
+		{
+			path:    "/admin/keys",
+			methods: []string{http.MethodGet, http.MethodPost, http.MethodDelete},
+			summary: "Lists, issues or revokes API keys",
+			auth:    authAPIKey,
+			params: []apiParam{
+				{name: "name", description: "What the key issued is for", kind: "string"},
+				{name: "domains", description: "The comma-separated domains of the key issued, every domain by default", kind: "string"},
+				{name: "scopes", description: "The comma-separated scopes of the key issued, read-stats by default", kind: "string"},
+				{name: "expires_at", description: "When the key issued stops working, never by default", kind: "string"},
+				{name: "id", description: "The key to revoke", kind: "integer"},
+			},
+			handler:     s.handleKeys,
+			contentType: "application/json",
+		},
+		{
+			path:    "/admin/keys/rotate",
+			methods: []string{http.MethodPost},
+			summary: "Replaces an API key, the old one expiring after a grace period",
+			auth:    authAPIKey,
+			params: []apiParam{
+				{name: "id", description: "The key to rotate", kind: "integer", required: true},
+				{name: "grace", description: "How long the old key keeps working, 24h by default, 0 to stop it right away", kind: "string"},
+			},
+			handler:     s.handleRotateKey,
+			contentType: "application/json",
+		},
+		{
+			path:    "/admin/reports",
+			methods: []string{http.MethodGet, http.MethodPost, http.MethodDelete},
+			summary: "Lists, subscribes or unsubscribes the recipients of email reports",
+			auth:    authAPIKey,
+			params: []apiParam{
+				{name: "domain", description: "The domain reported on, or to list the recipients of", kind: "string"},
+				{name: "email", description: "The address of the recipient to subscribe", kind: "string"},
+				{name: "frequency", description: "How often the recipient is sent reports, weekly by default", kind: "string", enum: []string{"weekly", "monthly"}},
+				{name: "id", description: "The subscription to unsubscribe", kind: "integer"},
+			},
+			handler:     s.handleReportSubscriptions,
+			contentType: "application/json",
+		},
+		{
+			path:    "/admin/alerts",
+			methods: []string{http.MethodGet, http.MethodPost, http.MethodDelete},
+			summary: "Lists, creates or deletes traffic alerts",
+			auth:    authAPIKey,
+			params: []apiParam{
+				{name: "domain", description: "The domain to watch, or to list the alerts of", kind: "string"},
+				{name: "kind", description: "Whether to alert on a spike or a drop of the traffic", kind: "string", enum: []string{"spike", "drop"}},
+				{name: "factor", description: "How many times the hourly average of the previous day the last hour's visitors must be for a spike, 3 by default", kind: "string"},
+				{name: "hours", description: "How many hours without a pageview make a drop, 2 by default", kind: "integer"},
+				{name: "email", description: "The address the alert is emailed to", kind: "string"},
+				{name: "webhook_url", description: "The URL the alert is posted to, instead of an email", kind: "string"},
+				{name: "id", description: "The alert to delete", kind: "integer"},
+			},
+			handler:     s.handleAlerts,
+			contentType: "application/json",
+		},
+		{
+			path:    "/admin/notifications",
+			methods: []string{http.MethodGet, http.MethodPost, http.MethodDelete},
+			summary: "Lists, adds or removes the channels a site's alerts, goal completions and weekly reports are sent to",
+			auth:    authAPIKey,
+			params: []apiParam{
+				{name: "domain", description: "The domain of the site, or to list the channels of", kind: "string"},
+				{name: "kind", description: "The kind of channel to add", kind: "string", enum: []string{"email", "webhook", "slack", "discord"}},
+				{name: "target", description: "The email address or the webhook URL of the channel", kind: "string"},
+				{name: "events", description: "The comma-separated events sent to the channel, all of alerts, goals and reports by default", kind: "string"},
+				{name: "id", description: "The channel to remove", kind: "integer"},
+			},
+			handler:     s.handleNotificationChannels,
+			contentType: "application/json",
+		},
+		{
+			path:    "/admin/annotations",
+			methods: []string{http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodDelete},
+			summary: "Lists, adds, changes or deletes the annotations marking days of a domain's stats",
+			auth:    authAPIKey,
+			params: []apiParam{
+				{name: "domain", description: "The domain to annotate, or to list the annotations of", kind: "string"},
+				{name: "start", description: "The first day of the annotation (YYYY-MM-DD), or of the range to list the annotations of", kind: "string"},
+				{name: "end", description: "The last day of the annotation, its start by default, or of the range to list the annotations of", kind: "string"},
+				{name: "period", description: "The range to list the annotations of, instead of start and end", kind: "string", enum: periodNames()},
+				{name: "text", description: "What happened, up to 500 characters", kind: "string"},
+				{name: "id", description: "The annotation to change or delete", kind: "integer"},
+			},
+			handler:     s.handleAnnotations,
+			contentType: "application/json",
+		},
+		{
+			path:        "/share/{token}",
+			summary:     "The domain a share link is for",
+			auth:        authShare,
+			params:      []apiParam{shareTokenParam},
+			handler:     s.handleShare,
+			contentType: "application/json",
+		},
+		{
+			path:    "/embed/{token}",
+			summary: "A widget with the visitors, pageviews and visitors per day of a share link's domain, to embed in an iframe",
+			auth:    authShare,
+			params: []apiParam{
+				shareTokenParam,
+				{name: "period", description: "The range shown, 30d by default", kind: "string", enum: []string{"7d", "30d", "90d"}},
+			},
+			handler:     s.handleEmbed,
+			contentType: "text/html",
+		},
+		{
+			path:        "/{domain}",
+			summary:     "The public site of a domain",
+			auth:        authPublic,
+			params:      []apiParam{publicDomainParam},
+			handler:     s.handlePublicSite,
+			contentType: "application/json",
+		},
+		{
+			path:    "/badge/{file}",
+			summary: "A badge with the visitors of a domain",
+			params: []apiParam{
+				{name: "file", description: "The domain followed by .svg", kind: "string", required: true, inPath: true},
+				{name: "period", description: "The number of days counted, 30 by default", kind: "string", enum: []string{"7d", "30d"}},
+			},
+			handler:     s.handleBadge,
+			contentType: "image/svg+xml",
+		},
+		{
+			path:        "/openapi.json",
+			summary:     "This document",
+			handler:     s.handleOpenAPI,
+			contentType: "application/json",
+		},
+		{
+			path:        "/version",
+			summary:     "The version of the server running",
+			handler:     s.handleVersion,
+			contentType: "application/json",
+			schema:      "Version",
+		},
+	}
+
+	if s.cfg.MetricsEnabled {
+		routes = append(routes, apiRoute{
+			path:        "/metrics",
+			summary:     "The daily totals in the Prometheus text format",
+			auth:        authAPIKey,
+			handler:     s.handleMetrics,
+			contentType: "text/plain",
+		})
+	}
+
+	return routes
+}
+
+// sharedPath returns the path a stats route is served at under share links.
+func sharedPath(path string) string {
+	return "/share/{token}" + path
+}
+
+// publicPath returns the path a stats route is served at for public sites.
+func publicPath(path string) string {
+	return "/{domain}" + path
+}
+
+// register adds the route to mux, wrapped according to how it's
+// authenticated.
+func (s *server) register(mux *http.ServeMux, route apiRoute) {
+	switch route.auth {
+	case authNone:
+		mux.HandleFunc(route.path, route.handler)
+	case authAPIKey:
+		scope := route.scope
+		if scope == "" {
+			scope = scopeAdmin
+		}
+		mux.HandleFunc(route.path, s.requireAPIKey(scope, route.handler))
+	case authShare:
+		mux.HandleFunc(route.path, s.requireShare(route.handler))
+	case authPublic:
+		mux.HandleFunc(route.path, s.requirePublic(route.handler))
+	case authStats:
+		handler := s.conditional(s.cached(route.handler))
+		mux.HandleFunc(route.path, s.requireAPIKeyOrSignature(handler))
+		mux.HandleFunc(sharedPath(route.path), s.requireShare(handler))
+		mux.HandleFunc(publicPath(route.path), s.requirePublic(handler))
+	}
+}
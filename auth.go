@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Signed URLs can't be valid for more than 30 days
+const maxSignatureTTL = 30 * 24 * 60 * 60
+
+// requireAPIKey accepts the API key, or the session of a browser that logged
+// in with it, or a key issued through /admin/keys granting scope over the
+// domain queried, or a bearer token of OIDC_ISSUER reading its stats.
+func (s *server) requireAPIKey(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.APIKey == "" && s.oidc == nil {
+			if s.cfg.Environment == "production" {
+				writeError(w, http.StatusUnauthorized, errUnauthorized, "API_KEY is mandatory in production")
+				return
+			}
+			next(w, r)
+			return
+		}
+
+		domain := r.URL.Query().Get("domain")
+		if token, ok := bearerToken(r); ok && s.oidc != nil {
+			granted, err := s.oidc.verify(r.Context(), token)
+			if err != nil {
+				s.logger.ErrorContext(r.Context(), "Failed to fetch the OIDC keys", slog.String("error", err.Error()))
+				writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+				return
+			}
+			if granted == nil {
+				writeError(w, http.StatusUnauthorized, errUnauthorized, "Invalid or expired token")
+				return
+			}
+			if !granted.allows(scope, domain) {
+				writeError(w, http.StatusForbidden, errForbidden, fmt.Sprintf("The token isn't allowed to %s here", scope))
+				return
+			}
+			next(w, r)
+			return
+		}
+
+		key := r.URL.Query().Get("api_key")
+		if (s.cfg.APIKey != "" && key == s.cfg.APIKey) || s.authenticatedBySession(r) {
+			next(w, r)
+			return
+		}
+		issued, err := s.lookupAPIKey(key)
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to load API key", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+		if issued == nil {
+			writeError(w, http.StatusUnauthorized, errUnauthorized, "Unauthorized")
+			return
+		}
+		if !issued.allows(scope, domain) {
+			writeError(w, http.StatusForbidden, errForbidden, fmt.Sprintf("The API key isn't allowed to %s here", scope))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireAPIKeyOrSignature accepts either the API key or a signed URL
+// generated by /stats/sign.
+func (s *server) requireAPIKeyOrSignature(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("sig") != "" {
+			if !s.validSignature(r) {
+				writeError(w, http.StatusUnauthorized, errInvalidSignature, "Invalid or expired signature")
+				return
+			}
+			next(w, r)
+			return
+		}
+
+		s.requireAPIKey(scopeReadStats, next)(w, r)
+	}
+}
+
+// signingKey returns the key derived from SIGNING_KEY for a use, so that a
+// signature made for one use, e.g. a session, can't be replayed as another,
+// and that none can be made with the API key SIGNING_KEY defaults to.
+func (s *server) signingKey(use string) []byte {
+	mac := hmac.New(sha256.New, []byte(s.cfg.SigningKey))
+	mac.Write([]byte(use))
+	return mac.Sum(nil)
+}
+
+// signStatsQuery returns the hex-encoded HMAC of what a signed URL grants
+// access to: the endpoint, the domain, the range and the expiry timestamp.
+func (s *server) signStatsQuery(path string, query url.Values) string {
+	mac := hmac.New(sha256.New, s.signingKey("url-sig"))
+	mac.Write([]byte("path=" + path + "\n"))
+	for _, key := range []string{"domain", "start", "end", "period", "tz", "exp"} {
+		mac.Write([]byte(key + "=" + query.Get(key) + "\n"))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validSignature reports whether the request carries a valid, unexpired
+// signature for the endpoint, domain and range it queries.
+func (s *server) validSignature(r *http.Request) bool {
+	query := r.URL.Query()
+	sig := query.Get("sig")
+	if sig == "" || s.cfg.SigningKey == "" {
+		return false
+	}
+
+	expiresAt, err := strconv.ParseInt(query.Get("exp"), 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return false
+	}
+
+	return hmac.Equal([]byte(sig), []byte(s.signStatsQuery(r.URL.Path, query)))
+}
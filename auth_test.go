@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSignedURLs(t *testing.T) {
+	s := newTestServer(t, "-api-key=secret")
+
+	status, body := serveGet(t, http.HandlerFunc(s.handleSign), "/stats/sign?endpoint=/stats/pages&domain=example.com&period=7d")
+	if status != http.StatusOK {
+		t.Fatalf("/stats/sign = %d %s", status, body)
+	}
+	var signed struct {
+		Path  string `json:"path"`
+		Query string `json:"query"`
+	}
+	if err := json.Unmarshal([]byte(body), &signed); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		want   bool
+	}{
+		{"signed endpoint", signed.Path + "?" + signed.Query, true},
+		{"other endpoint", "/stats/countries?" + signed.Query, false},
+		{"other domain", signed.Path + "?" + strings.Replace(signed.Query, "example.com", "other.com", 1), false},
+		{"other period", signed.Path + "?" + strings.Replace(signed.Query, "period=7d", "period=90d", 1), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.validSignature(httptest.NewRequest(http.MethodGet, tt.target, nil)); got != tt.want {
+				t.Errorf("validSignature(%s) = %v, want %v", tt.target, got, tt.want)
+			}
+		})
+	}
+
+	for _, target := range []string{"/stats/sign?domain=example.com", "/stats/sign?endpoint=/admin/keys&domain=example.com"} {
+		if status, body := serveGet(t, http.HandlerFunc(s.handleSign), target); status != http.StatusBadRequest {
+			t.Errorf("%s = %d %s, want 400", target, status, body)
+		}
+	}
+}
+
+// TestSigningKeys checks that a signature made for one use isn't valid for
+// another, as SIGNING_KEY defaults to the API key.
+func TestSigningKeys(t *testing.T) {
+	s := newTestServer(t, "-api-key=secret")
+	if string(s.signingKey("url-sig")) == string(s.signingKey("session")) {
+		t.Errorf("signed URLs and sessions are signed with the same key")
+	}
+	if string(s.signingKey("session")) == s.cfg.APIKey {
+		t.Errorf("sessions are signed with the API key")
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+)
+
+// backupTables are the aggregate tables backed up, in the order they're
+// restored, along with the sites they belong to. Salts and returning visitors
+// aren't, so that visitors can't be recognized across the restore.
+var backupTables = []string{"sites", "pages", "countries", "sources", "page_countries", "page_sources", "referrer_paths", "environments", "visitor_types", "pages_monthly", "countries_monthly", "sources_monthly", "rollups", "digests"}
+
+// How many rows are inserted by each statement of a restore
+const restoreBatchSize = 1000
+
+// backupHeader is the first line of a backup, telling what its rows can be
+// restored into.
+type backupHeader struct {
+	Version       int    `json:"potato_backup"`
+	SchemaVersion int    `json:"schema_version"`
+	SketchType    string `json:"sketch_type"`
+}
+
+// backupLine is a row of one of the backed up tables, its columns named as
+// in the table and sketches written in hex.
+type backupLine struct {
+	Table string          `json:"table"`
+	Row   json.RawMessage `json:"row"`
+}
+
+// backup writes every row of the aggregate tables to w as JSON Lines, after
+// a header.
+func backup(db *sql.DB, sketches sketchFormat, w io.Writer) error {
+	var version int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version); err != nil {
+		return fmt.Errorf("failed to read the schema version: %w", err)
+	}
+
+	out := bufio.NewWriter(w)
+	encoder := json.NewEncoder(out)
+	if err := encoder.Encode(backupHeader{Version: 1, SchemaVersion: version, SketchType: sketches.sqlType()}); err != nil {
+		return err
+	}
+
+	for _, table := range backupTables {
+		// Sketches are written in hex, as both hll and bytea values are
+		rows, err := db.Query(`SELECT row_to_json(t)::text FROM ` + table + ` AS t`)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", table, err)
+		}
+		for rows.Next() {
+			var row string
+			if err := rows.Scan(&row); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to read %s: %w", table, err)
+			}
+			if err := encoder.Encode(backupLine{Table: table, Row: json.RawMessage(row)}); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to read %s: %w", table, err)
+		}
+	}
+
+	return out.Flush()
+}
+
+// restore inserts the rows of a backup into a database whose aggregate tables
+// are empty, in a single transaction. The database has to be at the same
+// schema version and store sketches the same way as the one backed up.
+func restore(db *sql.DB, sketches sketchFormat, r io.Reader) error {
+	var version int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version); err != nil {
+		return fmt.Errorf("failed to read the schema version: %w", err)
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	if !scanner.Scan() {
+		return fmt.Errorf("the backup is empty")
+	}
+	var header backupHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Version != 1 {
+		return fmt.Errorf("not a backup of this server")
+	}
+	if header.SchemaVersion != version {
+		return fmt.Errorf("the backup is at schema version %d and the database at %d, migrate it with MIGRATE_TO first", header.SchemaVersion, version)
+	}
+	if header.SketchType != sketches.sqlType() {
+		return fmt.Errorf("the backup's sketches are %s and the database's %s, they can't be converted", header.SketchType, sketches.sqlType())
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin restore: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, table := range backupTables {
+		var found bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM ` + table + `)`).Scan(&found); err != nil {
+			return fmt.Errorf("failed to check %s: %w", table, err)
+		}
+		if found {
+			return fmt.Errorf("%s already has rows, backups can only be restored into a fresh database", table)
+		}
+	}
+
+	// Rows are inserted a batch at a time, each batch being of a single table
+	var table string
+	var batch []string
+	insert := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		_, err := tx.Exec(`INSERT INTO `+table+` SELECT * FROM json_populate_recordset(NULL::`+table+`, $1::json)`, "["+strings.Join(batch, ",")+"]")
+		if err != nil {
+			return fmt.Errorf("failed to restore %s: %w", table, err)
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	for line := 2; scanner.Scan(); line++ {
+		var row backupLine
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			return fmt.Errorf("invalid row on line %d: %w", line, err)
+		}
+		if !slices.Contains(backupTables, row.Table) {
+			return fmt.Errorf("unknown table %q on line %d", row.Table, line)
+		}
+		if row.Table != table || len(batch) == restoreBatchSize {
+			if err := insert(); err != nil {
+				return err
+			}
+			table = row.Table
+		}
+		batch = append(batch, string(row.Row))
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read the backup: %w", err)
+	}
+	if err := insert(); err != nil {
+		return err
+	}
+
+	// Sites are restored with their IDs, which new sites must follow
+	if _, err := tx.Exec(`SELECT setval(pg_get_serial_sequence('sites', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM sites`); err != nil {
+		return fmt.Errorf("failed to restore sites: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// runCommand runs a command: export or import, writing or reading the file
+// it's given, or the standard output or input when it's "-" or missing, or
+// import-plausible, import-ga4 and import-logs, importing a domain's history.
+func runCommand(cfg Config, db *sql.DB, logger *slog.Logger, sketches sketchFormat, args []string) error {
+	path := "-"
+	if len(args) > 1 {
+		path = args[1]
+	}
+
+	switch args[0] {
+	case "import-plausible":
+		if len(args) < 3 {
+			return fmt.Errorf("usage: import-plausible DOMAIN EXPORT...")
+		}
+		return importPlausible(db, sketches, args[1], args[2:])
+	case "import-ga4":
+		if len(args) < 3 {
+			return fmt.Errorf("usage: import-ga4 DOMAIN EVENTS...")
+		}
+		return importGA4(db, logger, sketches, args[1], !cfg.privacyProfile(args[1]).TrackCountries, args[2:])
+	case "import-logs":
+		if len(args) < 3 {
+			return fmt.Errorf("usage: import-logs DOMAIN LOG...")
+		}
+		return importLogs(cfg, db, logger, sketches, args[1], args[2:])
+	case "export":
+		if path == "-" {
+			return backup(db, sketches, os.Stdout)
+		}
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		if err := backup(db, sketches, file); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	case "import":
+		if path == "-" {
+			return restore(db, sketches, os.Stdin)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return restore(db, sketches, file)
+	default:
+		return fmt.Errorf("unknown command %q, expected export, import, import-plausible, import-ga4 or import-logs", args[0])
+	}
+}
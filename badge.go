@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// badgeTemplate is a shields.io-style badge, formatted with its total width,
+// the widths of its label and value, the centers of their texts, and the
+// label and value themselves.
+const badgeTemplate = `<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[5]s: %[6]s">
+<title>%[5]s: %[6]s</title>
+<linearGradient id="s" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+<clipPath id="r"><rect width="%[1]d" height="20" rx="3" fill="#fff"/></clipPath>
+<g clip-path="url(#r)"><rect width="%[2]d" height="20" fill="#555"/><rect x="%[2]d" width="%[3]d" height="20" fill="#4c1"/><rect width="%[1]d" height="20" fill="url(#s)"/></g>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="%[4]d" y="15" fill="#010101" fill-opacity=".3">%[5]s</text><text x="%[4]d" y="14">%[5]s</text>
+<text x="%[7]d" y="15" fill="#010101" fill-opacity=".3">%[6]s</text><text x="%[7]d" y="14">%[6]s</text>
+</g>
+</svg>
+`
+
+// How long badges can be cached for, by browsers and image proxies alike
+const badgeMaxAge = 5 * time.Minute
+
+// handleBadge serves /badge/{domain}.svg: an SVG badge with the number of
+// visitors of the last 7 or 30 days, for the domains that opted in. It's
+// public so that it can be embedded anywhere.
+func (s *server) handleBadge(w http.ResponseWriter, r *http.Request) {
+	domain, ok := strings.CutSuffix(r.PathValue("file"), ".svg")
+	if !ok || !s.cfg.BadgeDomains[domain] {
+		writeError(w, http.StatusNotFound, errNotConfigured, "No badge for this domain")
+		return
+	}
+
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = "30d"
+	}
+	if period != "7d" && period != "30d" {
+		writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid period parameter, expected 7d or 30d")
+		return
+	}
+
+	today := dayIn(time.Now(), s.siteLocation(domain))
+	start, _ := periodStart(period, today)
+	totals, err := s.queryTotals(statsQuery{
+		table:  "pages",
+		domain: domain,
+		ctx:    r.Context(),
+		start:  start,
+		end:    today,
+	})
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to query badge", slog.String("error", err.Error()))
+		writeError(w, http.StatusInternalServerError, errInternal, "Failed to fetch stats")
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(badgeMaxAge.Seconds())))
+	w.WriteHeader(http.StatusOK)
+	writeBadge(w, "visitors ("+period+")", compactCount(totals.Visitors))
+}
+
+// writeBadge writes a badge, sized from an approximation of the width of its
+// texts since the font they're rendered with isn't known.
+func writeBadge(w http.ResponseWriter, label string, value string) {
+	textWidth := func(text string) int { return len(text)*7 + 10 }
+	labelWidth, valueWidth := textWidth(label), textWidth(value)
+	fmt.Fprintf(w, badgeTemplate,
+		labelWidth+valueWidth, labelWidth, valueWidth, labelWidth/2,
+		label, value, labelWidth+valueWidth/2)
+}
+
+// compactCount formats a count the way badges show them: 950, 1.2k, 3.4M.
+func compactCount(n int) string {
+	switch {
+	case n < 1000:
+		return strconv.Itoa(n)
+	// Rounded up, 999,999 would be 1000k
+	case n < 999950:
+		return strings.TrimSuffix(strconv.FormatFloat(float64(n)/1000, 'f', 1, 64), ".0") + "k"
+	default:
+		return strings.TrimSuffix(strconv.FormatFloat(float64(n)/1000000, 'f', 1, 64), ".0") + "M"
+	}
+}
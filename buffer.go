@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// writeBuffer holds the pageviews counted in each row of the stats tables
+// until they're flushed, so that busy sites update a row once per flush
+// rather than once per pageview. The buffer is flushed when the server is
+// stopped, but pageviews still in it are lost if it crashes.
+type writeBuffer struct {
+	mu   sync.Mutex
+	rows map[string]*bufferedRow
+}
+
+// bufferedRow is a row's distinct visitors and pageviews since the last
+// flush.
+type bufferedRow struct {
+	row       countedRow
+	visitors  map[string]struct{}
+	pageviews int
+}
+
+func newWriteBuffer() *writeBuffer {
+	return &writeBuffer{rows: map[string]*bufferedRow{}}
+}
+
+// bufferKey identifies a row across pageviews.
+func bufferKey(row countedRow) string {
+	return row.table + "\x00" + row.domain + "\x00" + row.day.Format(time.DateOnly) + "\x00" + strings.Join(row.values, "\x00")
+}
+
+func (b *writeBuffer) add(row countedRow, visitor string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := bufferKey(row)
+	buffered, ok := b.rows[key]
+	if !ok {
+		buffered = &bufferedRow{row: row, visitors: map[string]struct{}{}}
+		b.rows[key] = buffered
+	}
+	buffered.visitors[visitor] = struct{}{}
+	buffered.pageviews++
+}
+
+// len returns the number of rows waiting to be flushed.
+func (b *writeBuffer) len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.rows)
+}
+
+// take empties the buffer, returning the rows it held.
+func (b *writeBuffer) take() map[string]*bufferedRow {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	rows := b.rows
+	b.rows = map[string]*bufferedRow{}
+	return rows
+}
+
+// restore puts back a row that couldn't be flushed, merging it with the
+// pageviews buffered since.
+func (b *writeBuffer) restore(key string, row *bufferedRow) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	buffered, ok := b.rows[key]
+	if !ok {
+		b.rows[key] = row
+		return
+	}
+	maps.Copy(buffered.visitors, row.visitors)
+	buffered.pageviews += row.pageviews
+}
+
+// flush writes the buffered rows, keeping those that failed for the next
+// flush. The rows of months that may have been rolled up are written in a
+// single transaction, along with their monthly rows.
+func (st *postgresStore) flush() error {
+	var errs []string
+	late := map[string]*bufferedRow{}
+	now := time.Now()
+	for key, buffered := range st.buffer.take() {
+		if buffered.row.mayBeRolledUp(now) {
+			late[key] = buffered
+			continue
+		}
+		if err := st.merge(st.db, nil, buffered); err != nil {
+			st.buffer.restore(key, buffered)
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(late) > 0 {
+		if err := st.mergeLate(late); err != nil {
+			for key, buffered := range late {
+				st.buffer.restore(key, buffered)
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to flush %d rows: %s", len(errs), errs[0])
+	}
+	return nil
+}
+
+// mergeLate merges the buffered rows of months that may have been rolled up
+// in a transaction, so that none of them is counted if one fails.
+func (st *postgresStore) mergeLate(late map[string]*bufferedRow) error {
+	// Sites are created beforehand, on a connection of their own
+	for _, buffered := range late {
+		if _, err := st.sites.id(buffered.row.domain); err != nil {
+			return err
+		}
+	}
+
+	tx, err := st.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin flush: %w", err)
+	}
+	defer tx.Rollback()
+
+	rolledUp, err := lockRollups(tx)
+	if err != nil {
+		return err
+	}
+	for _, buffered := range late {
+		if err := st.merge(tx, rolledUp, buffered); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// merge adds a buffered row's visitors and pageviews to its row in db, and
+// to its monthly row if its month is among those rolled up.
+func (st *postgresStore) merge(db execer, rolledUp rolledUpMonths, buffered *bufferedRow) error {
+	site, err := st.sites.id(buffered.row.domain)
+	if err != nil {
+		return err
+	}
+
+	visitors := slices.Collect(maps.Keys(buffered.visitors))
+	err = rolledUp.upsert(db, buffered.row, func(row countedRow, args *queryArgs) string {
+		sketch, update := st.sketches.mergeExprs(row.table, args, visitors)
+		return row.upsertSQL(args, site, sketch, update, args.add(buffered.pageviews))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to track %s views: %w", buffered.row.table, err)
+	}
+	return nil
+}
+
+// flushEvery flushes the buffered pageviews periodically. It never returns.
+func (st *postgresStore) flushEvery(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := st.flush(); err != nil {
+			st.logger.Error("Failed to flush buffered pageviews", slog.String("error", err.Error()))
+		}
+	}
+}
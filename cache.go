@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Most responses kept in the stats cache
+const statsCacheMaxEntries = 1000
+
+// Estimated bytes held per cached response, on top of its key and body
+const statsCacheEntryOverhead = 256
+
+// statsCache keeps the responses of stats queries over closed ranges for a
+// short while, so that dashboards refreshing often don't run the same HLL
+// aggregations again and again. Ranges including today aren't cached as
+// their stats are still changing.
+type statsCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedResponse
+}
+
+type cachedResponse struct {
+	// The domain queried, to forget the responses of a domain when its
+	// annotations change
+	domain  string
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func newStatsCache(ttl time.Duration) *statsCache {
+	return &statsCache{ttl: ttl, entries: map[string]cachedResponse{}}
+}
+
+func (c *statsCache) get(key string, now time.Time) (cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || now.After(entry.expires) {
+		return cachedResponse{}, false
+	}
+	return entry, true
+}
+
+func (c *statsCache) set(key string, domain string, header http.Header, body []byte, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= statsCacheMaxEntries {
+		c.evictLocked(1)
+	}
+	c.entries[key] = cachedResponse{domain: domain, header: header, body: body, expires: now.Add(c.ttl)}
+}
+
+// forget forgets the responses of a domain, which are out of date.
+func (c *statsCache) forget(domain string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, entry := range c.entries {
+		if entry.domain == strings.ToLower(domain) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// prune forgets the expired responses.
+func (c *statsCache) prune(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// pruneEvery prunes the cache periodically. It never returns.
+func (c *statsCache) pruneEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		c.prune(now)
+	}
+}
+
+func (c *statsCache) memoryUsage() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var bytes int64
+	for key, entry := range c.entries {
+		bytes += int64(statsCacheEntryOverhead + len(key) + len(entry.body))
+	}
+	return bytes
+}
+
+// evict forgets the responses closest to expiring until enough is freed.
+func (c *statsCache) evict(bytes int64) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.evictLocked(bytes)
+}
+
+func (c *statsCache) evictLocked(bytes int64) int64 {
+	keys := make([]string, 0, len(c.entries))
+	for key := range c.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return c.entries[keys[i]].expires.Before(c.entries[keys[j]].expires)
+	})
+
+	var freed int64
+	for _, key := range keys {
+		if freed >= bytes {
+			break
+		}
+		freed += int64(statsCacheEntryOverhead + len(key) + len(c.entries[key].body))
+		delete(c.entries, key)
+	}
+	return freed
+}
+
+// cached serves the responses of a stats endpoint from the cache when its
+// range is over. CSV exports are streamed rather than cached.
+func (s *server) cached(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.StatsCacheTTL == 0 || r.Method != http.MethodGet || wantsCSV(r) {
+			next(w, r)
+			return
+		}
+
+		query := r.URL.Query()
+		_, end, err := s.parseDateRange(query)
+		if err != nil || !end.Before(dayIn(time.Now(), s.siteLocation(query.Get("domain")))) {
+			next(w, r)
+			return
+		}
+
+		key := statsCacheKey(r)
+		if entry, ok := s.cache.get(key, time.Now()); ok {
+			for name, values := range entry.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("X-Cache", "HIT")
+			w.WriteHeader(http.StatusOK)
+			w.Write(entry.body)
+			return
+		}
+
+		rec := &responseRecorder{header: http.Header{}, status: http.StatusOK}
+		next(rec, r)
+
+		if rec.status == http.StatusOK {
+			s.cache.set(key, strings.ToLower(query.Get("domain")), rec.header.Clone(), rec.body.Bytes(), time.Now())
+		}
+
+		for name, values := range rec.header {
+			w.Header()[name] = values
+		}
+		if rec.status == http.StatusOK {
+			w.Header().Set("X-Cache", "MISS")
+		}
+		w.WriteHeader(rec.status)
+		w.Write(rec.body.Bytes())
+	}
+}
+
+// statsCacheKey identifies a stats query whoever makes it: the credentials
+// are left out, and the Accept header is part of it as it selects the
+// representation.
+func statsCacheKey(r *http.Request) string {
+	query := url.Values{}
+	for name, values := range r.URL.Query() {
+		switch name {
+		case "api_key", "sig", "exp":
+			continue
+		}
+		query[name] = values
+	}
+	return r.URL.Path + "?" + query.Encode() + "\n" + r.Header.Get("Accept")
+}
+
+// responseRecorder buffers a response so that it can be cached before being
+// written.
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) Header() http.Header { return rec.header }
+
+func (rec *responseRecorder) WriteHeader(status int) { rec.status = status }
+
+func (rec *responseRecorder) Write(b []byte) (int, error) { return rec.body.Write(b) }
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// TestStatsCacheForget checks that the cached stats of a domain are served
+// again once its annotations change, the others staying cached.
+func TestStatsCacheForget(t *testing.T) {
+	s := newTestServer(t)
+
+	served := 0
+	h := s.cached(func(w http.ResponseWriter, r *http.Request) {
+		served++
+		fmt.Fprintf(w, "%s %d", r.URL.Query().Get("domain"), served)
+	})
+
+	get := func(domain string) string {
+		_, body := serveGet(t, h, "/stats/pages?domain="+domain+"&start=2024-01-01&end=2024-01-31")
+		return body
+	}
+
+	first := get("example.com")
+	other := get("other.com")
+	if got := get("example.com"); got != first {
+		t.Fatalf("the stats weren't cached: %q, then %q", first, got)
+	}
+
+	s.cache.forget("Example.com")
+	if got := get("example.com"); got == first {
+		t.Errorf("the stats of example.com are still cached after forgetting them: %q", got)
+	}
+	if got := get("other.com"); got != other {
+		t.Errorf("the stats of other.com were forgotten: %q, then %q", other, got)
+	}
+}
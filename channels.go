@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// channels group sources by the kind of site visitors come from. Referrers
+// are matched in order against these regular expressions, which PostgreSQL
+// and ClickHouse both understand, and fall back to "Referral", while direct
+// visits are their own channel.
+var channels = []struct {
+	name    string
+	pattern string
+}{
+	{"Search", `(^|\.)(google|bing|duckduckgo|yahoo|yandex|baidu|ecosia|qwant|startpage|kagi)\.[a-z.]+$`},
+	{"Social", `^(([a-z0-9-]+\.)*(facebook|instagram|linkedin|reddit|youtube|pinterest|tiktok|threads)\.com|t\.co|x\.com|twitter\.com|lnkd\.in|bsky\.app|news\.ycombinator\.com|mastodon\.social)$`},
+}
+
+// channelExpr returns the SQL expression mapping the referrer column to its
+// channel, adding its arguments to args.
+func channelExpr(args *queryArgs) string {
+	expr := `CASE WHEN referrer = 'Direct / None' THEN 'Direct'`
+	for _, channel := range channels {
+		expr += ` WHEN referrer ~ ` + args.add(channel.pattern) + ` THEN ` + args.add(channel.name)
+	}
+	return expr + ` ELSE 'Referral' END`
+}
+
+// sourceTree is a domain's sources over a range, grouped by channel and
+// optionally broken down by referring page. Unique visitors are counted at
+// each level, so a channel's visitors aren't the sum of its sources'.
+type sourceTree struct {
+	Domain   string        `json:"domain"`
+	Start    time.Time     `json:"start"`
+	End      time.Time     `json:"end"`
+	Channels []channelNode `json:"channels"`
+}
+
+type channelNode struct {
+	Channel   string       `json:"channel"`
+	Visitors  int          `json:"visitors"`
+	Pageviews int          `json:"pageviews"`
+	Sources   []sourceNode `json:"sources"`
+}
+
+type sourceNode struct {
+	Source    string     `json:"source"`
+	Visitors  int        `json:"visitors"`
+	Pageviews int        `json:"pageviews"`
+	Paths     []pathNode `json:"paths,omitempty"`
+}
+
+type pathNode struct {
+	Path      string `json:"path"`
+	Visitors  int    `json:"visitors"`
+	Pageviews int    `json:"pageviews"`
+}
+
+func (s *server) handleSourcesTree(w http.ResponseWriter, r *http.Request) {
+	params, ok := s.parseStatsParams(w, r)
+	if !ok {
+		return
+	}
+
+	withPaths := false
+	switch r.URL.Query().Get("paths") {
+	case "", "false":
+	case "true":
+		withPaths = true
+	default:
+		writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid paths parameter, expected true or false")
+		return
+	}
+
+	tree, err := s.querySourceTree(params.domain, params.startTime, params.endTime, withPaths)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to query sources tree", slog.String("error", err.Error()))
+		writeError(w, http.StatusInternalServerError, errInternal, "Failed to fetch stats")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tree)
+}
+
+// querySourceTree builds the tree level by level, each level being ordered
+// by visitors, then pageviews, then name.
+func (s *server) querySourceTree(domain string, start, end time.Time, withPaths bool) (sourceTree, error) {
+	tree := sourceTree{Domain: domain, Start: start, End: end, Channels: []channelNode{}}
+	byVisitors := []sortKey{{column: "visitors", desc: true}, {column: "pageviews", desc: true}}
+
+	q := statsQuery{table: "sources", domain: domain, start: start, end: end}
+	q.dimensions = []string{"channel"}
+	q.order = append(byVisitors, sortKey{column: "channel"})
+	rows, err := s.queryRows(q)
+	if err != nil {
+		return tree, fmt.Errorf("failed to query channels: %w", err)
+	}
+
+	channelIndex := map[string]int{}
+	for _, row := range rows {
+		channelIndex[row.dimensions[0]] = len(tree.Channels)
+		tree.Channels = append(tree.Channels, channelNode{
+			Channel:   row.dimensions[0],
+			Visitors:  row.visitors,
+			Pageviews: row.pageviews,
+			Sources:   []sourceNode{},
+		})
+	}
+
+	q.dimensions = []string{"channel", "referrer"}
+	q.order = append(byVisitors, sortKey{column: "referrer"})
+	rows, err = s.queryRows(q)
+	if err != nil {
+		return tree, fmt.Errorf("failed to query sources: %w", err)
+	}
+
+	// Where each source is in the tree, to attach its paths
+	type position struct{ channel, source int }
+	sourceIndex := map[string]position{}
+	for _, row := range rows {
+		i, ok := channelIndex[row.dimensions[0]]
+		if !ok {
+			continue
+		}
+		node := sourceNode{Source: row.dimensions[1], Visitors: row.visitors, Pageviews: row.pageviews}
+		sourceIndex[node.Source] = position{i, len(tree.Channels[i].Sources)}
+		tree.Channels[i].Sources = append(tree.Channels[i].Sources, node)
+	}
+
+	if !withPaths {
+		return tree, nil
+	}
+
+	q = statsQuery{table: "referrer_paths", domain: domain, start: start, end: end}
+	q.dimensions = []string{"referrer", "path"}
+	q.order = append(byVisitors, sortKey{column: "path"})
+	rows, err = s.queryRows(q)
+	if err != nil {
+		return tree, fmt.Errorf("failed to query referrer paths: %w", err)
+	}
+
+	for _, row := range rows {
+		pos, ok := sourceIndex[row.dimensions[0]]
+		if !ok {
+			continue
+		}
+		source := &tree.Channels[pos.channel].Sources[pos.source]
+		source.Paths = append(source.Paths, pathNode{Path: row.dimensions[1], Visitors: row.visitors, Pageviews: row.pageviews})
+	}
+
+	return tree, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/url"
+	"time"
+)
+
+// periodTotals are the headline numbers of a range of days.
+type periodTotals struct {
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Visitors  int       `json:"visitors"`
+	Pageviews int       `json:"pageviews"`
+}
+
+// metricChange is the difference between two periods. Percent is null when
+// the previous period has nothing to compare to. Significant is false when
+// the change could be explained by the error of the estimates alone.
+type metricChange struct {
+	Absolute    int      `json:"absolute"`
+	Percent     *float64 `json:"percent"`
+	Significant bool     `json:"significant"`
+}
+
+// comparison compares the requested range with the one before it.
+type comparison struct {
+	Current         periodTotals `json:"current"`
+	Previous        periodTotals `json:"previous"`
+	VisitorsChange  metricChange `json:"visitors_change"`
+	PageviewsChange metricChange `json:"pageviews_change"`
+}
+
+// wantsComparison reports whether the compare query parameter asks for a
+// comparison with the previous period, which only exists for bounded ranges.
+func wantsComparison(query url.Values, start time.Time) (bool, error) {
+	switch query.Get("compare") {
+	case "":
+		return false, nil
+	case "previous_period":
+		if start.IsZero() {
+			return false, errors.New("comparing with the previous period requires a bounded range")
+		}
+		return true, nil
+	}
+	return false, errors.New("invalid compare parameter, expected previous_period")
+}
+
+// previousPeriod returns the range of as many days ending the day before
+// start. Days are rounded as the range may span a DST change, making one of
+// them an hour shorter or longer.
+func previousPeriod(start, end time.Time) (time.Time, time.Time) {
+	days := int(math.Round(end.Sub(start).Hours() / 24))
+	previousEnd := start.AddDate(0, 0, -1)
+	return previousEnd.AddDate(0, 0, -days), previousEnd
+}
+
+// compareTotals computes the totals of the rows q matches for its range and
+// the previous period, regardless of how q groups them.
+func (s *server) compareTotals(q statsQuery) (*comparison, error) {
+	current, err := s.queryTotals(q)
+	if err != nil {
+		return nil, err
+	}
+
+	q.start, q.end = previousPeriod(q.start, q.end)
+	previous, err := s.queryTotals(q)
+	if err != nil {
+		return nil, err
+	}
+
+	return &comparison{
+		Current:         current,
+		Previous:        previous,
+		VisitorsChange:  visitorsChange(current.Visitors, previous.Visitors, s.sketches.relativeError()),
+		PageviewsChange: change(current.Pageviews, previous.Pageviews),
+	}, nil
+}
+
+// queryTotals returns the unique visitors and pageviews of the rows q
+// matches over its range, regardless of how q groups them.
+func (s *server) queryTotals(q statsQuery) (periodTotals, error) {
+	totals := periodTotals{Start: q.start, End: q.end}
+
+	q.dimensions, q.interval, q.order, q.limit = nil, "", nil, 0
+	rows, err := s.queryRows(q)
+	if err != nil {
+		return totals, err
+	}
+
+	// Without grouping, there's a single row
+	if len(rows) > 0 {
+		totals.Visitors, totals.Pageviews = rows[0].visitors, rows[0].pageviews
+	}
+	return totals, nil
+}
+
+// change compares exact counts, any difference being significant.
+func change(current, previous int) metricChange {
+	c := metricChange{Absolute: current - previous, Significant: current != previous}
+	if previous != 0 {
+		percent := float64(current-previous) / float64(previous) * 100
+		c.Percent = &percent
+	}
+	return c
+}
+
+// visitorsChange compares unique visitor estimates, whose change is only
+// significant beyond twice the standard error of their difference, for a
+// confidence of about 95%. relativeError is that of the sketches.
+func visitorsChange(current, previous int, relativeError float64) metricChange {
+	c := change(current, previous)
+	stdErr := relativeError * math.Hypot(float64(current), float64(previous))
+	c.Significant = math.Abs(float64(c.Absolute)) > 2*stdErr
+	return c
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Smallest response worth compressing: below it, gzip's overhead outweighs
+// what it saves.
+const minCompressedSize = 1024
+
+// compressibleTypes are the content types compressed responses can have.
+var compressibleTypes = []string{
+	"application/json",
+	"application/javascript",
+	"text/",
+}
+
+var gzipWriters = sync.Pool{
+	New: func() any { return gzip.NewWriter(nil) },
+}
+
+// compressed gzips the responses of next when the client accepts it and the
+// response is large enough to benefit from it.
+func compressed(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip.
+func acceptsGzip(header string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(candidate), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		// Only an explicit q=0 refuses it
+		name, value, _ := strings.Cut(strings.TrimSpace(params), "=")
+		if strings.TrimSpace(name) == "q" {
+			if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter holds back the start of a response until it knows
+// whether to compress it, which it does once the response reaches
+// minCompressedSize.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	buf         []byte
+
+	// Set once the response is being compressed
+	gz *gzip.Writer
+	// Set once the response is written as is
+	passthrough bool
+}
+
+func (gw *gzipResponseWriter) WriteHeader(status int) {
+	if !gw.wroteHeader {
+		gw.status = status
+		gw.wroteHeader = true
+	}
+}
+
+func (gw *gzipResponseWriter) Write(b []byte) (int, error) {
+	gw.wroteHeader = true
+	switch {
+	case gw.gz != nil:
+		return gw.gz.Write(b)
+	case gw.passthrough:
+		return gw.ResponseWriter.Write(b)
+	}
+
+	gw.buf = append(gw.buf, b...)
+	if len(gw.buf) < minCompressedSize {
+		return len(b), nil
+	}
+	if err := gw.start(gw.compressible()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// compressible reports whether the response can be compressed, now that its
+// headers are known.
+func (gw *gzipResponseWriter) compressible() bool {
+	header := gw.Header()
+	if gw.status != http.StatusOK || header.Get("Content-Encoding") != "" {
+		return false
+	}
+	contentType := header.Get("Content-Type")
+	// Events have to reach the client as they happen
+	if strings.HasPrefix(contentType, "text/event-stream") {
+		return false
+	}
+	for _, prefix := range compressibleTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// start writes the headers and what's been held back of the body, compressed
+// or not.
+func (gw *gzipResponseWriter) start(compress bool) error {
+	buf := gw.buf
+	gw.buf = nil
+
+	if !compress {
+		gw.passthrough = true
+		gw.ResponseWriter.WriteHeader(gw.status)
+		if len(buf) == 0 {
+			return nil
+		}
+		_, err := gw.ResponseWriter.Write(buf)
+		return err
+	}
+
+	gw.Header().Set("Content-Encoding", "gzip")
+	gw.Header().Del("Content-Length")
+	gw.ResponseWriter.WriteHeader(gw.status)
+
+	gw.gz = gzipWriters.Get().(*gzip.Writer)
+	gw.gz.Reset(gw.ResponseWriter)
+	_, err := gw.gz.Write(buf)
+	return err
+}
+
+// Flush sends what's been written so far, deciding whether to compress the
+// response if it hasn't been yet.
+func (gw *gzipResponseWriter) Flush() {
+	if gw.gz == nil && !gw.passthrough {
+		if err := gw.start(gw.compressible()); err != nil {
+			return
+		}
+	}
+	if gw.gz != nil {
+		gw.gz.Flush()
+	}
+	if flusher, ok := gw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the response being compressed, for http.ResponseController.
+func (gw *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return gw.ResponseWriter
+}
+
+// close ends the response, writing it as is if it never got large enough to
+// be compressed.
+func (gw *gzipResponseWriter) close() {
+	if gw.gz != nil {
+		gw.gz.Close()
+		gzipWriters.Put(gw.gz)
+		return
+	}
+	if !gw.passthrough && gw.wroteHeader {
+		gw.start(false)
+	}
+}
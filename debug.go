@@ -0,0 +1,45 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+)
+
+// The prefix the profiles of net/http/pprof are served under
+const pprofPrefix = "/internal/debug/pprof/"
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+}
+
+// handlePprof serves the profiles of the running server, to be read with
+// go tool pprof, and their index.
+func (s *server) handlePprof(w http.ResponseWriter, r *http.Request) {
+	// CPU profiles and execution traces last as long as asked
+	liftWriteDeadline(w)
+
+	switch name := strings.TrimPrefix(r.URL.Path, pprofPrefix); name {
+	case "":
+		pprof.Index(w, r)
+	case "cmdline":
+		pprof.Cmdline(w, r)
+	case "profile":
+		pprof.Profile(w, r)
+	case "symbol":
+		pprof.Symbol(w, r)
+	case "trace":
+		pprof.Trace(w, r)
+	default:
+		pprof.Handler(name).ServeHTTP(w, r)
+	}
+}
+
+// handleDebugVars serves the variables published with expvar: the memory
+// statistics of the runtime, the command line and the number of goroutines.
+func (s *server) handleDebugVars(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	expvar.Handler().ServeHTTP(w, r)
+}
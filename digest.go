@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Number of entries in each of the digest's top lists
+const digestTopSize = 10
+
+// digest is a snapshot of a day's stats for a domain. Once the day is over,
+// the first digest computed is stored and returned unchanged from then on.
+type digest struct {
+	Domain       string     `json:"domain"`
+	Date         string     `json:"date"`
+	Closed       bool       `json:"closed"`
+	Visitors     int        `json:"visitors"`
+	Pageviews    int        `json:"pageviews"`
+	TopPages     []topEntry `json:"top_pages"`
+	TopSources   []topEntry `json:"top_sources"`
+	TopCountries []topEntry `json:"top_countries"`
+}
+
+// topEntry is a page, source or country in a top list.
+type topEntry struct {
+	Name      string `json:"name"`
+	Visitors  int    `json:"visitors"`
+	Pageviews int    `json:"pageviews"`
+}
+
+func (s *server) handleDigest(w http.ResponseWriter, r *http.Request) {
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeError(w, http.StatusBadRequest, errMissingParameter, "Missing domain parameter")
+		return
+	}
+
+	today := dayIn(time.Now(), s.siteLocation(domain))
+	day := today
+	if value := r.URL.Query().Get("date"); value != "" {
+		var err error
+		day, err = time.Parse(time.DateOnly, value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid date parameter, expected YYYY-MM-DD")
+			return
+		}
+	}
+
+	if day.After(today) {
+		writeError(w, http.StatusBadRequest, errInvalidParameter, "The date parameter can't be in the future")
+		return
+	}
+
+	closed := day.Before(today)
+	if closed {
+		stored, err := s.storedDigest(domain, day)
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to load digest", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Failed to fetch digest")
+			return
+		}
+		if stored != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "public, max-age=86400")
+			w.WriteHeader(http.StatusOK)
+			w.Write(stored)
+			return
+		}
+	}
+
+	d, err := s.computeDigest(domain, day)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to compute digest", slog.String("error", err.Error()))
+		writeError(w, http.StatusInternalServerError, errInternal, "Failed to fetch digest")
+		return
+	}
+	d.Closed = closed
+
+	body, err := json.Marshal(d)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to encode digest", slog.String("error", err.Error()))
+		writeError(w, http.StatusInternalServerError, errInternal, "Failed to fetch digest")
+		return
+	}
+
+	// Freeze the digest of closed days. If another request stored one in the
+	// meantime, return that one so that every caller gets the same snapshot.
+	if closed {
+		body, err = s.storeDigest(domain, day, body)
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to store digest", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Failed to fetch digest")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func (s *server) storedDigest(domain string, day time.Time) ([]byte, error) {
+	var body []byte
+	err := s.db.QueryRow(`SELECT digest FROM digests WHERE domain = $1 AND day = $2`, domain, day).Scan(&body)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return body, err
+}
+
+func (s *server) storeDigest(domain string, day time.Time, body []byte) ([]byte, error) {
+	_, err := s.db.Exec(`
+	INSERT INTO digests (domain, day, digest)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (domain, day) DO NOTHING
+	`, domain, day, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.storedDigest(domain, day)
+}
+
+func (s *server) computeDigest(domain string, day time.Time) (digest, error) {
+	d := digest{Domain: domain, Date: day.Format(time.DateOnly)}
+
+	totals, err := s.queryTotals(statsQuery{table: "pages", domain: domain, start: day, end: day})
+	if err != nil {
+		return d, fmt.Errorf("failed to query totals: %w", err)
+	}
+	d.Visitors, d.Pageviews = totals.Visitors, totals.Pageviews
+
+	if d.TopPages, err = s.topEntries("pages", "path", domain, day, day, digestTopSize); err != nil {
+		return d, err
+	}
+	if d.TopSources, err = s.topEntries("sources", "referrer", domain, day, day, digestTopSize); err != nil {
+		return d, err
+	}
+	if d.TopCountries, err = s.topEntries("countries", "country", domain, day, day, digestTopSize); err != nil {
+		return d, err
+	}
+
+	return d, nil
+}
+
+// topEntries returns the entries of table with the most visitors over the
+// range, in a stable order.
+func (s *server) topEntries(table string, column string, domain string, start, end time.Time, limit int) ([]topEntry, error) {
+	q := statsQuery{
+		table:      table,
+		domain:     domain,
+		start:      start,
+		end:        end,
+		dimensions: []string{column},
+		order:      []sortKey{{column: "visitors", desc: true}, {column: "pageviews", desc: true}, {column: column}},
+		limit:      limit,
+	}
+	rows, err := s.queryRows(q)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query top %s: %w", table, err)
+	}
+
+	entries := make([]topEntry, 0, len(rows))
+	for _, row := range rows {
+		entries = append(entries, topEntry{Name: row.dimensions[0], Visitors: row.visitors, Pageviews: row.pageviews})
+	}
+
+	return entries, nil
+}
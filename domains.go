@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// domainStats is a domain that has recorded pageviews.
+type domainStats struct {
+	Domain    string    `json:"domain"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+
+	// The totals of the last 30 days
+	Visitors  int `json:"visitors_30d"`
+	Pageviews int `json:"pageviews_30d"`
+}
+
+// queryDomains returns the domains that have recorded pageviews, in
+// alphabetical order. The last 30 days are those of the default time zone,
+// so that all the domains are counted in a single query.
+func (s *server) queryDomains(now time.Time) ([]domainStats, error) {
+	domains, err := s.store.domainDays()
+	if err != nil {
+		return nil, err
+	}
+
+	today := dayIn(now, s.cfg.DefaultLocation)
+	start, _ := periodStart("30d", today)
+	totals, err := s.queryRows(statsQuery{
+		table:      "pages",
+		allDomains: true,
+		start:      start,
+		end:        today,
+		dimensions: []string{"domain"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query domain totals: %w", err)
+	}
+
+	byDomain := map[string]statsRow{}
+	for _, row := range totals {
+		byDomain[row.dimensions[0]] = row
+	}
+	for i := range domains {
+		domains[i].Visitors = byDomain[domains[i].Domain].visitors
+		domains[i].Pageviews = byDomain[domains[i].Domain].pageviews
+	}
+
+	return domains, nil
+}
+
+func (s *server) handleDomains(w http.ResponseWriter, r *http.Request) {
+	domains, err := s.queryDomains(time.Now())
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to query domains", slog.String("error", err.Error()))
+		writeError(w, http.StatusInternalServerError, errInternal, "Failed to fetch stats")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		Domains []domainStats `json:"domains"`
+	}{
+		Domains: domains,
+	})
+}
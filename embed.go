@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The size of the sparkline of the embeddable widget, in pixels
+const (
+	embedSparklineWidth  = 240
+	embedSparklineHeight = 48
+)
+
+var embedTemplate = template.Must(template.New("embed").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Domain}}</title>
+<style>
+body { margin: 0; font: 14px/1.4 -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif; color: #222; background: transparent; }
+.widget { display: inline-block; padding: 12px 16px; }
+.domain { font-weight: 600; }
+.totals { display: flex; gap: 24px; margin: 4px 0 8px; }
+.total strong { display: block; font-size: 20px; }
+.total span { color: #666; font-size: 12px; }
+svg { display: block; }
+</style>
+</head>
+<body>
+<div class="widget">
+<div class="domain">{{.Domain}}</div>
+<div class="totals">
+<div class="total"><strong>{{.Visitors}}</strong><span>visitors ({{.Period}})</span></div>
+<div class="total"><strong>{{.Pageviews}}</strong><span>pageviews</span></div>
+</div>
+<svg xmlns="http://www.w3.org/2000/svg" width="{{.Width}}" height="{{.Height}}" viewBox="0 0 {{.Width}} {{.Height}}" role="img" aria-label="Visitors per day">
+<polyline points="{{.Points}}" fill="none" stroke="#4c1" stroke-width="2" stroke-linejoin="round" stroke-linecap="round"/>
+</svg>
+</div>
+</body>
+</html>
+`))
+
+// handleEmbed serves /embed/{token}: a small HTML page with the visitors and
+// pageviews of the last 7, 30 or 90 days of the share link's domain, and a
+// sparkline of its visitors per day, meant to be embedded in an iframe.
+func (s *server) handleEmbed(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	period := query.Get("period")
+	if period == "" {
+		period = defaultPeriod
+	}
+	if period != "7d" && period != "30d" && period != "90d" {
+		writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid period parameter, expected 7d, 30d or 90d")
+		return
+	}
+
+	// requireShare set the domain of the share link
+	domain := query.Get("domain")
+	today := dayIn(time.Now(), s.siteLocation(domain))
+	start, _ := periodStart(period, today)
+	q := statsQuery{table: "pages", domain: domain, start: start, end: today, ctx: r.Context()}
+
+	totals, err := s.queryTotals(q)
+	var rows []statsRow
+	if err == nil {
+		q.interval = "day"
+		rows, err = s.queryRows(q)
+	}
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to query embed", slog.String("error", err.Error()))
+		writeError(w, http.StatusInternalServerError, errInternal, "Failed to fetch stats")
+		return
+	}
+
+	// Days without pageviews have no row
+	visitors := map[string]int{}
+	for _, row := range rows {
+		visitors[row.day.Format(time.DateOnly)] = row.visitors
+	}
+	series := []int{}
+	for day := start; !day.After(today); day = day.AddDate(0, 0, 1) {
+		series = append(series, visitors[day.Format(time.DateOnly)])
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(badgeMaxAge.Seconds())))
+	w.WriteHeader(http.StatusOK)
+	err = embedTemplate.Execute(w, struct {
+		Domain    string
+		Period    string
+		Visitors  string
+		Pageviews string
+		Width     int
+		Height    int
+		Points    string
+	}{domain, period, compactCount(totals.Visitors), compactCount(totals.Pageviews), embedSparklineWidth, embedSparklineHeight, sparklinePoints(series, embedSparklineWidth, embedSparklineHeight)})
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to write embed", slog.String("error", err.Error()))
+	}
+}
+
+// sparklinePoints returns the points of a polyline drawing values across a
+// width by height box, scaled to the largest of them and inset by the
+// stroke so that it isn't cut.
+func sparklinePoints(values []int, width int, height int) string {
+	const inset = 2
+	largest := 1
+	for _, v := range values {
+		largest = max(largest, v)
+	}
+
+	step := 0.0
+	if len(values) > 1 {
+		step = float64(width-2*inset) / float64(len(values)-1)
+	}
+	points := make([]string, len(values))
+	for i, v := range values {
+		x := inset + float64(i)*step
+		y := float64(height-inset) - float64(v)/float64(largest)*float64(height-2*inset)
+		points[i] = fmt.Sprintf("%.1f,%.1f", x, y)
+	}
+	return strings.Join(points, " ")
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How many errors can wait to be sent before new ones are dropped
+	errorQueueSize = 100
+	// How often the queued errors are sent
+	errorSendInterval = 5 * time.Second
+	// How long an error is left out of the reports once reported, counting
+	// its occurrences meanwhile, so that a database outage failing every
+	// tracking request is reported once a minute rather than per pageview
+	errorRepeatInterval = time.Minute
+)
+
+// errorEvent is an error logged or a panic, with the request it happened
+// in, if any.
+type errorEvent struct {
+	ID         string            `json:"id"`
+	Time       time.Time         `json:"time"`
+	Message    string            `json:"message"`
+	Attributes map[string]string `json:"attributes"`
+	Request    *errorRequest     `json:"request,omitempty"`
+	// How many times it occurred since it was last reported without being
+	// reported again
+	Repeated int `json:"repeated"`
+
+	Environment string `json:"environment"`
+	Release     string `json:"release"`
+	ServerName  string `json:"server_name"`
+}
+
+// errorRequest is the request an error happened in. The query string is left
+// out, as it may hold the API key.
+type errorRequest struct {
+	Method  string `json:"method"`
+	URL     string `json:"url"`
+	Route   string `json:"route,omitempty"`
+	TraceID string `json:"trace_id,omitempty"`
+	spanID  string
+}
+
+// errorReporter sends the errors logged, and the panics of the handlers, to
+// Sentry's SENTRY_DSN and as JSON to ERROR_WEBHOOK_URL. A nil reporter
+// reports nothing.
+type errorReporter struct {
+	// Sentry's envelope endpoint and the key it's authenticated with
+	sentryURL string
+	sentryKey string
+	dsn       string
+
+	webhookURL  string
+	environment string
+	release     string
+	serverName  string
+	logger      *slog.Logger
+	client      *http.Client
+
+	mu       sync.Mutex
+	events   []errorEvent
+	dropped  int
+	reported map[string]time.Time
+	repeated map[string]int
+}
+
+// newErrorReporter returns the reporter of the configuration, or nil if
+// errors aren't reported.
+func newErrorReporter(cfg Config) *errorReporter {
+	if cfg.SentryDSN == nil && cfg.ErrorWebhookURL == "" {
+		return nil
+	}
+	hostname, _ := os.Hostname()
+	e := &errorReporter{
+		webhookURL:  cfg.ErrorWebhookURL,
+		environment: cfg.Environment,
+		release:     currentBuild().Version,
+		serverName:  hostname,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		reported:    map[string]time.Time{},
+		repeated:    map[string]int{},
+	}
+	if dsn := cfg.SentryDSN; dsn != nil {
+		// https://key@o1.ingest.sentry.io/2 posts to /api/2/envelope/, with
+		// any path before the project id kept
+		path, project := "", strings.Trim(dsn.Path, "/")
+		if i := strings.LastIndex(project, "/"); i >= 0 {
+			path, project = "/"+project[:i], project[i+1:]
+		}
+		e.sentryURL = dsn.Scheme + "://" + dsn.Host + path + "/api/" + project + "/envelope/"
+		e.sentryKey = dsn.User.Username()
+		e.dsn = dsn.String()
+	}
+	return e
+}
+
+// report queues an error to be sent, unless it was reported less than a
+// minute ago. Errors are told apart by their message, their details being
+// in their attributes.
+func (e *errorReporter) report(ev errorEvent) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if time.Since(e.reported[ev.Message]) < errorRepeatInterval {
+		e.repeated[ev.Message]++
+		return
+	}
+	if len(e.events) >= errorQueueSize {
+		e.dropped++
+		return
+	}
+	// Messages are constants, but some may have details in them
+	if len(e.reported) > 1000 {
+		clear(e.reported)
+		clear(e.repeated)
+	}
+	e.reported[ev.Message] = time.Now()
+	ev.Repeated = e.repeated[ev.Message]
+	delete(e.repeated, ev.Message)
+
+	var id [16]byte
+	rand.Read(id[:])
+	ev.ID = hex.EncodeToString(id[:])
+	ev.Environment, ev.Release, ev.ServerName = e.environment, e.release, e.serverName
+	e.events = append(e.events, ev)
+}
+
+// sendEvery sends the queued errors periodically. It never returns.
+func (e *errorReporter) sendEvery(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := e.send(); err != nil {
+			// Warnings aren't reported, which would never end
+			e.logger.Warn("Failed to report errors", slog.String("error", err.Error()))
+		}
+	}
+}
+
+// send sends the queued errors. Errors failing to be sent are dropped.
+func (e *errorReporter) send() error {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	events, dropped := e.events, e.dropped
+	e.events, e.dropped = nil, 0
+	e.mu.Unlock()
+
+	if dropped > 0 {
+		e.logger.Warn("Dropped errors, the report queue is full", slog.Int("errors", dropped))
+	}
+	var errs []error
+	for _, ev := range events {
+		if e.sentryURL != "" {
+			if err := e.sendToSentry(ev); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if e.webhookURL != "" {
+			if err := e.postWebhook(ev); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to send %d of %d errors: %w", len(errs), len(events), errs[0])
+	}
+	return nil
+}
+
+// sendToSentry sends an error to Sentry as an envelope holding its event.
+func (e *errorReporter) sendToSentry(ev errorEvent) error {
+	event := map[string]any{
+		"event_id":    ev.ID,
+		"timestamp":   float64(ev.Time.UnixMicro()) / 1e6,
+		"platform":    "go",
+		"level":       "error",
+		"logger":      "potato-analytics",
+		"message":     map[string]string{"formatted": ev.Message},
+		"environment": ev.Environment,
+		"release":     ev.Release,
+		"server_name": ev.ServerName,
+		// Errors of the same message are grouped, whatever their details
+		"fingerprint": []string{ev.Message},
+		"extra":       ev.Attributes,
+	}
+	if detail, ok := ev.Attributes["error"]; ok {
+		event["exception"] = map[string]any{"values": []map[string]string{{"type": ev.Message, "value": detail}}}
+	}
+	tags := map[string]string{}
+	if ev.Repeated > 0 {
+		tags["repeated"] = fmt.Sprint(ev.Repeated)
+	}
+	if req := ev.Request; req != nil {
+		event["request"] = map[string]string{"method": req.Method, "url": req.URL}
+		if req.Route != "" {
+			tags["route"] = req.Route
+		}
+		if req.TraceID != "" {
+			event["contexts"] = map[string]any{"trace": map[string]string{"trace_id": req.TraceID, "span_id": req.spanID}}
+		}
+	}
+	event["tags"] = tags
+
+	header, err := json.Marshal(map[string]string{"event_id": ev.ID, "dsn": e.dsn})
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	var envelope bytes.Buffer
+	envelope.Write(header)
+	fmt.Fprintf(&envelope, "\n{\"type\":\"event\",\"length\":%d}\n", len(payload))
+	envelope.Write(payload)
+	envelope.WriteByte('\n')
+
+	req, err := http.NewRequest(http.MethodPost, e.sentryURL, &envelope)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", "Sentry sentry_version=7, sentry_client=potato-analytics/"+ev.Release+", sentry_key="+e.sentryKey)
+	return e.do(req, "Sentry")
+}
+
+// postWebhook posts an error as JSON to the webhook.
+func (e *errorReporter) postWebhook(ev errorEvent) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.webhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return e.do(req, "the error webhook")
+}
+
+func (e *errorReporter) do(req *http.Request, name string) error {
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s responded with %s", name, resp.Status)
+	}
+	return nil
+}
+
+// reportingHandler reports the records at the error level before passing
+// them on to the handler, with the request of their context if they're
+// logged with one.
+type reportingHandler struct {
+	slog.Handler
+	reporter *errorReporter
+	// The attributes and the group of the logger
+	attrs []slog.Attr
+	group string
+}
+
+func (h *reportingHandler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level >= slog.LevelError {
+		ev := errorEvent{Time: record.Time, Message: record.Message, Attributes: map[string]string{}, Request: requestFrom(ctx)}
+		for _, a := range h.attrs {
+			addErrorAttribute(ev.Attributes, "", a)
+		}
+		record.Attrs(func(a slog.Attr) bool {
+			addErrorAttribute(ev.Attributes, h.group, a)
+			return true
+		})
+		h.reporter.report(ev)
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *reportingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	prefixed := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		prefixed[i] = slog.Attr{Key: h.group + a.Key, Value: a.Value}
+	}
+	return &reportingHandler{Handler: h.Handler.WithAttrs(attrs), reporter: h.reporter, attrs: append(h.attrs[:len(h.attrs):len(h.attrs)], prefixed...), group: h.group}
+}
+
+func (h *reportingHandler) WithGroup(name string) slog.Handler {
+	return &reportingHandler{Handler: h.Handler.WithGroup(name), reporter: h.reporter, attrs: h.attrs, group: h.group + name + "."}
+}
+
+// Attributes of the logs identifying visitors, which are left out of the
+// errors reported as those leave the server
+var unreportedAttributes = map[string]bool{"visitor_ip": true, "remote_addr": true, "user_agent": true}
+
+// addErrorAttribute adds an attribute to those of an error, its groups
+// flattened into dotted keys.
+func addErrorAttribute(attributes map[string]string, prefix string, a slog.Attr) {
+	if unreportedAttributes[a.Key] {
+		return
+	}
+	value := a.Value.Resolve()
+	if value.Kind() == slog.KindGroup {
+		for _, member := range value.Group() {
+			addErrorAttribute(attributes, prefix+a.Key+".", member)
+		}
+		return
+	}
+	attributes[prefix+a.Key] = value.String()
+}
+
+type requestContextKey struct{}
+
+// servedRequest is the request a context was derived from for its handler.
+type servedRequest struct {
+	r *http.Request
+}
+
+// requestFrom returns the request of ctx, as served by a route, nil if
+// there's none.
+func requestFrom(ctx context.Context) *errorRequest {
+	if ctx == nil {
+		return nil
+	}
+	served, _ := ctx.Value(requestContextKey{}).(*servedRequest)
+	if served == nil || served.r == nil {
+		return nil
+	}
+	r := served.r
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	req := &errorRequest{Method: r.Method, URL: scheme + "://" + r.Host + r.URL.Path, Route: r.Pattern}
+	if sp := spanFrom(ctx); sp != nil {
+		req.TraceID, req.spanID = hex.EncodeToString(sp.traceID[:]), hex.EncodeToString(sp.spanID[:])
+	}
+	return req
+}
+
+// recovered lets the errors the handlers of next log with the context of
+// their request be reported along with it, and logs their panics with their
+// stack, responding with an internal error when nothing was written yet.
+func (s *server) recovered(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The route is only known once next matched it, which sets it on
+		// the request it's given
+		served := &servedRequest{}
+		r = r.WithContext(context.WithValue(r.Context(), requestContextKey{}, served))
+		served.r = r
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			err := recover()
+			if err == nil || err == http.ErrAbortHandler {
+				if err != nil {
+					panic(err)
+				}
+				return
+			}
+			s.logger.ErrorContext(r.Context(), "Panic serving request", slog.String("error", fmt.Sprint(err)), slog.String("stack", string(debug.Stack())))
+			if rec.code != 0 {
+				// The response can't be fixed anymore, so the connection is
+				// dropped for the client to notice
+				panic(http.ErrAbortHandler)
+			}
+			writeError(rec, http.StatusInternalServerError, errInternal, "Internal server error")
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// parseSentryDSN parses a Sentry DSN, such as
+// https://key@o1.ingest.sentry.io/2.
+func parseSentryDSN(value string) (*url.URL, error) {
+	dsn, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	if (dsn.Scheme != "http" && dsn.Scheme != "https") || dsn.Host == "" || dsn.User.Username() == "" || strings.Trim(dsn.Path, "/") == "" {
+		return nil, fmt.Errorf("%q has no key or project", value)
+	}
+	return dsn, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// The machine-readable codes of API errors. Clients rely on them, so new
+// codes can be added but existing ones must not change.
+const (
+	errMissingParameter = "missing_parameter"
+	errInvalidParameter = "invalid_parameter"
+	errInvalidBody      = "invalid_body"
+	errUnauthorized     = "unauthorized"
+	errForbidden        = "forbidden"
+	errInvalidSignature = "invalid_signature"
+	errInvalidShare     = "invalid_share"
+	errNotFound         = "not_found"
+	errMethodNotAllowed = "method_not_allowed"
+	errNotConfigured    = "not_configured"
+	errRateLimited      = "rate_limited"
+	errTooLarge         = "too_large"
+	errInvalidConfig    = "invalid_config"
+	errInternal         = "internal_error"
+)
+
+// writeError replies with an error in the envelope shared by all endpoints:
+//
+//	{"error": {"code": "missing_parameter", "message": "Missing domain parameter"}}
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	type apiError struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error apiError `json:"error"`
+	}{apiError{Code: code, Message: message}})
+}
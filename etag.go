@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// conditional sets a weak ETag on the successful responses of a stats
+// endpoint, answering with 304 Not Modified when the client already has it.
+// CSV exports are streamed instead, as they'd have to be held in memory to be
+// hashed.
+func (s *server) conditional(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead || wantsCSV(r) {
+			next(w, r)
+			return
+		}
+
+		rec := &responseRecorder{header: http.Header{}, status: http.StatusOK}
+		next(rec, r)
+
+		for name, values := range rec.header {
+			w.Header()[name] = values
+		}
+
+		if rec.status == http.StatusOK {
+			sum := sha256.Sum256(rec.body.Bytes())
+			etag := `W/"` + hex.EncodeToString(sum[:16]) + `"`
+			w.Header().Set("ETag", etag)
+
+			if etagMatches(r.Header.Get("If-None-Match"), etag) {
+				// Only the headers describing the representation are kept
+				for _, name := range []string{"Content-Type", "Content-Disposition", "X-Total-Count"} {
+					w.Header().Del(name)
+				}
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+
+		w.WriteHeader(rec.status)
+		w.Write(rec.body.Bytes())
+	}
+}
+
+// etagMatches reports whether an If-None-Match header lists the ETag, using
+// the weak comparison.
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
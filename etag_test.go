@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCSVExportsAreStreamed(t *testing.T) {
+	s := newTestServer(t)
+	s.cfg.StatsCacheTTL = time.Hour
+
+	for _, tc := range []struct{ target, accept string }{
+		{"/stats/pages?domain=example.com&start=2024-01-01&end=2024-01-31&format=csv", ""},
+		{"/stats/pages?domain=example.com&start=2024-01-01&end=2024-01-31", "text/csv"},
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+		req.Header.Set("Accept", tc.accept)
+
+		streamed := false
+		handler := s.conditional(s.cached(func(w http.ResponseWriter, r *http.Request) {
+			// Buffering wrappers pass their own writer
+			streamed = w == http.ResponseWriter(rec)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("path,visitors,pageviews\n"))
+		}))
+		handler(rec, req)
+
+		if !streamed {
+			t.Errorf("%s: the CSV export was buffered", tc.target)
+		}
+		if etag := rec.Header().Get("ETag"); etag != "" {
+			t.Errorf("%s: the CSV export has an ETag: %s", tc.target, etag)
+		}
+	}
+
+	// JSON responses keep their ETag
+	rec := httptest.NewRecorder()
+	s.conditional(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"results":[]}`))
+	})(rec, httptest.NewRequest(http.MethodGet, "/stats/pages?domain=example.com", nil))
+	if rec.Header().Get("ETag") == "" {
+		t.Errorf("the JSON response has no ETag")
+	}
+}
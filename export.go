@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// exportTables are the tables exported, in order.
+var exportTables = []string{"pages", "countries", "sources", "page_countries", "page_sources", "referrer_paths", "environments", "visitor_types"}
+
+// exportColumns are the dimensions of the exported rows in CSV, the ones a
+// table doesn't have being left empty. Channels aren't exported as they're
+// computed from referrers.
+var exportColumns = []string{"path", "country", "referrer", "environment", "visitor_type"}
+
+// handleExport streams the daily visitors and pageviews of every dimension of
+// a domain over a range, as JSON Lines or CSV. Tables are read a month at a
+// time so that large exports don't have to be held in memory.
+func (s *server) handleExport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	domain := query.Get("domain")
+	if domain == "" {
+		writeError(w, http.StatusBadRequest, errMissingParameter, "Missing domain parameter")
+		return
+	}
+
+	start, end, err := s.parseDateRange(query)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidParameter, err.Error())
+		return
+	}
+
+	format := query.Get("format")
+	switch format {
+	case "":
+		format = "jsonl"
+	case "jsonl", "csv":
+	default:
+		writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid format parameter, expected jsonl or csv")
+		return
+	}
+
+	contentType := "application/x-ndjson"
+	if format == "csv" {
+		contentType = "text/csv; charset=utf-8"
+	}
+	// Exports of large domains can take longer than the write timeout
+	liftWriteDeadline(w)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": domain + "-export." + format}))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	var write func(table string, columns []string, row statsRow) error
+	switch format {
+	case "jsonl":
+		encoder := json.NewEncoder(w)
+		write = func(table string, columns []string, row statsRow) error {
+			record := map[string]any{
+				"table":     table,
+				"day":       row.day.Format(time.DateOnly),
+				"visitors":  row.visitors,
+				"pageviews": row.pageviews,
+			}
+			for i, column := range columns {
+				record[column] = row.dimensions[i]
+			}
+			return encoder.Encode(record)
+		}
+	case "csv":
+		writer := csv.NewWriter(w)
+		header := append(append([]string{"table", "day"}, exportColumns...), "visitors", "pageviews")
+		writer.Write(header)
+		writer.Flush()
+
+		record := make([]string, len(header))
+		write = func(table string, columns []string, row statsRow) error {
+			clear(record)
+			record[0], record[1] = table, row.day.Format(time.DateOnly)
+			for i, column := range columns {
+				record[2+slices.Index(exportColumns, column)] = row.dimensions[i]
+			}
+			record[len(record)-2] = strconv.Itoa(row.visitors)
+			record[len(record)-1] = strconv.Itoa(row.pageviews)
+			writer.Write(record)
+			writer.Flush()
+			return writer.Error()
+		}
+	}
+
+	// The response has started, so errors can only end it early
+	if err := s.export(w, domain, start, end, write); err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to export stats", slog.String("domain", domain), slog.String("error", err.Error()))
+	}
+}
+
+// export writes the rows of every exported table, a month at a time.
+func (s *server) export(w io.Writer, domain string, start, end time.Time, write func(table string, columns []string, row statsRow) error) error {
+	for _, table := range exportTables {
+		var columns []string
+		for _, column := range statsTables[table] {
+			if column != "channel" {
+				columns = append(columns, column)
+			}
+		}
+
+		from := start
+		if from.IsZero() {
+			// Ranges without a start begin with the table's first day
+			first, ok, err := s.store.firstDay(table, domain)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			from = first
+		}
+
+		order := []sortKey{{column: "day"}}
+		for _, column := range columns {
+			order = append(order, sortKey{column: column})
+		}
+
+		for ; !from.After(end); from = from.AddDate(0, 1, 0) {
+			to := from.AddDate(0, 1, -1)
+			if to.After(end) {
+				to = end
+			}
+			rows, err := s.queryRows(statsQuery{
+				table:      table,
+				domain:     domain,
+				start:      from,
+				end:        to,
+				dimensions: columns,
+				interval:   "day",
+				order:      order,
+			})
+			if err != nil {
+				return err
+			}
+			for _, row := range rows {
+				if err := write(table, columns, row); err != nil {
+					return err
+				}
+			}
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// ga4Event is the part of an event of Google Analytics' BigQuery export that
+// is imported.
+type ga4Event struct {
+	EventDate    string `json:"event_date"`
+	EventName    string `json:"event_name"`
+	UserPseudoID string `json:"user_pseudo_id"`
+	EventParams  []struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue *string `json:"string_value"`
+		} `json:"value"`
+	} `json:"event_params"`
+	Geo struct {
+		Country string `json:"country"`
+	} `json:"geo"`
+}
+
+// param returns the string value of one of the event's parameters.
+func (e ga4Event) param(key string) string {
+	for _, param := range e.EventParams {
+		if param.Key == key && param.Value.StringValue != nil {
+			return *param.Value.StringValue
+		}
+	}
+	return ""
+}
+
+// importGA4 backfills a domain's stats from the page_view events of Google
+// Analytics' BigQuery export, extracted as newline-delimited JSON files,
+// gzipped or not. Events carry GA's pseudonymous visitor IDs, so unique
+// visitors are counted as they'd have been live, in every table but the
+// visitor types. Countries are left out when the domain doesn't track them.
+// Each file is written once read, as exports hold a day per table, in a
+// transaction that counts the rows of months already rolled up in their
+// monthly rows too.
+func importGA4(db *sql.DB, logger *slog.Logger, sketches sketchFormat, domain string, withoutCountries bool, paths []string) error {
+	st := newPostgresStore(db, logger, sketches)
+	st.buffer = newWriteBuffer()
+
+	unknown := map[string]bool{}
+	for _, path := range paths {
+		events, err := readGA4Events(path, func(event ga4Event) {
+			if event.EventName != "page_view" {
+				return
+			}
+			pv, ok := ga4Pageview(domain, event)
+			if !ok {
+				return
+			}
+			if withoutCountries {
+				pv.country = ""
+			} else if event.Geo.Country != "" && pv.country == "" && !unknown[event.Geo.Country] {
+				unknown[event.Geo.Country] = true
+				logger.Warn("Unknown country, its pageviews aren't counted in the countries", slog.String("country", event.Geo.Country))
+			}
+			for _, row := range pv.countedRows() {
+				st.buffer.add(row, pv.visitor)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+
+		if err := st.flush(); err != nil {
+			return err
+		}
+		logger.Info("Imported GA4 events", slog.String("file", path), slog.Int("events", events))
+	}
+	return nil
+}
+
+// readGA4Events calls fn with each event of a file, returning how many there
+// were.
+func readGA4Events(path string, fn func(event ga4Event)) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	count := 0
+	for scanner.Scan() {
+		var event ga4Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return count, fmt.Errorf("invalid event on line %d: %w", count+1, err)
+		}
+		fn(event)
+		count++
+	}
+	return count, scanner.Err()
+}
+
+// ga4Pageview returns the pageview of a page_view event, counted like those
+// tracked live, or false when it can't be.
+func ga4Pageview(domain string, event ga4Event) (pageview, bool) {
+	day, err := time.Parse("20060102", event.EventDate)
+	location, locationErr := url.Parse(event.param("page_location"))
+	if err != nil || locationErr != nil || event.UserPseudoID == "" {
+		return pageview{}, false
+	}
+
+	pv := pageview{
+		domain:      domain,
+		path:        location.Path,
+		day:         day,
+		visitor:     "ga4:" + event.UserPseudoID,
+		environment: "production",
+		country:     ga4Countries[event.Geo.Country],
+		referrer:    "Direct / None",
+	}
+	if pv.path == "" {
+		pv.path = "/"
+	}
+
+	if referrer, err := url.Parse(event.param("page_referrer")); err == nil && referrer.Host != "" && referrer.Host != location.Host {
+		pv.referrer = referrer.Host
+		pv.referrerPath = referrer.Path
+		if pv.referrerPath == "" {
+			pv.referrerPath = "/"
+		}
+	}
+	return pv, true
+}
+
+// ga4Countries maps the names countries have in GA's exports to the ISO
+// codes visitors' countries are tracked with.
+var ga4Countries = map[string]string{
+	"Afghanistan": "AF", "Albania": "AL", "Algeria": "DZ", "Andorra": "AD", "Angola": "AO",
+	"Antigua & Barbuda": "AG", "Argentina": "AR", "Armenia": "AM", "Australia": "AU", "Austria": "AT",
+	"Azerbaijan": "AZ", "Bahamas": "BS", "Bahrain": "BH", "Bangladesh": "BD", "Barbados": "BB",
+	"Belarus": "BY", "Belgium": "BE", "Belize": "BZ", "Benin": "BJ", "Bhutan": "BT",
+	"Bolivia": "BO", "Bosnia & Herzegovina": "BA", "Botswana": "BW", "Brazil": "BR", "Brunei": "BN",
+	"Bulgaria": "BG", "Burkina Faso": "BF", "Burundi": "BI", "Cambodia": "KH", "Cameroon": "CM",
+	"Canada": "CA", "Cape Verde": "CV", "Central African Republic": "CF", "Chad": "TD", "Chile": "CL",
+	"China": "CN", "Colombia": "CO", "Comoros": "KM", "Congo - Brazzaville": "CG", "Congo - Kinshasa": "CD",
+	"Costa Rica": "CR", "Côte d’Ivoire": "CI", "Croatia": "HR", "Cuba": "CU", "Cyprus": "CY",
+	"Czechia": "CZ", "Denmark": "DK", "Djibouti": "DJ", "Dominica": "DM", "Dominican Republic": "DO",
+	"Ecuador": "EC", "Egypt": "EG", "El Salvador": "SV", "Equatorial Guinea": "GQ", "Eritrea": "ER",
+	"Estonia": "EE", "Eswatini": "SZ", "Ethiopia": "ET", "Fiji": "FJ", "Finland": "FI",
+	"France": "FR", "Gabon": "GA", "Gambia": "GM", "Georgia": "GE", "Germany": "DE",
+	"Ghana": "GH", "Greece": "GR", "Grenada": "GD", "Guatemala": "GT", "Guinea": "GN",
+	"Guinea-Bissau": "GW", "Guyana": "GY", "Haiti": "HT", "Honduras": "HN", "Hong Kong": "HK",
+	"Hungary": "HU", "Iceland": "IS", "India": "IN", "Indonesia": "ID", "Iran": "IR",
+	"Iraq": "IQ", "Ireland": "IE", "Israel": "IL", "Italy": "IT", "Jamaica": "JM",
+	"Japan": "JP", "Jordan": "JO", "Kazakhstan": "KZ", "Kenya": "KE", "Kiribati": "KI",
+	"Kosovo": "XK", "Kuwait": "KW", "Kyrgyzstan": "KG", "Laos": "LA", "Latvia": "LV",
+	"Lebanon": "LB", "Lesotho": "LS", "Liberia": "LR", "Libya": "LY", "Liechtenstein": "LI",
+	"Lithuania": "LT", "Luxembourg": "LU", "Macao": "MO", "Madagascar": "MG", "Malawi": "MW",
+	"Malaysia": "MY", "Maldives": "MV", "Mali": "ML", "Malta": "MT", "Marshall Islands": "MH",
+	"Mauritania": "MR", "Mauritius": "MU", "Mexico": "MX", "Micronesia": "FM", "Moldova": "MD",
+	"Monaco": "MC", "Mongolia": "MN", "Montenegro": "ME", "Morocco": "MA", "Mozambique": "MZ",
+	"Myanmar (Burma)": "MM", "Namibia": "NA", "Nauru": "NR", "Nepal": "NP", "Netherlands": "NL",
+	"New Zealand": "NZ", "Nicaragua": "NI", "Niger": "NE", "Nigeria": "NG", "North Korea": "KP",
+	"North Macedonia": "MK", "Norway": "NO", "Oman": "OM", "Pakistan": "PK", "Palau": "PW",
+	"Palestine": "PS", "Panama": "PA", "Papua New Guinea": "PG", "Paraguay": "PY", "Peru": "PE",
+	"Philippines": "PH", "Poland": "PL", "Portugal": "PT", "Puerto Rico": "PR", "Qatar": "QA",
+	"Romania": "RO", "Russia": "RU", "Rwanda": "RW", "Samoa": "WS", "San Marino": "SM",
+	"São Tomé & Príncipe": "ST", "Saudi Arabia": "SA", "Senegal": "SN", "Serbia": "RS", "Seychelles": "SC",
+	"Sierra Leone": "SL", "Singapore": "SG", "Slovakia": "SK", "Slovenia": "SI", "Solomon Islands": "SB",
+	"Somalia": "SO", "South Africa": "ZA", "South Korea": "KR", "South Sudan": "SS", "Spain": "ES",
+	"Sri Lanka": "LK", "St. Kitts & Nevis": "KN", "St. Lucia": "LC", "St. Vincent & Grenadines": "VC", "Sudan": "SD",
+	"Suriname": "SR", "Sweden": "SE", "Switzerland": "CH", "Syria": "SY", "Taiwan": "TW",
+	"Tajikistan": "TJ", "Tanzania": "TZ", "Thailand": "TH", "Timor-Leste": "TL", "Togo": "TG",
+	"Tonga": "TO", "Trinidad & Tobago": "TT", "Tunisia": "TN", "Türkiye": "TR", "Turkey": "TR",
+	"Turkmenistan": "TM", "Tuvalu": "TV", "Uganda": "UG", "Ukraine": "UA", "United Arab Emirates": "AE",
+	"United Kingdom": "GB", "United States": "US", "Uruguay": "UY", "Uzbekistan": "UZ", "Vanuatu": "VU",
+	"Vatican City": "VA", "Venezuela": "VE", "Vietnam": "VN", "Yemen": "YE", "Zambia": "ZM",
+	"Zimbabwe": "ZW", "Réunion": "RE", "Guadeloupe": "GP", "Martinique": "MQ", "French Guiana": "GF",
+	"New Caledonia": "NC", "French Polynesia": "PF", "Greenland": "GL", "Faroe Islands": "FO", "Gibraltar": "GI",
+	"Jersey": "JE", "Guernsey": "GG", "Isle of Man": "IM", "Bermuda": "BM", "Cayman Islands": "KY",
+	"Guam": "GU", "Curaçao": "CW", "Aruba": "AW",
+}
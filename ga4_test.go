@@ -0,0 +1,46 @@
+package main
+
+import (
+	"database/sql/driver"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestImportGA4IntoRolledUpMonth(t *testing.T) {
+	db, rec := newRecordingDB(t, "pages 2024-01-01", "countries 2024-01-01")
+
+	path := filepath.Join(t.TempDir(), "events_202401.json")
+	export := `{"event_date":"20240115","event_name":"page_view","user_pseudo_id":"1","event_params":[{"key":"page_location","value":{"string_value":"https://example.com/pricing"}}],"geo":{"country":"France"}}
+{"event_date":"20240115","event_name":"page_view","user_pseudo_id":"1","event_params":[{"key":"page_location","value":{"string_value":"https://example.com/pricing"}}],"geo":{"country":"France"}}
+{"event_date":"20240116","event_name":"page_view","user_pseudo_id":"2","event_params":[{"key":"page_location","value":{"string_value":"https://example.com/pricing"}}],"geo":{"country":"France"}}
+{"event_date":"20240210","event_name":"page_view","user_pseudo_id":"1","event_params":[{"key":"page_location","value":{"string_value":"https://example.com/pricing"}}],"geo":{"country":"France"}}
+`
+	if err := os.WriteFile(path, []byte(export), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err := importGA4(db, logger, sketchFormat{}, "example.com", false, []string{path}); err != nil {
+		t.Fatalf("importGA4: %v", err)
+	}
+
+	statements := rec.recorded()
+	for _, table := range []string{"pages_monthly", "countries_monthly"} {
+		monthly := transactionUpserts(t, statements, table)
+		// Once for each day of the month with pageviews
+		upserts := monthly["2024-01-01"]
+		if len(upserts) != 2 || len(monthly) != 1 {
+			t.Errorf("the import upserted the %s rows of %v, want the one of the rolled up 2024-01 twice", table, monthly)
+			continue
+		}
+		if !slices.ContainsFunc(upserts, func(args []driver.Value) bool { return slices.Contains(args, driver.Value(int64(2))) }) {
+			t.Errorf("the %s row of 2024-01 was upserted with %v, want the 2 pageviews of 2024-01-15", table, upserts)
+		}
+	}
+	if monthly := transactionUpserts(t, statements, "sources_monthly"); len(monthly) != 0 {
+		t.Errorf("the import upserted the sources_monthly rows of %v, whose months aren't rolled up", monthly)
+	}
+}
@@ -2,14 +2,17 @@ module github.com/antoinefink/potato-analytics
 
 go 1.23.2
 
+require (
+	github.com/lib/pq v1.10.9
+	github.com/tdewolff/minify/v2 v2.21.1
+	github.com/ua-parser/uap-go v0.0.0-20241012191800-bbb40edc15aa
+	gopkg.in/yaml.v2 v2.2.1
+)
+
 require (
 	github.com/PuerkitoBio/purell v1.2.1 // indirect
 	github.com/hashicorp/golang-lru v0.5.4 // indirect
-	github.com/lib/pq v1.10.9 // indirect
-	github.com/tdewolff/minify/v2 v2.21.1 // indirect
 	github.com/tdewolff/parse/v2 v2.7.18 // indirect
-	github.com/ua-parser/uap-go v0.0.0-20241012191800-bbb40edc15aa // indirect
 	golang.org/x/net v0.17.0 // indirect
 	golang.org/x/text v0.13.0 // indirect
-	gopkg.in/yaml.v2 v2.2.1 // indirect
 )
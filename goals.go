@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// goal is completed when a visitor views its page, fires its event, or both
+// within the same session when it has both.
+type goal struct {
+	Name  string `json:"name"`
+	Path  string `json:"path,omitempty"`
+	Event string `json:"event,omitempty"`
+}
+
+// A visitor's session lasts until they're inactive for this long
+const goalSessionTimeout = 30 * time.Minute
+
+// parseGoal parses a goal defined as name:conditions, or just /path in which
+// case the goal is named after its path. Its conditions are a page, an event,
+// or both joined by &, like /pricing&signup.
+func parseGoal(value string) (goal, error) {
+	value = strings.TrimSpace(value)
+	name, conditions := value, value
+	if !strings.HasPrefix(value, "/") {
+		var ok bool
+		if name, conditions, ok = strings.Cut(value, ":"); !ok {
+			return goal{}, fmt.Errorf("expected name:/path, name:event, name:/path&event or /path, got %q", value)
+		}
+		name = strings.TrimSpace(name)
+	}
+
+	g := goal{Name: name}
+	for _, condition := range strings.Split(conditions, "&") {
+		condition = strings.TrimSpace(condition)
+		switch {
+		case strings.HasPrefix(condition, "/") && g.Path == "":
+			g.Path = condition
+		case !strings.HasPrefix(condition, "/") && g.Event == "" && validEventName(condition):
+			g.Event = condition
+		default:
+			return goal{}, fmt.Errorf("expected a page, an event or both, got %q", value)
+		}
+	}
+	return g, nil
+}
+
+// goalStats are a goal's results over a range.
+type goalStats struct {
+	Name        string `json:"name"`
+	Path        string `json:"path,omitempty"`
+	Event       string `json:"event,omitempty"`
+	Completions int    `json:"completions"`
+	Converters  int    `json:"converters"`
+
+	// The share of the range's unique visitors who completed the goal, in percent
+	ConversionRate float64 `json:"conversion_rate"`
+}
+
+func (s *server) handleGoalsStats(w http.ResponseWriter, r *http.Request) {
+	params, ok := s.parseStatsParams(w, r)
+	if !ok {
+		return
+	}
+
+	visitors, results, err := s.queryGoals(params.domain, params.startTime, params.endTime)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to query goals", slog.String("error", err.Error()))
+		writeError(w, http.StatusInternalServerError, errInternal, "Failed to fetch stats")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		Domain   string      `json:"domain"`
+		Start    time.Time   `json:"start"`
+		End      time.Time   `json:"end"`
+		Visitors int         `json:"visitors"`
+		Goals    []goalStats `json:"goals"`
+	}{
+		Domain:   params.domain,
+		Start:    params.startTime,
+		End:      params.endTime,
+		Visitors: visitors,
+		Goals:    results,
+	})
+}
+
+// queryGoals returns the domain's unique visitors over the range, and the
+// results of each of its goals.
+func (s *server) queryGoals(domain string, start, end time.Time) (int, []goalStats, error) {
+	q := statsQuery{table: "pages", domain: domain, start: start, end: end}
+	totals, err := s.queryTotals(q)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	results := []goalStats{}
+	for _, g := range s.goals(domain) {
+		stats := goalStats{Name: g.Name, Path: g.Path, Event: g.Event}
+		if g.Event == "" {
+			q.filters = []queryFilter{{column: "path", value: g.Path}}
+			completed, err := s.queryTotals(q)
+			if err != nil {
+				return 0, nil, err
+			}
+			stats.Completions, stats.Converters = completed.Pageviews, completed.Visitors
+		} else {
+			stats.Completions, stats.Converters, err = s.querySessionGoal(domain, g, start, end)
+			if err != nil {
+				return 0, nil, err
+			}
+		}
+
+		if totals.Visitors != 0 {
+			stats.ConversionRate = float64(stats.Converters) / float64(totals.Visitors) * 100
+		}
+		results = append(results, stats)
+	}
+
+	return totals.Visitors, results, nil
+}
+
+// goalSessions returns the WITH clause of the sessions of the raw events
+// matching where, numbered for each visitor: their events are in the same
+// session until they're inactive for goalSessionTimeout.
+func goalSessions(args *queryArgs, where string) string {
+	return `
+	WITH hits AS (
+		SELECT visitor, path, event, recorded_at,
+			CASE WHEN recorded_at - LAG(recorded_at) OVER (PARTITION BY visitor ORDER BY recorded_at) <= make_interval(secs => ` + args.add(goalSessionTimeout.Seconds()) + `)
+			THEN 0 ELSE 1 END AS starts_session
+		FROM events_raw
+		WHERE ` + where + ` AND environment <> 'preview'
+	), sessions AS (
+		SELECT visitor, path, event, SUM(starts_session) OVER (PARTITION BY visitor ORDER BY recorded_at) AS session
+		FROM hits
+	)`
+}
+
+// querySessionGoal returns the completions of a goal with an event over a
+// range, the sessions meeting its conditions in the raw event log, and its
+// unique converters.
+func (s *server) querySessionGoal(domain string, g goal, start, end time.Time) (int, int, error) {
+	args := queryArgs{}
+	sessions := goalSessions(&args, "domain = "+args.add(domain)+" AND day >= "+args.add(start)+" AND day <= "+args.add(end))
+	conditions := []string{"bool_or(event = " + args.add(g.Event) + ")"}
+	if g.Path != "" {
+		conditions = append(conditions, "bool_or(event = '"+pageviewEventName+"' AND path = "+args.add(g.Path)+")")
+	}
+
+	var completions, converters int
+	err := s.db.QueryRow(sessions+`
+	SELECT COUNT(*), COUNT(DISTINCT visitor) FROM (
+		SELECT visitor FROM sessions
+		GROUP BY visitor, session
+		HAVING `+strings.Join(conditions, " AND ")+`
+	) AS completed
+	`, args...).Scan(&completions, &converters)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to query the sessions completing goal %s: %w", g.Name, err)
+	}
+	return completions, converters, nil
+}
+
+// completesGoal reports whether a visitor's pageview or event, just recorded,
+// completes a goal: when it has one condition, by meeting it, and when it
+// has both, by meeting one of them for the first time in a session that
+// already met the other.
+func (s *server) completesGoal(g goal, pv pageview, event string) (bool, error) {
+	viewed := event == pageviewEventName && g.Path == pv.path
+	if !viewed && (event == pageviewEventName || g.Event != event) {
+		return false, nil
+	}
+	if g.Path == "" || g.Event == "" {
+		return true, nil
+	}
+
+	args := queryArgs{}
+	sessions := goalSessions(&args, "domain = "+args.add(pv.domain)+" AND visitor = "+args.add(pv.visitor)+" AND day = "+args.add(pv.day))
+	var views, events int
+	err := s.db.QueryRow(sessions+`
+	SELECT
+		COUNT(*) FILTER (WHERE event = '`+pageviewEventName+`' AND path = `+args.add(g.Path)+`),
+		COUNT(*) FILTER (WHERE event = `+args.add(g.Event)+`)
+	FROM sessions
+	WHERE session = (SELECT MAX(session) FROM sessions)
+	`, args...).Scan(&views, &events)
+	if err != nil {
+		return false, fmt.Errorf("failed to query the session of goal %s: %w", g.Name, err)
+	}
+	if viewed {
+		return views == 1 && events > 0, nil
+	}
+	return events == 1 && views > 0, nil
+}
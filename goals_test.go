@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql/driver"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseGoal(t *testing.T) {
+	tests := []struct {
+		value string
+		want  goal
+		err   bool
+	}{
+		{value: "/thanks", want: goal{Name: "/thanks", Path: "/thanks"}},
+		{value: "Signup:/welcome", want: goal{Name: "Signup", Path: "/welcome"}},
+		{value: "Signup:signup", want: goal{Name: "Signup", Event: "signup"}},
+		{value: " Pricing signup : /pricing & signup ", want: goal{Name: "Pricing signup", Path: "/pricing", Event: "signup"}},
+		{value: "Pricing signup:signup&/pricing", want: goal{Name: "Pricing signup", Path: "/pricing", Event: "signup"}},
+		{value: "/pricing&signup", want: goal{Name: "/pricing&signup", Path: "/pricing", Event: "signup"}},
+		{value: "signup", err: true},
+		{value: "Two pages:/pricing&/checkout", err: true},
+		{value: "Two events:signup&purchase", err: true},
+		{value: "Pageviews:pageview", err: true},
+		{value: "Spaces:sign up", err: true},
+		{value: "Empty:/pricing&", err: true},
+	}
+	for _, tt := range tests {
+		g, err := parseGoal(tt.value)
+		if (err != nil) != tt.err {
+			t.Errorf("parseGoal(%q) error = %v, want an error: %v", tt.value, err, tt.err)
+			continue
+		}
+		if g != tt.want {
+			t.Errorf("parseGoal(%q) = %+v, want %+v", tt.value, g, tt.want)
+		}
+	}
+}
+
+func TestGoalsWithEventsNeedRawEvents(t *testing.T) {
+	if _, _, err := loadConfig([]string{"-goals=example.com=Pricing signup:/pricing&signup"}); err == nil {
+		t.Errorf("loadConfig() accepted a goal with an event without RAW_EVENTS_DAYS")
+	}
+	cfg, _, err := loadConfig([]string{"-raw-events-days=7", "-goals=example.com=Pricing signup:/pricing&signup,example.com=/thanks"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []goal{{Name: "Pricing signup", Path: "/pricing", Event: "signup"}, {Name: "/thanks", Path: "/thanks"}}; len(cfg.Goals["example.com"]) != 2 || cfg.Goals["example.com"][0] != want[0] || cfg.Goals["example.com"][1] != want[1] {
+		t.Errorf("the goals are %+v, want %+v", cfg.Goals["example.com"], want)
+	}
+}
+
+func TestQuerySessionGoal(t *testing.T) {
+	db, rec := newRecordingDB(t)
+	s := newTestServer(t, "-raw-events-days=7")
+	s.db = db
+	rec.answer("FROM sessions", []string{"completions", "converters"}, []driver.Value{int64(12), int64(11)})
+
+	start, end := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)
+	completions, converters, err := s.querySessionGoal("example.com", goal{Name: "Pricing signup", Path: "/pricing", Event: "signup"}, start, end)
+	if err != nil || completions != 12 || converters != 11 {
+		t.Fatalf("querySessionGoal() = %d, %d, %v, want 12, 11", completions, converters, err)
+	}
+
+	recorded := rec.recorded()
+	query := recorded[len(recorded)-1]
+	for _, want := range []string{
+		"WHERE domain = $1 AND day >= $2 AND day <= $3 AND environment <> 'preview'",
+		"PARTITION BY visitor ORDER BY recorded_at) <= make_interval(secs => $4)",
+		"GROUP BY visitor, session",
+		"HAVING bool_or(event = $5) AND bool_or(event = 'pageview' AND path = $6)",
+	} {
+		if !strings.Contains(query.query, want) {
+			t.Errorf("querySessionGoal() sent a query without %q:\n%s", want, query.query)
+		}
+	}
+	if want := []driver.Value{"example.com", start, end, goalSessionTimeout.Seconds(), "signup", "/pricing"}; !reflect.DeepEqual(query.args, want) {
+		t.Errorf("querySessionGoal() sent the arguments %v, want %v", query.args, want)
+	}
+
+	// Goals of an event alone only need it to be fired
+	if _, _, err := s.querySessionGoal("example.com", goal{Name: "Signup", Event: "signup"}, start, end); err != nil {
+		t.Fatal(err)
+	}
+	recorded = rec.recorded()
+	if query := recorded[len(recorded)-1].query; strings.Contains(query, "path = ") {
+		t.Errorf("the sessions of a goal without a page are filtered by path:\n%s", query)
+	}
+}
+
+func TestCompletesGoal(t *testing.T) {
+	combined := goal{Name: "Pricing signup", Path: "/pricing", Event: "signup"}
+	pv := pageview{domain: "example.com", path: "/pricing", day: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), visitor: "visitor"}
+
+	tests := []struct {
+		name    string
+		goal    goal
+		path    string
+		event   string
+		session []driver.Value
+		want    bool
+	}{
+		{name: "page viewed", goal: goal{Name: "Pricing", Path: "/pricing"}, path: "/pricing", event: pageviewEventName, want: true},
+		{name: "other page viewed", goal: goal{Name: "Pricing", Path: "/pricing"}, path: "/", event: pageviewEventName},
+		{name: "event of a page goal", goal: goal{Name: "Pricing", Path: "/pricing"}, path: "/pricing", event: "signup"},
+		{name: "event fired", goal: goal{Name: "Signup", Event: "signup"}, path: "/", event: "signup", want: true},
+		{name: "other event fired", goal: goal{Name: "Signup", Event: "signup"}, path: "/", event: "purchase"},
+		{name: "page viewed before the event", goal: combined, path: "/signup", event: "signup", session: []driver.Value{int64(2), int64(1)}, want: true},
+		{name: "event fired before the page", goal: combined, path: "/pricing", event: pageviewEventName, session: []driver.Value{int64(1), int64(1)}, want: true},
+		{name: "event without the page", goal: combined, path: "/", event: "signup", session: []driver.Value{int64(0), int64(1)}},
+		{name: "event fired again", goal: combined, path: "/", event: "signup", session: []driver.Value{int64(1), int64(2)}},
+		{name: "page viewed again", goal: combined, path: "/pricing", event: pageviewEventName, session: []driver.Value{int64(2), int64(1)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, rec := newRecordingDB(t)
+			s := newTestServer(t, "-raw-events-days=7")
+			s.db = db
+			if tt.session != nil {
+				rec.answer("FROM sessions", []string{"views", "events"}, tt.session)
+			}
+
+			hit := pv
+			hit.path = tt.path
+			completed, err := s.completesGoal(tt.goal, hit, tt.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if completed != tt.want {
+				t.Errorf("completesGoal() = %v, want %v", completed, tt.want)
+			}
+
+			recorded := rec.recorded()
+			if (len(recorded) > 0) != (tt.session != nil) {
+				t.Errorf("completesGoal() ran %d queries", len(recorded))
+			}
+			if len(recorded) > 0 && !strings.Contains(recorded[0].query, "WHERE domain = $1 AND visitor = $2 AND day = $3 AND environment <> 'preview'") {
+				t.Errorf("completesGoal() didn't query the visitor's session:\n%s", recorded[0].query)
+			}
+		})
+	}
+}
@@ -0,0 +1,638 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// This file implements the subset of GraphQL the stats API needs: queries
+// made of fields, aliases and arguments, with variables. Fragments,
+// directives, mutations and introspection aren't supported.
+
+// gqlField is a field selected in a query, with its arguments resolved.
+type gqlField struct {
+	alias      string
+	name       string
+	args       map[string]any
+	selections []gqlField
+}
+
+// gqlResolver resolves the fields of an object. It returns a scalar, a
+// gqlResolver for an object, or a []gqlResolver for a list of objects.
+type gqlResolver func(field gqlField) (any, error)
+
+// gqlResult is an object in a response, with its fields in the order they
+// were selected as GraphQL requires.
+type gqlResult []gqlEntry
+
+type gqlEntry struct {
+	key   string
+	value any
+}
+
+func (r gqlResult) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, entry := range r {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(entry.key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(entry.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// executeGraphQL resolves the selections against the root resolver.
+func executeGraphQL(selections []gqlField, resolve gqlResolver) (gqlResult, error) {
+	result := gqlResult{}
+	for _, field := range selections {
+		value, err := resolve(field)
+		if err != nil {
+			return nil, err
+		}
+
+		switch v := value.(type) {
+		case gqlResolver:
+			if len(field.selections) == 0 {
+				return nil, fmt.Errorf("field %q must have a selection of subfields", field.name)
+			}
+			value, err = executeGraphQL(field.selections, v)
+			if err != nil {
+				return nil, err
+			}
+		case []gqlResolver:
+			if len(field.selections) == 0 {
+				return nil, fmt.Errorf("field %q must have a selection of subfields", field.name)
+			}
+			list := make([]gqlResult, 0, len(v))
+			for _, item := range v {
+				object, err := executeGraphQL(field.selections, item)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, object)
+			}
+			value = list
+		default:
+			if len(field.selections) != 0 {
+				return nil, fmt.Errorf("field %q can't have a selection of subfields", field.name)
+			}
+		}
+
+		result = append(result, gqlEntry{key: field.alias, value: value})
+	}
+	return result, nil
+}
+
+// argString returns a string argument, or def if it isn't set.
+func (f gqlField) argString(name string, def string) (string, error) {
+	value, ok := f.args[name]
+	if !ok || value == nil {
+		return def, nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("argument %q of field %q must be a string", name, f.name)
+	}
+	return s, nil
+}
+
+// argInt returns an integer argument, or def if it isn't set.
+func (f gqlField) argInt(name string, def int) (int, error) {
+	value, ok := f.args[name]
+	if !ok || value == nil {
+		return def, nil
+	}
+	n, ok := value.(int)
+	if !ok {
+		return 0, fmt.Errorf("argument %q of field %q must be an integer", name, f.name)
+	}
+	return n, nil
+}
+
+type gqlTokenKind int
+
+const (
+	gqlEOF gqlTokenKind = iota
+	gqlPunct
+	gqlName
+	gqlString
+	gqlInt
+	gqlFloat
+)
+
+type gqlToken struct {
+	kind  gqlTokenKind
+	value string
+}
+
+// gqlLexer splits a query into tokens, skipping whitespace, commas and
+// comments which are insignificant in GraphQL.
+type gqlLexer struct {
+	src string
+	pos int
+}
+
+func (l *gqlLexer) next() (gqlToken, error) {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			l.pos++
+		} else if c == '#' {
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		} else if strings.HasPrefix(l.src[l.pos:], "\ufeff") {
+			l.pos += len("\ufeff")
+		} else {
+			break
+		}
+	}
+	if l.pos >= len(l.src) {
+		return gqlToken{kind: gqlEOF}, nil
+	}
+
+	start := l.pos
+	c := l.src[l.pos]
+	switch {
+	case strings.HasPrefix(l.src[l.pos:], "..."):
+		l.pos += 3
+		return gqlToken{kind: gqlPunct, value: "..."}, nil
+	case strings.ContainsRune("!$()&:=@[]{}|", rune(c)):
+		l.pos++
+		return gqlToken{kind: gqlPunct, value: string(c)}, nil
+	case c == '_' || isLetter(c):
+		for l.pos < len(l.src) && (l.src[l.pos] == '_' || isLetter(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		return gqlToken{kind: gqlName, value: l.src[start:l.pos]}, nil
+	case c == '-' || isDigit(c):
+		return l.number()
+	case c == '"':
+		return l.string()
+	}
+	return gqlToken{}, fmt.Errorf("unexpected character %q at position %d", c, start)
+}
+
+func (l *gqlLexer) number() (gqlToken, error) {
+	start := l.pos
+	kind := gqlInt
+	if l.src[l.pos] == '-' {
+		l.pos++
+	}
+	digits := func() int {
+		from := l.pos
+		for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+			l.pos++
+		}
+		return l.pos - from
+	}
+	if digits() == 0 {
+		return gqlToken{}, fmt.Errorf("invalid number at position %d", start)
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '.' {
+		kind = gqlFloat
+		l.pos++
+		if digits() == 0 {
+			return gqlToken{}, fmt.Errorf("invalid number at position %d", start)
+		}
+	}
+	if l.pos < len(l.src) && (l.src[l.pos] == 'e' || l.src[l.pos] == 'E') {
+		kind = gqlFloat
+		l.pos++
+		if l.pos < len(l.src) && (l.src[l.pos] == '+' || l.src[l.pos] == '-') {
+			l.pos++
+		}
+		if digits() == 0 {
+			return gqlToken{}, fmt.Errorf("invalid number at position %d", start)
+		}
+	}
+	return gqlToken{kind: kind, value: l.src[start:l.pos]}, nil
+}
+
+func (l *gqlLexer) string() (gqlToken, error) {
+	start := l.pos
+	if strings.HasPrefix(l.src[l.pos:], `"""`) {
+		return gqlToken{}, fmt.Errorf("block strings aren't supported, at position %d", start)
+	}
+	l.pos++
+
+	var sb strings.Builder
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '"':
+			l.pos++
+			return gqlToken{kind: gqlString, value: sb.String()}, nil
+		case c == '\n' || c == '\r':
+			return gqlToken{}, fmt.Errorf("unterminated string at position %d", start)
+		case c == '\\':
+			if l.pos+1 >= len(l.src) {
+				return gqlToken{}, fmt.Errorf("unterminated string at position %d", start)
+			}
+			escape := l.src[l.pos+1]
+			l.pos += 2
+			switch escape {
+			case '"', '\\', '/':
+				sb.WriteByte(escape)
+			case 'b':
+				sb.WriteByte('\b')
+			case 'f':
+				sb.WriteByte('\f')
+			case 'n':
+				sb.WriteByte('\n')
+			case 'r':
+				sb.WriteByte('\r')
+			case 't':
+				sb.WriteByte('\t')
+			case 'u':
+				if l.pos+4 > len(l.src) {
+					return gqlToken{}, fmt.Errorf("invalid escape in string at position %d", start)
+				}
+				code, err := strconv.ParseUint(l.src[l.pos:l.pos+4], 16, 32)
+				if err != nil {
+					return gqlToken{}, fmt.Errorf("invalid escape in string at position %d", start)
+				}
+				sb.WriteRune(rune(code))
+				l.pos += 4
+			default:
+				return gqlToken{}, fmt.Errorf("invalid escape in string at position %d", start)
+			}
+		default:
+			r, size := utf8.DecodeRuneInString(l.src[l.pos:])
+			sb.WriteRune(r)
+			l.pos += size
+		}
+	}
+	return gqlToken{}, fmt.Errorf("unterminated string at position %d", start)
+}
+
+func isLetter(c byte) bool { return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') }
+func isDigit(c byte) bool  { return c >= '0' && c <= '9' }
+
+// gqlParser parses a query document into the selections of the operation to
+// run, substituting variables along the way.
+type gqlParser struct {
+	lexer     gqlLexer
+	token     gqlToken
+	variables map[string]any
+}
+
+// parseGraphQL returns the selections of the requested operation, or of the
+// only one if the name is empty.
+func parseGraphQL(query string, operationName string, variables map[string]any) ([]gqlField, error) {
+	p := &gqlParser{lexer: gqlLexer{src: query}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	// Operations are kept unparsed until the one to run is known, as
+	// variables are resolved while parsing
+	type operation struct {
+		name string
+		pos  int
+	}
+	var operations []operation
+	for p.token.kind != gqlEOF {
+		pos := p.lexer.pos - len(p.token.value)
+		name := ""
+		if p.token.kind == gqlName {
+			switch p.token.value {
+			case "query":
+			case "mutation", "subscription":
+				return nil, fmt.Errorf("%s operations aren't supported", p.token.value)
+			case "fragment":
+				return nil, errors.New("fragments aren't supported")
+			default:
+				return nil, fmt.Errorf("unexpected %q", p.token.value)
+			}
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			if p.token.kind == gqlName {
+				name = p.token.value
+			}
+		} else if !p.is("{") {
+			return nil, fmt.Errorf("unexpected %q", p.token.value)
+		}
+		operations = append(operations, operation{name: name, pos: pos})
+		if err := p.skipOperation(); err != nil {
+			return nil, err
+		}
+	}
+
+	var selected *operation
+	for i, op := range operations {
+		if operationName == "" || op.name == operationName {
+			if selected != nil {
+				return nil, errors.New("operationName is required when the document has several operations")
+			}
+			selected = &operations[i]
+		}
+	}
+	if selected == nil {
+		if operationName != "" {
+			return nil, fmt.Errorf("unknown operation %q", operationName)
+		}
+		return nil, errors.New("the document has no operation")
+	}
+
+	p = &gqlParser{lexer: gqlLexer{src: query, pos: selected.pos}, variables: map[string]any{}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	return p.parseOperation(variables)
+}
+
+func (p *gqlParser) advance() error {
+	token, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+	p.token = token
+	return nil
+}
+
+func (p *gqlParser) is(punct string) bool {
+	return p.token.kind == gqlPunct && p.token.value == punct
+}
+
+func (p *gqlParser) expect(punct string) error {
+	if !p.is(punct) {
+		if p.token.kind == gqlEOF {
+			return fmt.Errorf("expected %q, got the end of the query", punct)
+		}
+		return fmt.Errorf("expected %q, got %q", punct, p.token.value)
+	}
+	return p.advance()
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.token.kind != gqlName {
+		return "", fmt.Errorf("expected a name, got %q", p.token.value)
+	}
+	name := p.token.value
+	return name, p.advance()
+}
+
+// skipOperation moves past the current operation's selection set.
+func (p *gqlParser) skipOperation() error {
+	for !p.is("{") {
+		if p.token.kind == gqlEOF {
+			return errors.New("expected a selection set, got the end of the query")
+		}
+		if err := p.advance(); err != nil {
+			return err
+		}
+	}
+
+	depth := 0
+	for {
+		switch {
+		case p.token.kind == gqlEOF:
+			return errors.New("unterminated selection set")
+		case p.is("{"):
+			depth++
+		case p.is("}"):
+			depth--
+		}
+		if err := p.advance(); err != nil {
+			return err
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+func (p *gqlParser) parseOperation(variables map[string]any) ([]gqlField, error) {
+	if p.token.kind == gqlName && p.token.value == "query" {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.token.kind == gqlName {
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+		}
+		if p.is("(") {
+			if err := p.parseVariableDefinitions(variables); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if p.is("@") {
+		return nil, errors.New("directives aren't supported")
+	}
+	return p.parseSelectionSet()
+}
+
+// parseVariableDefinitions resolves the operation's variables from the
+// values sent with the query and their defaults.
+func (p *gqlParser) parseVariableDefinitions(variables map[string]any) error {
+	if err := p.expect("("); err != nil {
+		return err
+	}
+	for !p.is(")") {
+		if err := p.expect("$"); err != nil {
+			return err
+		}
+		name, err := p.name()
+		if err != nil {
+			return err
+		}
+		if err := p.expect(":"); err != nil {
+			return err
+		}
+		required, err := p.parseType()
+		if err != nil {
+			return err
+		}
+
+		var value any
+		if p.is("=") {
+			if err := p.advance(); err != nil {
+				return err
+			}
+			if value, err = p.parseValue(true); err != nil {
+				return err
+			}
+		}
+		if sent, ok := variables[name]; ok {
+			if value, err = jsonVariable(sent); err != nil {
+				return fmt.Errorf("invalid value for variable $%s: %w", name, err)
+			}
+		}
+		if required && value == nil {
+			return fmt.Errorf("variable $%s is required", name)
+		}
+		p.variables[name] = value
+	}
+	return p.advance()
+}
+
+// parseType skips a variable's type, reporting whether it's non-null.
+func (p *gqlParser) parseType() (bool, error) {
+	if p.is("[") {
+		if err := p.advance(); err != nil {
+			return false, err
+		}
+		if _, err := p.parseType(); err != nil {
+			return false, err
+		}
+		if err := p.expect("]"); err != nil {
+			return false, err
+		}
+	} else if _, err := p.name(); err != nil {
+		return false, err
+	}
+
+	if p.is("!") {
+		return true, p.advance()
+	}
+	return false, nil
+}
+
+func (p *gqlParser) parseSelectionSet() ([]gqlField, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+
+	var fields []gqlField
+	for !p.is("}") {
+		if p.is("...") {
+			return nil, errors.New("fragments aren't supported")
+		}
+
+		field := gqlField{args: map[string]any{}}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		field.alias, field.name = name, name
+		if p.is(":") {
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			if field.name, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+
+		if p.is("(") {
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			for !p.is(")") {
+				arg, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect(":"); err != nil {
+					return nil, err
+				}
+				if field.args[arg], err = p.parseValue(false); err != nil {
+					return nil, err
+				}
+			}
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+		}
+
+		if p.is("@") {
+			return nil, errors.New("directives aren't supported")
+		}
+
+		if p.is("{") {
+			if field.selections, err = p.parseSelectionSet(); err != nil {
+				return nil, err
+			}
+		}
+		fields = append(fields, field)
+	}
+
+	if len(fields) == 0 {
+		return nil, errors.New("selection sets can't be empty")
+	}
+	return fields, p.advance()
+}
+
+// parseValue parses an argument's value. Constant values, such as variable
+// defaults, can't reference variables.
+func (p *gqlParser) parseValue(constant bool) (any, error) {
+	token := p.token
+	switch {
+	case p.is("$") && !constant:
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		value, ok := p.variables[name]
+		if !ok {
+			return nil, fmt.Errorf("variable $%s isn't defined", name)
+		}
+		return value, nil
+	case token.kind == gqlInt:
+		n, err := strconv.Atoi(token.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer %s", token.value)
+		}
+		return n, p.advance()
+	case token.kind == gqlFloat:
+		f, err := strconv.ParseFloat(token.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", token.value)
+		}
+		return f, p.advance()
+	case token.kind == gqlString:
+		return token.value, p.advance()
+	case token.kind == gqlName:
+		switch token.value {
+		case "true":
+			return true, p.advance()
+		case "false":
+			return false, p.advance()
+		case "null":
+			return nil, p.advance()
+		}
+		// Enum values are handled as their name
+		return token.value, p.advance()
+	}
+	return nil, fmt.Errorf("unsupported value %q", token.value)
+}
+
+// jsonVariable converts a variable decoded from JSON to the types arguments
+// are parsed to.
+func jsonVariable(value any) (any, error) {
+	switch v := value.(type) {
+	case nil, string, bool:
+		return v, nil
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) <= math.MaxInt32 {
+			return int(v), nil
+		}
+		return v, nil
+	}
+	return nil, errors.New("only strings, numbers and booleans are supported")
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// The schema served at /graphql:
+//
+//	type Query {
+//	  site(domain: String!, period: String, start: String, end: String, tz: String): Site
+//	}
+//
+//	type Site {
+//	  domain: String!
+//	  start: String!
+//	  end: String!
+//	  visitors: Int!
+//	  pageviews: Int!
+//	  series(interval: String): [Point!]!
+//	  pages(limit: Int, offset: Int, country: String, source: String): [Page!]!
+//	  sources(limit: Int, offset: Int, page: String): [Source!]!
+//	  countries(limit: Int, offset: Int, page: String): [Country!]!
+//	  goals: [Goal!]!
+//	}
+//
+//	type Page { path: String!, visitors: Int!, pageviews: Int!, series(interval: String): [Point!]! }
+//	type Source { referrer: String!, visitors: Int!, pageviews: Int!, series(interval: String): [Point!]! }
+//	type Country { country: String!, visitors: Int!, pageviews: Int!, series(interval: String): [Point!]! }
+//	type Point { day: String!, visitors: Int!, pageviews: Int! }
+//	type Goal { name: String!, path: String, event: String, completions: Int!, converters: Int!, conversionRate: Float! }
+
+// Largest accepted /graphql request body
+const maxGraphQLBody = 1 << 20
+
+func (s *server) handleGraphQL(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Query         string         `json:"query"`
+		OperationName string         `json:"operationName"`
+		Variables     map[string]any `json:"variables"`
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		request.Query = r.URL.Query().Get("query")
+		request.OperationName = r.URL.Query().Get("operationName")
+		if value := r.URL.Query().Get("variables"); value != "" {
+			if err := json.Unmarshal([]byte(value), &request.Variables); err != nil {
+				writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid variables parameter")
+				return
+			}
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxGraphQLBody)).Decode(&request); err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidBody, "Invalid request body")
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if request.Query == "" {
+		writeError(w, http.StatusBadRequest, errMissingParameter, "Missing query")
+		return
+	}
+
+	type gqlError struct {
+		Message string `json:"message"`
+	}
+	var response struct {
+		Data   any        `json:"data,omitempty"`
+		Errors []gqlError `json:"errors,omitempty"`
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	selections, err := parseGraphQL(request.Query, request.OperationName, request.Variables)
+	if err != nil {
+		response.Errors = []gqlError{{Message: err.Error()}}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	data, err := executeGraphQL(selections, s.resolveQuery)
+	if err != nil {
+		s.logger.Debug("Failed to execute GraphQL query", slog.String("error", err.Error()))
+		response.Data = json.RawMessage("null")
+		response.Errors = []gqlError{{Message: err.Error()}}
+	} else {
+		response.Data = data
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *server) resolveQuery(f gqlField) (any, error) {
+	switch f.name {
+	case "__typename":
+		return "Query", nil
+	case "site":
+		domain, err := f.argString("domain", "")
+		if err != nil {
+			return nil, err
+		}
+		if domain == "" {
+			return nil, fmt.Errorf("argument %q of field %q is required", "domain", f.name)
+		}
+
+		// The range is parsed like the parameters of the other endpoints
+		query := url.Values{"domain": {domain}}
+		for _, name := range []string{"period", "start", "end", "tz"} {
+			value, err := f.argString(name, "")
+			if err != nil {
+				return nil, err
+			}
+			if value != "" {
+				query.Set(name, value)
+			}
+		}
+		start, end, err := s.parseDateRange(query)
+		if err != nil {
+			return nil, err
+		}
+
+		return (&siteResolver{s: s, domain: domain, start: start, end: end}).resolve, nil
+	}
+	return nil, fmt.Errorf("cannot query field %q on type Query", f.name)
+}
+
+// siteResolver resolves a domain's stats over a range.
+type siteResolver struct {
+	s      *server
+	domain string
+	start  time.Time
+	end    time.Time
+
+	// Loaded once, whether visitors, pageviews or both are requested
+	totals *periodTotals
+}
+
+func (sr *siteResolver) resolve(f gqlField) (any, error) {
+	switch f.name {
+	case "__typename":
+		return "Site", nil
+	case "domain":
+		return sr.domain, nil
+	case "start":
+		return sr.start.Format(time.DateOnly), nil
+	case "end":
+		return sr.end.Format(time.DateOnly), nil
+	case "visitors", "pageviews":
+		if sr.totals == nil {
+			totals, err := sr.s.queryTotals(sr.query("pages"))
+			if err != nil {
+				return nil, sr.s.internalGraphQLError(err)
+			}
+			sr.totals = &totals
+		}
+		if f.name == "visitors" {
+			return sr.totals.Visitors, nil
+		}
+		return sr.totals.Pageviews, nil
+	case "series":
+		return sr.series(f, sr.query("pages"))
+	case "pages":
+		return sr.dimension(f, "Page", "pages", "path",
+			crossFilter{param: "country", table: "page_countries", column: "country"},
+			crossFilter{param: "source", table: "page_sources", column: "referrer"},
+		)
+	case "sources":
+		return sr.dimension(f, "Source", "sources", "referrer",
+			crossFilter{param: "page", table: "page_sources", column: "path"},
+		)
+	case "countries":
+		return sr.dimension(f, "Country", "countries", "country",
+			crossFilter{param: "page", table: "page_countries", column: "path"},
+		)
+	case "goals":
+		_, goals, err := sr.s.queryGoals(sr.domain, sr.start, sr.end)
+		if err != nil {
+			return nil, sr.s.internalGraphQLError(err)
+		}
+		resolvers := make([]gqlResolver, 0, len(goals))
+		for _, g := range goals {
+			resolvers = append(resolvers, goalResolver(g))
+		}
+		return resolvers, nil
+	}
+	return nil, fmt.Errorf("cannot query field %q on type Site", f.name)
+}
+
+// query returns the query of the stats of table over the site's range.
+func (sr *siteResolver) query(table string, filters ...queryFilter) statsQuery {
+	return statsQuery{table: table, domain: sr.domain, filters: filters, start: sr.start, end: sr.end}
+}
+
+// dimension resolves the top entries of a dimension over the range, which can
+// be filtered by another dimension through the field's arguments.
+func (sr *siteResolver) dimension(f gqlField, typename string, table string, column string, filters ...crossFilter) (any, error) {
+	limit, err := f.argInt("limit", defaultLimit)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := f.argInt("offset", 0)
+	if err != nil {
+		return nil, err
+	}
+	if limit < 1 || limit > maxLimit {
+		return nil, fmt.Errorf("argument %q of field %q must be between 1 and %d", "limit", f.name, maxLimit)
+	}
+	if offset < 0 {
+		return nil, fmt.Errorf("argument %q of field %q can't be negative", "offset", f.name)
+	}
+
+	query := url.Values{}
+	for _, filter := range filters {
+		value, err := f.argString(filter.param, "")
+		if err != nil {
+			return nil, err
+		}
+		if value != "" {
+			query.Set(filter.param, value)
+		}
+	}
+	table, queryFilters, err := parseCrossFilter(query, table, filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	q := sr.query(table, queryFilters...)
+	q.dimensions = []string{column}
+	q.order = []sortKey{{column: "visitors", desc: true}, {column: "pageviews", desc: true}, {column: column}}
+	q.limit, q.offset = limit, offset
+
+	rows, err := sr.s.queryRows(q)
+	if err != nil {
+		return nil, sr.s.internalGraphQLError(err)
+	}
+
+	resolvers := make([]gqlResolver, 0, len(rows))
+	for _, row := range rows {
+		entry := topEntry{Name: row.dimensions[0], Visitors: row.visitors, Pageviews: row.pageviews}
+
+		// An entry's series is filtered like the entry itself
+		entryQuery := sr.query(table, append(slices.Clone(queryFilters), queryFilter{column: column, value: entry.Name})...)
+
+		resolvers = append(resolvers, func(f gqlField) (any, error) {
+			switch f.name {
+			case "__typename":
+				return typename, nil
+			case column:
+				return entry.Name, nil
+			case "visitors":
+				return entry.Visitors, nil
+			case "pageviews":
+				return entry.Pageviews, nil
+			case "series":
+				return sr.series(f, entryQuery)
+			}
+			return nil, fmt.Errorf("cannot query field %q on type %s", f.name, typename)
+		})
+	}
+
+	return resolvers, nil
+}
+
+// series resolves the visitors and pageviews of the rows q matches, per
+// interval.
+func (sr *siteResolver) series(f gqlField, q statsQuery) (any, error) {
+	interval, err := f.argString("interval", "")
+	if err != nil {
+		return nil, err
+	}
+	q.interval, err = parseInterval(url.Values{"interval": {interval}})
+	if err != nil {
+		return nil, err
+	}
+	q.order = []sortKey{{column: "day"}}
+
+	rows, err := sr.s.queryRows(q)
+	if err != nil {
+		return nil, sr.s.internalGraphQLError(err)
+	}
+
+	resolvers := make([]gqlResolver, 0, len(rows))
+	for _, row := range rows {
+		resolvers = append(resolvers, func(f gqlField) (any, error) {
+			switch f.name {
+			case "__typename":
+				return "Point", nil
+			case "day":
+				return row.day.Format(time.DateOnly), nil
+			case "visitors":
+				return row.visitors, nil
+			case "pageviews":
+				return row.pageviews, nil
+			}
+			return nil, fmt.Errorf("cannot query field %q on type Point", f.name)
+		})
+	}
+
+	return resolvers, nil
+}
+
+func goalResolver(g goalStats) gqlResolver {
+	return func(f gqlField) (any, error) {
+		switch f.name {
+		case "__typename":
+			return "Goal", nil
+		case "name":
+			return g.Name, nil
+		case "path":
+			if g.Path == "" {
+				return nil, nil
+			}
+			return g.Path, nil
+		case "event":
+			if g.Event == "" {
+				return nil, nil
+			}
+			return g.Event, nil
+		case "completions":
+			return g.Completions, nil
+		case "converters":
+			return g.Converters, nil
+		case "conversionRate":
+			return g.ConversionRate, nil
+		}
+		return nil, fmt.Errorf("cannot query field %q on type Goal", f.name)
+	}
+}
+
+// internalGraphQLError logs a failure to fetch stats, which is reported to
+// the client without its details.
+func (s *server) internalGraphQLError(err error) error {
+	s.logger.Error("Failed to resolve GraphQL query", slog.String("error", err.Error()))
+	return errors.New("failed to fetch stats")
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// renderFields writes selections compactly, as alias:name(arg=value){...}
+// with the arguments sorted, to compare them.
+func renderFields(fields []gqlField) string {
+	parts := []string{}
+	for _, f := range fields {
+		part := f.name
+		if f.alias != f.name {
+			part = f.alias + ":" + f.name
+		}
+		if len(f.args) > 0 {
+			args := []string{}
+			for name, value := range f.args {
+				args = append(args, fmt.Sprintf("%s=%#v", name, value))
+			}
+			slices.Sort(args)
+			part += "(" + strings.Join(args, ",") + ")"
+		}
+		if len(f.selections) > 0 {
+			part += "{" + renderFields(f.selections) + "}"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestParseGraphQL(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		operation string
+		variables map[string]any
+		want      string
+	}{
+		{"shorthand", `{ site(domain: "example.com") { visitors } }`, "", nil,
+			`site(domain="example.com"){visitors}`},
+		{"aliases", `{ a: site(domain: "a.com") { visitors } b: site(domain: "b.com") { v: pageviews } }`, "", nil,
+			`a:site(domain="a.com"){visitors} b:site(domain="b.com"){v:pageviews}`},
+		{"values", `{ site(domain: "ex\"ampleé.com", limit: 10, rate: 1.5e2, all: true, none: null, period: LAST_7D) { domain } }`, "", nil,
+			`site(all=true,domain="ex\"ampleé.com",limit=10,none=<nil>,period="LAST_7D",rate=150){domain}`},
+		{"commas and comments", "query Stats {\n  # The site\n  site(domain: \"example.com\",,) { visitors, pageviews, }\n}", "", nil,
+			`site(domain="example.com"){visitors pageviews}`},
+		{"nested", `{ site(domain: "example.com") { pages(limit: 5) { path series(interval: "week") { day visitors } } } }`, "", nil,
+			`site(domain="example.com"){pages(limit=5){path series(interval="week"){day visitors}}}`},
+		{"variables", `query Stats($domain: String!, $limit: Int = 5, $period: String = "7d") { site(domain: $domain, period: $period) { pages(limit: $limit) { path } } }`, "", map[string]any{"domain": "example.com", "period": "30d"},
+			`site(domain="example.com",period="30d"){pages(limit=5){path}}`},
+		{"JSON numbers", `query($limit: Int) { site(domain: "example.com") { pages(limit: $limit) { path } } }`, "", map[string]any{"limit": float64(3)},
+			`site(domain="example.com"){pages(limit=3){path}}`},
+		{"list variable type", `query($domains: [String!]) { __typename }`, "", nil,
+			`__typename`},
+		{"operation name", `query A { a: __typename } query B { b: __typename }`, "B", nil,
+			`b:__typename`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields, err := parseGraphQL(tt.query, tt.operation, tt.variables)
+			if err != nil {
+				t.Fatalf("parseGraphQL: %v", err)
+			}
+			if got := renderFields(fields); got != tt.want {
+				t.Errorf("parseGraphQL() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseGraphQLErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		operation string
+		variables map[string]any
+		want      string
+	}{
+		{"mutation", `mutation { deleteSite }`, "", nil, "mutation operations aren't supported"},
+		{"subscription", `subscription { pageviews }`, "", nil, "subscription operations aren't supported"},
+		{"fragment definition", `fragment F on Site { visitors }`, "", nil, "fragments aren't supported"},
+		{"fragment spread", `{ site(domain: "a.com") { ...F } }`, "", nil, "fragments aren't supported"},
+		{"directive", `{ site(domain: "a.com") @include(if: true) { visitors } }`, "", nil, "directives aren't supported"},
+		{"undefined variable", `{ site(domain: $domain) { visitors } }`, "", nil, "variable $domain isn't defined"},
+		{"required variable", `query($domain: String!) { site(domain: $domain) { visitors } }`, "", nil, "variable $domain is required"},
+		{"object variable", `query($domain: String) { site(domain: $domain) { visitors } }`, "", map[string]any{"domain": map[string]any{}}, "invalid value for variable $domain"},
+		{"variable in a default", `query($a: String, $b: String = $a) { __typename }`, "", nil, "unsupported value"},
+		{"several operations", `query A { __typename } query B { __typename }`, "", nil, "operationName is required"},
+		{"unknown operation", `query A { __typename }`, "B", nil, `unknown operation "B"`},
+		{"no operation", `# Nothing`, "", nil, "the document has no operation"},
+		{"empty selection", `{ }`, "", nil, "selection sets can't be empty"},
+		{"unterminated selection", `{ site(domain: "a.com") { visitors }`, "", nil, "unterminated selection set"},
+		{"unterminated string", `{ site(domain: "a.com) { visitors } }`, "", nil, "unterminated string"},
+		{"block string", `{ site(domain: """a.com""") { visitors } }`, "", nil, "block strings aren't supported"},
+		{"invalid escape", `{ site(domain: "\x") { visitors } }`, "", nil, "invalid escape"},
+		{"invalid number", `{ site(limit: 1.) { visitors } }`, "", nil, "invalid number"},
+		{"unexpected character", `{ site(domain: 'a.com') { visitors } }`, "", nil, "unexpected character"},
+		{"list value", `{ site(domain: ["a.com"]) { visitors } }`, "", nil, "unsupported value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields, err := parseGraphQL(tt.query, tt.operation, tt.variables)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("parseGraphQL() = %s, %v, want an error containing %q", renderFields(fields), err, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecuteGraphQL(t *testing.T) {
+	// Sites with pages, resolved from the fields of a map
+	var object func(values map[string]any) gqlResolver
+	object = func(values map[string]any) gqlResolver {
+		return func(f gqlField) (any, error) {
+			value, ok := values[f.name]
+			if !ok {
+				return nil, fmt.Errorf("cannot query field %q", f.name)
+			}
+			switch v := value.(type) {
+			case map[string]any:
+				return object(v), nil
+			case []map[string]any:
+				list := []gqlResolver{}
+				for _, item := range v {
+					list = append(list, object(item))
+				}
+				return list, nil
+			}
+			return value, nil
+		}
+	}
+	root := object(map[string]any{
+		"site": map[string]any{
+			"visitors": 3,
+			"pages":    []map[string]any{{"path": "/", "visitors": 2}, {"path": "/pricing", "visitors": 1}},
+		},
+	})
+
+	tests := []struct {
+		name  string
+		query string
+		want  string
+		err   string
+	}{
+		{"fields in the order selected", `{ site { visitors pages { visitors path } } }`, `{"site":{"visitors":3,"pages":[{"visitors":2,"path":"/"},{"visitors":1,"path":"/pricing"}]}}`, ""},
+		{"aliases", `{ s: site { total: visitors } }`, `{"s":{"total":3}}`, ""},
+		{"object without selection", `{ site }`, "", `field "site" must have a selection of subfields`},
+		{"list without selection", `{ site { pages } }`, "", `field "pages" must have a selection of subfields`},
+		{"scalar with selection", `{ site { visitors { value } } }`, "", `field "visitors" can't have a selection of subfields`},
+		{"unknown field", `{ site { bounces } }`, "", `cannot query field "bounces"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields, err := parseGraphQL(tt.query, "", nil)
+			if err != nil {
+				t.Fatalf("parseGraphQL: %v", err)
+			}
+			result, err := executeGraphQL(fields, root)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("executeGraphQL() = %v, want an error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("executeGraphQL: %v", err)
+			}
+			data, err := json.Marshal(result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("executeGraphQL() = %s, want %s", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleGraphQL(t *testing.T) {
+	s := newTestServer(t)
+
+	tests := []struct {
+		name       string
+		query      url.Values
+		wantStatus int
+		want       string
+	}{
+		{"typename", url.Values{"query": {`{ __typename }`}}, http.StatusOK, `{"data":{"__typename":"Query"}}`},
+		{"syntax error", url.Values{"query": {`{ __typename`}}, http.StatusBadRequest, `{"errors":[{"message":"unterminated selection set"}]}`},
+		{"unknown field", url.Values{"query": {`{ sites { domain } }`}}, http.StatusOK, `{"data":null,"errors":[{"message":"cannot query field \"sites\" on type Query"}]}`},
+		{"site without domain", url.Values{"query": {`{ site { visitors } }`}}, http.StatusOK, `{"data":null,"errors":[{"message":"argument \"domain\" of field \"site\" is required"}]}`},
+		{"invalid range", url.Values{"query": {`query($period: String) { site(domain: "example.com", period: $period) { visitors } }`}, "variables": {`{"period": "fortnight"}`}}, http.StatusOK, `"data":null`},
+		{"invalid variables", url.Values{"query": {`{ __typename }`}, "variables": {`[`}}, http.StatusBadRequest, `"code":"invalid_parameter"`},
+		{"without query", url.Values{}, http.StatusBadRequest, `"code":"missing_parameter"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := serveGet(t, http.HandlerFunc(s.handleGraphQL), "/graphql?"+tt.query.Encode())
+			if status != tt.wantStatus || !strings.Contains(body, tt.want) {
+				t.Errorf("/graphql = %d %s, want %d %s", status, body, tt.wantStatus, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The gRPC service of analytics.proto, served on the API listeners next to
+// the HTTP API for backends to track pageviews and read their stats with
+// typed clients. gRPC needs HTTP/2, which is only served over HTTPS.
+const grpcService = "potato.v1.Analytics"
+
+// The metadata the API key of a call is passed in, as gRPC clients can't set
+// query parameters. SSO tokens are passed as a bearer token of the
+// authorization metadata, as over HTTP.
+const grpcKeyHeader = "X-Api-Key"
+
+// Largest request message accepted, well above what a request of the service
+// needs
+const grpcMaxMessageSize = 64 << 10
+
+// The gRPC status codes the service replies with
+const (
+	grpcOK                = 0
+	grpcInvalidArgument   = 3
+	grpcNotFound          = 5
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+	grpcUnavailable       = 14
+	grpcUnauthenticated   = 16
+)
+
+// grpcError is the status a call fails with.
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (e *grpcError) Error() string {
+	return fmt.Sprintf("gRPC status %d: %s", e.code, e.message)
+}
+
+func grpcErrorf(code int, format string, args ...any) error {
+	return &grpcError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// grpcCode returns the gRPC status code of an HTTP status the API replied
+// with.
+func grpcCode(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return grpcInvalidArgument
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcNotFound
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		return grpcResourceExhausted
+	case http.StatusServiceUnavailable:
+		return grpcUnavailable
+	default:
+		return grpcInternal
+	}
+}
+
+// handleGRPC serves the calls of the gRPC service. Its methods are served by
+// the HTTP handlers doing the same, so that they're authorized, validated and
+// answered alike.
+func (s *server) handleGRPC(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 {
+		writeError(w, http.StatusHTTPVersionNotSupported, errNotConfigured, "gRPC needs HTTP/2, served over HTTPS with TLS_CERT_FILE or TLS_AUTOCERT")
+		return
+	}
+	if contentType := r.Header.Get("Content-Type"); contentType != "application/grpc" && !strings.HasPrefix(contentType, "application/grpc+proto") {
+		writeError(w, http.StatusUnsupportedMediaType, errInvalidBody, "Invalid request body, expected application/grpc")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	var err error
+	switch method := r.PathValue("method"); method {
+	case "Track":
+		err = s.grpcTrack(w, r)
+	case "GetStats":
+		err = s.grpcGetStats(w, r)
+	case "WatchPageviews":
+		err = s.grpcWatchPageviews(w, r)
+	default:
+		err = grpcErrorf(grpcUnimplemented, "Unknown method %s/%s", grpcService, method)
+	}
+	writeGRPCStatus(w, err)
+}
+
+// grpcTrack tracks a pageview or a custom event as a backend would over
+// HTTP, with an API key allowed to write the events of its domain:
+//
+//	rpc Track(TrackRequest) returns (TrackResponse)
+func (s *server) grpcTrack(w http.ResponseWriter, r *http.Request) error {
+	var req struct{ url, ip, userAgent, referrer, event string }
+	if err := readGRPCMessage(r, protoFields{1: &req.url, 2: &req.ip, 3: &req.userAgent, 4: &req.referrer, 5: &req.event}); err != nil {
+		return err
+	}
+	key := r.Header.Get(grpcKeyHeader)
+	if key == "" {
+		return grpcErrorf(grpcUnauthenticated, "Missing %s metadata", strings.ToLower(grpcKeyHeader))
+	}
+
+	form := url.Values{"url": {req.url}, "api_key": {key}}
+	for name, value := range map[string]string{"ip": req.ip, "user_agent": req.userAgent, "eventType": req.event} {
+		if value != "" {
+			form.Set(name, value)
+		}
+	}
+	body := form.Encode()
+	internal := grpcInternalRequest(r, http.MethodPost, "/track", nil)
+	internal.Body = io.NopCloser(strings.NewReader(body))
+	internal.ContentLength = int64(len(body))
+	internal.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if req.referrer != "" {
+		internal.Header.Set("Referer", req.referrer)
+	}
+
+	rec := newGRPCRecorder()
+	s.handleTrack(rec, internal)
+	if err := rec.err(); err != nil {
+		return err
+	}
+	return writeGRPCMessage(w, nil)
+}
+
+// grpcGetStats returns the top pages, sources or countries of a domain over
+// a range, as /stats/pages, /stats/sources and /stats/countries do with
+// aggregate=range:
+//
+//	rpc GetStats(StatsRequest) returns (StatsResponse)
+func (s *server) grpcGetStats(w http.ResponseWriter, r *http.Request) error {
+	var req struct {
+		domain, report, period, start, end, tz string
+		limit, offset                          int64
+	}
+	if err := readGRPCMessage(r, protoFields{1: &req.domain, 2: &req.report, 3: &req.period, 4: &req.start, 5: &req.end, 6: &req.limit, 7: &req.offset, 8: &req.tz}); err != nil {
+		return err
+	}
+	if req.domain == "" {
+		return grpcErrorf(grpcInvalidArgument, "Missing domain")
+	}
+	views := map[string]func(statsParams, url.Values) (statsView, error){
+		"pages":     s.pagesView,
+		"sources":   s.sourcesView,
+		"countries": s.countriesView,
+	}
+	view, ok := views[req.report]
+	if !ok {
+		return grpcErrorf(grpcInvalidArgument, "Invalid report %q, expected pages, sources or countries", req.report)
+	}
+	if err := s.grpcAuthorize(r, scopeReadStats, req.domain); err != nil {
+		return err
+	}
+
+	query := url.Values{"domain": {req.domain}, "aggregate": {"range"}}
+	for name, value := range map[string]string{"period": req.period, "start": req.start, "end": req.end, "tz": req.tz} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	if req.limit != 0 {
+		query.Set("limit", strconv.FormatInt(req.limit, 10))
+	}
+	if req.offset != 0 {
+		query.Set("offset", strconv.FormatInt(req.offset, 10))
+	}
+
+	rec := newGRPCRecorder()
+	s.serveStats(req.report, view)(rec, grpcInternalRequest(r, http.MethodGet, "/stats/"+req.report, query))
+	if err := rec.err(); err != nil {
+		return err
+	}
+
+	var response struct {
+		Total   int64 `json:"total"`
+		Results []struct {
+			Path      string `json:"path"`
+			Referrer  string `json:"referrer"`
+			Country   string `json:"country"`
+			Visitors  int64  `json:"visitors"`
+			Pageviews int64  `json:"pageviews"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(rec.body.Bytes(), &response); err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to decode stats", slog.String("error", err.Error()))
+		return grpcErrorf(grpcInternal, "Failed to fetch stats")
+	}
+
+	var message []byte
+	for _, result := range response.Results {
+		name := result.Path
+		switch req.report {
+		case "sources":
+			name = result.Referrer
+		case "countries":
+			name = result.Country
+		}
+		var row []byte
+		row = appendProtoString(row, 1, name)
+		row = appendProtoInt(row, 2, result.Visitors)
+		row = appendProtoInt(row, 3, result.Pageviews)
+		message = appendProtoBytes(message, 1, row)
+	}
+	message = appendProtoInt(message, 2, response.Total)
+	return writeGRPCMessage(w, message)
+}
+
+// grpcWatchPageviews streams a domain's pageviews as they're tracked, as
+// /stats/stream does:
+//
+//	rpc WatchPageviews(WatchRequest) returns (stream Pageview)
+func (s *server) grpcWatchPageviews(w http.ResponseWriter, r *http.Request) error {
+	var domain string
+	if err := readGRPCMessage(r, protoFields{1: &domain}); err != nil {
+		return err
+	}
+	if domain == "" {
+		return grpcErrorf(grpcInvalidArgument, "Missing domain")
+	}
+	if err := s.grpcAuthorize(r, scopeReadStats, domain); err != nil {
+		return err
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return grpcErrorf(grpcInternal, "Streaming isn't supported")
+	}
+
+	events := s.stream.subscribe(domain)
+	defer s.stream.unsubscribe(domain, events)
+	liftWriteDeadline(w)
+
+	// The headers tell the client the stream has started
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				return grpcErrorf(grpcUnavailable, "The server is shutting down")
+			}
+			var message []byte
+			message = appendProtoString(message, 1, event.Domain)
+			message = appendProtoString(message, 2, event.Path)
+			message = appendProtoString(message, 3, event.Referrer)
+			message = appendProtoString(message, 4, event.Country)
+			message = appendProtoInt(message, 5, event.Time.UnixMilli())
+			if err := writeGRPCMessage(w, message); err != nil {
+				return err
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// grpcAuthorize checks that the credentials of a call are allowed to scope
+// on domain, as requireAPIKey does those of HTTP requests.
+func (s *server) grpcAuthorize(r *http.Request, scope string, domain string) error {
+	query := url.Values{"domain": {domain}}
+	if key := r.Header.Get(grpcKeyHeader); key != "" {
+		query.Set("api_key", key)
+	}
+
+	authorized := false
+	rec := newGRPCRecorder()
+	s.requireAPIKey(scope, func(http.ResponseWriter, *http.Request) { authorized = true })(rec, grpcInternalRequest(r, http.MethodGet, "/", query))
+	if authorized {
+		return nil
+	}
+	return rec.err()
+}
+
+// grpcInternalRequest returns the HTTP request a call is served as, from the
+// same client and with the same headers but the gRPC ones.
+func grpcInternalRequest(r *http.Request, method string, path string, query url.Values) *http.Request {
+	internal := r.Clone(r.Context())
+	internal.Method = method
+	internal.URL = &url.URL{Path: path, RawQuery: query.Encode()}
+	internal.Body = http.NoBody
+	internal.ContentLength = 0
+	for name := range internal.Header {
+		if strings.HasPrefix(name, "Grpc-") {
+			internal.Header.Del(name)
+		}
+	}
+	for _, name := range []string{"Content-Type", "Te", "Referer", grpcKeyHeader} {
+		internal.Header.Del(name)
+	}
+	return internal
+}
+
+// grpcRecorder records the response of an HTTP handler serving a call.
+type grpcRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newGRPCRecorder() *grpcRecorder {
+	return &grpcRecorder{header: http.Header{}}
+}
+
+func (rec *grpcRecorder) Header() http.Header { return rec.header }
+
+func (rec *grpcRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *grpcRecorder) Write(b []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+	return rec.body.Write(b)
+}
+
+// err returns the status of the call of an error response, with the message
+// of its error envelope.
+func (rec *grpcRecorder) err() error {
+	if rec.status < http.StatusBadRequest {
+		return nil
+	}
+	var response struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	message := http.StatusText(rec.status)
+	if json.Unmarshal(rec.body.Bytes(), &response) == nil && response.Error.Message != "" {
+		message = response.Error.Message
+	}
+	return &grpcError{code: grpcCode(rec.status), message: message}
+}
+
+// readGRPCMessage reads the request message of a unary or server-streaming
+// call into fields.
+func readGRPCMessage(r *http.Request, fields protoFields) error {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r.Body, prefix[:]); err != nil {
+		return grpcErrorf(grpcInvalidArgument, "Missing request message")
+	}
+	if prefix[0] != 0 {
+		return grpcErrorf(grpcUnimplemented, "Compressed messages aren't supported")
+	}
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if length > grpcMaxMessageSize {
+		return grpcErrorf(grpcResourceExhausted, "Request message too large, expected at most %d bytes", grpcMaxMessageSize)
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(r.Body, message); err != nil {
+		return grpcErrorf(grpcInvalidArgument, "Truncated request message")
+	}
+	if err := unmarshalProto(message, fields); err != nil {
+		return grpcErrorf(grpcInvalidArgument, "Invalid request message: %v", err)
+	}
+	return nil
+}
+
+// writeGRPCMessage writes a response message, prefixed by its length and
+// uncompressed.
+func writeGRPCMessage(w http.ResponseWriter, message []byte) error {
+	prefix := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(message)))
+	_, err := w.Write(append(prefix, message...))
+	return err
+}
+
+// writeGRPCStatus sets the trailers ending a call with the status of err,
+// OK when it's nil. Calls failing to write their response have nobody left
+// to tell.
+func writeGRPCStatus(w http.ResponseWriter, err error) {
+	code, message := grpcOK, ""
+	var status *grpcError
+	if errors.As(err, &status) {
+		code, message = status.code, status.message
+	} else if err != nil {
+		code, message = grpcInternal, "Failed to write the response"
+	}
+
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcEscape(message))
+	}
+}
+
+// grpcEscape percent-encodes a status message, as gRPC metadata is ASCII.
+func grpcEscape(message string) string {
+	var b strings.Builder
+	for _, c := range []byte(message) {
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// protoFields are the fields a protobuf message is decoded into, by field
+// number: *string for strings and *int64 for integers. Other fields are
+// skipped, as proto3 decoders do.
+type protoFields map[int]any
+
+// unmarshalProto decodes a protobuf message into fields.
+func unmarshalProto(data []byte, fields protoFields) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("invalid field key")
+		}
+		data = data[n:]
+
+		field, wireType := int(key>>3), key&7
+		var number uint64
+		var value []byte
+		switch wireType {
+		case 0:
+			number, n = binary.Uvarint(data)
+			if n <= 0 {
+				return fmt.Errorf("invalid varint of field %d", field)
+			}
+			data = data[n:]
+		case 1, 5:
+			size := 8
+			if wireType == 5 {
+				size = 4
+			}
+			if len(data) < size {
+				return fmt.Errorf("truncated field %d", field)
+			}
+			data = data[size:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return fmt.Errorf("truncated field %d", field)
+			}
+			value, data = data[n:n+int(length)], data[n+int(length):]
+		default:
+			return fmt.Errorf("unsupported wire type %d of field %d", wireType, field)
+		}
+
+		switch dest := fields[field].(type) {
+		case *string:
+			if wireType != 2 || !utf8.Valid(value) {
+				return fmt.Errorf("field %d isn't a string", field)
+			}
+			*dest = string(value)
+		case *int64:
+			if wireType != 0 {
+				return fmt.Errorf("field %d isn't an integer", field)
+			}
+			*dest = int64(number)
+		}
+	}
+	return nil
+}
+
+// appendProtoString appends a string field, omitted when it's empty as
+// proto3 does.
+func appendProtoString(b []byte, field int, value string) []byte {
+	if value == "" {
+		return b
+	}
+	return appendProtoBytes(b, field, []byte(value))
+}
+
+// appendProtoBytes appends a length-delimited field, an embedded message
+// even when it's empty.
+func appendProtoBytes(b []byte, field int, value []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+// appendProtoInt appends an int64 field, omitted when it's zero.
+func appendProtoInt(b []byte, field int, value int64) []byte {
+	if value == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, uint64(value))
+}
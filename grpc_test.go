@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ua-parser/uap-go/uaparser"
+)
+
+// protoField is a field of an encoded protobuf message, a varint or the
+// bytes of a length-delimited field.
+type protoField struct {
+	number int
+	varint uint64
+	bytes  string
+}
+
+// splitProto returns the fields of a message in order, repeated ones
+// included.
+func splitProto(t *testing.T, data []byte) []protoField {
+	t.Helper()
+	var fields []protoField
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		value, m := binary.Uvarint(data[n:])
+		if n <= 0 || m <= 0 {
+			t.Fatalf("invalid message %x", data)
+		}
+		data = data[n+m:]
+		field := protoField{number: int(key >> 3), varint: value}
+		if key&7 == 2 {
+			field.varint, field.bytes, data = 0, string(data[:value]), data[value:]
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+func TestUnmarshalProto(t *testing.T) {
+	var message []byte
+	message = appendProtoString(message, 1, "example.com")
+	message = appendProtoInt(message, 6, 150)
+	// Fields unknown to the server are skipped, whatever their type
+	message = appendProtoBytes(message, 9, []byte{1, 2, 3})
+	message = append(message, 10<<3|5, 1, 2, 3, 4)
+	message = append(message, 11<<3|1, 1, 2, 3, 4, 5, 6, 7, 8)
+	message = appendProtoInt(message, 12, -1)
+
+	var domain, report string
+	var limit int64
+	if err := unmarshalProto(message, protoFields{1: &domain, 2: &report, 6: &limit}); err != nil {
+		t.Fatalf("unmarshalProto: %v", err)
+	}
+	if domain != "example.com" || report != "" || limit != 150 {
+		t.Errorf("unmarshalProto decoded domain %q, report %q and limit %d", domain, report, limit)
+	}
+
+	invalid := map[string][]byte{
+		"truncated string":  {1<<3 | 2, 5, 'a'},
+		"truncated varint":  {6 << 3, 0x80},
+		"truncated fixed32": {10<<3 | 5, 1},
+		"group":             {1<<3 | 3},
+		"string as varint":  {1 << 3, 1},
+		"integer as string": {6<<3 | 2, 1, '1'},
+		"invalid UTF-8":     {1<<3 | 2, 1, 0xff},
+	}
+	for name, message := range invalid {
+		if err := unmarshalProto(message, protoFields{1: &domain, 6: &limit}); err == nil {
+			t.Errorf("%s: unmarshalProto(%x) succeeded", name, message)
+		}
+	}
+}
+
+func TestGRPCEscape(t *testing.T) {
+	if got, want := grpcEscape("Invalid 'url' parameter: 100% é\n"), "Invalid 'url' parameter: 100%25 %C3%A9%0A"; got != want {
+		t.Errorf("grpcEscape = %q, want %q", got, want)
+	}
+}
+
+// grpcTestStore answers the stats queries with rows, as PostgreSQL isn't
+// available to the tests.
+type grpcTestStore struct {
+	statsStore
+	rows    []statsRow
+	queries []statsQuery
+}
+
+func (st *grpcTestStore) queryRows(q statsQuery) ([]statsRow, error) {
+	st.queries = append(st.queries, q)
+	return st.rows, nil
+}
+
+func (st *grpcTestStore) countRows(statsQuery) (int, error) { return len(st.rows) + 10, nil }
+
+// grpcResponse is the outcome of a gRPC call.
+type grpcResponse struct {
+	messages [][]byte
+	status   int
+	message  string
+}
+
+// newGRPCTestServer serves the API over HTTPS and HTTP/2, as gRPC needs.
+func newGRPCTestServer(t *testing.T, s *server) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(s.routes(false, true))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// startGRPCCall calls a method with a request message, returning the HTTP
+// response once its headers are received.
+func startGRPCCall(t *testing.T, srv *httptest.Server, method string, key string, request []byte) *http.Response {
+	t.Helper()
+	body := make([]byte, 5, 5+len(request))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(request)))
+	r, err := http.NewRequest(http.MethodPost, srv.URL+"/"+grpcService+"/"+method, bytes.NewReader(append(body, request...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "application/grpc")
+	r.Header.Set("TE", "trailers")
+	if key != "" {
+		r.Header.Set(grpcKeyHeader, key)
+	}
+	resp, err := srv.Client().Do(r)
+	if err != nil {
+		t.Fatalf("%s: %v", method, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/grpc" {
+		t.Fatalf("%s: got %s %d with Content-Type %q", method, resp.Proto, resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	return resp
+}
+
+// readGRPCResponse reads the rest of a call's messages and its status.
+func readGRPCResponse(t *testing.T, resp *http.Response) grpcResponse {
+	t.Helper()
+	var got grpcResponse
+	for {
+		var prefix [5]byte
+		if _, err := io.ReadFull(resp.Body, prefix[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("reading a message: %v", err)
+		}
+		message := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+		if _, err := io.ReadFull(resp.Body, message); err != nil {
+			t.Fatalf("reading a message: %v", err)
+		}
+		got.messages = append(got.messages, message)
+	}
+
+	status, err := strconv.Atoi(resp.Trailer.Get("Grpc-Status"))
+	if err != nil {
+		t.Fatalf("invalid grpc-status trailer %q", resp.Trailer.Get("Grpc-Status"))
+	}
+	got.status, got.message = status, resp.Trailer.Get("Grpc-Message")
+	return got
+}
+
+func callGRPC(t *testing.T, srv *httptest.Server, method string, key string, request []byte) grpcResponse {
+	t.Helper()
+	return readGRPCResponse(t, startGRPCCall(t, srv, method, key, request))
+}
+
+func TestGRPCGetStats(t *testing.T) {
+	s := newTestServer(t, "-api-key=key")
+	s.db, _ = newRecordingDB(t)
+	store := &grpcTestStore{rows: []statsRow{
+		{dimensions: []string{"google.com"}, visitors: 12, pageviews: 30},
+		{dimensions: []string{"Direct / None"}, visitors: 3, pageviews: 3},
+	}}
+	s.store = store
+	srv := newGRPCTestServer(t, s)
+
+	var request []byte
+	request = appendProtoString(request, 1, "example.com")
+	request = appendProtoString(request, 2, "sources")
+	request = appendProtoString(request, 3, "30d")
+	request = appendProtoInt(request, 6, 2)
+	got := callGRPC(t, srv, "GetStats", "key", request)
+	if got.status != grpcOK || len(got.messages) != 1 {
+		t.Fatalf("GetStats returned status %d (%s) and %d messages", got.status, got.message, len(got.messages))
+	}
+
+	type row struct {
+		name                string
+		visitors, pageviews uint64
+	}
+	var rows []row
+	var total uint64
+	for _, field := range splitProto(t, got.messages[0]) {
+		switch field.number {
+		case 1:
+			var r row
+			for _, column := range splitProto(t, []byte(field.bytes)) {
+				switch column.number {
+				case 1:
+					r.name = column.bytes
+				case 2:
+					r.visitors = column.varint
+				case 3:
+					r.pageviews = column.varint
+				}
+			}
+			rows = append(rows, r)
+		case 2:
+			total = field.varint
+		}
+	}
+	if want := []row{{"google.com", 12, 30}, {"Direct / None", 3, 3}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("GetStats returned rows %+v, want %+v", rows, want)
+	}
+	if total != 12 {
+		t.Errorf("GetStats returned a total of %d, want 12", total)
+	}
+	if len(store.queries) != 1 || store.queries[0].table != "sources" || store.queries[0].limit != 2 || store.queries[0].interval != "" {
+		t.Errorf("GetStats queried %+v", store.queries)
+	}
+
+	failures := []struct {
+		name    string
+		key     string
+		report  string
+		period  string
+		want    int
+		message string
+	}{
+		{"without key", "", "pages", "30d", grpcUnauthenticated, "Unauthorized"},
+		{"wrong report", "key", "browsers", "30d", grpcInvalidArgument, `Invalid report "browsers", expected pages, sources or countries`},
+		{"wrong period", "key", "pages", "1y", grpcInvalidArgument, ""},
+	}
+	for _, tt := range failures {
+		var request []byte
+		request = appendProtoString(request, 1, "example.com")
+		request = appendProtoString(request, 2, tt.report)
+		request = appendProtoString(request, 3, tt.period)
+		got := callGRPC(t, srv, "GetStats", tt.key, request)
+		if got.status != tt.want || len(got.messages) != 0 || got.message == "" || (tt.message != "" && got.message != tt.message) {
+			t.Errorf("%s: GetStats returned status %d (%s) and %d messages, want %d", tt.name, got.status, got.message, len(got.messages), tt.want)
+		}
+	}
+
+	if got := callGRPC(t, srv, "GetTrends", "key", nil); got.status != grpcUnimplemented {
+		t.Errorf("an unknown method returned status %d (%s)", got.status, got.message)
+	}
+}
+
+func TestGRPCTrack(t *testing.T) {
+	s := newTestServer(t, "-api-key=key")
+	s.db, _ = newRecordingDB(t)
+	parser, err := uaparser.NewFromBytes([]byte(userAgentRegexp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.parser = parser
+	srv := newGRPCTestServer(t, s)
+
+	track := func(key, visitedURL, userAgent string) grpcResponse {
+		var request []byte
+		request = appendProtoString(request, 1, visitedURL)
+		request = appendProtoString(request, 2, "203.0.113.7")
+		request = appendProtoString(request, 3, userAgent)
+		return callGRPC(t, srv, "Track", key, request)
+	}
+
+	// Bots are ignored once the call is authorized, without recording
+	// anything
+	if got := track("key", "https://example.com/", "Googlebot/2.1 (+http://www.google.com/bot.html)"); got.status != grpcOK || len(got.messages) != 1 || len(got.messages[0]) != 0 {
+		t.Errorf("tracking a bot returned status %d (%s) and %d messages", got.status, got.message, len(got.messages))
+	}
+
+	failures := []struct {
+		name       string
+		key        string
+		visitedURL string
+		want       int
+	}{
+		{"without key", "", "https://example.com/", grpcUnauthenticated},
+		{"unknown key", "other", "https://example.com/", grpcPermissionDenied},
+		{"without URL", "key", "", grpcInvalidArgument},
+	}
+	for _, tt := range failures {
+		if got := track(tt.key, tt.visitedURL, "Mozilla/5.0"); got.status != tt.want || len(got.messages) != 0 {
+			t.Errorf("%s: Track returned status %d (%s), want %d", tt.name, got.status, got.message, tt.want)
+		}
+	}
+}
+
+func TestGRPCWatchPageviews(t *testing.T) {
+	s := newTestServer(t, "-api-key=key")
+	s.stream = newEventStream()
+	srv := newGRPCTestServer(t, s)
+
+	request := appendProtoString(nil, 1, "example.com")
+	if got := callGRPC(t, srv, "WatchPageviews", "", request); got.status != grpcUnauthenticated {
+		t.Errorf("watching without key returned status %d (%s)", got.status, got.message)
+	}
+
+	// The stream has started once its headers are received
+	resp := startGRPCCall(t, srv, "WatchPageviews", "key", request)
+	viewed := time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC)
+	s.stream.publish(pageviewEvent{Domain: "other.com", Path: "/", Time: viewed})
+	s.stream.publish(pageviewEvent{Domain: "example.com", Path: "/pricing", Referrer: "google.com", Country: "FR", Time: viewed})
+	s.stream.close()
+
+	got := readGRPCResponse(t, resp)
+	if got.status != grpcUnavailable {
+		t.Errorf("the stream ended with status %d (%s), want %d", got.status, got.message, grpcUnavailable)
+	}
+	if len(got.messages) != 1 {
+		t.Fatalf("the stream sent %d messages, want 1", len(got.messages))
+	}
+	want := []protoField{
+		{number: 1, bytes: "example.com"},
+		{number: 2, bytes: "/pricing"},
+		{number: 3, bytes: "google.com"},
+		{number: 4, bytes: "FR"},
+		{number: 5, varint: uint64(viewed.UnixMilli())},
+	}
+	if fields := splitProto(t, got.messages[0]); !reflect.DeepEqual(fields, want) {
+		t.Errorf("the stream sent %+v, want %+v", fields, want)
+	}
+}
+
+func TestGRPCNeedsHTTP2(t *testing.T) {
+	s := newTestServer(t, "-api-key=key")
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/"+grpcService+"/Track", nil)
+	r.Header.Set("Content-Type", "application/grpc")
+	s.routes(false, true).ServeHTTP(rec, r)
+	if rec.Code != http.StatusHTTPVersionNotSupported {
+		t.Errorf("a gRPC call over HTTP/1.1 returned %d: %s", rec.Code, rec.Body)
+	}
+}
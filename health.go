@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// How long health checks wait for the database before failing
+const healthCheckTimeout = 2 * time.Second
+
+// How many rows the write buffer can hold before the instance stops being
+// ready, flushes having presumably fallen behind or been failing
+const writeBufferSaturation = 100000
+
+// healthCheck is the result of checking one of the things the server
+// depends on.
+type healthCheck struct {
+	Status string `json:"status"`
+	// What failed, or how it's set up when it's fine
+	Message string `json:"message,omitempty"`
+	// How long the check took, in milliseconds
+	Duration float64 `json:"duration_ms"`
+}
+
+// runHealthCheck runs check, timing it.
+func runHealthCheck(check func() (string, error)) healthCheck {
+	start := time.Now()
+	message, err := check()
+	result := healthCheck{Status: "ok", Message: message, Duration: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		result.Status, result.Message = "error", err.Error()
+	}
+	return result
+}
+
+// checkDatabase pings the database.
+func (s *server) checkDatabase(ctx context.Context) (string, error) {
+	if err := s.db.PingContext(ctx); err != nil {
+		return "", fmt.Errorf("failed to ping the database: %w", err)
+	}
+	return "", nil
+}
+
+// checkHLL checks that the hll extension is still installed, unless sketches
+// are computed by Potato.
+func (s *server) checkHLL(ctx context.Context) (string, error) {
+	if s.sketches.goHLL {
+		return "sketches are computed by Potato", nil
+	}
+	var installed bool
+	err := s.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'hll')`).Scan(&installed)
+	if err != nil {
+		return "", fmt.Errorf("failed to list extensions: %w", err)
+	}
+	if !installed {
+		return "", errors.New("the hll extension isn't installed")
+	}
+	return "the hll extension is installed", nil
+}
+
+// checkMigrations checks that the schema is at the version of the server's
+// latest migration.
+func (s *server) checkMigrations(ctx context.Context) (string, error) {
+	migrations, err := loadMigrations(s.sketches)
+	if err != nil {
+		return "", err
+	}
+	var current int
+	if err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&current); err != nil {
+		return "", fmt.Errorf("failed to read the schema version: %w", err)
+	}
+	if current != len(migrations) {
+		return "", fmt.Errorf("the schema is at version %d, expected %d", current, len(migrations))
+	}
+	return fmt.Sprintf("the schema is at version %d", current), nil
+}
+
+// checkBuffers checks that the pageviews waiting to be written and the goal
+// completions waiting to be notified aren't piling up.
+func (s *server) checkBuffers() (string, error) {
+	if postgres, ok := s.store.(*postgresStore); ok && postgres.buffer != nil {
+		if rows := postgres.buffer.len(); rows >= writeBufferSaturation {
+			return "", fmt.Errorf("%d rows are waiting to be written", rows)
+		}
+	}
+	if s.notifications != nil && len(s.notifications) == cap(s.notifications) {
+		return "", errors.New("the notification queue is full")
+	}
+	return "", nil
+}
+
+// handleHealth serves /healthz: the status of the database and of the hll
+// extension, with a 503 when one of them fails so that load balancers and
+// uptime monitors take the instance out.
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+
+	checks := map[string]healthCheck{
+		"database": runHealthCheck(func() (string, error) { return s.checkDatabase(ctx) }),
+		"hll":      runHealthCheck(func() (string, error) { return s.checkHLL(ctx) }),
+	}
+	writeHealth(w, checks)
+}
+
+// handleLive serves /livez, telling orchestrators that the process is up
+// and shouldn't be restarted, whatever the state of the database.
+func (s *server) handleLive(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, map[string]healthCheck{})
+}
+
+// handleReady serves /readyz: whether the instance can serve requests, its
+// database being reachable and migrated and its buffers keeping up, so that
+// orchestrators stop routing traffic to it until it is.
+func (s *server) handleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+
+	checks := map[string]healthCheck{
+		"database":   runHealthCheck(func() (string, error) { return s.checkDatabase(ctx) }),
+		"migrations": runHealthCheck(func() (string, error) { return s.checkMigrations(ctx) }),
+		"buffers":    runHealthCheck(s.checkBuffers),
+	}
+	writeHealth(w, checks)
+}
+
+// writeHealth replies with the result of checks, failing unless they're all
+// fine.
+func writeHealth(w http.ResponseWriter, checks map[string]healthCheck) {
+	status, code := "ok", http.StatusOK
+	for _, check := range checks {
+		if check.Status != "ok" {
+			status, code = "error", http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Status string                 `json:"status"`
+		Checks map[string]healthCheck `json:"checks"`
+	}{status, checks})
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// sketchFormat is how the visitor sketches are stored, detected at startup.
+// When the hll extension isn't available, as on some managed PostgreSQL
+// offerings, they're stored as bytea and maintained by Potato itself:
+// tracking sets their registers in SQL, while unions and cardinalities are
+// computed here. Otherwise, the extension's sketches have the parameters the
+// tables were created with, its defaults when they're left zero.
+type sketchFormat struct {
+	goHLL  bool
+	params hllParams
+}
+
+// hll returns the parameters of the extension's sketches.
+func (f sketchFormat) hll() hllParams {
+	if f.params == (hllParams{}) {
+		return defaultHLLParams
+	}
+	return f.params
+}
+
+// Precision of the sketches computed by Potato, the same as the extension's
+// default: 2^11 one-byte registers.
+const (
+	hllPrecision = 11
+	hllRegisters = 1 << hllPrecision
+)
+
+// hllParams are the log2m, regwidth and expthresh of the extension's
+// sketches: the log-base-2 of their number of registers, the width of a
+// register in bits, and the number of visitors kept explicitly before
+// switching to registers, -1 letting the extension decide.
+type hllParams struct {
+	log2m     int
+	regwidth  int
+	expthresh int64
+}
+
+// The extension's defaults, which the tables use unless configured otherwise
+var defaultHLLParams = hllParams{log2m: 11, regwidth: 5, expthresh: -1}
+
+// sql returns the parameters as arguments of the extension's functions and
+// type.
+func (p hllParams) sql() string {
+	return fmt.Sprintf("%d, %d, %d, 1", p.log2m, p.regwidth, p.expthresh)
+}
+
+// relativeError returns the standard error of the sketches' estimates, as a
+// fraction of the estimate: 1.04/sqrt(2^log2m), 0.023 by default.
+func (f sketchFormat) relativeError() float64 {
+	log2m := f.hll().log2m
+	if f.goHLL {
+		log2m = hllPrecision
+	}
+	return 1.04 / math.Sqrt(float64(int(1)<<log2m))
+}
+
+// detectHLL creates the hll extension, reporting whether sketches have to be
+// computed by Potato instead. They also are when the tables were created
+// without the extension, even if it has been installed since.
+func detectHLL(db *sql.DB, logger *slog.Logger) (bool, error) {
+	var columnType string
+	err := db.QueryRow(`
+	SELECT data_type FROM information_schema.columns
+	WHERE table_schema = current_schema() AND table_name = 'pages' AND column_name = 'visitor_hll'
+	`).Scan(&columnType)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return false, fmt.Errorf("failed to inspect the pages table: %w", err)
+	case columnType == "bytea":
+		return true, nil
+	}
+
+	if _, err := db.Exec(`CREATE EXTENSION IF NOT EXISTS hll`); err != nil {
+		logger.Warn("The hll extension isn't available, sketches will be computed by Potato", slog.String("error", err.Error()))
+		return true, nil
+	}
+	return false, nil
+}
+
+// loadHLLParams returns the parameters of the sketches of the existing
+// tables, or the configured ones when the tables are yet to be created.
+// Sketches of different parameters can't be merged, so the configured ones
+// are ignored once the tables exist.
+func loadHLLParams(db *sql.DB, logger *slog.Logger, configured hllParams) (hllParams, error) {
+	var columnType string
+	err := db.QueryRow(`
+	SELECT format_type(atttypid, atttypmod) FROM pg_attribute
+	WHERE attrelid = to_regclass('pages') AND attname = 'visitor_hll'
+	`).Scan(&columnType)
+	if err == sql.ErrNoRows {
+		return configured, nil
+	}
+	if err != nil {
+		return hllParams{}, fmt.Errorf("failed to inspect the pages table: %w", err)
+	}
+
+	// The type is written hll(log2m,regwidth,expthresh,sparseon), or hll for
+	// the defaults
+	params := defaultHLLParams
+	if columnType != "hll" {
+		if _, err := fmt.Sscanf(strings.ReplaceAll(columnType, " ", ""), "hll(%d,%d,%d,", &params.log2m, &params.regwidth, &params.expthresh); err != nil {
+			return hllParams{}, fmt.Errorf("unexpected sketch type %q: %w", columnType, err)
+		}
+	}
+	if params != configured {
+		logger.Warn("The HLL parameters only apply when the tables are created, keeping those they have", slog.String("type", columnType))
+	}
+	return params, nil
+}
+
+// sqlType returns the SQL type of the visitor_hll columns.
+func (f sketchFormat) sqlType() string {
+	if f.goHLL {
+		return "bytea"
+	}
+	if params := f.hll(); params != defaultHLLParams {
+		return "hll(" + params.sql() + ")"
+	}
+	return "hll"
+}
+
+// addExprs returns the SQL expressions of a new sketch of table holding
+// visitor and of its existing sketch with visitor added, adding their
+// arguments to args.
+func (f sketchFormat) addExprs(table string, args *queryArgs, visitor string) (string, string) {
+	if !f.goHLL {
+		arg := args.add(visitor)
+		return "hll_add(hll_empty(" + f.hll().sql() + "), hll_hash_text(" + arg + "))",
+			"hll_add(" + table + ".visitor_hll, hll_hash_text(" + arg + "))"
+	}
+
+	index, rank := hllPosition(visitor)
+	register, value := args.add(index), args.add(rank)
+	return "set_byte(decode(repeat('00', " + strconv.Itoa(hllRegisters) + "), 'hex'), " + register + ", " + value + ")",
+		"set_byte(" + table + ".visitor_hll, " + register + ", GREATEST(get_byte(" + table + ".visitor_hll, " + register + "), " + value + "))"
+}
+
+// mergeExprs returns the SQL expressions of a new sketch of table holding
+// visitors and of its existing sketch merged with the one inserted, adding
+// their arguments to args.
+func (f sketchFormat) mergeExprs(table string, args *queryArgs, visitors []string) (string, string) {
+	if !f.goHLL {
+		return "(SELECT hll_add_agg(hll_hash_text(visitor), " + f.hll().sql() + ") FROM unnest(" + args.add(pq.Array(visitors)) + "::text[]) AS visitor)",
+			"hll_union(" + table + ".visitor_hll, EXCLUDED.visitor_hll)"
+	}
+
+	sketch := make([]byte, hllRegisters)
+	for _, visitor := range visitors {
+		index, rank := hllPosition(visitor)
+		sketch[index] = max(sketch[index], byte(rank))
+	}
+	existing := table + ".visitor_hll"
+	return args.add(sketch),
+		"(SELECT decode(string_agg(lpad(to_hex(GREATEST(get_byte(" + existing + ", i), get_byte(EXCLUDED.visitor_hll, i))), 2, '0'), '' ORDER BY i), 'hex') FROM generate_series(0, " + strconv.Itoa(hllRegisters-1) + ") AS i)"
+}
+
+// hllPosition returns the register a visitor falls in and the value it sets
+// it to at least.
+func hllPosition(visitor string) (int, int) {
+	h := fnv.New64a()
+	h.Write([]byte(visitor))
+	hash := mix64(h.Sum64())
+
+	index := int(hash >> (64 - hllPrecision))
+	rank := bits.LeadingZeros64(hash<<hllPrecision|1<<(hllPrecision-1)) + 1
+	return index, rank
+}
+
+// mix64 is MurmurHash3's finalizer, spreading FNV's output over all bits.
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// hllUnion merges the sketch src into dst, skipping malformed sketches.
+func hllUnion(dst, src []byte) {
+	if len(src) != len(dst) {
+		return
+	}
+	for i, value := range src {
+		dst[i] = max(dst[i], value)
+	}
+}
+
+// hllCardinality estimates the number of distinct visitors of a sketch,
+// using linear counting while many registers are still empty.
+func hllCardinality(registers []byte) int {
+	m := float64(len(registers))
+	if m == 0 {
+		return 0
+	}
+
+	var sum float64
+	var zeros int
+	for _, value := range registers {
+		sum += math.Ldexp(1, -int(value))
+		if value == 0 {
+			zeros++
+		}
+	}
+
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int(math.Round(estimate))
+}
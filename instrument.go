@@ -0,0 +1,220 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// The upper bounds of the buckets of the latency histograms, in seconds
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram counts observations in latencyBuckets, cumulatively as
+// Prometheus expects.
+type histogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+func (h *histogram) observe(seconds float64) {
+	if h.buckets == nil {
+		h.buckets = make([]uint64, len(latencyBuckets))
+	}
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// write writes the histogram's series, labels being the series' other
+// labels, such as `operation="query",`.
+func (h *histogram) write(w io.Writer, name string, labels string) {
+	for i, bound := range latencyBuckets {
+		var count uint64
+		if h.buckets != nil {
+			count = h.buckets[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%g\"} %d\n", name, labels, bound, count)
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, h.count)
+	if labels != "" {
+		labels = "{" + labels[:len(labels)-1] + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n%s_count%s %d\n", name, labels, h.sum, name, labels, h.count)
+}
+
+// requestKey identifies the requests counted together.
+type requestKey struct {
+	route string
+	code  int
+}
+
+// serverMetrics are the operational metrics of the server, exposed at
+// /internal/metrics. A nil serverMetrics records nothing, for the commands
+// running without them.
+type serverMetrics struct {
+	mu        sync.Mutex
+	requests  map[requestKey]uint64
+	ingestion histogram
+	// Durations of the stats store's calls, per operation
+	queries map[string]*histogram
+	// Pageviews not counted, per reason
+	dropped map[string]uint64
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{requests: map[requestKey]uint64{}, queries: map[string]*histogram{}, dropped: map[string]uint64{}}
+}
+
+// countRequest counts a request served by the route of pattern.
+func (m *serverMetrics) countRequest(pattern string, code int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{pattern, code}]++
+}
+
+// observeIngestion records how long a pageview that started at start took
+// to be tracked.
+func (m *serverMetrics) observeIngestion(start time.Time) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ingestion.observe(time.Since(start).Seconds())
+}
+
+// observeQuery records how long an operation of the stats store that
+// started at start took.
+func (m *serverMetrics) observeQuery(operation string, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.queries[operation] == nil {
+		m.queries[operation] = &histogram{}
+	}
+	m.queries[operation].observe(time.Since(start).Seconds())
+}
+
+// countDropped counts a pageview that wasn't tracked, and why: "bot",
+// "excluded", "not_allowed", "invalid", "rate_limited" or "failed".
+func (m *serverMetrics) countDropped(reason string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dropped[reason]++
+}
+
+// write writes the metrics in the Prometheus text format.
+func (m *serverMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprint(w, "# HELP potato_http_requests_total Requests served, by route and status code.\n# TYPE potato_http_requests_total counter\n")
+	keys := slices.SortedFunc(maps.Keys(m.requests), func(a, b requestKey) int {
+		return cmp.Or(cmp.Compare(a.route, b.route), cmp.Compare(a.code, b.code))
+	})
+	for _, key := range keys {
+		fmt.Fprintf(w, "potato_http_requests_total{route=\"%s\",code=\"%d\"} %d\n", escapeLabelValue(key.route), key.code, m.requests[key])
+	}
+
+	fmt.Fprint(w, "# HELP potato_ingestion_duration_seconds Time taken to track a pageview.\n# TYPE potato_ingestion_duration_seconds histogram\n")
+	m.ingestion.write(w, "potato_ingestion_duration_seconds", "")
+
+	fmt.Fprint(w, "# HELP potato_db_query_duration_seconds Time taken by the stats store, by operation.\n# TYPE potato_db_query_duration_seconds histogram\n")
+	for _, operation := range slices.Sorted(maps.Keys(m.queries)) {
+		m.queries[operation].write(w, "potato_db_query_duration_seconds", "operation=\""+operation+"\",")
+	}
+
+	fmt.Fprint(w, "# HELP potato_events_dropped_total Pageviews not tracked, by reason.\n# TYPE potato_events_dropped_total counter\n")
+	for _, reason := range slices.Sorted(maps.Keys(m.dropped)) {
+		fmt.Fprintf(w, "potato_events_dropped_total{reason=\"%s\"} %d\n", reason, m.dropped[reason])
+	}
+}
+
+// statusRecorder remembers the status code and the size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	code  int
+	bytes int
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	if rec.code == 0 {
+		rec.code = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.code == 0 {
+		rec.code = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+func (rec *statusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the response being recorded, for http.ResponseController.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// instrumented counts the requests next serves by the pattern of the route
+// they matched, so that paths with ids or domains in them add up. Requests
+// matching no route, such as those with the wrong method, are counted as
+// "unmatched".
+func (s *server) instrumented(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+		pattern := r.Pattern
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+		s.metrics.countRequest(pattern, rec.code)
+	})
+}
+
+// handleInternalMetrics exposes the operational metrics, along with the
+// depth of the buffers, for Prometheus to scrape.
+func (s *server) handleInternalMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	s.metrics.write(w)
+
+	bufferedRows := 0
+	if postgres, ok := s.store.(*postgresStore); ok && postgres.buffer != nil {
+		bufferedRows = postgres.buffer.len()
+	}
+	fmt.Fprint(w, "# HELP potato_write_buffer_rows Rows waiting to be written to PostgreSQL.\n# TYPE potato_write_buffer_rows gauge\n")
+	fmt.Fprintf(w, "potato_write_buffer_rows %d\n", bufferedRows)
+	fmt.Fprint(w, "# HELP potato_notification_queue_length Goal completions waiting to be notified.\n# TYPE potato_notification_queue_length gauge\n")
+	fmt.Fprintf(w, "potato_notification_queue_length %d\n", len(s.notifications))
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The capabilities keys issued through /admin/keys are given: reading the
+// stats of their domains, tracking their pageviews on behalf of visitors, and
+// everything else API_KEY can do
+const (
+	scopeReadStats   = "read-stats"
+	scopeWriteEvents = "write-events"
+	scopeAdmin       = "admin"
+)
+
+var apiKeyScopes = []string{scopeAdmin, scopeReadStats, scopeWriteEvents}
+
+// How long a rotated key keeps working by default, for its replacement to
+// be deployed
+const apiKeyRotationGrace = 24 * time.Hour
+
+// apiKey is a key issued through /admin/keys, granting the capabilities of
+// its scopes over its domains, or over every domain when it has none, until
+// it expires. Only the hash of the key is stored, and the first characters
+// it starts with.
+type apiKey struct {
+	ID        int64      `json:"id"`
+	Name      string     `json:"name,omitempty"`
+	Prefix    string     `json:"prefix"`
+	Domains   []string   `json:"domains"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// The columns of a key, in the order of its fields
+const apiKeyColumns = `id, name, prefix, domains, scopes, created_at, expires_at`
+
+// scanAPIKey scans the columns of a key.
+func scanAPIKey(row interface{ Scan(...any) error }) (apiKey, error) {
+	var k apiKey
+	err := row.Scan(&k.ID, &k.Name, &k.Prefix, pq.Array(&k.Domains), pq.Array(&k.Scopes), &k.CreatedAt, &k.ExpiresAt)
+	return k, err
+}
+
+// hashAPIKey returns the hash a key is stored as. Keys are random tokens of
+// 192 bits, which can't be guessed from a fast hash, unlike passwords.
+func hashAPIKey(key string) string {
+	digest := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(digest[:])
+}
+
+// allows reports whether the key grants scope over domain. An admin key
+// grants every scope, as API_KEY does.
+func (k *apiKey) allows(scope string, domain string) bool {
+	if !slices.Contains(k.Scopes, scope) && !slices.Contains(k.Scopes, scopeAdmin) {
+		return false
+	}
+	return len(k.Domains) == 0 || slices.Contains(k.Domains, strings.ToLower(domain))
+}
+
+// lookupAPIKey returns the issued key of a value, or nil if it doesn't
+// exist, was revoked or expired.
+func (s *server) lookupAPIKey(value string) (*apiKey, error) {
+	if value == "" {
+		return nil, nil
+	}
+	k, err := scanAPIKey(s.db.QueryRow(`
+	SELECT `+apiKeyColumns+` FROM api_keys
+	WHERE key_hash = $1 AND (expires_at IS NULL OR expires_at > NOW())
+	`, hashAPIKey(value)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load API key: %w", err)
+	}
+	return &k, nil
+}
+
+// handleKeys lists the issued API keys (GET), issues one (POST), replying
+// with the key itself, or revokes one (DELETE). Keys are only shown when
+// they're issued.
+func (s *server) handleKeys(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := s.db.Query(`SELECT ` + apiKeyColumns + ` FROM api_keys ORDER BY id`)
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to query API keys", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+		defer rows.Close()
+
+		keys := []apiKey{}
+		for rows.Next() {
+			k, err := scanAPIKey(rows)
+			if err != nil {
+				s.logger.ErrorContext(r.Context(), "Failed to scan API key", slog.String("error", err.Error()))
+				writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+				return
+			}
+			keys = append(keys, k)
+		}
+		if err := rows.Err(); err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to query API keys", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(struct {
+			Keys []apiKey `json:"keys"`
+		}{keys})
+
+	case http.MethodPost:
+		k, ok := parseAPIKey(w, query)
+		if !ok {
+			return
+		}
+		k, key, err := issueAPIKey(s.db, k)
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to issue API key", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(struct {
+			apiKey
+			Key string `json:"key"`
+		}{k, key})
+
+	case http.MethodDelete:
+		id, err := strconv.ParseInt(query.Get("id"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid id parameter, expected the id of a key")
+			return
+		}
+
+		if _, err := s.db.Exec(`DELETE FROM api_keys WHERE id = $1`, id); err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to revoke API key", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// parseAPIKey returns the key to issue described by the query parameters,
+// reading the stats of every domain by default, replying with an error and
+// returning false when they're invalid.
+func parseAPIKey(w http.ResponseWriter, query url.Values) (apiKey, bool) {
+	k := apiKey{Name: query.Get("name"), Domains: []string{}, Scopes: []string{scopeReadStats}}
+	if value := query.Get("scopes"); value != "" {
+		k.Scopes = []string{}
+		for _, scope := range strings.Split(value, ",") {
+			scope = strings.TrimSpace(scope)
+			if !slices.Contains(apiKeyScopes, scope) {
+				writeError(w, http.StatusBadRequest, errInvalidParameter, fmt.Sprintf("Invalid scopes parameter, expected some of %s", strings.Join(apiKeyScopes, ", ")))
+				return apiKey{}, false
+			}
+			if !slices.Contains(k.Scopes, scope) {
+				k.Scopes = append(k.Scopes, scope)
+			}
+		}
+	}
+	if value := query.Get("domains"); value != "" {
+		for _, domain := range strings.Split(value, ",") {
+			if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+				k.Domains = append(k.Domains, domain)
+			}
+		}
+	}
+	if value := query.Get("expires_at"); value != "" {
+		expiresAt, err := time.Parse(time.RFC3339, value)
+		if err != nil || !expiresAt.After(time.Now()) {
+			writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid expires_at parameter, expected a future time such as 2025-01-31T00:00:00Z")
+			return apiKey{}, false
+		}
+		k.ExpiresAt = &expiresAt
+	}
+	// Administration spans every domain
+	if slices.Contains(k.Scopes, scopeAdmin) && len(k.Domains) > 0 {
+		writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid scopes parameter, admin keys can't be restricted to domains")
+		return apiKey{}, false
+	}
+	return k, true
+}
+
+// issueAPIKey stores a new key with the name, domains, scopes and expiry of
+// k, returning it along with the key itself.
+func issueAPIKey(db interface {
+	QueryRow(string, ...any) *sql.Row
+}, k apiKey) (apiKey, string, error) {
+	key, err := newToken()
+	if err != nil {
+		return apiKey{}, "", err
+	}
+	k, err = scanAPIKey(db.QueryRow(`
+	INSERT INTO api_keys (key_hash, prefix, name, domains, scopes, expires_at) VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING `+apiKeyColumns, hashAPIKey(key), key[:6], k.Name, pq.Array(k.Domains), pq.Array(k.Scopes), k.ExpiresAt))
+	if err != nil {
+		return apiKey{}, "", fmt.Errorf("failed to store API key: %w", err)
+	}
+	return k, key, nil
+}
+
+// handleRotateKey replaces a key with a new one of the same name, domains
+// and scopes. The old key keeps working for the grace period, 24h by
+// default, so that the new one can be deployed first, or stops right away
+// with a grace of 0 when it leaked.
+func (s *server) handleRotateKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Method not allowed")
+		return
+	}
+	query := r.URL.Query()
+	id, err := strconv.ParseInt(query.Get("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid id parameter, expected the id of a key")
+		return
+	}
+	grace := apiKeyRotationGrace
+	if value := query.Get("grace"); value != "" {
+		grace, err = time.ParseDuration(value)
+		if err != nil || grace < 0 {
+			writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid grace parameter, expected a duration such as 24h")
+			return
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to rotate API key", slog.String("error", err.Error()))
+		writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+		return
+	}
+	defer tx.Rollback()
+
+	// The old key expires at the end of the grace period, unless it would
+	// sooner
+	old, err := scanAPIKey(tx.QueryRow(`
+	UPDATE api_keys SET expires_at = LEAST(COALESCE(expires_at, 'infinity'), NOW() + $2 * INTERVAL '1 microsecond')
+	WHERE id = $1 AND (expires_at IS NULL OR expires_at > NOW())
+	RETURNING `+apiKeyColumns, id, grace.Microseconds()))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, errNotFound, "No active key with this id")
+		return
+	}
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to rotate API key", slog.String("error", err.Error()))
+		writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+		return
+	}
+	// The new key doesn't inherit the old one's expiry
+	replacement := old
+	replacement.ExpiresAt = nil
+	k, key, err := issueAPIKey(tx, replacement)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to rotate API key", slog.String("error", err.Error()))
+		writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		apiKey
+		Key     string `json:"key"`
+		Rotated apiKey `json:"rotated"`
+	}{k, key, old})
+}
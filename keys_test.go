@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestAPIKeyAllows(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    apiKey
+		scope  string
+		domain string
+		want   bool
+	}{
+		{"read-stats key reading", apiKey{Scopes: []string{scopeReadStats}}, scopeReadStats, "example.com", true},
+		{"read-stats key tracking", apiKey{Scopes: []string{scopeReadStats}}, scopeWriteEvents, "example.com", false},
+		{"read-stats key administering", apiKey{Scopes: []string{scopeReadStats}}, scopeAdmin, "", false},
+		{"admin key reading", apiKey{Scopes: []string{scopeAdmin}}, scopeReadStats, "example.com", true},
+		{"admin key tracking", apiKey{Scopes: []string{scopeAdmin}}, scopeWriteEvents, "example.com", true},
+		{"key of its domain", apiKey{Domains: []string{"example.com"}, Scopes: []string{scopeReadStats}}, scopeReadStats, "Example.com", true},
+		{"key of another domain", apiKey{Domains: []string{"example.com"}, Scopes: []string{scopeReadStats}}, scopeReadStats, "other.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.key.allows(tt.scope, tt.domain); got != tt.want {
+				t.Errorf("allows(%q, %q) = %v, want %v", tt.scope, tt.domain, got, tt.want)
+			}
+		})
+	}
+}
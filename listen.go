@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The limits of the HTTP servers, so that slow or idle clients can't hold
+// connections forever. Streaming responses lift their write deadline.
+const (
+	serverReadHeaderTimeout = 10 * time.Second
+	serverReadTimeout       = 30 * time.Second
+	serverWriteTimeout      = time.Minute
+	serverIdleTimeout       = 2 * time.Minute
+	serverMaxHeaderBytes    = 64 << 10
+)
+
+// newHTTPServer returns the HTTP server of handler, logging its errors with
+// the server's logger.
+func (s *server) newHTTPServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: serverReadHeaderTimeout,
+		ReadTimeout:       serverReadTimeout,
+		WriteTimeout:      serverWriteTimeout,
+		IdleTimeout:       serverIdleTimeout,
+		MaxHeaderBytes:    serverMaxHeaderBytes,
+		ErrorLog:          slog.NewLogLogger(s.logger.Handler(), slog.LevelWarn),
+	}
+}
+
+// serve serves srv on addr, a TCP address such as ":8080", a unix socket
+// path prefixed with "unix:", such as "unix:/run/potato/api.sock", or a
+// socket passed by systemd, such as "systemd:api". TCP sockets are served
+// over HTTPS when srv has a TLS configuration. It only returns on failure,
+// or with http.ErrServerClosed once srv is shut down.
+func (s *server) serve(srv *http.Server, name string, addr string) error {
+	listener, err := s.listen(addr)
+	if err != nil {
+		return err
+	}
+
+	if srv.TLSConfig != nil && listener.Addr().Network() == "tcp" {
+		s.logger.Info("Starting "+name, slog.String("address", addr), slog.Bool("tls", true))
+		return srv.ServeTLS(listener, "", "")
+	}
+	s.logger.Info("Starting "+name, slog.String("address", addr))
+	return srv.Serve(listener)
+}
+
+// listen returns the listener of an address serve accepts.
+func (s *server) listen(addr string) (net.Listener, error) {
+	if name, ok := strings.CutPrefix(addr, "systemd:"); ok {
+		return systemdListener(name)
+	}
+
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	// A socket left behind by a previous run would prevent listening
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// The proxy in front usually runs as another user, which needs write
+	// access to connect
+	if s.cfg.UnixSocketMode != 0 {
+		if err := os.Chmod(path, s.cfg.UnixSocketMode); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+// The first file descriptor systemd passes sockets from, after the
+// standard input, output and error
+const systemdFirstFD = 3
+
+// systemdSocket is a socket passed by systemd's socket activation.
+type systemdSocket struct {
+	// Its FileDescriptorName, the name of its socket unit by default
+	name string
+	file *os.File
+	// Whether a server listens on it already
+	used bool
+}
+
+// systemdSockets returns the sockets passed by systemd, found once as the
+// descriptors can only be taken over once.
+var systemdSockets = sync.OnceValue(func() []*systemdSocket {
+	var sockets []*systemdSocket
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := range systemdSocketCount() {
+		socket := &systemdSocket{file: os.NewFile(uintptr(systemdFirstFD+i), "systemd:"+strconv.Itoa(i))}
+		if i < len(names) {
+			socket.name = names[i]
+		}
+		sockets = append(sockets, socket)
+	}
+	return sockets
+})
+
+// Held while taking a socket passed by systemd
+var systemdSocketsMu sync.Mutex
+
+// systemdSocketCount returns how many sockets systemd passed to the
+// process, as LISTEN_FDS for the process of LISTEN_PID.
+func systemdSocketCount() int {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return 0
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// systemdListener returns the listener of the first socket passed by
+// systemd that isn't served yet and is named name, or is at that position
+// when name is a number, counting from 0. Several sockets of the same name
+// are listened on by listing the address as many times.
+func systemdListener(name string) (net.Listener, error) {
+	systemdSocketsMu.Lock()
+	defer systemdSocketsMu.Unlock()
+
+	for i, socket := range systemdSockets() {
+		if socket.used || socket.name != name && strconv.Itoa(i) != name {
+			continue
+		}
+		listener, err := net.FileListener(socket.file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on systemd socket %s: %w", name, err)
+		}
+		// The listener has a copy of the descriptor
+		socket.file.Close()
+		socket.used = true
+		return listener, nil
+	}
+	return nil, fmt.Errorf("no unused socket named %s was passed by systemd", name)
+}
+
+// liftWriteDeadline lets a streaming response run past the servers' write
+// timeout.
+func liftWriteDeadline(w http.ResponseWriter) {
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ua-parser/uap-go/uaparser"
+)
+
+// combinedLogLine matches a line of the combined log format nginx and Apache
+// write by default: the client's address, the time, the request, the status,
+// the referrer and the User-Agent.
+var combinedLogLine = regexp.MustCompile(`^(\S+) \S+ \S+ \[([^\]]+)\] "(\S+) (\S+)[^"]*" (\d{3}) \S+ "([^"]*)" "([^"]*)"`)
+
+const combinedLogTime = "02/Jan/2006:15:04:05 -0700"
+
+// How many pageviews are buffered before being written during an import
+const logImportBatchSize = 100000
+
+// pageExtensions are the extensions of the paths counted as pages, those
+// without one aside. Requests for anything else are for assets.
+var pageExtensions = map[string]bool{"": true, ".html": true, ".htm": true, ".php": true}
+
+// importLogs backfills a domain's stats from its server's access logs in the
+// combined format, gzipped or not, for the days before the tracking script
+// was installed. Requests are counted as pageviews like those tracked live:
+// bots and excluded addresses are ignored, paths are rewritten and visitors
+// are identified by their address as the domain's privacy profile says, the
+// salts of past days being made up for the import. Only successful GET
+// requests for pages are counted, and neither countries nor visitor types
+// are, as logs don't tell them. Each batch is written in a transaction that
+// counts the rows of months already rolled up in their monthly rows too.
+func importLogs(cfg Config, db *sql.DB, logger *slog.Logger, sketches sketchFormat, domain string, paths []string) error {
+	parser, err := uaparser.NewFromBytes([]byte(userAgentRegexp))
+	if err != nil {
+		return fmt.Errorf("failed to load User-Agent parser: %w", err)
+	}
+	rewrites, err := newRewriter(cfg.RewriteRulesFile)
+	if err != nil {
+		return fmt.Errorf("failed to load rewrite rules: %w", err)
+	}
+	s := &server{cfg: cfg, db: db, logger: logger, parser: parser, sketches: sketches, salts: newSaltStore(nil), rewrites: rewrites}
+	st := newPostgresStore(db, logger, sketches)
+	st.buffer = newWriteBuffer()
+
+	// Parsing User-Agents is slow, and logs hold the same ones over and over
+	nonHuman := map[string]bool{}
+	buffered := 0
+	for _, path := range paths {
+		var imported, skipped int
+		err := readLogLines(path, func(line string) error {
+			pv, ua, ok := s.logPageview(domain, line)
+			if !ok {
+				skipped++
+				return nil
+			}
+			bot, seen := nonHuman[ua]
+			if !seen {
+				bot = s.nonHuman(ua)
+				nonHuman[ua] = bot
+			}
+			if bot {
+				skipped++
+				return nil
+			}
+
+			for _, row := range pv.countedRows() {
+				st.buffer.add(row, pv.visitor)
+			}
+			imported++
+			if buffered++; buffered == logImportBatchSize {
+				buffered = 0
+				return st.flush()
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		logger.Info("Imported access log", slog.String("file", path), slog.Int("pageviews", imported), slog.Int("skipped", skipped))
+	}
+	return st.flush()
+}
+
+// readLogLines calls fn with each line of a log file.
+func readLogLines(path string, fn func(line string) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if err := fn(scanner.Text()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// logPageview returns the pageview of a line of an access log of domain with
+// the User-Agent it was requested by, or false when it isn't one to count.
+func (s *server) logPageview(domain string, line string) (pageview, string, bool) {
+	match := combinedLogLine.FindStringSubmatch(line)
+	if match == nil {
+		return pageview{}, "", false
+	}
+	visitorIP, method, target, referer, ua := match[1], match[3], match[4], match[6], match[7]
+
+	status, _ := strconv.Atoi(match[5])
+	if method != "GET" || (status/100 != 2 && status != 304) {
+		return pageview{}, "", false
+	}
+	t, err := time.Parse(combinedLogTime, match[2])
+	if err != nil {
+		return pageview{}, "", false
+	}
+	requested, err := url.ParseRequestURI(target)
+	if err != nil || !pageExtensions[strings.ToLower(path.Ext(requested.Path))] {
+		return pageview{}, "", false
+	}
+	if addr, err := netip.ParseAddr(hostOnly(visitorIP)); err == nil && s.config().excluded(addr) {
+		return pageview{}, "", false
+	}
+
+	pagePath := requested.Path
+	if rewritten, rule := s.rewrites.rewrite(domain, pagePath); rule >= 0 {
+		pagePath = rewritten
+	}
+
+	day := dayIn(t, s.siteLocation(domain))
+	visitor, err := s.visitorID(domain, visitorIP, day)
+	if err != nil {
+		return pageview{}, "", false
+	}
+
+	// Logs write a missing referrer as "-"
+	if referer == "-" {
+		referer = ""
+	}
+	pv := pageview{
+		domain:      domain,
+		path:        pagePath,
+		day:         day,
+		visitor:     visitor,
+		environment: s.config().environment(domain),
+	}
+	pv.referrer, pv.referrerPath = referrerOf(referer, domain)
+	return pv, ua, true
+}
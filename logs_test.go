@@ -0,0 +1,45 @@
+package main
+
+import (
+	"database/sql/driver"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestImportLogsIntoRolledUpMonth(t *testing.T) {
+	db, rec := newRecordingDB(t, "pages 2024-01-01")
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	lines := `203.0.113.1 - - [15/Jan/2024:10:00:00 +0000] "GET /pricing HTTP/1.1" 200 512 "-" "Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0"
+203.0.113.2 - - [15/Jan/2024:11:00:00 +0000] "GET /pricing HTTP/1.1" 200 512 "-" "Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0"
+203.0.113.1 - - [10/Feb/2024:10:00:00 +0000] "GET /pricing HTTP/1.1" 200 512 "-" "Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0"
+`
+	if err := os.WriteFile(path, []byte(lines), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, _, err := loadConfig(nil)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err := importLogs(cfg, db, logger, sketchFormat{}, "example.com", []string{path}); err != nil {
+		t.Fatalf("importLogs: %v", err)
+	}
+
+	statements := rec.recorded()
+	monthly := transactionUpserts(t, statements, "pages_monthly")
+	upserts := monthly["2024-01-01"]
+	if len(upserts) != 1 || len(monthly) != 1 {
+		t.Fatalf("the import upserted the monthly rows of %v, want the one of the rolled up 2024-01 only", monthly)
+	}
+	if !slices.Contains(upserts[0], driver.Value(int64(2))) {
+		t.Errorf("the monthly row of 2024-01 was upserted with %v, want its 2 imported pageviews", upserts[0])
+	}
+	if monthly := transactionUpserts(t, statements, "sources_monthly"); len(monthly) != 0 {
+		t.Errorf("the import upserted the sources_monthly rows of %v, whose months aren't rolled up", monthly)
+	}
+}
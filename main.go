@@ -1,16 +1,21 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"log/slog"
+	"net"
 	"net/http"
-	"net/url"
 	"os"
-	"strings"
+	"os/signal"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	_ "embed"
@@ -21,13 +26,6 @@ import (
 	"github.com/ua-parser/uap-go/uaparser"
 )
 
-var (
-	hostDomain  string
-	apiKey      string
-	environment string
-	logLevel    string
-)
-
 //go:embed tracking.js
 var trackingJS string
 
@@ -37,526 +35,486 @@ var userAgentRegexp string
 //go:embed index.html
 var indexHTML string
 
-func main() {
-	// Set up structured logging using slog
-	var level slog.Level
-	if environment == "production" {
-		level = slog.LevelInfo
-	} else {
-		level = slog.LevelDebug
-	}
-
-	// If LOG_LEVEL is set, use it to override the default level
-	if logLevel != "" {
-		switch logLevel {
-		case "debug":
-			level = slog.LevelDebug
-		case "info":
-			level = slog.LevelInfo
-		case "warn":
-			level = slog.LevelWarn
-		case "error":
-			level = slog.LevelError
-		}
-	}
+// server holds everything the handlers need. Nothing is read from global
+// state so several servers can run side by side.
+type server struct {
+	cfg    Config
+	db     *sql.DB
+	store  statsStore
+	logger *slog.Logger
+	parser *uaparser.Parser
 
-	logger := slog.New(slog.NewTextHandler(log.Writer(), &slog.HandlerOptions{Level: level}))
+	// How the visitor sketches are stored, detected at startup
+	sketches sketchFormat
 
-	// Establish a connection to the PostgreSQL database
-	db, err := sql.Open("postgres", getConnStr())
-	if err != nil {
-		log.Fatalf("Failed to connect to the database: %v", err)
-	}
-	defer db.Close()
+	realtime  *realtimeTracker
+	stream    *eventStream
+	salts     *saltStore
+	returning *returningStore
+	rewrites  *rewriter
+	memory    *memoryBudget
+	cache     *statsCache
 
-	// Ensure the database connection is working
-	err = db.Ping()
-	if err != nil {
-		log.Fatalf("Failed to ping the database: %v", err)
-	}
+	// The settings of the sites set through /admin/sites
+	siteSettings *siteSettingsStore
 
-	// Create the HLL extension if it doesn't exist
-	_, err = db.Exec(`CREATE EXTENSION IF NOT EXISTS hll`)
-	if err != nil {
-		log.Fatalf("Failed to create hll extension: %v", err)
-	}
-
-	// Merge all table creation statements
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS pages (
-			domain TEXT NOT NULL,
-			path TEXT NOT NULL,
-			day DATE NOT NULL,
-			visitor_hll hll NOT NULL,
-			UNIQUE (domain, day, path)
-		);
-		CREATE INDEX IF NOT EXISTS pages_day_idx ON pages (day DESC);
-
-		CREATE TABLE IF NOT EXISTS countries (
-			domain TEXT NOT NULL,
-			country TEXT NOT NULL,
-			day DATE NOT NULL,
-			visitor_hll hll NOT NULL,
-			UNIQUE (domain, day, country)
-		);
-		CREATE INDEX IF NOT EXISTS countries_day_idx ON countries (day DESC);
-
-		CREATE TABLE IF NOT EXISTS sources (
-			domain TEXT NOT NULL,
-			referrer TEXT NOT NULL,
-			day DATE NOT NULL,
-			visitor_hll hll NOT NULL,
-			UNIQUE (domain, day, referrer)
-		);
-		CREATE INDEX IF NOT EXISTS sources_day_idx ON sources (day DESC);`)
-	if err != nil {
-		log.Fatalf("Failed to create tables: %v", err)
-	}
+	// Goal completions waiting to be sent to their sites' channels
+	notifications chan notification
 
-	// Load the User-Agent parser
-	parser, err := uaparser.NewFromBytes([]byte(userAgentRegexp))
-	if err != nil {
-		log.Fatalf("Failed to load User-Agent parser: %v", err)
-	}
+	// Limits the tracking requests of each client, nil when they aren't
+	limiter rateLimiter
 
-	http.HandleFunc("/track", func(w http.ResponseWriter, r *http.Request) {
-		visitedURL := r.FormValue("url")
-		if visitedURL == "" {
-			logger.Warn("Missing 'url' parameter in request", slog.String("remote_addr", r.RemoteAddr))
-			http.Error(w, "Missing 'url' parameter", http.StatusBadRequest)
-			return
-		}
+	metrics *serverMetrics
+	tracer  *tracer
 
-		ua := r.Header.Get("User-Agent")
-		client := parser.Parse(ua)
-		if client.Device.Family == "Spider" || client.UserAgent.Family == "Bot" {
-			logger.Debug("Ignored non-human pageview", slog.String("url", visitedURL), slog.String("user_agent", ua), slog.String("remote_addr", r.RemoteAddr))
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+	// Reports the errors logged and the panics, nil when they aren't
+	reporter *errorReporter
 
-		day := time.Now().UTC().Truncate(24 * time.Hour)
+	// Validates the JWTs of OIDC_ISSUER, nil when they aren't accepted
+	oidc *oidcVerifier
 
-		visitorIP := r.Header.Get("CF-Connecting-IP")
-		if visitorIP == "" {
-			visitorIP = r.RemoteAddr
-		}
+	// The certificate HTTPS is served with, nil when it isn't
+	certificates *certificateStore
 
-		// Parse the URL to extract domain and path
-		parsedURL, err := url.Parse(visitedURL)
-		if err != nil {
-			logger.Error("Failed to parse URL", slog.String("url", visitedURL), slog.String("error", err.Error()))
-			http.Error(w, "Invalid URL", http.StatusBadRequest)
-			return
-		}
+	// Warns once about a CF-Connecting-IP header sent by an untrusted address
+	untrustedProxy sync.Once
 
-		path := parsedURL.Path
-		if path == "" {
-			path = "/"
-		}
+	// The configuration with the settings reloaded since startup, nil until
+	// they are, and the level logs are written at
+	live     atomic.Pointer[Config]
+	logLevel *slog.LevelVar
 
-		err = trackPageView(db, parsedURL.Host, path, day, visitorIP)
-		if err != nil {
-			logger.Error("Failed to track pageview", slog.String("url", visitedURL), slog.String("visitor_ip", visitorIP), slog.String("error", err.Error()))
-			http.Error(w, fmt.Sprintf("Failed to track pageview: %v", err), http.StatusInternalServerError)
-			return
-		}
+	// Serializes the reloads of the configuration
+	reloading sync.Mutex
+}
 
-		country := r.Header.Get("CF-IPCountry")
-		if country != "" {
-			err = trackCountryView(db, parsedURL.Host, country, day, visitorIP)
-			if err != nil {
-				logger.Error("Failed to track country view", slog.String("error", err.Error()))
-			}
-		}
+func main() {
+	cfg, args, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
 
-		referrer := r.Header.Get("Referer")
-		if referrer == "" {
-			referrer = "Direct / None"
-		} else {
-			// Parse referrer to get domain only
-			if refURL, err := url.Parse(referrer); err == nil {
-				referrer = refURL.Host
-			}
-		}
+	// Set up structured logging using slog, which the fatal errors below go
+	// through too. The level can be changed by reloading the configuration.
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(cfg.logLevel())
+	var handler slog.Handler = cfg.logHandler(log.Writer(), logLevel)
+	// The errors logged are reported, if SENTRY_DSN or ERROR_WEBHOOK_URL is
+	// set
+	reporter := newErrorReporter(cfg)
+	if reporter != nil {
+		handler = &reportingHandler{Handler: handler, reporter: reporter}
+	}
+	logger := slog.New(handler)
+	if reporter != nil {
+		reporter.logger = logger
+	}
+	slog.SetDefault(logger)
+	b := currentBuild()
+	logger.Info("Potato Analytics", slog.String("version", b.Version), slog.String("commit", b.Commit), slog.String("build_date", b.BuildDate), slog.String("go_version", b.GoVersion))
+
+	// Let the garbage collector work harder as the limit gets closer, and keep
+	// the in-memory subsystems to their share of it
+	if cfg.MemoryLimit > 0 {
+		debug.SetMemoryLimit(cfg.MemoryLimit)
+	}
+	memory := newMemoryBudget(int64(float64(cfg.MemoryLimit) * memoryBudgetShare))
 
-		// If the referrer is the same as the domain, set it to "Direct / None"
-		if referrer == parsedURL.Host {
-			referrer = "Direct / None"
-		}
+	// Establish a connection to the PostgreSQL database
+	db, err := openDatabase(cfg, cfg.DatabaseURL)
+	if err != nil {
+		log.Fatalf("Failed to connect to the database: %v", err)
+	}
+	defer db.Close()
 
-		err = trackSourceView(db, parsedURL.Host, referrer, day, visitorIP)
+	// Create the HLL extension if it doesn't exist, or fall back to sketches
+	// computed by Potato when it isn't available
+	var sketches sketchFormat
+	sketches.goHLL, err = detectHLL(db, logger)
+	if err != nil {
+		log.Fatalf("Failed to set up HLL: %v", err)
+	}
+	if !sketches.goHLL {
+		sketches.params, err = loadHLLParams(db, logger, cfg.HLLParams)
 		if err != nil {
-			logger.Error("Failed to track source view", slog.String("error", err.Error()))
-		}
-
-		logger.Debug("Pageview tracked", slog.String("url", visitedURL), slog.String("visitor_ip", visitorIP), slog.String("user_agent", ua))
-
-		if r.URL.Query().Get("url") != "" {
-			w.Header().Set("Cache-Control", "public, max-age=3600, s-maxage=3600, must-revalidate")
-		}
-		w.WriteHeader(http.StatusOK)
-	})
-
-	http.HandleFunc("/stats/pages", requireAPIKey(func(w http.ResponseWriter, r *http.Request) {
-		domain := r.URL.Query().Get("domain")
-		if domain == "" {
-			http.Error(w, "Missing domain parameter", http.StatusBadRequest)
-			return
+			log.Fatalf("Failed to set up HLL: %v", err)
 		}
+	}
 
-		// Get stats for the last 30 days by default
-		endTime := time.Now().UTC().Truncate(24 * time.Hour)
-		startTime := endTime.Add(-30 * 24 * time.Hour)
-
-		// Check if domain-level stats are requested
-		aggregate := r.URL.Query().Get("aggregate") == "true"
+	// Bring the schema up to date, or to the version asked for
+	if err := migrate(db, logger, sketches, cfg.MigrateTo); err != nil {
+		log.Fatalf("Failed to migrate the database: %v", err)
+	}
+	if cfg.MigrateTo >= 0 {
+		logger.Info("Migrated the database", slog.Int("version", cfg.MigrateTo))
+		return
+	}
 
-		type PageStat struct {
-			Path     string    `json:"path,omitempty"`
-			Day      time.Time `json:"day"`
-			Visitors int       `json:"visitors"`
+	// TimescaleDB partitions the daily tables instead of the server once
+	// they're hypertables
+	if cfg.TimescaleDB {
+		if err := setUpTimescale(db, logger, cfg.TimescaleCompressDays); err != nil {
+			log.Fatalf("Failed to set up TimescaleDB: %v", err)
 		}
+	}
+	timescale, err := detectHypertables(db)
+	if err != nil {
+		log.Fatalf("Failed to set up TimescaleDB: %v", err)
+	}
 
-		var query string
-		if aggregate {
-			query = `
-			SELECT day, #(hll_union_agg(visitor_hll)) as visitors
-			FROM pages
-			WHERE domain = $1 AND day >= $2 AND day <= $3
-			GROUP BY day
-				ORDER BY day DESC
-			`
-		} else {
-			query = `
-			SELECT path, day, hll_cardinality(visitor_hll) as visitors
-			FROM pages
-			WHERE domain = $1 AND day >= $2 AND day <= $3
-			ORDER BY day DESC, visitors DESC
-			`
+	// Backups and imports are run by commands, which exit once done
+	if len(args) > 0 {
+		if err := runCommand(cfg, db, logger, sketches, args); err != nil {
+			log.Fatalf("Failed to run %s: %v", args[0], err)
 		}
+		return
+	}
 
-		rows, err := db.Query(query, domain, startTime, endTime)
+	// The stats are stored in PostgreSQL along with everything else, unless
+	// ClickHouse is set up for them
+	var store statsStore
+	if cfg.ClickHouseURL != "" {
+		clickHouse, err := newClickHouseStore(cfg.ClickHouseURL)
 		if err != nil {
-			logger.Error("Failed to query stats", slog.String("error", err.Error()))
-			http.Error(w, "Failed to fetch stats", http.StatusInternalServerError)
-			return
+			log.Fatalf("Failed to connect to ClickHouse: %v", err)
 		}
-		defer rows.Close()
-
-		var stats []PageStat
-		for rows.Next() {
-			var stat PageStat
-			var err error
-			if aggregate {
-				err = rows.Scan(&stat.Day, &stat.Visitors)
-			} else {
-				err = rows.Scan(&stat.Path, &stat.Day, &stat.Visitors)
-			}
+		if err := clickHouse.createSchema(); err != nil {
+			log.Fatalf("Failed to set up ClickHouse: %v", err)
+		}
+		store = clickHouse
+	} else {
+		postgres := newPostgresStore(db, logger, sketches)
+		if cfg.ReadDatabaseURL != "" {
+			replica, err := openDatabase(cfg, cfg.ReadDatabaseURL)
 			if err != nil {
-				logger.Error("Failed to scan stats", slog.String("error", err.Error()))
-				http.Error(w, "Failed to fetch stats", http.StatusInternalServerError)
-				return
+				log.Fatalf("Failed to connect to the read replica: %v", err)
 			}
-			stats = append(stats, stat)
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(stats)
-	}))
-
-	http.HandleFunc("/stats/sources", requireAPIKey(func(w http.ResponseWriter, r *http.Request) {
-		domain := r.URL.Query().Get("domain")
-		if domain == "" {
-			http.Error(w, "Missing domain parameter", http.StatusBadRequest)
-			return
+			defer replica.Close()
+			postgres.replica = replica
 		}
-
-		endTime := time.Now().UTC().Truncate(24 * time.Hour)
-		startTime := endTime.Add(-30 * 24 * time.Hour)
-
-		type SourceStat struct {
-			Referrer string    `json:"referrer"`
-			Day      time.Time `json:"day"`
-			Visitors int       `json:"visitors"`
+		if cfg.WriteBufferInterval > 0 {
+			postgres.buffer = newWriteBuffer()
+			go postgres.flushEvery(cfg.WriteBufferInterval)
 		}
+		store = postgres
+	}
 
-		query := `
-		SELECT referrer, day, hll_cardinality(visitor_hll) as visitors
-		FROM sources
-		WHERE domain = $1 AND day >= $2 AND day <= $3
-		ORDER BY day DESC, visitors DESC
-		`
-
-		rows, err := db.Query(query, domain, startTime, endTime)
-		if err != nil {
-			logger.Error("Failed to query stats", slog.String("error", err.Error()))
-			http.Error(w, "Failed to fetch stats", http.StatusInternalServerError)
-			return
-		}
-		defer rows.Close()
-
-		var stats []SourceStat
-		for rows.Next() {
-			var stat SourceStat
-			if err := rows.Scan(&stat.Referrer, &stat.Day, &stat.Visitors); err != nil {
-				logger.Error("Failed to scan stats", slog.String("error", err.Error()))
-				http.Error(w, "Failed to fetch stats", http.StatusInternalServerError)
-				return
-			}
-			stats = append(stats, stat)
-		}
+	// Load the User-Agent parser
+	parser, err := uaparser.NewFromBytes([]byte(userAgentRegexp))
+	if err != nil {
+		log.Fatalf("Failed to load User-Agent parser: %v", err)
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(stats)
-	}))
+	rewrites, err := newRewriter(cfg.RewriteRulesFile)
+	if err != nil {
+		log.Fatalf("Failed to load rewrite rules: %v", err)
+	}
 
-	http.HandleFunc("/stats/countries", requireAPIKey(func(w http.ResponseWriter, r *http.Request) {
-		domain := r.URL.Query().Get("domain")
-		if domain == "" {
-			http.Error(w, "Missing domain parameter", http.StatusBadRequest)
-			return
-		}
+	certificates, err := newCertificateStore(cfg, logger)
+	if err != nil {
+		log.Fatalf("Failed to set up TLS: %v", err)
+	}
 
-		endTime := time.Now().UTC().Truncate(24 * time.Hour)
-		startTime := endTime.Add(-30 * 24 * time.Hour)
+	s := &server{
+		cfg:    cfg,
+		db:     db,
+		store:  store,
+		logger: logger,
+		parser: parser,
+
+		sketches: sketches,
+
+		realtime:  newRealtimeTracker(),
+		stream:    newEventStream(),
+		salts:     newSaltStore(db),
+		returning: newReturningStore(db),
+		rewrites:  rewrites,
+		memory:    memory,
+		cache:     newStatsCache(cfg.StatsCacheTTL),
+
+		siteSettings: newSiteSettingsStore(db),
+
+		notifications: make(chan notification, notificationQueueSize),
+		limiter:       newRateLimiter(cfg),
+		metrics:       newServerMetrics(),
+		tracer:        newTracer(cfg, logger),
+		reporter:      reporter,
+		oidc:          newOIDCVerifier(cfg),
+		certificates:  certificates,
+		logLevel:      logLevel,
+	}
+	if err := s.siteSettings.reload(); err != nil {
+		log.Fatalf("Failed to load site settings: %v", err)
+	}
+	s.memory.register("realtime", priorityRealtime, s.realtime)
+	s.memory.register("stats cache", priorityCache, s.cache)
+	if limiter, ok := s.limiter.(*memoryRateLimiter); ok {
+		s.memory.register("rate limits", priorityRateLimits, limiter)
+		go limiter.pruneEvery(time.Minute)
+	}
 
-		type CountryStat struct {
-			Country  string    `json:"country"`
-			Day      time.Time `json:"day"`
-			Visitors int       `json:"visitors"`
+	go s.realtime.pruneEvery(time.Minute)
+	go s.memory.enforceEvery(time.Second)
+	go s.cache.pruneEvery(time.Minute)
+	go s.pruneExpiredStatsEvery(24 * time.Hour)
+	if cfg.ClickHouseURL == "" {
+		if !timescale {
+			go s.createPartitionsEvery(24 * time.Hour)
 		}
+		go s.rollUpEvery(24 * time.Hour)
+	}
+	if cfg.MaintenanceInterval > 0 {
+		go s.maintainEvery(cfg.MaintenanceInterval)
+	}
+	if cfg.PushgatewayURL != "" || cfg.RemoteWriteURL != "" {
+		go s.pushDailyTotalsEvery(time.Minute)
+	}
+	go s.sendReportsEvery(time.Hour)
+	go s.deliverNotifications()
+	if cfg.RawEventsDays >= alertMinEventsDays {
+		go s.evaluateAlertsEvery(5 * time.Minute)
+	}
+	if cfg.RawEventsDays >= accuracyMinEventsDays && cfg.ClickHouseURL == "" {
+		go s.checkAccuracyEvery(24 * time.Hour)
+	}
+	if cfg.RewriteRulesFile != "" {
+		go s.rewrites.reloadEvery(10*time.Second, logger)
+	}
+	go s.siteSettings.reloadEvery(time.Minute, logger)
+	if s.tracer != nil {
+		go s.tracer.exportEvery(spanExportInterval)
+	}
+	if s.reporter != nil {
+		go s.reporter.sendEvery(errorSendInterval)
+	}
+	if cfg.TLSAutocert {
+		go s.renewCertificatesEvery(12 * time.Hour)
+	}
 
-		query := `
-		SELECT country, day, hll_cardinality(visitor_hll) as visitors
-		FROM countries
-		WHERE domain = $1 AND day >= $2 AND day <= $3
-		ORDER BY day DESC, visitors DESC
-		`
-
-		rows, err := db.Query(query, domain, startTime, endTime)
-		if err != nil {
-			logger.Error("Failed to query stats", slog.String("error", err.Error()))
-			http.Error(w, "Failed to fetch stats", http.StatusInternalServerError)
-			return
-		}
-		defer rows.Close()
-
-		var stats []CountryStat
-		for rows.Next() {
-			var stat CountryStat
-			if err := rows.Scan(&stat.Country, &stat.Day, &stat.Visitors); err != nil {
-				logger.Error("Failed to scan stats", slog.String("error", err.Error()))
-				http.Error(w, "Failed to fetch stats", http.StatusInternalServerError)
-				return
+	go s.reloadOnHangup()
+
+	stopped, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var servers []*http.Server
+	failed := make(chan error, len(cfg.ListenAddrs)+len(cfg.IngestAddrs)+1)
+	listen := func(name string, addr string, handler http.Handler) {
+		srv := s.newHTTPServer(handler)
+		if s.certificates != nil {
+			srv.TLSConfig = s.certificates.tlsConfig()
+		}
+		// Realtime streams never end by themselves, so they're closed for
+		// the shutdown not to wait for them
+		srv.RegisterOnShutdown(s.stream.close)
+		servers = append(servers, srv)
+		go func() {
+			if err := s.serve(srv, name, addr); !errors.Is(err, http.ErrServerClosed) {
+				failed <- fmt.Errorf("failed to serve the %s: %w", name, err)
 			}
-			stats = append(stats, stat)
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(stats)
-	}))
-
-	http.HandleFunc("/stats/page", requireAPIKey(func(w http.ResponseWriter, r *http.Request) {
-		domain := r.URL.Query().Get("domain")
-		if domain == "" {
-			http.Error(w, "Missing domain parameter", http.StatusBadRequest)
-			return
-		}
-
-		path := r.URL.Query().Get("path")
-		if path == "" {
-			http.Error(w, "Missing path parameter", http.StatusBadRequest)
-			return
+		}()
+	}
+	if len(cfg.IngestAddrs) == 0 {
+		handler := s.routes(true, true)
+		for _, addr := range cfg.ListenAddrs {
+			listen("server", addr, handler)
 		}
-
-		// Get stats for the last 30 days by default
-		endTime := time.Now().UTC().Truncate(24 * time.Hour)
-		startTime := endTime.Add(-30 * 24 * time.Hour)
-
-		type PageStat struct {
-			Day      time.Time `json:"day"`
-			Visitors int       `json:"visitors"`
+	} else {
+		ingestion, api := s.routes(true, false), s.routes(false, true)
+		for _, addr := range cfg.IngestAddrs {
+			listen("ingestion server", addr, ingestion)
 		}
-
-		query := `
-		SELECT day, hll_cardinality(visitor_hll) as visitors
-		FROM pages
-		WHERE domain = $1 AND path = $2 AND day >= $3 AND day <= $4
-		ORDER BY day DESC
-		`
-
-		rows, err := db.Query(query, domain, path, startTime, endTime)
-		if err != nil {
-			logger.Error("Failed to query stats", slog.String("error", err.Error()))
-			http.Error(w, "Failed to fetch stats", http.StatusInternalServerError)
-			return
+		for _, addr := range cfg.ListenAddrs {
+			listen("API server", addr, api)
 		}
-		defer rows.Close()
-
-		var stats []PageStat
-		for rows.Next() {
-			var stat PageStat
-			if err := rows.Scan(&stat.Day, &stat.Visitors); err != nil {
-				logger.Error("Failed to scan stats", slog.String("error", err.Error()))
-				http.Error(w, "Failed to fetch stats", http.StatusInternalServerError)
-				return
+	}
+	if cfg.RedirectAddr != "" {
+		srv := s.newHTTPServer(s.redirectRoutes())
+		servers = append(servers, srv)
+		go func() {
+			if err := s.serve(srv, "redirect server", cfg.RedirectAddr); !errors.Is(err, http.ErrServerClosed) {
+				failed <- fmt.Errorf("failed to serve the redirect server: %w", err)
 			}
-			stats = append(stats, stat)
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(stats)
-	}))
-
-	http.HandleFunc("/analytics.js", func(w http.ResponseWriter, r *http.Request) {
-		var url string
-		switch hostDomain {
-		case "":
-			logger.Error("HOST_DOMAIN is not set")
-			http.Error(w, "HOST_DOMAIN is not set", http.StatusInternalServerError)
-			return
-		case "localhost":
-			url = "http://localhost:8080/track"
-		default:
-			url = "https://" + hostDomain + "/track"
-		}
+		}()
+	}
 
-		script, err := jsMinifier.String("text/javascript", fmt.Sprintf(trackingJS, url))
-		if err != nil {
-			logger.Error("Failed to minify tracking.js", slog.String("error", err.Error()))
-			http.Error(w, "Failed to minify tracking.js", http.StatusInternalServerError)
-			return
-		}
+	select {
+	case err := <-failed:
+		log.Fatal(err)
+	case <-stopped.Done():
+	}
+	s.shutdown(servers)
+}
 
-		w.Header().Set("Content-Type", "application/javascript")
-		w.Header().Set("Cache-Control", "public, max-age=86400") // Cache for 24 hours
-		w.Write([]byte(script))
-	})
+// shutdown stops the servers once their in-flight requests are done, or
+// after SHUTDOWN_TIMEOUT, then writes the pageviews still buffered and
+// exports the last spans and errors.
+func (s *server) shutdown(servers []*http.Server) {
+	s.logger.Info("Shutting down", slog.Duration("timeout", s.cfg.ShutdownTimeout))
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				s.logger.Error("Failed to shut down gracefully", slog.String("error", err.Error()))
+				srv.Close()
+			}
+		}()
+	}
+	wg.Wait()
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path != "/" {
-			http.NotFound(w, r)
-			return
+	if postgres, ok := s.store.(*postgresStore); ok && postgres.buffer != nil {
+		if err := postgres.flush(); err != nil {
+			s.logger.Error("Failed to flush buffered pageviews", slog.String("error", err.Error()))
 		}
-
-		w.Header().Set("Content-Type", "text/html")
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintln(w, indexHTML)
-	})
-
-	logger.Info("Starting server", slog.String("address", ":8080"))
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	}
+	if err := s.tracer.export(); err != nil {
+		s.logger.Error("Failed to export traces", slog.String("error", err.Error()))
+	}
+	if err := s.reporter.send(); err != nil {
+		s.logger.Warn("Failed to report errors", slog.String("error", err.Error()))
+	}
+	s.logger.Info("Shut down")
 }
 
-func trackPageView(db *sql.DB, domain string, path string, day time.Time, visitor string) error {
-	hash := fmt.Sprintf("%x", visitor)
-
-	query := `
-	INSERT INTO pages (domain, path, day, visitor_hll)
-	VALUES ($1, $2, $3, hll_add(hll_empty(), hll_hash_text($4)))
-	ON CONFLICT (domain, day, path)
-	DO UPDATE SET visitor_hll = hll_add(pages.visitor_hll, hll_hash_text($4))
-	`
-
-	_, err := db.Exec(query, domain, path, day, hash)
+// openDatabase connects to a PostgreSQL database, with the configured limits
+// of its connection pool.
+func openDatabase(cfg Config, url string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", url)
 	if err != nil {
-		return fmt.Errorf("failed to execute query: %w", err)
+		return nil, err
 	}
-
-	return nil
+	db.SetMaxOpenConns(cfg.DBMaxOpenConns)
+	db.SetMaxIdleConns(cfg.DBMaxIdleConns)
+	db.SetConnMaxLifetime(cfg.DBConnMaxLifetime)
+
+	// Ensure the connection is working
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to ping the database: %w", err)
+	}
+	return db, nil
 }
 
-func trackCountryView(db *sql.DB, domain string, country string, day time.Time, visitor string) error {
-	hash := fmt.Sprintf("%x", visitor)
-
-	query := `
-	INSERT INTO countries (domain, country, day, visitor_hll)
-	VALUES ($1, $2, $3, hll_add(hll_empty(), hll_hash_text($4)))
-	ON CONFLICT (domain, day, country)
-	DO UPDATE SET visitor_hll = hll_add(countries.visitor_hll, hll_hash_text($4))
-	`
+// routes returns the handler serving the ingestion endpoints the tracked
+// sites use, the API endpoints, or both.
+func (s *server) routes(ingestion bool, api bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleIndex)
+	// Every server is checked on its own by load balancers and orchestrators
+	mux.HandleFunc("/healthz", s.handleHealth)
+	mux.HandleFunc("/livez", s.handleLive)
+	mux.HandleFunc("/readyz", s.handleReady)
 
-	_, err := db.Exec(query, domain, country, day, hash)
-	if err != nil {
-		return fmt.Errorf("failed to track country view: %w", err)
+	for _, route := range s.apiRoutes() {
+		if route.ingestion && ingestion || !route.ingestion && api {
+			s.register(mux, route)
+		}
+	}
+	if api {
+		mux.HandleFunc("POST /"+grpcService+"/{method}", s.handleGRPC)
 	}
 
-	return nil
+	return s.traced(s.instrumented(s.logged(compressed(s.recovered(mux)))))
 }
 
-func trackSourceView(db *sql.DB, domain string, referrer string, day time.Time, visitor string) error {
-	hash := fmt.Sprintf("%x", visitor)
+// collectorOrigin returns the origin the tracking script is served from and
+// sends its beacons to, or an empty string if HOST_DOMAIN isn't set.
+func (s *server) collectorOrigin() string {
+	switch s.cfg.HostDomain {
+	case "":
+		return ""
+	case "localhost":
+		// The port the tracking endpoints are served on
+		addrs := s.cfg.IngestAddrs
+		if len(addrs) == 0 {
+			addrs = s.cfg.ListenAddrs
+		}
+		scheme := "http"
+		if s.cfg.TLSCertFile != "" {
+			scheme = "https"
+		}
+		for _, addr := range addrs {
+			if _, port, err := net.SplitHostPort(addr); err == nil && port != "" {
+				return scheme + "://localhost:" + port
+			}
+		}
+		return scheme + "://localhost:8080"
+	default:
+		return "https://" + s.cfg.HostDomain
+	}
+}
 
-	query := `
-	INSERT INTO sources (domain, referrer, day, visitor_hll)
-	VALUES ($1, $2, $3, hll_add(hll_empty(), hll_hash_text($4)))
-	ON CONFLICT (domain, day, referrer)
-	DO UPDATE SET visitor_hll = hll_add(sources.visitor_hll, hll_hash_text($4))
-	`
+func (s *server) handleScript(w http.ResponseWriter, r *http.Request) {
+	origin := s.collectorOrigin()
+	if origin == "" {
+		s.logger.ErrorContext(r.Context(), "HOST_DOMAIN is not set")
+		writeError(w, http.StatusInternalServerError, errNotConfigured, "HOST_DOMAIN is not set")
+		return
+	}
 
-	_, err := db.Exec(query, domain, referrer, day, hash)
+	script, err := jsMinifier.String("text/javascript", fmt.Sprintf(trackingJS, origin+"/track", !s.cfg.strictCompliance()))
 	if err != nil {
-		return fmt.Errorf("failed to track source view: %w", err)
+		s.logger.ErrorContext(r.Context(), "Failed to minify tracking.js", slog.String("error", err.Error()))
+		writeError(w, http.StatusInternalServerError, errInternal, "Failed to minify tracking.js")
+		return
 	}
 
-	return nil
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Header().Set("Cache-Control", "public, max-age=86400") // Cache for 24 hours
+	w.Write([]byte(script))
 }
 
-func getConnStr() string {
-	if value := os.Getenv("DATABASE_URL"); value != "" {
-		return value
+// handleSnippet returns the HTML to add to a website to track it. It starts
+// with a preconnect hint so the browser sets up the connection to the
+// collector before the script is requested, and comes with the equivalent
+// Link header for sites sending 103 Early Hints.
+func (s *server) handleSnippet(w http.ResponseWriter, r *http.Request) {
+	origin := s.collectorOrigin()
+	if origin == "" {
+		s.logger.ErrorContext(r.Context(), "HOST_DOMAIN is not set")
+		writeError(w, http.StatusInternalServerError, errNotConfigured, "HOST_DOMAIN is not set")
+		return
 	}
-	return "postgres://postgres@localhost:5432/potato?sslmode=disable"
-}
-
-// init loads environment variables from .env file
-func init() {
-	// Check if the .env file exists
-	if _, err := os.Stat(".env"); err == nil {
-
-		file, err := os.Open(".env")
-		if err != nil {
-			panic(err)
-		}
-		defer file.Close()
-
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			line := scanner.Text()
-			// Skip empty lines and comments
-			if line == "" || strings.HasPrefix(line, "#") {
-				continue
-			}
 
-			// Split on first '=' only
-			parts := strings.SplitN(line, "=", 2)
-			if len(parts) != 2 {
-				continue
-			}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(newSnippet(origin))
+}
 
-			// Trim spaces and quotes
-			key := strings.TrimSpace(parts[0])
-			value := strings.TrimSpace(parts[1])
-			value = strings.Trim(value, `"'`)
+// snippet is the HTML tracking a website, whole and in parts.
+type snippet struct {
+	Snippet    string `json:"snippet"`
+	Preconnect string `json:"preconnect"`
+	Script     string `json:"script"`
+	LinkHeader string `json:"link_header"`
+}
 
-			// Set environment variable
-			os.Setenv(key, value)
-		}
+// newSnippet returns the snippet loading the tracking script from origin.
+func newSnippet(origin string) snippet {
+	preconnect := fmt.Sprintf(`<link rel="preconnect" href="%s">`, origin)
+	script := fmt.Sprintf(`<script src="%s/analytics.js" defer></script>`, origin)
+	return snippet{
+		Snippet:    preconnect + "\n" + script,
+		Preconnect: preconnect,
+		Script:     script,
+		LinkHeader: fmt.Sprintf("<%s>; rel=preconnect", origin),
+	}
+}
 
-		if err := scanner.Err(); err != nil {
-			panic(err)
-		}
+func (s *server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
 	}
 
-	hostDomain = os.Getenv("HOST_DOMAIN")
-	apiKey = os.Getenv("API_KEY")
-	environment = os.Getenv("ENVIRONMENT")
-	logLevel = os.Getenv("LOG_LEVEL")
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, indexHTML)
 }
 
 var jsMinifier *minify.M
@@ -565,18 +523,3 @@ func init() {
 	jsMinifier = minify.New()
 	jsMinifier.AddFunc("text/javascript", js.Minify)
 }
-
-func requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if apiKey == "" && environment == "production" {
-			http.Error(w, "API_KEY is mandatory in production", http.StatusUnauthorized)
-			return
-		}
-
-		if apiKey != "" && r.URL.Query().Get("api_key") != apiKey {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		next(w, r)
-	}
-}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a server of the configuration loaded from args,
+// without a database, which serves the routes that don't query one.
+func newTestServer(t *testing.T, args ...string) *server {
+	t.Helper()
+	cfg, _, err := loadConfig(args)
+	if err != nil {
+		t.Fatalf("loadConfig(%q): %v", args, err)
+	}
+	return &server{
+		cfg:     cfg,
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		cache:   newStatsCache(cfg.StatsCacheTTL),
+		metrics: newServerMetrics(),
+	}
+}
+
+// serveGet serves a GET request of target, returning the status and body.
+func serveGet(t *testing.T, h http.Handler, target string) (int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	return rec.Code, rec.Body.String()
+}
+
+// recordingDB is a database recording the statements executed in it, as
+// PostgreSQL isn't available to the tests. It answers the creation of sites
+// with the ID 1, the queries of rollups with its months and those it's told
+// to answer with their rows, and every other query with no rows.
+type recordingDB struct {
+	// The months rolled up, as "table YYYY-MM-DD"
+	rolledUp []string
+
+	mu         sync.Mutex
+	statements []recordedStatement
+	answers    []recordedAnswer
+}
+
+// recordedAnswer is the rows a recordingDB answers the queries containing
+// a string with.
+type recordedAnswer struct {
+	contains string
+	columns  []string
+	values   [][]driver.Value
+}
+
+// recordedStatement is a statement executed in a recordingDB, or BEGIN,
+// COMMIT or ROLLBACK.
+type recordedStatement struct {
+	query string
+	args  []driver.Value
+}
+
+// newRecordingDB returns a database whose months are rolled up.
+func newRecordingDB(t *testing.T, rolledUp ...string) (*sql.DB, *recordingDB) {
+	t.Helper()
+	rec := &recordingDB{rolledUp: rolledUp}
+	db := sql.OpenDB(rec)
+	t.Cleanup(func() { db.Close() })
+	return db, rec
+}
+
+func (rec *recordingDB) record(query string, args []driver.NamedValue) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	rec.statements = append(rec.statements, recordedStatement{query: strings.TrimSpace(query), args: values})
+}
+
+// answer answers the queries containing a string with rows from now on.
+func (rec *recordingDB) answer(contains string, columns []string, values ...[]driver.Value) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.answers = append(rec.answers, recordedAnswer{contains: contains, columns: columns, values: values})
+}
+
+// recorded returns the statements executed so far.
+func (rec *recordingDB) recorded() []recordedStatement {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]recordedStatement{}, rec.statements...)
+}
+
+func (rec *recordingDB) Connect(context.Context) (driver.Conn, error) { return recordingConn{rec}, nil }
+func (rec *recordingDB) Driver() driver.Driver                        { return nil }
+
+type recordingConn struct{ db *recordingDB }
+
+func (c recordingConn) Prepare(string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (c recordingConn) Close() error                        { return nil }
+
+func (c recordingConn) Begin() (driver.Tx, error) {
+	c.db.record("BEGIN", nil)
+	return recordingTx{c.db}, nil
+}
+
+func (c recordingConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.db.record(query, args)
+	return driver.RowsAffected(1), nil
+}
+
+func (c recordingConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.db.record(query, args)
+	rows := &recordingRows{}
+	c.db.mu.Lock()
+	answers := c.db.answers
+	c.db.mu.Unlock()
+	for _, answer := range answers {
+		if strings.Contains(query, answer.contains) {
+			rows.columns, rows.values = answer.columns, answer.values
+			return rows, nil
+		}
+	}
+	switch {
+	case strings.Contains(query, "INSERT INTO sites"):
+		rows.columns = []string{"id"}
+		rows.values = [][]driver.Value{{int64(1)}}
+	case strings.Contains(query, "FROM rollups"):
+		rows.columns = []string{"table_name", "month"}
+		for _, rolledUp := range c.db.rolledUp {
+			table, month, _ := strings.Cut(rolledUp, " ")
+			day, err := time.Parse(time.DateOnly, month)
+			if err != nil {
+				return nil, err
+			}
+			rows.values = append(rows.values, []driver.Value{table, day})
+		}
+	}
+	return rows, nil
+}
+
+type recordingTx struct{ db *recordingDB }
+
+func (tx recordingTx) Commit() error {
+	tx.db.record("COMMIT", nil)
+	return nil
+}
+
+func (tx recordingTx) Rollback() error {
+	tx.db.record("ROLLBACK", nil)
+	return nil
+}
+
+type recordingRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *recordingRows) Columns() []string { return r.columns }
+func (r *recordingRows) Close() error      { return nil }
+
+func (r *recordingRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func TestServersSideBySide(t *testing.T) {
+	one := newTestServer(t, "-host-domain=one.example.com", "-api-key=one")
+	two := newTestServer(t, "-host-domain=two.example.com", "-api-key=two")
+
+	// Registering every route panics on conflicting patterns
+	routes := map[string]http.Handler{
+		"one": one.routes(true, true),
+		"two": two.routes(true, true),
+	}
+
+	for name, h := range routes {
+		code, body := serveGet(t, h, "/analytics.js")
+		if code != http.StatusOK {
+			t.Fatalf("%s: /analytics.js returned %d: %s", name, code, body)
+		}
+		if !strings.Contains(body, "https://"+name+".example.com/track") {
+			t.Errorf("%s: /analytics.js doesn't send its beacons to its own host: %s", name, body)
+		}
+
+		if code, body := serveGet(t, h, "/stats/sign?endpoint=/stats/pages&domain=example.com&period=7d"); code != http.StatusUnauthorized {
+			t.Errorf("%s: /stats/sign without the API key returned %d: %s", name, code, body)
+		}
+	}
+
+	signatures := map[string]string{}
+	for name, h := range routes {
+		code, body := serveGet(t, h, "/stats/sign?endpoint=/stats/pages&domain=example.com&period=7d&api_key="+name)
+		if code != http.StatusOK {
+			t.Fatalf("%s: /stats/sign returned %d: %s", name, code, body)
+		}
+		var signed struct {
+			Query string `json:"query"`
+		}
+		if err := json.Unmarshal([]byte(body), &signed); err != nil {
+			t.Fatalf("%s: /stats/sign returned %s: %v", name, body, err)
+		}
+		signatures[name] = signed.Query
+	}
+	if signatures["one"] == signatures["two"] {
+		t.Errorf("the servers signed with the same key: %s", signatures["one"])
+	}
+}
+
+func TestRoutesSplitByListener(t *testing.T) {
+	s := newTestServer(t, "-host-domain=example.com", "-api-key=key")
+
+	ingestion, api := s.routes(true, false), s.routes(false, true)
+	if code, _ := serveGet(t, ingestion, "/analytics.js"); code != http.StatusOK {
+		t.Errorf("the ingestion listener doesn't serve the script: %d", code)
+	}
+	if code, _ := serveGet(t, api, "/stats/sign?endpoint=/stats/pages&domain=example.com&api_key=key"); code != http.StatusOK {
+		t.Errorf("the API listener doesn't serve the stats: %d", code)
+	}
+	if code, _ := serveGet(t, ingestion, "/stats/sign?endpoint=/stats/pages&domain=example.com&api_key=key"); code == http.StatusOK {
+		t.Errorf("the ingestion listener serves the stats")
+	}
+}
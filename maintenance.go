@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// maintainedTables are the tables every pageview upserts into, whose
+// statistics go stale and whose dead rows pile up fastest.
+var maintainedTables = []string{"pages", "countries", "sources", "page_countries", "page_sources", "referrer_paths", "environments", "visitor_types", "visitor_days"}
+
+// Key of the advisory lock held during maintenance, so that a single
+// instance runs it at a time
+const maintenanceLock = 7108306
+
+// tableBloat is how many live and dead rows a table has, its partitions or
+// chunks included, as estimated by PostgreSQL.
+type tableBloat struct {
+	table string
+	live  int64
+	dead  int64
+}
+
+// deadRatio returns the share of the table's rows that are dead.
+func (b tableBloat) deadRatio() float64 {
+	if b.live+b.dead == 0 {
+		return 0
+	}
+	return float64(b.dead) / float64(b.live+b.dead)
+}
+
+// maintain analyzes the upserted tables and rebuilds their day indexes
+// without blocking writes, then logs their bloat. It does nothing when
+// another instance is already at it.
+func (s *server) maintain() error {
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get a connection: %w", err)
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, maintenanceLock).Scan(&locked); err != nil {
+		return fmt.Errorf("failed to lock maintenance: %w", err)
+	}
+	if !locked {
+		return nil
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, maintenanceLock)
+
+	for _, table := range maintainedTables {
+		if _, err := conn.ExecContext(ctx, `ANALYZE `+table); err != nil {
+			return fmt.Errorf("failed to analyze %s: %w", table, err)
+		}
+	}
+
+	indexes, err := dayIndexes(ctx, conn)
+	if err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		// An index that can't be rebuilt concurrently, like those of
+		// hypertables, is left as it is rather than locking its table
+		if _, err := conn.ExecContext(ctx, `REINDEX INDEX CONCURRENTLY `+pq.QuoteIdentifier(index)); err != nil {
+			s.logger.Warn("Failed to reindex", slog.String("index", index), slog.String("error", err.Error()))
+		}
+	}
+
+	bloat, err := tableBloats(s.db)
+	if err != nil {
+		return err
+	}
+	for _, b := range bloat {
+		s.logger.Info("Table bloat", slog.String("table", b.table), slog.Int64("live_rows", b.live), slog.Int64("dead_rows", b.dead), slog.Float64("dead_ratio", b.deadRatio()))
+	}
+	return nil
+}
+
+// dayIndexes returns the indexes of the maintained tables on their day alone.
+func dayIndexes(ctx context.Context, conn *sql.Conn) ([]string, error) {
+	rows, err := conn.QueryContext(ctx, `
+	SELECT index_class.relname FROM pg_index
+	JOIN pg_class AS index_class ON index_class.oid = pg_index.indexrelid
+	JOIN pg_class AS table_class ON table_class.oid = pg_index.indrelid
+	JOIN pg_attribute ON pg_attribute.attrelid = table_class.oid AND pg_attribute.attnum = pg_index.indkey[0]
+	WHERE table_class.relnamespace = current_schema()::regnamespace AND table_class.relname = ANY($1)
+	AND pg_index.indnatts = 1 AND pg_attribute.attname = 'day'
+	ORDER BY index_class.relname
+	`, pq.Array(maintainedTables))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the day indexes: %w", err)
+	}
+	defer rows.Close()
+
+	var indexes []string
+	for rows.Next() {
+		var index string
+		if err := rows.Scan(&index); err != nil {
+			return nil, fmt.Errorf("failed to scan index: %w", err)
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes, rows.Err()
+}
+
+// tableBloats returns the bloat of the maintained tables, in alphabetical
+// order.
+func tableBloats(db *sql.DB) ([]tableBloat, error) {
+	// Partitions and chunks are counted in the table they belong to
+	rows, err := db.Query(`
+	SELECT COALESCE(parent.relname, child.relname) AS table_name, SUM(n_live_tup)::bigint, SUM(n_dead_tup)::bigint
+	FROM pg_stat_user_tables AS stats
+	JOIN pg_class AS child ON child.oid = stats.relid
+	LEFT JOIN pg_inherits ON pg_inherits.inhrelid = child.oid
+	LEFT JOIN pg_class AS parent ON parent.oid = pg_inherits.inhparent
+	WHERE COALESCE(parent.relnamespace, child.relnamespace) = current_schema()::regnamespace
+	AND COALESCE(parent.relname, child.relname) = ANY($1)
+	GROUP BY table_name
+	ORDER BY table_name
+	`, pq.Array(maintainedTables))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query table bloat: %w", err)
+	}
+	defer rows.Close()
+
+	var bloat []tableBloat
+	for rows.Next() {
+		var b tableBloat
+		if err := rows.Scan(&b.table, &b.live, &b.dead); err != nil {
+			return nil, fmt.Errorf("failed to scan table bloat: %w", err)
+		}
+		bloat = append(bloat, b)
+	}
+	return bloat, rows.Err()
+}
+
+// writeBloatMetrics writes the tables' bloat in the Prometheus text format.
+func writeBloatMetrics(w io.Writer, bloat []tableBloat) {
+	for _, metric := range []struct {
+		name  string
+		help  string
+		value func(b tableBloat) float64
+	}{
+		{"potato_table_live_rows", "Estimated live rows of the table.", func(b tableBloat) float64 { return float64(b.live) }},
+		{"potato_table_dead_rows", "Estimated dead rows of the table, waiting to be vacuumed.", func(b tableBloat) float64 { return float64(b.dead) }},
+		{"potato_table_dead_ratio", "Share of the table's rows that are dead.", func(b tableBloat) float64 { return b.deadRatio() }},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", metric.name, metric.help, metric.name)
+		for _, b := range bloat {
+			fmt.Fprintf(w, "%s{table=\"%s\"} %g\n", metric.name, escapeLabelValue(b.table), metric.value(b))
+		}
+	}
+}
+
+// maintainEvery runs the maintenance periodically, starting an interval
+// after startup so that deploys don't all rebuild the indexes. It never
+// returns.
+func (s *server) maintainEvery(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := s.maintain(); err != nil {
+			s.logger.Error("Failed to maintain the database", slog.String("error", err.Error()))
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Share of MEMORY_LIMIT the in-memory subsystems can use together, the rest
+// being left for requests in flight, the database driver and the runtime
+const memoryBudgetShare = 0.5
+
+// Eviction priorities: consumers with the lowest priority are evicted from
+// first when the budget is exceeded
+const (
+	priorityCache      = 0
+	priorityRateLimits = 5
+	priorityRealtime   = 10
+)
+
+// memoryConsumer is an in-memory subsystem whose usage counts against the
+// memory budget.
+type memoryConsumer interface {
+	// memoryUsage returns an estimate of the bytes held
+	memoryUsage() int64
+
+	// evict frees at least the given number of bytes if it can, returning
+	// the estimate of what it freed
+	evict(bytes int64) int64
+}
+
+// memoryBudget keeps the in-memory subsystems under a single limit, evicting
+// from the least important ones first.
+type memoryBudget struct {
+	limit int64
+
+	mu        sync.Mutex
+	consumers []*budgetConsumer
+}
+
+type budgetConsumer struct {
+	name     string
+	priority int
+	consumer memoryConsumer
+
+	evictions    int64
+	evictedBytes int64
+}
+
+// newMemoryBudget returns a budget of limit bytes. Nothing is ever evicted
+// when limit is 0.
+func newMemoryBudget(limit int64) *memoryBudget {
+	return &memoryBudget{limit: limit}
+}
+
+func (b *memoryBudget) register(name string, priority int, consumer memoryConsumer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.consumers = append(b.consumers, &budgetConsumer{name: name, priority: priority, consumer: consumer})
+	sort.SliceStable(b.consumers, func(i, j int) bool {
+		return b.consumers[i].priority < b.consumers[j].priority
+	})
+}
+
+// enforce evicts from the consumers, lowest priority first, until their
+// usage fits in the budget again.
+func (b *memoryBudget) enforce() {
+	if b.limit == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var used int64
+	for _, c := range b.consumers {
+		used += c.consumer.memoryUsage()
+	}
+
+	for _, c := range b.consumers {
+		if used <= b.limit {
+			return
+		}
+		freed := c.consumer.evict(used - b.limit)
+		if freed > 0 {
+			c.evictions++
+			c.evictedBytes += freed
+			used -= freed
+		}
+	}
+}
+
+// enforceEvery enforces the budget periodically. It never returns.
+func (b *memoryBudget) enforceEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		b.enforce()
+	}
+}
+
+type consumerMetrics struct {
+	Name         string `json:"name"`
+	Priority     int    `json:"priority"`
+	Bytes        int64  `json:"bytes"`
+	Evictions    int64  `json:"evictions"`
+	EvictedBytes int64  `json:"evicted_bytes"`
+}
+
+func (s *server) handleMemory(w http.ResponseWriter, r *http.Request) {
+	s.memory.mu.Lock()
+	var used int64
+	consumers := []consumerMetrics{}
+	for _, c := range s.memory.consumers {
+		bytes := c.consumer.memoryUsage()
+		used += bytes
+		consumers = append(consumers, consumerMetrics{
+			Name:         c.name,
+			Priority:     c.priority,
+			Bytes:        bytes,
+			Evictions:    c.evictions,
+			EvictedBytes: c.evictedBytes,
+		})
+	}
+	s.memory.mu.Unlock()
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		Limit     int64             `json:"limit"`
+		Budget    int64             `json:"budget"`
+		Used      int64             `json:"used"`
+		HeapBytes uint64            `json:"heap_bytes"`
+		Consumers []consumerMetrics `json:"consumers"`
+	}{
+		Limit:     s.cfg.MemoryLimit,
+		Budget:    s.memory.limit,
+		Used:      used,
+		HeapBytes: stats.HeapAlloc,
+		Consumers: consumers,
+	})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The schema is changed by the SQL files of the migrations directory, named
+// after their version and what they do: 0002_add_column.up.sql, along with
+// 0002_add_column.down.sql undoing it. In them, {{sketch_type}} is replaced
+// with the type of the visitor_hll columns.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Key of the advisory lock held while migrating, so that instances starting
+// together don't apply the same migrations
+const migrationLock = 7108305
+
+// migration is a versioned change of the schema.
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// loadMigrations returns the embedded migrations in order, for sketches of
+// the given format, checking that their versions follow each other and that
+// each can be undone.
+func loadMigrations(sketches sketchFormat) ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list migrations: %w", err)
+	}
+
+	byVersion := map[int]*migration{}
+	for _, entry := range entries {
+		base, direction, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), ".")
+		prefix, name, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("invalid migration file name %q", entry.Name())
+		}
+
+		content, err := migrationFiles.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %w", entry.Name(), err)
+		}
+		statements := strings.ReplaceAll(string(content), "{{sketch_type}}", sketches.sqlType())
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: name}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.up = statements
+		} else {
+			m.down = statements
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+
+	for i, m := range migrations {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("missing migration %d", i+1)
+		}
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %d must have an up and a down file", m.version)
+		}
+	}
+	return migrations, nil
+}
+
+// migrate applies or undoes migrations until the schema is at version
+// target, the latest one when target is negative. Each migration runs in its
+// own transaction, recorded in the schema_version table.
+func migrate(db *sql.DB, logger *slog.Logger, sketches sketchFormat, target int) error {
+	migrations, err := loadMigrations(sketches)
+	if err != nil {
+		return err
+	}
+	if target < 0 {
+		target = len(migrations)
+	}
+	if target > len(migrations) {
+		return fmt.Errorf("unknown schema version %d, the latest is %d", target, len(migrations))
+	}
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get a connection: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLock); err != nil {
+		return fmt.Errorf("failed to lock migrations: %w", err)
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLock)
+
+	_, err = conn.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create the schema_version table: %w", err)
+	}
+
+	var current int
+	if err := conn.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&current); err != nil {
+		return fmt.Errorf("failed to read the schema version: %w", err)
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("the schema is at version %d, newer than this server's %d", current, len(migrations))
+	}
+
+	run := func(m migration, statements string, record string, args ...any) error {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin migration %d: %w", m.version, err)
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.ExecContext(ctx, statements); err != nil {
+			return fmt.Errorf("failed to run migration %d_%s: %w", m.version, m.name, err)
+		}
+		if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+			return fmt.Errorf("failed to record migration %d: %w", m.version, err)
+		}
+		return tx.Commit()
+	}
+
+	for _, m := range migrations[min(current, target):target] {
+		logger.Info("Applying migration", slog.Int("version", m.version), slog.String("name", m.name))
+		if err := run(m, m.up, `INSERT INTO schema_version (version, name) VALUES ($1, $2)`, m.version, m.name); err != nil {
+			return err
+		}
+	}
+	for i := current - 1; i >= target; i-- {
+		m := migrations[i]
+		logger.Info("Undoing migration", slog.Int("version", m.version), slog.String("name", m.name))
+		if err := run(m, m.down, `DELETE FROM schema_version WHERE version = $1`, m.version); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
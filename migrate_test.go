@@ -0,0 +1,305 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// baselineSchema is the schema of the databases created before versioned
+// migrations, with sketches stored as bytea.
+const baselineSchema = `
+CREATE TABLE pages (
+	domain TEXT NOT NULL,
+	path TEXT NOT NULL,
+	day DATE NOT NULL,
+	visitor_hll bytea NOT NULL,
+	UNIQUE (domain, day, path)
+);
+CREATE INDEX pages_day_idx ON pages (day DESC);
+
+CREATE TABLE countries (
+	domain TEXT NOT NULL,
+	country TEXT NOT NULL,
+	day DATE NOT NULL,
+	visitor_hll bytea NOT NULL,
+	UNIQUE (domain, day, country)
+);
+CREATE INDEX countries_day_idx ON countries (day DESC);
+
+CREATE TABLE sources (
+	domain TEXT NOT NULL,
+	referrer TEXT NOT NULL,
+	day DATE NOT NULL,
+	visitor_hll bytea NOT NULL,
+	UNIQUE (domain, day, referrer)
+);
+CREATE INDEX sources_day_idx ON sources (day DESC);
+
+INSERT INTO pages (domain, path, day, visitor_hll) VALUES
+	('example.com', '/', '2023-05-01', '\x01'),
+	('example.com', '/blog', '2023-05-02', '\x01'),
+	('other.example.com', '/', '2023-05-01', '\x01');
+INSERT INTO countries (domain, country, day, visitor_hll) VALUES ('example.com', 'FR', '2023-05-01', '\x01');
+INSERT INTO sources (domain, referrer, day, visitor_hll) VALUES ('other.example.com', 'news.example.org', '2023-05-01', '\x01');
+`
+
+// baselineSketches is the format of the sketches of baselineSchema, which
+// doesn't need the hll extension.
+var baselineSketches = sketchFormat{goHLL: true}
+
+func TestLoadMigrations(t *testing.T) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".up.sql") {
+			continue
+		}
+		content, _ := migrationFiles.ReadFile("migrations/" + entry.Name())
+		if !strings.HasPrefix(string(content), "-- ") {
+			t.Errorf("%s doesn't start with a comment saying what it does", entry.Name())
+		}
+	}
+
+	for _, sketches := range []sketchFormat{{}, baselineSketches} {
+		migrations, err := loadMigrations(sketches)
+		if err != nil {
+			t.Fatalf("loadMigrations(): %v", err)
+		}
+		if len(migrations)*2 != len(entries) {
+			t.Errorf("loaded %d migrations from %d files", len(migrations), len(entries))
+		}
+		for _, m := range migrations {
+			if strings.Contains(m.up+m.down, "{{") {
+				t.Errorf("migration %d_%s has placeholders left", m.version, m.name)
+			}
+		}
+	}
+}
+
+// openTestDatabase returns a connection to the database of
+// TEST_DATABASE_URL, in a schema of its own dropped once the test is over.
+// Tests using it are skipped when the variable isn't set.
+func openTestDatabase(t *testing.T) *sql.DB {
+	t.Helper()
+	rawURL := os.Getenv("TEST_DATABASE_URL")
+	if rawURL == "" {
+		t.Skip("TEST_DATABASE_URL isn't set")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatalf("invalid TEST_DATABASE_URL: %v", err)
+	}
+
+	admin, err := sql.Open("postgres", rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("potato_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatalf("failed to create the test schema: %v", err)
+	}
+	t.Cleanup(func() {
+		admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`)
+		admin.Close()
+	})
+
+	// Extensions are found in public
+	query := u.Query()
+	query.Set("search_path", schema+",public")
+	u.RawQuery = query.Encode()
+	db, err := sql.Open("postgres", u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// queryStrings returns the first column of the rows of a query, as strings.
+func queryStrings(t *testing.T, db *sql.DB, query string, args ...any) []string {
+	t.Helper()
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, value)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
+
+// migrateTo migrates db to version target, failing the test otherwise.
+func migrateTo(t *testing.T, db *sql.DB, target int) {
+	t.Helper()
+	if err := migrate(db, slog.New(slog.NewTextHandler(io.Discard, nil)), baselineSketches, target); err != nil {
+		t.Fatalf("migrate(%d): %v", target, err)
+	}
+}
+
+func TestMigrateBaseline(t *testing.T) {
+	db := openTestDatabase(t)
+	if _, err := db.Exec(baselineSchema); err != nil {
+		t.Fatalf("failed to create the baseline schema: %v", err)
+	}
+
+	// The existing tables become the DEFAULT partitions, still holding
+	// their rows and their uniqueness
+	migrateTo(t, db, 2)
+	for _, table := range []string{"pages", "countries", "sources"} {
+		bounds := queryStrings(t, db, `
+		SELECT c.relname || ' ' || pg_get_expr(c.relpartbound, c.oid)
+		FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = to_regclass($1)
+		`, table)
+		if want := []string{table + "_default DEFAULT"}; !reflect.DeepEqual(bounds, want) {
+			t.Errorf("the partitions of %s are %v, want %v", table, bounds, want)
+		}
+	}
+	if paths := queryStrings(t, db, `SELECT domain || path || ' ' || pageviews FROM pages ORDER BY 1`); !reflect.DeepEqual(paths, []string{"example.com/ 0", "example.com/blog 0", "other.example.com/ 0"}) {
+		t.Errorf("the partitioned pages are %v", paths)
+	}
+	if _, err := db.Exec(`
+	INSERT INTO pages (domain, path, day, visitor_hll, pageviews) VALUES ('example.com', '/', '2023-05-01', '\x01', 1)
+	ON CONFLICT (domain, day, path) DO UPDATE SET pageviews = pages.pageviews + EXCLUDED.pageviews
+	`); err != nil {
+		t.Errorf("failed to upsert a pageview into the default partition: %v", err)
+	}
+
+	// Sites are created for every domain, whose column is dropped once the
+	// rows point to their site
+	migrateTo(t, db, 5)
+	if sites := queryStrings(t, db, `SELECT id || ' ' || domain FROM sites ORDER BY id`); !reflect.DeepEqual(sites, []string{"1 example.com", "2 other.example.com"}) {
+		t.Errorf("the sites are %v", sites)
+	}
+	backfilled := map[string][]string{
+		"pages":     {"example.com /", "example.com /blog", "other.example.com /"},
+		"countries": {"example.com FR"},
+		"sources":   {"other.example.com news.example.org"},
+	}
+	for table, want := range backfilled {
+		column := storedColumns(table)[1]
+		got := queryStrings(t, db, `SELECT sites.domain || ' ' || `+column+` FROM `+table+` JOIN sites ON sites.id = `+table+`.site_id ORDER BY 1`)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("the rows of %s are %v, want %v", table, got, want)
+		}
+	}
+	keyed := queryStrings(t, db, `
+	SELECT table_name FROM information_schema.columns
+	WHERE table_schema = current_schema() AND column_name = 'domain' AND table_name <> ALL ($1)
+	ORDER BY 1
+	`, pq.Array([]string{"sites", "digests", "shares", "visitor_days", "events_raw"}))
+	if len(keyed) > 0 {
+		t.Errorf("the stats tables %v are still keyed by domain", keyed)
+	}
+
+	// Keys issued before they're hashed and scoped keep working with every
+	// scope
+	migrateTo(t, db, 11)
+	if _, err := db.Exec(`INSERT INTO api_keys (key, name) VALUES ('pk_live_abcdef', 'ci')`); err != nil {
+		t.Fatal(err)
+	}
+	migrateTo(t, db, 13)
+	s := &server{db: db}
+	k, err := s.lookupAPIKey("pk_live_abcdef")
+	if err != nil || k == nil {
+		t.Fatalf("lookupAPIKey() of a key issued before hashing = %v, %v", k, err)
+	}
+	if k.Prefix != "pk_liv" || !reflect.DeepEqual(k.Scopes, apiKeyScopes) || len(k.Domains) != 0 {
+		t.Errorf("the key issued before hashing is %+v", k)
+	}
+	if columns := queryStrings(t, db, `SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = 'api_keys' AND column_name = 'key'`); len(columns) > 0 {
+		t.Errorf("the keys are still stored in the clear")
+	}
+	var scopes []string
+	if err := db.QueryRow(`INSERT INTO api_keys (key_hash, name) VALUES ('hash', 'new') RETURNING scopes`).Scan(pq.Array(&scopes)); err != nil || !reflect.DeepEqual(scopes, []string{scopeReadStats}) {
+		t.Errorf("a key issued after scoping has the scopes %v, %v", scopes, err)
+	}
+
+	// Every migration can be undone, keying the stats by domain again
+	migrateTo(t, db, -1)
+	migrateTo(t, db, 4)
+	if paths := queryStrings(t, db, `SELECT domain || path FROM pages ORDER BY 1`); !reflect.DeepEqual(paths, []string{"example.com/", "example.com/blog", "other.example.com/"}) {
+		t.Errorf("the pages keyed by domain again are %v", paths)
+	}
+	migrateTo(t, db, 0)
+	migrateTo(t, db, -1)
+}
+
+func TestSetUpTimescaleBaseline(t *testing.T) {
+	db := openTestDatabase(t)
+	if _, err := db.Exec(`CREATE EXTENSION IF NOT EXISTS timescaledb`); err != nil {
+		t.Skipf("TimescaleDB isn't available: %v", err)
+	}
+	if _, err := db.Exec(baselineSchema); err != nil {
+		t.Fatalf("failed to create the baseline schema: %v", err)
+	}
+	migrateTo(t, db, -1)
+	if _, err := db.Exec(`INSERT INTO page_sources (site_id, path, referrer, day, visitor_hll) VALUES (1, '/', 'news.example.org', '2023-05-01', '\x01')`); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[string]string{}
+	for _, table := range hypertables {
+		counts[table] = queryStrings(t, db, `SELECT count(*) FROM `+table)[0]
+	}
+
+	// The partitioned tables are copied into hypertables replacing them, the
+	// others converted in place
+	if err := setUpTimescale(db, slog.New(slog.NewTextHandler(io.Discard, nil)), 30); err != nil {
+		t.Fatalf("setUpTimescale(): %v", err)
+	}
+	if found, err := detectHypertables(db); err != nil || !found {
+		t.Fatalf("detectHypertables() = %v, %v", found, err)
+	}
+	converted := queryStrings(t, db, `
+	SELECT hypertable_name FROM timescaledb_information.hypertables
+	WHERE hypertable_schema = current_schema() AND compression_enabled
+	ORDER BY 1
+	`)
+	if len(converted) != len(hypertables) {
+		t.Errorf("the compressed hypertables are %v, want %v", converted, hypertables)
+	}
+	for _, table := range hypertables {
+		if got := queryStrings(t, db, `SELECT count(*) FROM `+table)[0]; got != counts[table] {
+			t.Errorf("%s has %s rows once converted, want %s", table, got, counts[table])
+		}
+	}
+	if paths := queryStrings(t, db, `SELECT sites.domain || pages.path FROM pages JOIN sites ON sites.id = pages.site_id ORDER BY 1`); !reflect.DeepEqual(paths, []string{"example.com/", "example.com/blog", "other.example.com/"}) {
+		t.Errorf("the pages copied into the hypertable are %v", paths)
+	}
+	if _, err := db.Exec(`
+	INSERT INTO pages (site_id, path, day, visitor_hll, pageviews) VALUES (1, '/', '2023-05-01', '\x01', 1)
+	ON CONFLICT (site_id, day, path) DO UPDATE SET pageviews = pages.pageviews + EXCLUDED.pageviews
+	`); err != nil {
+		t.Errorf("failed to upsert a pageview into the hypertable: %v", err)
+	}
+
+	// Starting again only updates the compression policies
+	if converted, err := convertToHypertable(db, "pages"); err != nil || converted {
+		t.Errorf("convertToHypertable() of a hypertable = %v, %v", converted, err)
+	}
+	if err := setUpTimescale(db, slog.New(slog.NewTextHandler(io.Discard, nil)), 0); err != nil {
+		t.Errorf("setUpTimescale() of hypertables: %v", err)
+	}
+}
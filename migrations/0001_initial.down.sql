@@ -0,0 +1,13 @@
+DROP TABLE IF EXISTS visitor_types;
+DROP TABLE IF EXISTS visitor_days;
+DROP TABLE IF EXISTS shares;
+DROP TABLE IF EXISTS keys;
+DROP TABLE IF EXISTS salts;
+DROP TABLE IF EXISTS digests;
+DROP TABLE IF EXISTS referrer_paths;
+DROP TABLE IF EXISTS page_sources;
+DROP TABLE IF EXISTS page_countries;
+DROP TABLE IF EXISTS environments;
+DROP TABLE IF EXISTS sources;
+DROP TABLE IF EXISTS countries;
+DROP TABLE IF EXISTS pages;
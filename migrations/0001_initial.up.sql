@@ -0,0 +1,119 @@
+-- The tables as they were before versioned migrations. They're only created
+-- if missing, so that existing databases can be adopted at this version.
+
+CREATE TABLE IF NOT EXISTS pages (
+	domain TEXT NOT NULL,
+	path TEXT NOT NULL,
+	day DATE NOT NULL,
+	visitor_hll {{sketch_type}} NOT NULL,
+	UNIQUE (domain, day, path)
+);
+CREATE INDEX IF NOT EXISTS pages_day_idx ON pages (day DESC);
+
+CREATE TABLE IF NOT EXISTS countries (
+	domain TEXT NOT NULL,
+	country TEXT NOT NULL,
+	day DATE NOT NULL,
+	visitor_hll {{sketch_type}} NOT NULL,
+	UNIQUE (domain, day, country)
+);
+CREATE INDEX IF NOT EXISTS countries_day_idx ON countries (day DESC);
+
+CREATE TABLE IF NOT EXISTS sources (
+	domain TEXT NOT NULL,
+	referrer TEXT NOT NULL,
+	day DATE NOT NULL,
+	visitor_hll {{sketch_type}} NOT NULL,
+	UNIQUE (domain, day, referrer)
+);
+CREATE INDEX IF NOT EXISTS sources_day_idx ON sources (day DESC);
+
+ALTER TABLE pages ADD COLUMN IF NOT EXISTS pageviews BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE countries ADD COLUMN IF NOT EXISTS pageviews BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE sources ADD COLUMN IF NOT EXISTS pageviews BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS environments (
+	domain TEXT NOT NULL,
+	environment TEXT NOT NULL,
+	day DATE NOT NULL,
+	visitor_hll {{sketch_type}} NOT NULL,
+	pageviews BIGINT NOT NULL DEFAULT 0,
+	UNIQUE (domain, day, environment)
+);
+CREATE INDEX IF NOT EXISTS environments_day_idx ON environments (day DESC);
+
+CREATE TABLE IF NOT EXISTS page_countries (
+	domain TEXT NOT NULL,
+	path TEXT NOT NULL,
+	country TEXT NOT NULL,
+	day DATE NOT NULL,
+	visitor_hll {{sketch_type}} NOT NULL,
+	pageviews BIGINT NOT NULL DEFAULT 0,
+	UNIQUE (domain, day, path, country)
+);
+CREATE INDEX IF NOT EXISTS page_countries_day_idx ON page_countries (day DESC);
+
+CREATE TABLE IF NOT EXISTS page_sources (
+	domain TEXT NOT NULL,
+	path TEXT NOT NULL,
+	referrer TEXT NOT NULL,
+	day DATE NOT NULL,
+	visitor_hll {{sketch_type}} NOT NULL,
+	pageviews BIGINT NOT NULL DEFAULT 0,
+	UNIQUE (domain, day, path, referrer)
+);
+CREATE INDEX IF NOT EXISTS page_sources_day_idx ON page_sources (day DESC);
+
+CREATE TABLE IF NOT EXISTS referrer_paths (
+	domain TEXT NOT NULL,
+	referrer TEXT NOT NULL,
+	path TEXT NOT NULL,
+	day DATE NOT NULL,
+	visitor_hll {{sketch_type}} NOT NULL,
+	pageviews BIGINT NOT NULL DEFAULT 0,
+	UNIQUE (domain, day, referrer, path)
+);
+CREATE INDEX IF NOT EXISTS referrer_paths_day_idx ON referrer_paths (day DESC);
+
+CREATE TABLE IF NOT EXISTS digests (
+	domain TEXT NOT NULL,
+	day DATE NOT NULL,
+	digest JSON NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	UNIQUE (domain, day)
+);
+
+CREATE TABLE IF NOT EXISTS salts (
+	day DATE PRIMARY KEY,
+	salt BYTEA NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS keys (
+	name TEXT PRIMARY KEY,
+	key BYTEA NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS shares (
+	token TEXT PRIMARY KEY,
+	domain TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS visitor_days (
+	domain TEXT NOT NULL,
+	visitor BYTEA NOT NULL,
+	last_day DATE NOT NULL,
+	previous_day DATE,
+	PRIMARY KEY (domain, visitor)
+);
+CREATE INDEX IF NOT EXISTS visitor_days_last_day_idx ON visitor_days (last_day);
+
+CREATE TABLE IF NOT EXISTS visitor_types (
+	domain TEXT NOT NULL,
+	visitor_type TEXT NOT NULL,
+	day DATE NOT NULL,
+	visitor_hll {{sketch_type}} NOT NULL,
+	pageviews BIGINT NOT NULL DEFAULT 0,
+	UNIQUE (domain, day, visitor_type)
+);
+CREATE INDEX IF NOT EXISTS visitor_types_day_idx ON visitor_types (day DESC);
@@ -0,0 +1,23 @@
+-- Merges the partitions back into the former default partitions, which become
+-- plain tables again.
+
+ALTER TABLE pages DETACH PARTITION pages_default;
+INSERT INTO pages_default SELECT * FROM pages;
+DROP TABLE pages;
+ALTER TABLE pages_default RENAME TO pages;
+ALTER TABLE pages RENAME CONSTRAINT pages_default_domain_day_path_key TO pages_domain_day_path_key;
+ALTER INDEX pages_default_day_idx RENAME TO pages_day_idx;
+
+ALTER TABLE countries DETACH PARTITION countries_default;
+INSERT INTO countries_default SELECT * FROM countries;
+DROP TABLE countries;
+ALTER TABLE countries_default RENAME TO countries;
+ALTER TABLE countries RENAME CONSTRAINT countries_default_domain_day_country_key TO countries_domain_day_country_key;
+ALTER INDEX countries_default_day_idx RENAME TO countries_day_idx;
+
+ALTER TABLE sources DETACH PARTITION sources_default;
+INSERT INTO sources_default SELECT * FROM sources;
+DROP TABLE sources;
+ALTER TABLE sources_default RENAME TO sources;
+ALTER TABLE sources RENAME CONSTRAINT sources_default_domain_day_referrer_key TO sources_domain_day_referrer_key;
+ALTER INDEX sources_default_day_idx RENAME TO sources_day_idx;
@@ -0,0 +1,28 @@
+-- Partitions pages, countries and sources by month. The existing tables become
+-- their default partitions, holding the rows of the months without a partition
+-- of their own: the ones before this migration. Monthly partitions are created
+-- ahead of time by the server.
+
+ALTER TABLE pages RENAME TO pages_default;
+ALTER TABLE pages_default RENAME CONSTRAINT pages_domain_day_path_key TO pages_default_domain_day_path_key;
+ALTER INDEX pages_day_idx RENAME TO pages_default_day_idx;
+CREATE TABLE pages (LIKE pages_default INCLUDING DEFAULTS) PARTITION BY RANGE (day);
+ALTER TABLE pages ATTACH PARTITION pages_default DEFAULT;
+ALTER TABLE pages ADD UNIQUE (domain, day, path);
+CREATE INDEX pages_day_idx ON pages (day DESC);
+
+ALTER TABLE countries RENAME TO countries_default;
+ALTER TABLE countries_default RENAME CONSTRAINT countries_domain_day_country_key TO countries_default_domain_day_country_key;
+ALTER INDEX countries_day_idx RENAME TO countries_default_day_idx;
+CREATE TABLE countries (LIKE countries_default INCLUDING DEFAULTS) PARTITION BY RANGE (day);
+ALTER TABLE countries ATTACH PARTITION countries_default DEFAULT;
+ALTER TABLE countries ADD UNIQUE (domain, day, country);
+CREATE INDEX countries_day_idx ON countries (day DESC);
+
+ALTER TABLE sources RENAME TO sources_default;
+ALTER TABLE sources_default RENAME CONSTRAINT sources_domain_day_referrer_key TO sources_default_domain_day_referrer_key;
+ALTER INDEX sources_day_idx RENAME TO sources_default_day_idx;
+CREATE TABLE sources (LIKE sources_default INCLUDING DEFAULTS) PARTITION BY RANGE (day);
+ALTER TABLE sources ATTACH PARTITION sources_default DEFAULT;
+ALTER TABLE sources ADD UNIQUE (domain, day, referrer);
+CREATE INDEX sources_day_idx ON sources (day DESC);
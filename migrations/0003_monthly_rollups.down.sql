@@ -0,0 +1,4 @@
+DROP TABLE rollups;
+DROP TABLE sources_monthly;
+DROP TABLE countries_monthly;
+DROP TABLE pages_monthly;
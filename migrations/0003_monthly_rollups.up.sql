@@ -0,0 +1,41 @@
+-- Monthly rollups of pages, countries and sources: one row per month, labelled
+-- with its first day, holding the union of the month's daily sketches. The
+-- rollups table records the months rolled up, which are then answered from
+-- them.
+
+CREATE TABLE pages_monthly (
+	domain TEXT NOT NULL,
+	path TEXT NOT NULL,
+	day DATE NOT NULL,
+	visitor_hll {{sketch_type}} NOT NULL,
+	pageviews BIGINT NOT NULL DEFAULT 0,
+	UNIQUE (domain, day, path)
+);
+CREATE INDEX pages_monthly_day_idx ON pages_monthly (day DESC);
+
+CREATE TABLE countries_monthly (
+	domain TEXT NOT NULL,
+	country TEXT NOT NULL,
+	day DATE NOT NULL,
+	visitor_hll {{sketch_type}} NOT NULL,
+	pageviews BIGINT NOT NULL DEFAULT 0,
+	UNIQUE (domain, day, country)
+);
+CREATE INDEX countries_monthly_day_idx ON countries_monthly (day DESC);
+
+CREATE TABLE sources_monthly (
+	domain TEXT NOT NULL,
+	referrer TEXT NOT NULL,
+	day DATE NOT NULL,
+	visitor_hll {{sketch_type}} NOT NULL,
+	pageviews BIGINT NOT NULL DEFAULT 0,
+	UNIQUE (domain, day, referrer)
+);
+CREATE INDEX sources_monthly_day_idx ON sources_monthly (day DESC);
+
+CREATE TABLE rollups (
+	table_name TEXT NOT NULL,
+	month DATE NOT NULL,
+	rolled_up_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (table_name, month)
+);
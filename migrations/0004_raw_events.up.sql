@@ -0,0 +1,19 @@
+-- Individual pageviews, recorded when RAW_EVENTS_DAYS is set and pruned once
+-- they're older. They hold what was counted, without addresses or user
+-- agents, so that stats can be recomputed from them.
+
+CREATE TABLE events_raw (
+	id BIGSERIAL PRIMARY KEY,
+	recorded_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	domain TEXT NOT NULL,
+	path TEXT NOT NULL,
+	day DATE NOT NULL,
+	visitor TEXT NOT NULL,
+	environment TEXT NOT NULL,
+	visitor_type TEXT NOT NULL,
+	country TEXT NOT NULL,
+	referrer TEXT NOT NULL,
+	referrer_path TEXT NOT NULL
+);
+CREATE INDEX events_raw_domain_day_idx ON events_raw (domain, day);
+CREATE INDEX events_raw_recorded_at_idx ON events_raw (recorded_at);
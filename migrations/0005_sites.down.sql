@@ -0,0 +1,69 @@
+-- Keys the stats tables by domain again.
+
+ALTER TABLE pages ADD COLUMN domain TEXT;
+UPDATE pages SET domain = sites.domain FROM sites WHERE sites.id = pages.site_id;
+ALTER TABLE pages ALTER COLUMN domain SET NOT NULL;
+ALTER TABLE pages DROP COLUMN site_id;
+ALTER TABLE pages ADD UNIQUE (domain, day, path);
+
+ALTER TABLE countries ADD COLUMN domain TEXT;
+UPDATE countries SET domain = sites.domain FROM sites WHERE sites.id = countries.site_id;
+ALTER TABLE countries ALTER COLUMN domain SET NOT NULL;
+ALTER TABLE countries DROP COLUMN site_id;
+ALTER TABLE countries ADD UNIQUE (domain, day, country);
+
+ALTER TABLE sources ADD COLUMN domain TEXT;
+UPDATE sources SET domain = sites.domain FROM sites WHERE sites.id = sources.site_id;
+ALTER TABLE sources ALTER COLUMN domain SET NOT NULL;
+ALTER TABLE sources DROP COLUMN site_id;
+ALTER TABLE sources ADD UNIQUE (domain, day, referrer);
+
+ALTER TABLE page_countries ADD COLUMN domain TEXT;
+UPDATE page_countries SET domain = sites.domain FROM sites WHERE sites.id = page_countries.site_id;
+ALTER TABLE page_countries ALTER COLUMN domain SET NOT NULL;
+ALTER TABLE page_countries DROP COLUMN site_id;
+ALTER TABLE page_countries ADD UNIQUE (domain, day, path, country);
+
+ALTER TABLE page_sources ADD COLUMN domain TEXT;
+UPDATE page_sources SET domain = sites.domain FROM sites WHERE sites.id = page_sources.site_id;
+ALTER TABLE page_sources ALTER COLUMN domain SET NOT NULL;
+ALTER TABLE page_sources DROP COLUMN site_id;
+ALTER TABLE page_sources ADD UNIQUE (domain, day, path, referrer);
+
+ALTER TABLE referrer_paths ADD COLUMN domain TEXT;
+UPDATE referrer_paths SET domain = sites.domain FROM sites WHERE sites.id = referrer_paths.site_id;
+ALTER TABLE referrer_paths ALTER COLUMN domain SET NOT NULL;
+ALTER TABLE referrer_paths DROP COLUMN site_id;
+ALTER TABLE referrer_paths ADD UNIQUE (domain, day, referrer, path);
+
+ALTER TABLE environments ADD COLUMN domain TEXT;
+UPDATE environments SET domain = sites.domain FROM sites WHERE sites.id = environments.site_id;
+ALTER TABLE environments ALTER COLUMN domain SET NOT NULL;
+ALTER TABLE environments DROP COLUMN site_id;
+ALTER TABLE environments ADD UNIQUE (domain, day, environment);
+
+ALTER TABLE visitor_types ADD COLUMN domain TEXT;
+UPDATE visitor_types SET domain = sites.domain FROM sites WHERE sites.id = visitor_types.site_id;
+ALTER TABLE visitor_types ALTER COLUMN domain SET NOT NULL;
+ALTER TABLE visitor_types DROP COLUMN site_id;
+ALTER TABLE visitor_types ADD UNIQUE (domain, day, visitor_type);
+
+ALTER TABLE pages_monthly ADD COLUMN domain TEXT;
+UPDATE pages_monthly SET domain = sites.domain FROM sites WHERE sites.id = pages_monthly.site_id;
+ALTER TABLE pages_monthly ALTER COLUMN domain SET NOT NULL;
+ALTER TABLE pages_monthly DROP COLUMN site_id;
+ALTER TABLE pages_monthly ADD UNIQUE (domain, day, path);
+
+ALTER TABLE countries_monthly ADD COLUMN domain TEXT;
+UPDATE countries_monthly SET domain = sites.domain FROM sites WHERE sites.id = countries_monthly.site_id;
+ALTER TABLE countries_monthly ALTER COLUMN domain SET NOT NULL;
+ALTER TABLE countries_monthly DROP COLUMN site_id;
+ALTER TABLE countries_monthly ADD UNIQUE (domain, day, country);
+
+ALTER TABLE sources_monthly ADD COLUMN domain TEXT;
+UPDATE sources_monthly SET domain = sites.domain FROM sites WHERE sites.id = sources_monthly.site_id;
+ALTER TABLE sources_monthly ALTER COLUMN domain SET NOT NULL;
+ALTER TABLE sources_monthly DROP COLUMN site_id;
+ALTER TABLE sources_monthly ADD UNIQUE (domain, day, referrer);
+
+DROP TABLE sites;
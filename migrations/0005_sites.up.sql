@@ -0,0 +1,94 @@
+-- Sites identify the domains stats are recorded for, along with their
+-- settings and owner. The stats tables are keyed by site rather than by
+-- domain, the site's uniqueness constraints replacing the domain's, which are
+-- dropped along with their column. Digests, shares and returning visitors
+-- stay keyed by domain. Hypertables compressed by domain have to be
+-- decompressed first.
+
+CREATE TABLE sites (
+	id SERIAL PRIMARY KEY,
+	domain TEXT NOT NULL UNIQUE,
+	owner TEXT,
+	settings JSONB NOT NULL DEFAULT '{}',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+INSERT INTO sites (domain)
+SELECT domain FROM pages
+UNION SELECT domain FROM countries
+UNION SELECT domain FROM sources
+UNION SELECT domain FROM page_countries
+UNION SELECT domain FROM page_sources
+UNION SELECT domain FROM referrer_paths
+UNION SELECT domain FROM environments
+UNION SELECT domain FROM visitor_types
+UNION SELECT domain FROM pages_monthly
+UNION SELECT domain FROM countries_monthly
+UNION SELECT domain FROM sources_monthly
+ORDER BY domain;
+
+ALTER TABLE pages ADD COLUMN site_id INTEGER REFERENCES sites (id);
+UPDATE pages SET site_id = sites.id FROM sites WHERE sites.domain = pages.domain;
+ALTER TABLE pages ALTER COLUMN site_id SET NOT NULL;
+ALTER TABLE pages DROP COLUMN domain;
+ALTER TABLE pages ADD UNIQUE (site_id, day, path);
+
+ALTER TABLE countries ADD COLUMN site_id INTEGER REFERENCES sites (id);
+UPDATE countries SET site_id = sites.id FROM sites WHERE sites.domain = countries.domain;
+ALTER TABLE countries ALTER COLUMN site_id SET NOT NULL;
+ALTER TABLE countries DROP COLUMN domain;
+ALTER TABLE countries ADD UNIQUE (site_id, day, country);
+
+ALTER TABLE sources ADD COLUMN site_id INTEGER REFERENCES sites (id);
+UPDATE sources SET site_id = sites.id FROM sites WHERE sites.domain = sources.domain;
+ALTER TABLE sources ALTER COLUMN site_id SET NOT NULL;
+ALTER TABLE sources DROP COLUMN domain;
+ALTER TABLE sources ADD UNIQUE (site_id, day, referrer);
+
+ALTER TABLE page_countries ADD COLUMN site_id INTEGER REFERENCES sites (id);
+UPDATE page_countries SET site_id = sites.id FROM sites WHERE sites.domain = page_countries.domain;
+ALTER TABLE page_countries ALTER COLUMN site_id SET NOT NULL;
+ALTER TABLE page_countries DROP COLUMN domain;
+ALTER TABLE page_countries ADD UNIQUE (site_id, day, path, country);
+
+ALTER TABLE page_sources ADD COLUMN site_id INTEGER REFERENCES sites (id);
+UPDATE page_sources SET site_id = sites.id FROM sites WHERE sites.domain = page_sources.domain;
+ALTER TABLE page_sources ALTER COLUMN site_id SET NOT NULL;
+ALTER TABLE page_sources DROP COLUMN domain;
+ALTER TABLE page_sources ADD UNIQUE (site_id, day, path, referrer);
+
+ALTER TABLE referrer_paths ADD COLUMN site_id INTEGER REFERENCES sites (id);
+UPDATE referrer_paths SET site_id = sites.id FROM sites WHERE sites.domain = referrer_paths.domain;
+ALTER TABLE referrer_paths ALTER COLUMN site_id SET NOT NULL;
+ALTER TABLE referrer_paths DROP COLUMN domain;
+ALTER TABLE referrer_paths ADD UNIQUE (site_id, day, referrer, path);
+
+ALTER TABLE environments ADD COLUMN site_id INTEGER REFERENCES sites (id);
+UPDATE environments SET site_id = sites.id FROM sites WHERE sites.domain = environments.domain;
+ALTER TABLE environments ALTER COLUMN site_id SET NOT NULL;
+ALTER TABLE environments DROP COLUMN domain;
+ALTER TABLE environments ADD UNIQUE (site_id, day, environment);
+
+ALTER TABLE visitor_types ADD COLUMN site_id INTEGER REFERENCES sites (id);
+UPDATE visitor_types SET site_id = sites.id FROM sites WHERE sites.domain = visitor_types.domain;
+ALTER TABLE visitor_types ALTER COLUMN site_id SET NOT NULL;
+ALTER TABLE visitor_types DROP COLUMN domain;
+ALTER TABLE visitor_types ADD UNIQUE (site_id, day, visitor_type);
+
+ALTER TABLE pages_monthly ADD COLUMN site_id INTEGER REFERENCES sites (id);
+UPDATE pages_monthly SET site_id = sites.id FROM sites WHERE sites.domain = pages_monthly.domain;
+ALTER TABLE pages_monthly ALTER COLUMN site_id SET NOT NULL;
+ALTER TABLE pages_monthly DROP COLUMN domain;
+ALTER TABLE pages_monthly ADD UNIQUE (site_id, day, path);
+
+ALTER TABLE countries_monthly ADD COLUMN site_id INTEGER REFERENCES sites (id);
+UPDATE countries_monthly SET site_id = sites.id FROM sites WHERE sites.domain = countries_monthly.domain;
+ALTER TABLE countries_monthly ALTER COLUMN site_id SET NOT NULL;
+ALTER TABLE countries_monthly DROP COLUMN domain;
+ALTER TABLE countries_monthly ADD UNIQUE (site_id, day, country);
+
+ALTER TABLE sources_monthly ADD COLUMN site_id INTEGER REFERENCES sites (id);
+UPDATE sources_monthly SET site_id = sites.id FROM sites WHERE sites.domain = sources_monthly.domain;
+ALTER TABLE sources_monthly ALTER COLUMN site_id SET NOT NULL;
+ALTER TABLE sources_monthly DROP COLUMN domain;
+ALTER TABLE sources_monthly ADD UNIQUE (site_id, day, referrer);
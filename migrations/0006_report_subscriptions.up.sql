@@ -0,0 +1,15 @@
+-- Recipients of the periodic email reports of a domain. last_period is the
+-- first day of the last period reported, so that a report is only sent once
+-- however many instances run. The token identifies the recipient in the
+-- unsubscribe link of their reports.
+
+CREATE TABLE report_subscriptions (
+	id SERIAL PRIMARY KEY,
+	domain TEXT NOT NULL,
+	email TEXT NOT NULL,
+	frequency TEXT NOT NULL CHECK (frequency IN ('weekly', 'monthly')),
+	token TEXT NOT NULL UNIQUE,
+	last_period DATE,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	UNIQUE (domain, email, frequency)
+);
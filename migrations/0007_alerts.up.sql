@@ -0,0 +1,19 @@
+-- Alerts on a domain's traffic, evaluated on the raw event log. A spike
+-- alert fires when the visitors of the last hour are factor times the hourly
+-- average of the day before it, a drop alert when there hasn't been a
+-- pageview for hours. Each is delivered by email or to a webhook, once when
+-- it starts firing.
+
+CREATE TABLE alerts (
+	id SERIAL PRIMARY KEY,
+	domain TEXT NOT NULL,
+	kind TEXT NOT NULL CHECK (kind IN ('spike', 'drop')),
+	factor DOUBLE PRECISION NOT NULL DEFAULT 3,
+	hours INTEGER NOT NULL DEFAULT 2,
+	email TEXT,
+	webhook_url TEXT,
+	firing BOOLEAN NOT NULL DEFAULT false,
+	fired_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	CHECK ((email IS NULL) <> (webhook_url IS NULL))
+);
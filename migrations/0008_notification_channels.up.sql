@@ -0,0 +1,14 @@
+-- Where the events of a site are sent: an email address, a webhook, or a
+-- Slack or Discord webhook, each getting the events listed. last_report is
+-- the first day of the last week whose report was sent to the channel.
+
+CREATE TABLE notification_channels (
+	id SERIAL PRIMARY KEY,
+	domain TEXT NOT NULL,
+	kind TEXT NOT NULL CHECK (kind IN ('email', 'webhook', 'slack', 'discord')),
+	target TEXT NOT NULL,
+	events TEXT[] NOT NULL,
+	last_report DATE,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX notification_channels_domain_idx ON notification_channels (domain);
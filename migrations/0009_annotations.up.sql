@@ -0,0 +1,14 @@
+-- Notes on a domain's stats, like a deploy, a campaign or an incident,
+-- covering the days from start_day to end_day. They're returned with the
+-- stats of the ranges they overlap.
+
+CREATE TABLE annotations (
+	id SERIAL PRIMARY KEY,
+	domain TEXT NOT NULL,
+	start_day DATE NOT NULL,
+	end_day DATE NOT NULL,
+	text TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	CHECK (start_day <= end_day)
+);
+CREATE INDEX annotations_domain_idx ON annotations (domain, start_day);
@@ -0,0 +1,3 @@
+DROP TABLE tls_certificates;
+DROP TABLE acme_challenges;
+DROP TABLE acme_accounts;
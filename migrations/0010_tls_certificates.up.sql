@@ -0,0 +1,24 @@
+-- The certificates obtained from the ACME server for TLS_AUTOCERT, along
+-- with the account they're ordered with and the HTTP-01 challenges being
+-- validated, so that every instance serves the same certificate and can
+-- answer the challenges of another.
+
+CREATE TABLE acme_accounts (
+	directory_url TEXT PRIMARY KEY,
+	private_key TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE acme_challenges (
+	token TEXT PRIMARY KEY,
+	key_authorization TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE tls_certificates (
+	domain TEXT PRIMARY KEY,
+	certificate TEXT NOT NULL,
+	private_key TEXT NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
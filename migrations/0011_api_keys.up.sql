@@ -0,0 +1,9 @@
+-- API keys issued through /admin/keys, each granting what API_KEY does until
+-- it's revoked, so that integrations can be given their own.
+
+CREATE TABLE api_keys (
+	id SERIAL PRIMARY KEY,
+	key TEXT NOT NULL UNIQUE,
+	name TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
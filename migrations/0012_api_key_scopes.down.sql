@@ -0,0 +1,2 @@
+ALTER TABLE api_keys DROP COLUMN scopes;
+ALTER TABLE api_keys DROP COLUMN domains;
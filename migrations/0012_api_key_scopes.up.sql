@@ -0,0 +1,7 @@
+-- Keys are restricted to what they're issued for: the capabilities of their
+-- scopes, over their domains or every domain when they have none. The keys
+-- issued before keep granting everything.
+
+ALTER TABLE api_keys ADD COLUMN domains TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE api_keys ADD COLUMN scopes TEXT[] NOT NULL DEFAULT '{admin,read-stats,write-events}';
+ALTER TABLE api_keys ALTER COLUMN scopes SET DEFAULT '{read-stats}';
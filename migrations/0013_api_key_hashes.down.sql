@@ -0,0 +1,11 @@
+-- Keys can't be recovered from their hashes, so they stop working and have
+-- to be issued again.
+
+ALTER TABLE api_keys DROP COLUMN expires_at;
+
+ALTER TABLE api_keys ADD COLUMN key TEXT;
+UPDATE api_keys SET key = key_hash;
+ALTER TABLE api_keys ALTER COLUMN key SET NOT NULL;
+ALTER TABLE api_keys ADD UNIQUE (key);
+ALTER TABLE api_keys DROP COLUMN prefix;
+ALTER TABLE api_keys DROP COLUMN key_hash;
@@ -0,0 +1,13 @@
+-- Keys are stored as the SHA-256 of their value, so that the database can't
+-- leak them, along with their first characters to recognize them by. Keys
+-- can expire, which lets a rotated key keep working until its replacement
+-- is deployed.
+
+ALTER TABLE api_keys ADD COLUMN key_hash TEXT;
+ALTER TABLE api_keys ADD COLUMN prefix TEXT NOT NULL DEFAULT '';
+UPDATE api_keys SET key_hash = encode(sha256(convert_to(key, 'UTF8')), 'hex'), prefix = left(key, 6);
+ALTER TABLE api_keys ALTER COLUMN key_hash SET NOT NULL;
+ALTER TABLE api_keys ADD UNIQUE (key_hash);
+ALTER TABLE api_keys DROP COLUMN key;
+
+ALTER TABLE api_keys ADD COLUMN expires_at TIMESTAMPTZ;
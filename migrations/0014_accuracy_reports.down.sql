@@ -0,0 +1 @@
+DROP TABLE accuracy_reports;
@@ -0,0 +1,15 @@
+-- The nightly comparisons of the visitors the sketches of a day's pages
+-- estimate with the exact counts of the raw event log. Errors are relative
+-- to the exact counts, and the day is the key so that a single instance
+-- reports on each.
+
+CREATE TABLE accuracy_reports (
+	day DATE PRIMARY KEY,
+	checked_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	sampled_rows INTEGER NOT NULL,
+	expected_error DOUBLE PRECISION NOT NULL,
+	mean_error DOUBLE PRECISION NOT NULL,
+	p95_error DOUBLE PRECISION NOT NULL,
+	max_error DOUBLE PRECISION NOT NULL,
+	within_expected DOUBLE PRECISION NOT NULL
+);
@@ -0,0 +1,8 @@
+-- The sessions ended by logging out before they expire. Sessions are signed
+-- rather than stored, so their cookies would otherwise keep working if they
+-- were copied. Rows are deleted once the sessions would have expired.
+
+CREATE TABLE revoked_sessions (
+	signature TEXT PRIMARY KEY,
+	expires_at TIMESTAMPTZ NOT NULL
+);
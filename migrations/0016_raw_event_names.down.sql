@@ -0,0 +1,5 @@
+-- Drops the custom events, keeping the pageviews.
+
+DROP INDEX events_raw_domain_visitor_idx;
+DELETE FROM events_raw WHERE event <> 'pageview';
+ALTER TABLE events_raw DROP COLUMN event;
@@ -0,0 +1,5 @@
+-- Raw events are pageviews or the custom events sites send, named by their
+-- event column, so that goals can combine both within a visitor's session.
+
+ALTER TABLE events_raw ADD COLUMN event TEXT NOT NULL DEFAULT 'pageview';
+CREATE INDEX events_raw_domain_visitor_idx ON events_raw (domain, visitor, recorded_at);
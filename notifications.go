@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// How many goal completions can wait to be notified before new ones are
+// dropped
+const notificationQueueSize = 1000
+
+// Discord rejects messages longer than this
+const discordMaxLength = 2000
+
+// notificationEvents are the events a site's channels can be notified of.
+var notificationEvents = []string{"alerts", "goals", "reports"}
+
+// notification is an event of a site, sent to the channels that want it.
+type notification struct {
+	Domain string
+	// One of notificationEvents
+	Event string
+	Title string
+	Text  string
+	Time  time.Time
+}
+
+// notifier delivers notifications somewhere.
+type notifier interface {
+	notify(n notification) error
+}
+
+// newNotifier returns the notifier of a kind of channel sending to target,
+// an email address or a webhook URL.
+func (s *server) newNotifier(kind string, target string) (notifier, error) {
+	switch kind {
+	case "email":
+		if s.cfg.SMTPURL == nil {
+			return nil, errors.New("SMTP_URL is not set")
+		}
+		return emailNotifier{s: s, address: target}, nil
+	case "webhook":
+		return webhookNotifier{url: target}, nil
+	case "slack":
+		return slackNotifier{url: target}, nil
+	case "discord":
+		return discordNotifier{url: target}, nil
+	}
+	return nil, fmt.Errorf("unknown notification channel %q", kind)
+}
+
+// emailNotifier emails notifications through SMTP_URL.
+type emailNotifier struct {
+	s       *server
+	address string
+}
+
+func (e emailNotifier) notify(n notification) error {
+	msg, err := e.s.emailMessage(e.address, n.Title, n.Text+"\n", n.Time)
+	if err != nil {
+		return fmt.Errorf("failed to write email: %w", err)
+	}
+	return e.s.sendEmail(e.address, msg)
+}
+
+// webhookNotifier posts notifications as JSON.
+type webhookNotifier struct {
+	url string
+}
+
+func (h webhookNotifier) notify(n notification) error {
+	return postJSON(h.url, struct {
+		Domain  string    `json:"domain"`
+		Event   string    `json:"event"`
+		Title   string    `json:"title"`
+		Message string    `json:"message"`
+		Time    time.Time `json:"time"`
+	}{n.Domain, n.Event, n.Title, n.Text, n.Time.UTC()})
+}
+
+// slackNotifier posts notifications to a Slack incoming webhook.
+type slackNotifier struct {
+	url string
+}
+
+func (h slackNotifier) notify(n notification) error {
+	return postJSON(h.url, struct {
+		Text string `json:"text"`
+	}{"*" + n.Title + "*\n" + n.Text})
+}
+
+// discordNotifier posts notifications to a Discord webhook, cut to the
+// length Discord accepts.
+type discordNotifier struct {
+	url string
+}
+
+func (h discordNotifier) notify(n notification) error {
+	content := []rune("**" + n.Title + "**\n" + n.Text)
+	if len(content) > discordMaxLength {
+		content = append(content[:discordMaxLength-1], '…')
+	}
+	return postJSON(h.url, struct {
+		Content string `json:"content"`
+	}{string(content)})
+}
+
+// postJSON posts body as JSON to url, failing unless it's accepted.
+func postJSON(url string, body any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to post to the webhook: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// notificationChannel is where a site's events are sent.
+type notificationChannel struct {
+	ID     int64  `json:"id"`
+	Domain string `json:"domain"`
+	// "email", "webhook", "slack" or "discord"
+	Kind string `json:"kind"`
+	// The email address or the webhook URL notifications are sent to
+	Target    string    `json:"target"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// The columns of a notification channel, in the order of its fields
+const notificationChannelColumns = `id, domain, kind, target, events, created_at`
+
+// scanNotificationChannel scans the columns of a notification channel.
+func scanNotificationChannel(row interface{ Scan(...any) error }) (notificationChannel, error) {
+	var c notificationChannel
+	err := row.Scan(&c.ID, &c.Domain, &c.Kind, &c.Target, pq.Array(&c.Events), &c.CreatedAt)
+	return c, err
+}
+
+// listNotificationChannels returns the channels of a domain, or all of
+// them, that want event, or any event when it's empty.
+func (s *server) listNotificationChannels(domain string, event string) ([]notificationChannel, error) {
+	rows, err := s.db.Query(`
+	SELECT `+notificationChannelColumns+` FROM notification_channels
+	WHERE ($1 = '' OR domain = $1) AND ($2 = '' OR $2 = ANY(events))
+	ORDER BY domain, id
+	`, domain, event)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notification channels: %w", err)
+	}
+	defer rows.Close()
+
+	channels := []notificationChannel{}
+	for rows.Next() {
+		c, err := scanNotificationChannel(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan notification channel: %w", err)
+		}
+		channels = append(channels, c)
+	}
+	return channels, rows.Err()
+}
+
+// notifySite sends a notification to the channels of its site that want
+// it. Channels failing are logged, without keeping the others from being
+// notified.
+func (s *server) notifySite(n notification) error {
+	channels, err := s.listNotificationChannels(n.Domain, n.Event)
+	if err != nil {
+		return err
+	}
+	for _, c := range channels {
+		if err := s.notifyChannel(c, n); err != nil {
+			s.logger.Error("Failed to notify channel", slog.String("domain", c.Domain), slog.Int64("channel", c.ID), slog.String("kind", c.Kind), slog.String("error", err.Error()))
+		}
+	}
+	return nil
+}
+
+// notifyChannel sends a notification to a channel.
+func (s *server) notifyChannel(c notificationChannel, n notification) error {
+	channel, err := s.newNotifier(c.Kind, c.Target)
+	if err != nil {
+		return err
+	}
+	return channel.notify(n)
+}
+
+// notifyGoalCompletions queues the notifications of the goals a pageview or
+// a custom event completes. They're dropped when the queue is full rather
+// than slowing tracking down.
+func (s *server) notifyGoalCompletions(pv pageview, event string, now time.Time) {
+	if s.notifications == nil {
+		return
+	}
+	for _, g := range s.goals(pv.domain) {
+		completed, err := s.completesGoal(g, pv, event)
+		if err != nil {
+			s.logger.Error("Failed to check goal completion", slog.String("domain", pv.domain), slog.String("goal", g.Name), slog.String("error", err.Error()))
+		}
+		if !completed {
+			continue
+		}
+		text := fmt.Sprintf("A visitor viewed %s.", g.Path)
+		switch {
+		case g.Path == "":
+			text = fmt.Sprintf("A visitor fired %s on %s.", g.Event, pv.path)
+		case g.Event != "":
+			text = fmt.Sprintf("A visitor viewed %s and fired %s in the same session.", g.Path, g.Event)
+		}
+		n := notification{
+			Domain: pv.domain,
+			Event:  "goals",
+			Title:  fmt.Sprintf("Goal %s completed on %s", g.Name, pv.domain),
+			Text:   text,
+			Time:   now,
+		}
+		select {
+		case s.notifications <- n:
+		default:
+			s.logger.Warn("Dropped goal notification, the queue is full", slog.String("domain", pv.domain), slog.String("goal", g.Name))
+		}
+	}
+}
+
+// deliverNotifications sends the queued notifications to their sites'
+// channels. It never returns.
+func (s *server) deliverNotifications() {
+	for n := range s.notifications {
+		if err := s.notifySite(n); err != nil {
+			s.logger.Error("Failed to notify site", slog.String("domain", n.Domain), slog.String("error", err.Error()))
+		}
+	}
+}
+
+// handleNotificationChannels lists the notification channels (GET), adds
+// one to a site (POST) or removes one (DELETE).
+func (s *server) handleNotificationChannels(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	switch r.Method {
+	case http.MethodGet:
+		channels, err := s.listNotificationChannels(query.Get("domain"), "")
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to query notification channels", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(channels)
+
+	case http.MethodPost:
+		c, ok := parseNotificationChannel(w, query)
+		if !ok {
+			return
+		}
+		if c.Kind == "email" && s.cfg.SMTPURL == nil {
+			writeError(w, http.StatusInternalServerError, errNotConfigured, "SMTP_URL is not set")
+			return
+		}
+
+		c, err := scanNotificationChannel(s.db.QueryRow(`
+		INSERT INTO notification_channels (domain, kind, target, events)
+		VALUES ($1, $2, $3, $4)
+		RETURNING `+notificationChannelColumns, c.Domain, c.Kind, c.Target, pq.Array(c.Events)))
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to create notification channel", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(c)
+
+	case http.MethodDelete:
+		id, err := strconv.ParseInt(query.Get("id"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid id parameter, expected the id of a channel")
+			return
+		}
+
+		if _, err := s.db.Exec(`DELETE FROM notification_channels WHERE id = $1`, id); err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to delete notification channel", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// parseNotificationChannel returns the channel described by the query
+// parameters, replying with an error and returning false when they're
+// invalid. Channels get every event unless told otherwise.
+func parseNotificationChannel(w http.ResponseWriter, query url.Values) (notificationChannel, bool) {
+	c := notificationChannel{Domain: query.Get("domain"), Kind: query.Get("kind"), Target: query.Get("target"), Events: notificationEvents}
+	if c.Domain == "" {
+		writeError(w, http.StatusBadRequest, errMissingParameter, "Missing domain parameter")
+		return c, false
+	}
+	if c.Target == "" {
+		writeError(w, http.StatusBadRequest, errMissingParameter, "Missing target parameter")
+		return c, false
+	}
+
+	switch c.Kind {
+	case "email":
+		address, err := mail.ParseAddress(c.Target)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid target parameter, expected an email address")
+			return c, false
+		}
+		c.Target = address.Address
+	case "webhook", "slack", "discord":
+		u, err := url.Parse(c.Target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid target parameter, expected a webhook URL")
+			return c, false
+		}
+	default:
+		writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid kind parameter, expected email, webhook, slack or discord")
+		return c, false
+	}
+
+	if value := query.Get("events"); value != "" {
+		c.Events = nil
+		for _, event := range strings.Split(value, ",") {
+			event = strings.TrimSpace(event)
+			if !slices.Contains(notificationEvents, event) {
+				writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid events parameter, expected a comma-separated list of alerts, goals and reports")
+				return c, false
+			}
+			if !slices.Contains(c.Events, event) {
+				c.Events = append(c.Events, event)
+			}
+		}
+	}
+	return c, true
+}
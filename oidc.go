@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long the signing keys of the issuer are used before being fetched
+	// again
+	oidcKeysTTL = time.Hour
+	// How often the keys can be fetched again, when a token is signed with
+	// one that isn't known yet, which happens when the issuer rotates them
+	oidcRefreshInterval = time.Minute
+	// How far the clocks of the issuer and the server can be apart
+	oidcClockSkew = time.Minute
+)
+
+// oidcVerifier validates the JWTs of the OIDC_ISSUER, signed with RS256 or
+// ES256 by one of the keys it publishes and issued for OIDC_AUDIENCE. They
+// grant reading the stats of the domains of OIDC_DOMAINS_CLAIM, or of every
+// domain when it isn't set. A nil verifier doesn't accept any token.
+type oidcVerifier struct {
+	issuer       string
+	audience     string
+	domainsClaim string
+	client       *http.Client
+
+	mu        sync.Mutex
+	keys      []oidcKey
+	fetched   time.Time
+	attempted time.Time
+}
+
+// oidcKey is a signing key of the issuer, of its JWKS.
+type oidcKey struct {
+	id  string
+	key crypto.PublicKey
+}
+
+// newOIDCVerifier returns the verifier of the configuration, or nil if
+// tokens aren't accepted.
+func newOIDCVerifier(cfg Config) *oidcVerifier {
+	if cfg.OIDCIssuer == "" {
+		return nil
+	}
+	return &oidcVerifier{
+		issuer:       cfg.OIDCIssuer,
+		audience:     cfg.OIDCAudience,
+		domainsClaim: cfg.OIDCDomainsClaim,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// bearerToken returns the token of the Authorization header, if any.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// audience is the aud claim, a single audience or a list of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// verify returns what a token grants, as an issued key would, or nil if it's
+// invalid, expired or not meant for this server. An error is only returned
+// when the keys of the issuer can't be fetched.
+func (v *oidcVerifier) verify(ctx context.Context, token string) (*apiKey, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if !decodeJWTPart(parts[0], &header) {
+		return nil, nil
+	}
+	// The algorithm the token claims is only trusted among those expected,
+	// so that "none" or HMAC signatures with a public key are refused
+	if header.Alg != "RS256" && header.Alg != "ES256" {
+		return nil, nil
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil
+	}
+
+	keys, err := v.keysFor(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	verified := false
+	for _, k := range keys {
+		if header.Kid != "" && k.id != header.Kid {
+			continue
+		}
+		if verifyJWTSignature(header.Alg, k.key, digest[:], signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, nil
+	}
+
+	var claims map[string]json.RawMessage
+	if !decodeJWTPart(parts[1], &claims) {
+		return nil, nil
+	}
+	var registered struct {
+		Issuer    string   `json:"iss"`
+		Subject   string   `json:"sub"`
+		Audience  audience `json:"aud"`
+		ExpiresAt *float64 `json:"exp"`
+		NotBefore *float64 `json:"nbf"`
+	}
+	if !decodeJWTPart(parts[1], &registered) {
+		return nil, nil
+	}
+	now := time.Now()
+	if registered.Issuer != v.issuer || !slices.Contains(registered.Audience, v.audience) {
+		return nil, nil
+	}
+	if registered.ExpiresAt == nil || now.Add(-oidcClockSkew).After(time.Unix(int64(*registered.ExpiresAt), 0)) {
+		return nil, nil
+	}
+	if registered.NotBefore != nil && now.Add(oidcClockSkew).Before(time.Unix(int64(*registered.NotBefore), 0)) {
+		return nil, nil
+	}
+
+	granted := &apiKey{Name: registered.Subject, Domains: []string{}, Scopes: []string{scopeReadStats}}
+	if v.domainsClaim != "" {
+		domains, ok := claimedDomains(claims[v.domainsClaim])
+		// A token without domains grants none, rather than every one
+		if !ok || len(domains) == 0 {
+			return nil, nil
+		}
+		granted.Domains = domains
+	}
+	return granted, nil
+}
+
+// claimedDomains returns the domains of a claim, a list of them or a string
+// of them separated by commas or spaces.
+func claimedDomains(claim json.RawMessage) ([]string, bool) {
+	if claim == nil {
+		return nil, false
+	}
+	var values []string
+	var joined string
+	if err := json.Unmarshal(claim, &joined); err == nil {
+		values = strings.FieldsFunc(joined, func(r rune) bool { return r == ',' || r == ' ' })
+	} else if err := json.Unmarshal(claim, &values); err != nil {
+		return nil, false
+	}
+	domains := []string{}
+	for _, domain := range values {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains, true
+}
+
+// decodeJWTPart decodes the base64url-encoded JSON of the header or the
+// claims of a token into v.
+func decodeJWTPart(part string, v any) bool {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(data, v) == nil
+}
+
+// verifyJWTSignature reports whether signature is the signature of digest
+// with alg by key.
+func verifyJWTSignature(alg string, key crypto.PublicKey, digest []byte, signature []byte) bool {
+	switch alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, signature) == nil
+	case "ES256":
+		// The signature is r and s, 32 bytes each
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve != elliptic.P256() || len(signature) != 64 {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(pub, digest, r, s)
+	}
+	return false
+}
+
+// keysFor returns the signing keys of the issuer, fetched again once they're
+// stale, or when none of them has the id a token was signed with.
+func (v *oidcVerifier) keysFor(ctx context.Context, id string) ([]oidcKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := time.Now()
+	stale := v.fetched.IsZero() || now.Sub(v.fetched) > oidcKeysTTL
+	missing := id != "" && !slices.ContainsFunc(v.keys, func(k oidcKey) bool { return k.id == id })
+	if (stale || missing) && now.Sub(v.attempted) > oidcRefreshInterval {
+		v.attempted = now
+		keys, err := v.fetchKeys(ctx)
+		// The previous keys are kept while the issuer can't be reached
+		if err != nil && v.keys == nil {
+			return nil, err
+		}
+		if err == nil {
+			v.keys, v.fetched = keys, now
+		}
+	}
+	if v.keys == nil {
+		return nil, fmt.Errorf("the keys of %s couldn't be fetched yet", v.issuer)
+	}
+	return v.keys, nil
+}
+
+// fetchKeys fetches the signing keys of the issuer, from the jwks_uri of its
+// discovery document. The keys of other types than RSA and P-256 are left
+// out.
+func (v *oidcVerifier) fetchKeys(ctx context.Context) ([]oidcKey, error) {
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := v.getJSON(ctx, strings.TrimSuffix(v.issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if discovery.Issuer != v.issuer {
+		return nil, fmt.Errorf("the discovery document of %s is for the issuer %q", v.issuer, discovery.Issuer)
+	}
+	if discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("the discovery document of %s has no jwks_uri", v.issuer)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := v.getJSON(ctx, discovery.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := []oidcKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		switch {
+		case jwk.Kty == "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+			if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+				continue
+			}
+			exponent := new(big.Int).SetBytes(e)
+			keys = append(keys, oidcKey{id: jwk.Kid, key: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}})
+		case jwk.Kty == "EC" && jwk.Crv == "P-256":
+			x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+				continue
+			}
+			keys = append(keys, oidcKey{id: jwk.Kid, key: pub})
+		}
+	}
+	return keys, nil
+}
+
+// getJSON decodes the JSON document at url into target.
+func (v *oidcVerifier) getJSON(ctx context.Context, url string, target any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", url, err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch %s: %s", url, resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(target); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", url, err)
+	}
+	return nil
+}
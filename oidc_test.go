@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIssuer is an OIDC issuer publishing its discovery document and JWKS.
+type testIssuer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	jwks    []map[string]string
+	fetches int
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	issuer := &testIssuer{}
+	issuer.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		issuer.mu.Lock()
+		defer issuer.mu.Unlock()
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": issuer.URL, "jwks_uri": issuer.URL + "/jwks"})
+		case "/jwks":
+			issuer.fetches++
+			json.NewEncoder(w).Encode(map[string]any{"keys": issuer.jwks})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+// publish replaces the keys of the issuer.
+func (issuer *testIssuer) publish(jwks ...map[string]string) {
+	issuer.mu.Lock()
+	defer issuer.mu.Unlock()
+	issuer.jwks = jwks
+}
+
+func b64(data []byte) string { return base64.RawURLEncoding.EncodeToString(data) }
+
+func rsaJWK(id string, key *rsa.PrivateKey) map[string]string {
+	return map[string]string{"kty": "RSA", "kid": id, "use": "sig", "n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes())}
+}
+
+func ecJWK(id string, crv string, key *ecdsa.PrivateKey) map[string]string {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	return map[string]string{"kty": "EC", "kid": id, "crv": crv, "x": b64(key.X.FillBytes(make([]byte, size))), "y": b64(key.Y.FillBytes(make([]byte, size)))}
+}
+
+// signJWT returns a token of the claims, signed with key according to alg,
+// or left unsigned for "none".
+func signJWT(t *testing.T, alg string, kid string, key any, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch alg {
+	case "RS256":
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case "ES256":
+		priv := key.(*ecdsa.PrivateKey)
+		r, s, err := ecdsa.Sign(rand.Reader, priv, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (priv.Curve.Params().BitSize + 7) / 8
+		signature = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	case "HS256":
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+	return signed + "." + b64(signature)
+}
+
+func TestOIDCVerify(t *testing.T) {
+	issuer := newTestIssuer(t)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := newOIDCVerifier(Config{OIDCIssuer: issuer.URL, OIDCAudience: "potato", OIDCDomainsClaim: "domains"})
+	now := time.Now().Unix()
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{"iss": issuer.URL, "sub": "alice", "aud": "potato", "exp": now + 300, "domains": "example.com"}
+		for name, value := range changes {
+			if value == nil {
+				delete(c, name)
+			} else {
+				c[name] = value
+			}
+		}
+		return c
+	}
+
+	// An RSA public key as an HMAC secret, as in the algorithm confusion
+	// attack
+	rsaPublic := []byte(rsaJWK("rsa", rsaKey)["n"])
+	// A P-256 key claimed to be on another curve, with the coordinates of
+	// the P-384 key
+	swapped := ecJWK("swapped", "P-256", p384Key)
+	issuer.publish(rsaJWK("rsa", rsaKey), ecJWK("ec", "P-256", ecKey), ecJWK("p384", "P-384", p384Key), swapped)
+
+	tests := []struct {
+		name  string
+		token string
+		want  bool
+	}{
+		{"RS256", signJWT(t, "RS256", "rsa", rsaKey, claims(nil)), true},
+		{"ES256", signJWT(t, "ES256", "ec", ecKey, claims(nil)), true},
+		{"without kid", signJWT(t, "RS256", "", rsaKey, claims(nil)), true},
+		{"audience list", signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]any{"aud": []string{"other", "potato"}})), true},
+		{"expired within the clock skew", signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]any{"exp": now - 30})), true},
+		{"alg none", signJWT(t, "none", "rsa", nil, claims(nil)), false},
+		{"alg none without signature", strings.TrimSuffix(signJWT(t, "none", "rsa", nil, claims(nil)), "."), false},
+		{"HS256 with the public key", signJWT(t, "HS256", "rsa", rsaPublic, claims(nil)), false},
+		{"RS256 signature claimed as ES256", withHeader(signJWT(t, "RS256", "rsa", rsaKey, claims(nil)), `{"alg":"ES256","kid":"rsa"}`), false},
+		{"ES256 signature claimed as RS256", withHeader(signJWT(t, "ES256", "ec", ecKey, claims(nil)), `{"alg":"RS256","kid":"ec"}`), false},
+		{"wrong audience", signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]any{"aud": "other"})), false},
+		{"wrong issuer", signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]any{"iss": "https://evil.example.com"})), false},
+		{"expired", signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]any{"exp": now - 3600})), false},
+		{"without expiry", signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]any{"exp": nil})), false},
+		{"not yet valid", signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]any{"nbf": now + 3600})), false},
+		{"without domains", signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]any{"domains": nil})), false},
+		{"signed by another key", signJWT(t, "RS256", "rsa", mustRSAKey(t), claims(nil)), false},
+		{"signed with the key of another kid", signJWT(t, "ES256", "rsa", ecKey, claims(nil)), false},
+		{"signed with a P-384 key", signJWT(t, "ES256", "p384", p384Key, claims(nil)), false},
+		{"P-384 key swapped into a P-256 JWK", signJWT(t, "ES256", "swapped", p384Key, claims(nil)), false},
+		{"tampered claims", tamperClaims(signJWT(t, "RS256", "rsa", rsaKey, claims(nil)), claims(map[string]any{"domains": "other.com"})), false},
+		{"not a JWT", "not-a-jwt", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			granted, err := v.verify(context.Background(), tt.token)
+			if err != nil {
+				t.Fatalf("verify: %v", err)
+			}
+			if got := granted != nil; got != tt.want {
+				t.Errorf("verify() granted %v, want %v", granted, tt.want)
+			}
+			if granted != nil && (!granted.allows(scopeReadStats, "example.com") || granted.allows(scopeReadStats, "other.com")) {
+				t.Errorf("verify() granted %v, want example.com only", granted)
+			}
+		})
+	}
+}
+
+// TestOIDCKeyRotation checks that the keys are fetched again when a token
+// is signed with a new one, but not more than once a minute.
+func TestOIDCKeyRotation(t *testing.T) {
+	issuer := newTestIssuer(t)
+	oldKey, newKey := mustRSAKey(t), mustRSAKey(t)
+	issuer.publish(rsaJWK("old", oldKey))
+
+	v := newOIDCVerifier(Config{OIDCIssuer: issuer.URL, OIDCAudience: "potato"})
+	claims := map[string]any{"iss": issuer.URL, "aud": "potato", "exp": time.Now().Unix() + 300}
+	verify := func(kid string, key *rsa.PrivateKey) bool {
+		granted, err := v.verify(context.Background(), signJWT(t, "RS256", kid, key, claims))
+		if err != nil {
+			t.Fatalf("verify: %v", err)
+		}
+		return granted != nil
+	}
+
+	if !verify("old", oldKey) {
+		t.Fatalf("the token of the published key was refused")
+	}
+	issuer.publish(rsaJWK("old", oldKey), rsaJWK("new", newKey))
+	if verify("new", newKey) {
+		t.Errorf("the keys were fetched again right after being fetched")
+	}
+
+	v.mu.Lock()
+	v.attempted = v.attempted.Add(-oidcRefreshInterval - time.Second)
+	v.mu.Unlock()
+	if !verify("new", newKey) {
+		t.Errorf("the token of the new key was refused once the keys could be fetched again")
+	}
+	if issuer.fetches != 2 {
+		t.Errorf("the keys were fetched %d times, want 2", issuer.fetches)
+	}
+
+	// The keys are kept while the issuer is down
+	issuer.Close()
+	v.mu.Lock()
+	v.fetched = v.fetched.Add(-oidcKeysTTL - time.Second)
+	v.attempted = v.attempted.Add(-oidcRefreshInterval - time.Second)
+	v.mu.Unlock()
+	if !verify("old", oldKey) {
+		t.Errorf("the keys weren't kept while the issuer is down")
+	}
+}
+
+func TestOIDCUnreachableIssuer(t *testing.T) {
+	issuer := newTestIssuer(t)
+	issuer.Close()
+
+	v := newOIDCVerifier(Config{OIDCIssuer: issuer.URL, OIDCAudience: "potato"})
+	token := signJWT(t, "RS256", "rsa", mustRSAKey(t), map[string]any{"iss": issuer.URL, "aud": "potato", "exp": time.Now().Unix() + 300})
+	if _, err := v.verify(context.Background(), token); err == nil {
+		t.Errorf("verify() didn't fail without the keys of the issuer")
+	}
+}
+
+func mustRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// withHeader replaces the header of a token, keeping its signature.
+func withHeader(token string, header string) string {
+	parts := strings.Split(token, ".")
+	return b64([]byte(header)) + "." + parts[1] + "." + parts[2]
+}
+
+// tamperClaims replaces the claims of a token, keeping its signature.
+func tamperClaims(token string, claims map[string]any) string {
+	parts := strings.Split(token, ".")
+	payload, _ := json.Marshal(claims)
+	return parts[0] + "." + b64(payload) + "." + parts[2]
+}
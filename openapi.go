@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// openAPISchemas are the component schemas responses refer to.
+var openAPISchemas = map[string]any{
+	"Error": map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"error": map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"code":    map[string]any{"type": "string"},
+					"message": map[string]any{"type": "string"},
+				},
+				"required": []string{"code", "message"},
+			},
+		},
+		"required": []string{"error"},
+	},
+	"StatsResponse": map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"total":       map[string]any{"type": "integer", "description": "The number of results matching the query, regardless of the page returned"},
+			"limit":       map[string]any{"type": "integer"},
+			"offset":      map[string]any{"type": "integer"},
+			"results":     map[string]any{"type": "array", "items": map[string]any{"type": "object"}},
+			"comparison":  map[string]any{"type": "object", "description": "The totals of the range and of the previous one, when compare is set"},
+			"annotations": map[string]any{"type": "array", "description": "The domain's annotations overlapping the range", "items": map[string]any{"type": "object"}},
+		},
+		"required": []string{"total", "limit", "offset", "results", "annotations"},
+	},
+	"Version": map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"version":    map[string]any{"type": "string", "description": "The release, dev when unknown"},
+			"commit":     map[string]any{"type": "string"},
+			"build_date": map[string]any{"type": "string"},
+			"go_version": map[string]any{"type": "string"},
+		},
+		"required": []string{"version", "commit", "build_date", "go_version"},
+	},
+}
+
+// openAPIDocument returns the OpenAPI 3 document describing the routes.
+func openAPIDocument(routes []apiRoute) map[string]any {
+	paths := map[string]any{}
+	for _, route := range routes {
+		paths[route.path] = openAPIPath(route, route.params, routeSecurity(route))
+		if route.auth == authStats {
+			// The domain is the share link's, or the public site's
+			var params []apiParam
+			for _, param := range route.params {
+				if param.name != "domain" {
+					params = append(params, param)
+				}
+			}
+			paths[sharedPath(route.path)] = openAPIPath(route, append([]apiParam{shareTokenParam}, params...), []any{})
+			paths[publicPath(route.path)] = openAPIPath(route, append([]apiParam{publicDomainParam}, params...), []any{})
+		}
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "Potato Analytics",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": openAPISchemas,
+			"securitySchemes": map[string]any{
+				"apiKey":    map[string]any{"type": "apiKey", "in": "query", "name": "api_key"},
+				"signature": map[string]any{"type": "apiKey", "in": "query", "name": "sig", "description": "A signature generated by /stats/sign, along with the exp and range parameters it was generated with"},
+				"bearer":    map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT", "description": "A JWT of OIDC_ISSUER, when it's set"},
+			},
+		},
+	}
+}
+
+// routeSecurity returns the security requirements of a route, an empty list
+// when it's public. Bearer tokens only read stats.
+func routeSecurity(route apiRoute) []any {
+	switch route.auth {
+	case authAPIKey:
+		if route.scope == scopeReadStats {
+			return []any{map[string]any{"apiKey": []string{}}, map[string]any{"bearer": []string{}}}
+		}
+		return []any{map[string]any{"apiKey": []string{}}}
+	case authStats:
+		return []any{map[string]any{"apiKey": []string{}}, map[string]any{"signature": []string{}}, map[string]any{"bearer": []string{}}}
+	}
+	return []any{}
+}
+
+// openAPIPath returns the path item of a route, with an operation for each
+// of its methods.
+func openAPIPath(route apiRoute, params []apiParam, security []any) map[string]any {
+	parameters := []any{}
+	for _, param := range params {
+		schema := map[string]any{"type": param.kind}
+		if len(param.enum) > 0 {
+			schema["enum"] = param.enum
+		}
+		in := "query"
+		if param.inPath {
+			in = "path"
+		}
+		parameters = append(parameters, map[string]any{
+			"name":        param.name,
+			"in":          in,
+			"description": param.description,
+			"required":    param.required,
+			"schema":      schema,
+		})
+	}
+
+	success := map[string]any{"description": "OK"}
+	if route.contentType != "" {
+		var schema map[string]any
+		switch {
+		case route.schema != "":
+			schema = map[string]any{"$ref": "#/components/schemas/" + route.schema}
+		case route.contentType == "application/json":
+			schema = map[string]any{"type": "object"}
+		default:
+			schema = map[string]any{"type": "string"}
+		}
+		success["content"] = map[string]any{route.contentType: map[string]any{"schema": schema}}
+	}
+	failure := map[string]any{
+		"description": "The error, with a code clients can rely on",
+		"content": map[string]any{
+			"application/json": map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/Error"}},
+		},
+	}
+
+	methods := route.methods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet}
+	}
+	item := map[string]any{}
+	for _, method := range methods {
+		item[strings.ToLower(method)] = map[string]any{
+			"summary":    route.summary,
+			"parameters": parameters,
+			"security":   security,
+			"responses": map[string]any{
+				"200":     success,
+				"default": failure,
+			},
+		}
+	}
+	return item
+}
+
+func (s *server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(openAPIDocument(s.apiRoutes()))
+}
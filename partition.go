@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// partitionedTables are partitioned by month, their default partition
+// holding the rows of the months without a partition of their own.
+var partitionedTables = []string{"pages", "countries", "sources"}
+
+// How many months ahead partitions are created. Rows can't be moved out of
+// a default partition when a month's partition is created, so they must
+// exist before the first pageview of their month, in any time zone.
+const partitionMonthsAhead = 2
+
+// createPartitions creates the partitions of the months following now's.
+func (s *server) createPartitions(now time.Time) error {
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	for i := 1; i <= partitionMonthsAhead; i++ {
+		start := month.AddDate(0, i, 0)
+		end := start.AddDate(0, 1, 0)
+		for _, table := range partitionedTables {
+			// Partition bounds can't be passed as arguments, but they're
+			// formatted from dates rather than coming from a request
+			name := table + "_" + start.Format("2006_01")
+			_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS ` + name + ` PARTITION OF ` + table +
+				` FOR VALUES FROM ('` + start.Format(time.DateOnly) + `') TO ('` + end.Format(time.DateOnly) + `')`)
+			if err != nil {
+				return fmt.Errorf("failed to create partition %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// createPartitionsEvery creates the upcoming partitions periodically. It
+// never returns.
+func (s *server) createPartitionsEvery(interval time.Duration) {
+	for {
+		if err := s.createPartitions(time.Now()); err != nil {
+			s.logger.Error("Failed to create partitions", slog.String("error", err.Error()))
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The period covered when a range isn't given
+const defaultPeriod = "30d"
+
+// periods are the presets accepted by the period parameter, in the order
+// they're documented. Each returns the first day of the range ending today,
+// "all" starting at the zero time. Ranges include today, so that 7d is today
+// and the 6 days before it.
+var periods = []struct {
+	name  string
+	start func(today time.Time) time.Time
+}{
+	{"today", func(today time.Time) time.Time { return today }},
+	{"7d", func(today time.Time) time.Time { return today.AddDate(0, 0, -6) }},
+	{"30d", func(today time.Time) time.Time { return today.AddDate(0, 0, -29) }},
+	{"90d", func(today time.Time) time.Time { return today.AddDate(0, 0, -89) }},
+	{"month_to_date", func(today time.Time) time.Time { return today.AddDate(0, 0, 1-today.Day()) }},
+	{"12mo", func(today time.Time) time.Time { return today.AddDate(-1, 0, 0) }},
+	{"all", func(today time.Time) time.Time { return time.Time{} }},
+}
+
+// periodNames returns the names of the presets.
+func periodNames() []string {
+	names := make([]string, len(periods))
+	for i, p := range periods {
+		names[i] = p.name
+	}
+	return names
+}
+
+// periodStart returns the first day of the preset range ending on end,
+// reporting whether the preset exists.
+func periodStart(period string, end time.Time) (time.Time, bool) {
+	for _, p := range periods {
+		if p.name == period {
+			return p.start(end), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// parseDateRange returns the range of days requested through the start/end
+// (YYYY-MM-DD) or period query parameters. Without any of them, the
+// defaultPeriod is returned. Relative periods are resolved in the time zone
+// given by the tz parameter, or the domain's time zone.
+func (s *server) parseDateRange(query url.Values) (time.Time, time.Time, error) {
+	loc := s.siteLocation(query.Get("domain"))
+	if tz := query.Get("tz"); tz != "" {
+		var err error
+		loc, err = time.LoadLocation(tz)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("invalid tz parameter, expected an IANA time zone")
+		}
+	}
+
+	today := dayIn(time.Now(), loc)
+
+	period := query.Get("period")
+	start := query.Get("start")
+	end := query.Get("end")
+
+	if period != "" && (start != "" || end != "") {
+		return time.Time{}, time.Time{}, errors.New("the period parameter can't be combined with start or end")
+	}
+
+	if period != "" {
+		startTime, ok := periodStart(period, today)
+		if !ok {
+			names := periodNames()
+			return time.Time{}, time.Time{}, errors.New("invalid period parameter, expected one of " + strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1])
+		}
+		return startTime, today, nil
+	}
+
+	endTime := today
+	if end != "" {
+		t, err := time.Parse(time.DateOnly, end)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("invalid end parameter, expected YYYY-MM-DD")
+		}
+		endTime = t
+	}
+
+	// Custom ranges default to the defaultPeriod before their end
+	startTime, _ := periodStart(defaultPeriod, endTime)
+	if start != "" {
+		t, err := time.Parse(time.DateOnly, start)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("invalid start parameter, expected YYYY-MM-DD")
+		}
+		startTime = t
+	}
+
+	if startTime.After(endTime) {
+		return time.Time{}, time.Time{}, errors.New("the start parameter must be before the end parameter")
+	}
+
+	return startTime, endTime, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// calendarDays returns the number of days from start to end, both included.
+func calendarDays(start, end time.Time) int {
+	days := 1
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		days++
+	}
+	return days
+}
+
+func TestPeriodLengths(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skipf("no time zone database: %v", err)
+	}
+	// Ranges spanning the start of DST in Paris, on the 31st of March
+	today := time.Date(2024, 4, 15, 0, 0, 0, 0, paris)
+
+	for period, want := range map[string]int{"today": 1, "7d": 7, "30d": 30, "90d": 90} {
+		start, ok := periodStart(period, today)
+		if !ok {
+			t.Fatalf("unknown period %q", period)
+		}
+		if days := calendarDays(start, today); days != want {
+			t.Errorf("%s covers %d days from %s, want %d", period, days, start.Format(time.DateOnly), want)
+		}
+
+		previousStart, previousEnd := previousPeriod(start, today)
+		if !previousEnd.Equal(start.AddDate(0, 0, -1)) {
+			t.Errorf("the period before %s ends on %s, want the day before its start", period, previousEnd.Format(time.DateOnly))
+		}
+		if days := calendarDays(previousStart, previousEnd); days != want {
+			t.Errorf("the period before %s covers %d days from %s, want %d", period, days, previousStart.Format(time.DateOnly), want)
+		}
+	}
+}
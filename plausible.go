@@ -0,0 +1,221 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// plausibleFiles are the files of a Plausible CSV export that are imported,
+// by the prefix of their name, with the table each is imported into and the
+// function naming the row's dimension.
+var plausibleFiles = map[string]struct {
+	table     string
+	dimension func(record map[string]string) string
+}{
+	"imported_pages": {"pages", func(record map[string]string) string {
+		return record["page"]
+	}},
+	"imported_sources": {"sources", func(record map[string]string) string {
+		// Sources are stored by referring host, or by Plausible's name for
+		// them when it has none
+		if referrer := record["referrer"]; referrer != "" {
+			if u, err := url.Parse(referrer); err == nil && u.Host != "" {
+				return u.Host
+			}
+			host, _, _ := strings.Cut(referrer, "/")
+			return host
+		}
+		if source := record["source"]; source != "" {
+			return source
+		}
+		return "Direct / None"
+	}},
+	"imported_locations": {"countries", func(record map[string]string) string {
+		return record["country"]
+	}},
+}
+
+// plausibleRow is a day's visitors and pageviews of a page, source or country
+// in a Plausible export.
+type plausibleRow struct {
+	row       countedRow
+	visitors  int
+	pageviews int
+}
+
+// importPlausible backfills a domain's pages, sources and countries from the
+// files of a Plausible CSV export, given as the export's zip or as the CSV
+// files it contains.
+//
+// Plausible only exports the number of visitors of each row, so sketches are
+// seeded with made up visitors. Those of a day are drawn from a pool as large
+// as the day's visitors, each row of a table taking the next ones, so that
+// the rows of a day add up to the day's visitors rather than to the sum of
+// theirs. Visitors are still counted once per day over longer ranges.
+func importPlausible(db *sql.DB, sketches sketchFormat, domain string, paths []string) error {
+	daily := map[string]int{}
+	var rows []plausibleRow
+
+	read := func(name string, r io.Reader) error {
+		prefix := strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+		if i := strings.Index(prefix, "_20"); i >= 0 {
+			// Exports name their files after their range, like
+			// imported_pages_20240101_20241231.csv
+			prefix = prefix[:i]
+		}
+		file, ok := plausibleFiles[prefix]
+		if !ok && prefix != "imported_visitors" {
+			return nil
+		}
+
+		return readCSVRecords(r, func(record map[string]string) error {
+			day, err := time.Parse(time.DateOnly, record["date"])
+			if err != nil {
+				return fmt.Errorf("invalid date %q in %s", record["date"], name)
+			}
+			visitors, _ := strconv.Atoi(record["visitors"])
+			pageviews, err := strconv.Atoi(record["pageviews"])
+			if err != nil {
+				pageviews, _ = strconv.Atoi(record["visits"])
+			}
+
+			if prefix == "imported_visitors" {
+				daily[record["date"]] = visitors
+				return nil
+			}
+			dimension := file.dimension(record)
+			if dimension == "" {
+				return nil
+			}
+			rows = append(rows, plausibleRow{
+				row:       countedRow{table: file.table, domain: domain, values: []string{dimension}, day: day},
+				visitors:  visitors,
+				pageviews: pageviews,
+			})
+			return nil
+		})
+	}
+
+	for _, path := range paths {
+		if strings.EqualFold(filepath.Ext(path), ".zip") {
+			archive, err := zip.OpenReader(path)
+			if err != nil {
+				return err
+			}
+			for _, entry := range archive.File {
+				file, err := entry.Open()
+				if err != nil {
+					archive.Close()
+					return err
+				}
+				err = read(entry.Name, file)
+				file.Close()
+				if err != nil {
+					archive.Close()
+					return err
+				}
+			}
+			archive.Close()
+			continue
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = read(path, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if len(rows) == 0 {
+		return fmt.Errorf("no pages, sources or locations found in the export")
+	}
+
+	site, err := newSiteRegistry(db).id(domain)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin import: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The months already rolled up have their monthly rows updated as well
+	rolledUp, err := lockRollups(tx)
+	if err != nil {
+		return err
+	}
+
+	// The next visitor of each day's pool, by table
+	next := map[string]int{}
+	for _, row := range rows {
+		date := row.row.day.Format(time.DateOnly)
+		pool := daily[date]
+		key := row.row.table + " " + date
+
+		visitors := make([]string, row.visitors)
+		for i := range visitors {
+			id := next[key] + i
+			if pool > 0 {
+				id %= pool
+			}
+			visitors[i] = "plausible:" + date + ":" + strconv.Itoa(id)
+		}
+		next[key] += row.visitors
+
+		err := rolledUp.upsert(tx, row.row, func(counted countedRow, args *queryArgs) string {
+			sketch, update := sketches.mergeExprs(counted.table, args, visitors)
+			return counted.upsertSQL(args, site, sketch, update, args.add(row.pageviews))
+		})
+		if err != nil {
+			return fmt.Errorf("failed to import %s: %w", row.row.table, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// readCSVRecords calls fn with each record of a CSV file, keyed by the names
+// of its header's columns.
+func readCSVRecords(r io.Reader, fn func(record map[string]string) error) error {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for {
+		values, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		record := make(map[string]string, len(header))
+		for i, name := range header {
+			if i < len(values) {
+				record[name] = values[i]
+			}
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"database/sql/driver"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// transactionUpserts returns the arguments of the upserts into table of the
+// transactions committed in statements, by the day of their rows, failing t
+// if one of them is made without holding the rollup lock.
+func transactionUpserts(t *testing.T, statements []recordedStatement, table string) map[string][][]driver.Value {
+	t.Helper()
+	upserts := map[string][][]driver.Value{}
+	var pending map[string][][]driver.Value
+	locked := false
+	for _, statement := range statements {
+		switch {
+		case statement.query == "BEGIN":
+			pending, locked = map[string][][]driver.Value{}, false
+		case statement.query == "COMMIT":
+			for day, args := range pending {
+				upserts[day] = append(upserts[day], args...)
+			}
+			pending = nil
+		case strings.Contains(statement.query, "pg_advisory_xact_lock_shared"):
+			locked = true
+		case strings.HasPrefix(statement.query, "INSERT INTO "+table+" "):
+			if pending == nil {
+				t.Errorf("%s was upserted outside of a transaction: %s", table, statement.query)
+				continue
+			}
+			if !locked {
+				t.Errorf("%s was upserted without locking the rollups", table)
+			}
+			for _, arg := range statement.args {
+				if day, ok := arg.(time.Time); ok {
+					pending[day.Format(time.DateOnly)] = append(pending[day.Format(time.DateOnly)], statement.args)
+				}
+			}
+		}
+	}
+	return upserts
+}
+
+func TestImportPlausibleIntoRolledUpMonth(t *testing.T) {
+	db, rec := newRecordingDB(t, "pages 2024-01-01")
+
+	path := filepath.Join(t.TempDir(), "imported_pages_20240101_20240229.csv")
+	export := "date,page,visitors,pageviews\n2024-01-15,/pricing,3,5\n2024-02-10,/pricing,2,2\n"
+	if err := os.WriteFile(path, []byte(export), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := importPlausible(db, sketchFormat{}, "example.com", []string{path}); err != nil {
+		t.Fatalf("importPlausible: %v", err)
+	}
+
+	statements := rec.recorded()
+	if daily := transactionUpserts(t, statements, "pages"); len(daily) != 2 {
+		t.Errorf("the import upserted the daily rows of %v, want 2024-01-15 and 2024-02-10", daily)
+	}
+	monthly := transactionUpserts(t, statements, "pages_monthly")
+	upserts := monthly["2024-01-01"]
+	if len(upserts) != 1 || len(monthly) != 1 {
+		t.Fatalf("the import upserted the monthly rows of %v, want the one of the rolled up 2024-01 only", monthly)
+	}
+	if !slices.Contains(upserts[0], driver.Value(int64(5))) {
+		t.Errorf("the monthly row of 2024-01 was upserted with %v, want its 5 imported pageviews", upserts[0])
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// privacyProfile bundles the settings deciding how much is known about
+// visitors, so that sites pick a coherent set rather than each setting.
+type privacyProfile struct {
+	Name string
+
+	// TrackCountries records the country visitors come from
+	TrackCountries bool
+
+	// RetentionDays is how long stats are kept for, 0 keeps them forever
+	RetentionDays int
+
+	// TruncateIP drops the last octet of IPv4 addresses, and the last 80
+	// bits of IPv6 ones, before identifying visitors
+	TruncateIP bool
+
+	// DailySalt hashes visitor identifiers with a salt replaced every day,
+	// so that they can't be linked from one day to the next. Visitors coming
+	// back on another day are then counted again over a range.
+	DailySalt bool
+}
+
+var privacyProfiles = map[string]privacyProfile{
+	"standard": {
+		Name:           "standard",
+		TrackCountries: true,
+	},
+	"gdpr-strict": {
+		Name:           "gdpr-strict",
+		TrackCountries: true,
+		RetentionDays:  395,
+		TruncateIP:     true,
+		DailySalt:      true,
+	},
+	"minimal": {
+		Name:          "minimal",
+		RetentionDays: 90,
+		TruncateIP:    true,
+		DailySalt:     true,
+	},
+}
+
+// visitorID returns the identifier a visitor is counted with, according to
+// the domain's privacy profile.
+func (s *server) visitorID(domain string, visitorIP string, day time.Time) (string, error) {
+	profile := s.cfg.privacyProfile(domain)
+
+	if profile.TruncateIP {
+		visitorIP = truncateIP(visitorIP)
+	}
+
+	if !profile.DailySalt {
+		return fmt.Sprintf("%x", visitorIP), nil
+	}
+
+	salt, err := s.salts.forDay(day)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(domain + "\n" + visitorIP))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// truncateIP anonymizes an IP address, dropping its port if it has one.
+func truncateIP(visitorIP string) string {
+	addr, err := netip.ParseAddr(hostOnly(visitorIP))
+	if err != nil {
+		return visitorIP
+	}
+
+	addr = addr.Unmap()
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return visitorIP
+	}
+	return prefix.Addr().String()
+}
+
+// saltStore hands out the salt of each day. Salts are stored in the database
+// so that all instances share them, and deleted once they've been rotated so
+// that past identifiers can't be recomputed. Without a database, they're made
+// up and only held in memory, as when importing past pageviews.
+type saltStore struct {
+	db *sql.DB
+
+	mu    sync.Mutex
+	salts map[string][]byte
+}
+
+func newSaltStore(db *sql.DB) *saltStore {
+	return &saltStore{db: db, salts: map[string][]byte{}}
+}
+
+func (st *saltStore) forDay(day time.Time) ([]byte, error) {
+	key := day.Format(time.DateOnly)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if salt, ok := st.salts[key]; ok {
+		return salt, nil
+	}
+
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	// Salts held in memory only are never stored
+	if st.db == nil {
+		st.salts[key] = salt
+		return salt, nil
+	}
+
+	// Another instance may have created the day's salt first, in which case
+	// it's the one to use
+	err := st.db.QueryRow(`
+	WITH inserted AS (
+		INSERT INTO salts (day, salt) VALUES ($1, $2)
+		ON CONFLICT (day) DO NOTHING
+		RETURNING salt
+	)
+	SELECT salt FROM inserted
+	UNION ALL
+	SELECT salt FROM salts WHERE day = $1
+	LIMIT 1
+	`, day, salt).Scan(&salt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load salt: %w", err)
+	}
+
+	// Keep the previous day's salt around for sites in other time zones
+	_, err = st.db.Exec(`DELETE FROM salts WHERE day < $1`, day.AddDate(0, 0, -1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete old salts: %w", err)
+	}
+	oldest := day.AddDate(0, 0, -1).Format(time.DateOnly)
+	for k := range st.salts {
+		if k < oldest {
+			delete(st.salts, k)
+		}
+	}
+	st.salts[key] = salt
+
+	return salt, nil
+}
+
+// retainedTables are the tables whose rows are pruned once they expire.
+var retainedTables = []string{"pages", "countries", "sources", "page_countries", "page_sources", "referrer_paths", "environments", "visitor_types", "digests", "pages_monthly", "countries_monthly", "sources_monthly"}
+
+// lastDayExpr returns the SQL expression of the last day a row of table
+// covers, which has to be past the retention for the row to be pruned.
+// Monthly rows are labelled with their first day.
+func lastDayExpr(table string) string {
+	if strings.HasSuffix(table, "_monthly") {
+		return "(day + interval '1 month' - interval '1 day')"
+	}
+	return "day"
+}
+
+// pruneExpiredStats deletes the stats older than the retention of each
+// domain and table, and forgets the visitors not seen for the returning
+// window.
+func (s *server) pruneExpiredStats(now time.Time) error {
+	if err := s.returning.prune(now); err != nil {
+		return err
+	}
+	if err := s.pruneRawEvents(now); err != nil {
+		return err
+	}
+	if err := s.pruneRevokedSessions(now); err != nil {
+		return err
+	}
+
+	// Domains with their own profile or retention are pruned separately
+	cfg := s.config()
+	explicit := []string{}
+	for domain := range cfg.SitePrivacyProfiles {
+		explicit = append(explicit, domain)
+	}
+	for domain := range cfg.SiteRetentionDays {
+		if _, ok := cfg.SitePrivacyProfiles[domain]; !ok {
+			explicit = append(explicit, domain)
+		}
+	}
+	for domain, st := range s.siteSettings.all() {
+		_, profile := cfg.SitePrivacyProfiles[domain]
+		_, retention := cfg.SiteRetentionDays[domain]
+		if st.RetentionDays != nil && !profile && !retention {
+			explicit = append(explicit, domain)
+		}
+	}
+
+	for _, table := range retainedTables {
+		// Digests and monthly rows are always kept in PostgreSQL
+		store := s.store
+		if _, ok := statsTables[table]; !ok {
+			store = newPostgresStore(s.db, s.logger, s.sketches)
+		}
+
+		// Any domain that isn't explicit gets the default retention
+		if days := s.retentionDays("", table); days > 0 {
+			cutoff := dayIn(now, time.UTC).AddDate(0, 0, -days)
+			if err := store.prune(table, cutoff, "", explicit); err != nil {
+				return err
+			}
+		}
+
+		for _, domain := range explicit {
+			days := s.retentionDays(domain, table)
+			if days == 0 {
+				continue
+			}
+			cutoff := dayIn(now, s.siteLocation(domain)).AddDate(0, 0, -days)
+			if err := store.prune(table, cutoff, domain, nil); err != nil {
+				return fmt.Errorf("failed to prune %s: %w", domain, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// pruneExpiredStatsEvery prunes expired stats periodically. It never
+// returns.
+func (s *server) pruneExpiredStatsEvery(interval time.Duration) {
+	for {
+		if err := s.pruneExpiredStats(time.Now()); err != nil {
+			s.logger.Error("Failed to prune expired stats", slog.String("error", err.Error()))
+		}
+		time.Sleep(interval)
+	}
+}
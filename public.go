@@ -0,0 +1,60 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// lookupPublicSite returns the site of a domain if it's public, or false if
+// there isn't one or it's private.
+func (s *server) lookupPublicSite(domain string) (site, bool, error) {
+	st, err := scanSite(s.db.QueryRow(`SELECT `+siteColumns+` FROM sites WHERE domain = $1`, strings.ToLower(domain)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return site{}, false, nil
+	}
+	if err != nil {
+		return site{}, false, fmt.Errorf("failed to load site: %w", err)
+	}
+	return st, st.Public, nil
+}
+
+// requirePublic serves next for the public site of the domain the request is
+// made under, whatever domain the query asks for. Private sites are answered
+// as if they didn't exist.
+func (s *server) requirePublic(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st, ok, err := s.lookupPublicSite(r.PathValue("domain"))
+		if err != nil {
+			s.logger.Error("Failed to load site", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+		if !ok {
+			writeError(w, http.StatusNotFound, errNotFound, "No public site for this domain")
+			return
+		}
+		next(w, scopedToDomain(r, st.Domain))
+	}
+}
+
+// handlePublicSite describes the public site the request is made for, so that
+// pages showing its stats can tell it exists.
+func (s *server) handlePublicSite(w http.ResponseWriter, r *http.Request) {
+	domain := r.URL.Query().Get("domain")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		Domain string `json:"domain"`
+		Public bool   `json:"public"`
+	}{
+		Domain: domain,
+		Public: true,
+	})
+}
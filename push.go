@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dailyTotal is a domain's visitors and pageviews so far today.
+type dailyTotal struct {
+	Domain    string
+	Visitors  int
+	Pageviews int
+}
+
+// dailyTotals returns the totals of each domain for the current day in its
+// time zone.
+func (s *server) dailyTotals(now time.Time) ([]dailyTotal, error) {
+	// Sites are a day ahead or behind UTC at most
+	today := dayIn(now, time.UTC)
+	rows, err := s.queryRows(statsQuery{
+		table:      "pages",
+		allDomains: true,
+		start:      today.AddDate(0, 0, -1),
+		end:        today.AddDate(0, 0, 1),
+		dimensions: []string{"domain"},
+		interval:   "day",
+		order:      []sortKey{{column: "domain"}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query daily totals: %w", err)
+	}
+
+	var totals []dailyTotal
+	for _, row := range rows {
+		domain := row.dimensions[0]
+		if row.day.Equal(dayIn(now, s.siteLocation(domain))) {
+			totals = append(totals, dailyTotal{Domain: domain, Visitors: row.visitors, Pageviews: row.pageviews})
+		}
+	}
+
+	return totals, nil
+}
+
+// pushDailyTotalsEvery pushes the daily totals to the configured Pushgateway
+// and remote-write endpoints periodically. It never returns.
+func (s *server) pushDailyTotalsEvery(interval time.Duration) {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	for {
+		now := time.Now()
+		totals, err := s.dailyTotals(now)
+		if err != nil {
+			s.logger.Error("Failed to push daily totals", slog.String("error", err.Error()))
+		} else {
+			if s.cfg.PushgatewayURL != "" {
+				if err := pushToGateway(client, s.cfg.PushgatewayURL, totals); err != nil {
+					s.logger.Error("Failed to push daily totals to the Pushgateway", slog.String("error", err.Error()))
+				}
+			}
+			if s.cfg.RemoteWriteURL != "" {
+				if err := remoteWrite(client, s.cfg.RemoteWriteURL, totals, now); err != nil {
+					s.logger.Error("Failed to remote-write daily totals", slog.String("error", err.Error()))
+				}
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// pushToGateway replaces the metrics of the potato job on a Pushgateway, so
+// that domains without pageviews today disappear from it.
+func pushToGateway(client *http.Client, gatewayURL string, totals []dailyTotal) error {
+	var body bytes.Buffer
+	writeMetrics(&body, totals)
+
+	req, err := http.NewRequest(http.MethodPut, strings.TrimSuffix(gatewayURL, "/")+"/metrics/job/potato", &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	return sendPush(client, req)
+}
+
+// writeMetrics writes the totals in the Prometheus text format.
+func writeMetrics(w io.Writer, totals []dailyTotal) {
+	for _, metric := range []struct {
+		name  string
+		help  string
+		value func(t dailyTotal) int
+	}{
+		{"potato_visitors_today", "Unique visitors so far today.", func(t dailyTotal) int { return t.Visitors }},
+		{"potato_pageviews_today", "Pageviews so far today.", func(t dailyTotal) int { return t.Pageviews }},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", metric.name, metric.help, metric.name)
+		for _, total := range totals {
+			fmt.Fprintf(w, "%s{domain=\"%s\"} %d\n", metric.name, escapeLabelValue(total.Domain), metric.value(total))
+		}
+	}
+}
+
+// handleMetrics exposes the daily totals and the tables' bloat for Prometheus
+// to scrape.
+func (s *server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	totals, err := s.dailyTotals(time.Now())
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to query daily totals", slog.String("error", err.Error()))
+		writeError(w, http.StatusInternalServerError, errInternal, "Failed to fetch metrics")
+		return
+	}
+
+	bloat, err := tableBloats(s.db)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to query table bloat", slog.String("error", err.Error()))
+		writeError(w, http.StatusInternalServerError, errInternal, "Failed to fetch metrics")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	writeMetrics(w, totals)
+	writeBloatMetrics(w, bloat)
+}
+
+// escapeLabelValue escapes a label value for the Prometheus text format.
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// remoteWrite sends the totals as samples of the Prometheus remote-write
+// protocol, a snappy-compressed protobuf WriteRequest.
+func remoteWrite(client *http.Client, writeURL string, totals []dailyTotal, now time.Time) error {
+	var request []byte
+	for _, total := range totals {
+		for _, metric := range []struct {
+			name  string
+			value int
+		}{
+			{"potato_visitors_today", total.Visitors},
+			{"potato_pageviews_today", total.Pageviews},
+		} {
+			series := protoTimeSeries(map[string]string{"__name__": metric.name, "domain": total.Domain}, float64(metric.value), now.UnixMilli())
+			request = protoBytes(request, 1, series)
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, writeURL, bytes.NewReader(snappyEncode(request)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	return sendPush(client, req)
+}
+
+func sendPush(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// protoTimeSeries encodes a TimeSeries message with a single sample. Labels
+// are sorted by name as remote-write requires.
+func protoTimeSeries(labels map[string]string, value float64, timestamp int64) []byte {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var series []byte
+	for _, name := range names {
+		var label []byte
+		label = protoBytes(label, 1, []byte(name))
+		label = protoBytes(label, 2, []byte(labels[name]))
+		series = protoBytes(series, 1, label)
+	}
+
+	var sample []byte
+	sample = binary.AppendUvarint(sample, 1<<3|1) // value, 64-bit
+	sample = binary.LittleEndian.AppendUint64(sample, math.Float64bits(value))
+	sample = binary.AppendUvarint(sample, 2<<3|0) // timestamp, varint
+	sample = binary.AppendUvarint(sample, uint64(timestamp))
+
+	return protoBytes(series, 2, sample)
+}
+
+// protoBytes appends a length-delimited protobuf field.
+func protoBytes(b []byte, field int, value []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+// snappyEncode encodes data in the snappy block format using literals only,
+// which every decoder accepts. Requests are small enough for compression not
+// to matter.
+func snappyEncode(data []byte) []byte {
+	b := binary.AppendUvarint(nil, uint64(len(data)))
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > 1<<16 {
+			chunk = chunk[:1<<16]
+		}
+		data = data[len(chunk):]
+
+		n := len(chunk) - 1
+		switch {
+		case n < 60:
+			b = append(b, byte(n)<<2)
+		case n < 1<<8:
+			b = append(b, 60<<2, byte(n))
+		default:
+			b = append(b, 61<<2, byte(n), byte(n>>8))
+		}
+		b = append(b, chunk...)
+	}
+	return b
+}
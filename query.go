@@ -0,0 +1,320 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statsTables lists the tables stats are queried from, with the columns each
+// can be grouped and filtered by. Along with the interval buckets, they're
+// the only identifiers the query builder ever writes into SQL. A source's
+// channel is computed from its referrer.
+var statsTables = map[string][]string{
+	"pages":          {"path"},
+	"countries":      {"country"},
+	"sources":        {"referrer", "channel"},
+	"page_countries": {"path", "country"},
+	"page_sources":   {"path", "referrer"},
+	"referrer_paths": {"referrer", "path"},
+	"environments":   {"environment"},
+	"visitor_types":  {"visitor_type"},
+}
+
+// intervalBuckets are the SQL expressions grouping days by each interval,
+// buckets being labelled with their first day. Weeks start on Monday.
+var intervalBuckets = map[string]string{
+	"day":   "day",
+	"week":  "date_trunc('week', day::timestamp)::date",
+	"month": "date_trunc('month', day::timestamp)::date",
+}
+
+// queryFilter restricts a query to the rows where column matches value.
+type queryFilter struct {
+	column string
+	value  any
+	match  filterMatch
+}
+
+// filterMatch is how a filter's column is compared to its value.
+type filterMatch int
+
+const (
+	// The column equals the value
+	matchExact filterMatch = iota
+	// The column starts with the value
+	matchPrefix
+	// The column contains the value, regardless of case
+	matchContains
+)
+
+// sortKey orders results by one of the columns a query returns.
+type sortKey struct {
+	column string
+	desc   bool
+}
+
+// statsQuery counts the unique visitors and pageviews of a domain over a
+// range, grouped by dimensions and optionally by interval. Values are always
+// passed as arguments, and identifiers are checked against statsTables, so
+// that nothing coming from a request is written into the SQL itself.
+type statsQuery struct {
+	table   string
+	domain  string
+	filters []queryFilter
+	start   time.Time
+	end     time.Time
+
+	// When set, domain is ignored and every domain's rows are counted
+	allDomains bool
+
+	// The columns rows are grouped by, returned first
+	dimensions []string
+	// When set, rows are also grouped by interval, returned as day
+	interval string
+
+	order  []sortKey
+	limit  int
+	offset int
+
+	// The whole months of the range answered from monthly rollups, set by
+	// withRollups
+	rolledUp []time.Time
+
+	// Whether the sketches are merged once they're fetched, set by the store
+	// from its sketch format
+	goHLL bool
+
+	// The context of the request the query is made for, whose span is the
+	// parent of the query's. Queries of background jobs leave it nil.
+	ctx context.Context
+}
+
+// outputs returns the columns the query returns, in order.
+func (q statsQuery) outputs() []string {
+	outputs := slices.Clone(q.dimensions)
+	if q.interval != "" {
+		outputs = append(outputs, "day")
+	}
+	return append(outputs, "visitors", "pageviews")
+}
+
+func (q statsQuery) validate() error {
+	columns, ok := statsTables[q.table]
+	if !ok {
+		return fmt.Errorf("unknown stats table %q", q.table)
+	}
+	for _, column := range q.dimensions {
+		// Any table can be grouped by domain
+		if !slices.Contains(columns, column) && column != "domain" {
+			return fmt.Errorf("unknown column %q in %s", column, q.table)
+		}
+	}
+	for _, filter := range q.filters {
+		if !slices.Contains(columns, filter.column) {
+			return fmt.Errorf("unknown column %q in %s", filter.column, q.table)
+		}
+	}
+	if _, ok := intervalBuckets[q.interval]; q.interval != "" && !ok {
+		return fmt.Errorf("unknown interval %q", q.interval)
+	}
+	outputs := q.outputs()
+	for _, key := range q.order {
+		if !slices.Contains(outputs, key.column) {
+			return fmt.Errorf("can't sort by %q", key.column)
+		}
+	}
+	return nil
+}
+
+// queryArgs numbers the arguments of a query as they're added.
+type queryArgs []any
+
+func (a *queryArgs) add(value any) string {
+	*a = append(*a, value)
+	return "$" + strconv.Itoa(len(*a))
+}
+
+// sql returns the query and its arguments, paginated when a limit is set.
+func (q statsQuery) sql() (string, []any, error) {
+	query, args, err := q.unpaginated()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(q.order) > 0 {
+		clauses := make([]string, len(q.order))
+		for i, key := range q.order {
+			clauses[i] = key.column + " ASC"
+			if key.desc {
+				clauses[i] = key.column + " DESC"
+			}
+		}
+		query += "\nORDER BY " + strings.Join(clauses, ", ")
+	}
+	if q.limit > 0 {
+		query += "\nLIMIT " + args.add(q.limit) + " OFFSET " + args.add(q.offset)
+	}
+	return query, args, nil
+}
+
+// countSQL returns the query counting the rows q returns, regardless of
+// pagination.
+func (q statsQuery) countSQL() (string, []any, error) {
+	query, args, err := q.unpaginated()
+	if err != nil {
+		return "", nil, err
+	}
+	return "SELECT COUNT(*) FROM (" + query + ") AS results", args, nil
+}
+
+func (q statsQuery) unpaginated() (string, queryArgs, error) {
+	if err := q.validate(); err != nil {
+		return "", nil, err
+	}
+
+	var args queryArgs
+	var selected, groups []string
+	for _, column := range q.dimensions {
+		expr := column
+		if column == "channel" {
+			expr = channelExpr(&args)
+			selected = append(selected, expr+" as channel")
+		} else {
+			selected = append(selected, expr)
+		}
+		groups = append(groups, expr)
+	}
+	if q.interval != "" {
+		selected = append(selected, intervalBuckets[q.interval]+" as day")
+		groups = append(groups, intervalBuckets[q.interval])
+	}
+	if q.goHLL {
+		// Sketches are merged once they're fetched
+		selected = append(selected, "array_agg(visitor_hll) as sketches")
+	} else {
+		selected = append(selected, "COALESCE(#(hll_union_agg(visitor_hll)), 0)::bigint as visitors")
+	}
+	selected = append(selected, "COALESCE(SUM(pageviews), 0) as pageviews")
+
+	var conditions []string
+	if !q.allDomains {
+		conditions = append(conditions, "domain = "+args.add(q.domain))
+	}
+	conditions = append(conditions, "day >= "+args.add(q.start), "day <= "+args.add(q.end))
+	for _, filter := range q.filters {
+		expr := filter.column
+		if filter.column == "channel" {
+			expr = channelExpr(&args)
+		}
+		switch filter.match {
+		case matchPrefix:
+			conditions = append(conditions, "starts_with("+expr+", "+args.add(filter.value)+")")
+		case matchContains:
+			conditions = append(conditions, "strpos(lower("+expr+"), lower("+args.add(filter.value)+")) > 0")
+		default:
+			conditions = append(conditions, expr+" = "+args.add(filter.value))
+		}
+	}
+
+	query := "SELECT " + strings.Join(selected, ", ") +
+		"\nFROM " + q.fromSQL(&args) + " JOIN sites ON sites.id = " + q.table + ".site_id" +
+		"\nWHERE " + strings.Join(conditions, " AND ")
+	if len(groups) > 0 {
+		query += "\nGROUP BY " + strings.Join(groups, ", ")
+	}
+	return query, args, nil
+}
+
+// statsRow is a row returned by a stats query, with the values of its
+// dimensions in order.
+type statsRow struct {
+	dimensions []string
+	day        time.Time
+	visitors   int
+	pageviews  int
+}
+
+// queryRows runs q and returns its rows.
+func (s *server) queryRows(q statsQuery) ([]statsRow, error) {
+	defer s.metrics.observeQuery("query", time.Now())
+	_, sp := s.startQuerySpan(q, "query")
+	defer sp.finish()
+
+	rows, err := s.store.queryRows(q)
+	sp.fail(err)
+	sp.set("potato.rows", len(rows))
+	return rows, err
+}
+
+// countRows returns the number of rows q matches regardless of pagination.
+func (s *server) countRows(q statsQuery) (int, error) {
+	defer s.metrics.observeQuery("count", time.Now())
+	_, sp := s.startQuerySpan(q, "count")
+	defer sp.finish()
+
+	total, err := s.store.countRows(q)
+	sp.fail(err)
+	return total, err
+}
+
+// startQuerySpan starts the span of an operation of the stats store for q.
+func (s *server) startQuerySpan(q statsQuery, operation string) (context.Context, *span) {
+	ctx, sp := s.tracer.start(q.ctx, "stats."+operation+" "+q.table, spanClient)
+	sp.set("db.system", s.storeSystem())
+	sp.set("db.operation", operation)
+	sp.set("potato.table", q.table)
+	sp.set("potato.domain", q.domain)
+	return ctx, sp
+}
+
+// storeSystem returns the database the stats are stored in, as OpenTelemetry
+// names them.
+func (s *server) storeSystem() string {
+	if s.cfg.ClickHouseURL != "" {
+		return "clickhouse"
+	}
+	return "postgresql"
+}
+
+// scanDest returns where to scan the columns q returns into row, the
+// visitors column being scanned into visitors.
+func (q statsQuery) scanDest(row *statsRow, visitors any) []any {
+	dest := make([]any, 0, len(q.dimensions)+3)
+	for i := range row.dimensions {
+		dest = append(dest, &row.dimensions[i])
+	}
+	if q.interval != "" {
+		dest = append(dest, &row.day)
+	}
+	return append(dest, visitors, &row.pageviews)
+}
+
+// compare orders rows the way q's ORDER BY clause does.
+func (q statsQuery) compare(a, b statsRow) int {
+	for _, key := range q.order {
+		var c int
+		switch key.column {
+		case "day":
+			c = a.day.Compare(b.day)
+		case "visitors":
+			c = cmp.Compare(a.visitors, b.visitors)
+		case "pageviews":
+			c = cmp.Compare(a.pageviews, b.pageviews)
+		default:
+			i := slices.Index(q.dimensions, key.column)
+			c = strings.Compare(a.dimensions[i], b.dimensions[i])
+		}
+		if key.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
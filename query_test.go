@@ -0,0 +1,299 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	queryStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	queryEnd   = time.Date(2024, 2, 15, 0, 0, 0, 0, time.UTC)
+)
+
+const (
+	visitorsSQL  = "COALESCE(#(hll_union_agg(visitor_hll)), 0)::bigint as visitors"
+	pageviewsSQL = "COALESCE(SUM(pageviews), 0) as pageviews"
+)
+
+func TestStatsQuerySQL(t *testing.T) {
+	// The channel expression's arguments come first when grouping by it,
+	// and after the domain and range when filtering by it
+	var groupedArgs queryArgs
+	grouped := channelExpr(&groupedArgs)
+	filteredArgs := queryArgs{"example.com", queryStart, queryEnd}
+	filtered := channelExpr(&filteredArgs)
+
+	tests := []struct {
+		name  string
+		query statsQuery
+		want  string
+		args  []any
+	}{
+		{
+			name:  "totals",
+			query: statsQuery{table: "pages", domain: "example.com", start: queryStart, end: queryEnd},
+			want: "SELECT " + visitorsSQL + ", " + pageviewsSQL +
+				"\nFROM pages JOIN sites ON sites.id = pages.site_id" +
+				"\nWHERE domain = $1 AND day >= $2 AND day <= $3",
+			args: []any{"example.com", queryStart, queryEnd},
+		},
+		{
+			name: "grouped, sorted and paginated",
+			query: statsQuery{
+				table: "pages", domain: "example.com", start: queryStart, end: queryEnd,
+				dimensions: []string{"path"},
+				order:      []sortKey{{column: "visitors", desc: true}, {column: "path"}},
+				limit:      10, offset: 20,
+			},
+			want: "SELECT path, " + visitorsSQL + ", " + pageviewsSQL +
+				"\nFROM pages JOIN sites ON sites.id = pages.site_id" +
+				"\nWHERE domain = $1 AND day >= $2 AND day <= $3" +
+				"\nGROUP BY path" +
+				"\nORDER BY visitors DESC, path ASC" +
+				"\nLIMIT $4 OFFSET $5",
+			args: []any{"example.com", queryStart, queryEnd, 10, 20},
+		},
+		{
+			name: "exact filter by interval",
+			query: statsQuery{
+				table: "page_countries", domain: "example.com", start: queryStart, end: queryEnd,
+				filters:    []queryFilter{{column: "country", value: "FR"}},
+				dimensions: []string{"path"},
+				interval:   "week",
+				order:      []sortKey{{column: "day"}},
+			},
+			want: "SELECT path, date_trunc('week', day::timestamp)::date as day, " + visitorsSQL + ", " + pageviewsSQL +
+				"\nFROM page_countries JOIN sites ON sites.id = page_countries.site_id" +
+				"\nWHERE domain = $1 AND day >= $2 AND day <= $3 AND country = $4" +
+				"\nGROUP BY path, date_trunc('week', day::timestamp)::date" +
+				"\nORDER BY day ASC",
+			args: []any{"example.com", queryStart, queryEnd, "FR"},
+		},
+		{
+			name: "prefix and contains filters",
+			query: statsQuery{
+				table: "referrer_paths", domain: "example.com", start: queryStart, end: queryEnd,
+				filters: []queryFilter{
+					{column: "path", value: "/blog/", match: matchPrefix},
+					{column: "referrer", value: "News", match: matchContains},
+				},
+				dimensions: []string{"referrer", "path"},
+			},
+			want: "SELECT referrer, path, " + visitorsSQL + ", " + pageviewsSQL +
+				"\nFROM referrer_paths JOIN sites ON sites.id = referrer_paths.site_id" +
+				"\nWHERE domain = $1 AND day >= $2 AND day <= $3 AND starts_with(path, $4) AND strpos(lower(referrer), lower($5)) > 0" +
+				"\nGROUP BY referrer, path",
+			args: []any{"example.com", queryStart, queryEnd, "/blog/", "News"},
+		},
+		{
+			name: "grouped by channel",
+			query: statsQuery{
+				table: "sources", domain: "example.com", start: queryStart, end: queryEnd,
+				dimensions: []string{"channel"},
+				order:      []sortKey{{column: "channel", desc: true}},
+			},
+			want: "SELECT " + grouped + " as channel, " + visitorsSQL + ", " + pageviewsSQL +
+				"\nFROM sources JOIN sites ON sites.id = sources.site_id" +
+				"\nWHERE domain = $" + strconv.Itoa(len(groupedArgs)+1) + " AND day >= $" + strconv.Itoa(len(groupedArgs)+2) + " AND day <= $" + strconv.Itoa(len(groupedArgs)+3) +
+				"\nGROUP BY " + grouped +
+				"\nORDER BY channel DESC",
+			args: append(slices.Clone(groupedArgs), "example.com", queryStart, queryEnd),
+		},
+		{
+			name: "filtered by channel",
+			query: statsQuery{
+				table: "sources", domain: "example.com", start: queryStart, end: queryEnd,
+				filters:    []queryFilter{{column: "channel", value: "Search"}},
+				dimensions: []string{"referrer"},
+			},
+			want: "SELECT referrer, " + visitorsSQL + ", " + pageviewsSQL +
+				"\nFROM sources JOIN sites ON sites.id = sources.site_id" +
+				"\nWHERE domain = $1 AND day >= $2 AND day <= $3 AND " + filtered + " = $" + strconv.Itoa(len(filteredArgs)+1) +
+				"\nGROUP BY referrer",
+			args: append(slices.Clone(filteredArgs), "Search"),
+		},
+		{
+			name: "every domain",
+			query: statsQuery{
+				table: "environments", start: queryStart, end: queryEnd, allDomains: true,
+				dimensions: []string{"domain", "environment"},
+			},
+			want: "SELECT domain, environment, " + visitorsSQL + ", " + pageviewsSQL +
+				"\nFROM environments JOIN sites ON sites.id = environments.site_id" +
+				"\nWHERE day >= $1 AND day <= $2" +
+				"\nGROUP BY domain, environment",
+			args: []any{queryStart, queryEnd},
+		},
+		{
+			name: "sketches merged in Go",
+			query: statsQuery{
+				table: "visitor_types", domain: "example.com", start: queryStart, end: queryEnd,
+				dimensions: []string{"visitor_type"}, goHLL: true,
+			},
+			want: "SELECT visitor_type, array_agg(visitor_hll) as sketches, " + pageviewsSQL +
+				"\nFROM visitor_types JOIN sites ON sites.id = visitor_types.site_id" +
+				"\nWHERE domain = $1 AND day >= $2 AND day <= $3" +
+				"\nGROUP BY visitor_type",
+			args: []any{"example.com", queryStart, queryEnd},
+		},
+		{
+			name: "rolled up month",
+			query: statsQuery{
+				table: "countries", domain: "example.com", start: queryStart, end: queryEnd,
+				dimensions: []string{"country"}, interval: "month",
+				rolledUp: []time.Time{queryStart},
+			},
+			want: "SELECT country, date_trunc('month', day::timestamp)::date as day, " + visitorsSQL + ", " + pageviewsSQL +
+				"\nFROM (" +
+				"\n\tSELECT site_id, country, day, visitor_hll, pageviews FROM countries_monthly WHERE day = ANY($6::date[])" +
+				"\n\tUNION ALL" +
+				"\n\tSELECT site_id, country, day, visitor_hll, pageviews FROM countries WHERE day BETWEEN $4 AND $5" +
+				"\n) AS countries JOIN sites ON sites.id = countries.site_id" +
+				"\nWHERE domain = $1 AND day >= $2 AND day <= $3" +
+				"\nGROUP BY country, date_trunc('month', day::timestamp)::date",
+			args: []any{"example.com", queryStart, queryEnd, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), queryEnd, pq.Array([]string{"2024-01-01"})},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, args, err := tt.query.sql()
+			if err != nil {
+				t.Fatalf("sql() returned %v", err)
+			}
+			if query != tt.want {
+				t.Errorf("sql() returned\n%s\nwant\n%s", query, tt.want)
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("sql() returned the arguments %#v, want %#v", args, tt.args)
+			}
+		})
+	}
+}
+
+func TestStatsQueryCountSQL(t *testing.T) {
+	q := statsQuery{
+		table: "pages", domain: "example.com", start: queryStart, end: queryEnd,
+		dimensions: []string{"path"},
+		order:      []sortKey{{column: "pageviews", desc: true}},
+		limit:      10,
+	}
+	query, args, err := q.countSQL()
+	if err != nil {
+		t.Fatalf("countSQL() returned %v", err)
+	}
+	unpaginated, _, _ := q.unpaginated()
+	if want := "SELECT COUNT(*) FROM (" + unpaginated + ") AS results"; query != want {
+		t.Errorf("countSQL() returned\n%s\nwant\n%s", query, want)
+	}
+	if want := []any{"example.com", queryStart, queryEnd}; !reflect.DeepEqual(args, want) {
+		t.Errorf("countSQL() returned the arguments %#v, want %#v", args, want)
+	}
+}
+
+func TestStatsQueryValidate(t *testing.T) {
+	for table, columns := range statsTables {
+		q := statsQuery{table: table, dimensions: append([]string{"domain"}, columns...)}
+		for _, column := range columns {
+			q.filters = append(q.filters, queryFilter{column: column, value: "x"})
+		}
+		for interval := range intervalBuckets {
+			q.interval = interval
+			q.order = []sortKey{{column: columns[0]}, {column: "day"}, {column: "visitors"}, {column: "pageviews"}}
+			if err := q.validate(); err != nil {
+				t.Errorf("validate() refused a query of %s by %s: %v", table, interval, err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query statsQuery
+	}{
+		{"unknown table", statsQuery{table: "sites"}},
+		{"injected table", statsQuery{table: "pages; DROP TABLE sites"}},
+		{"monthly table", statsQuery{table: "pages_monthly"}},
+		{"unknown dimension", statsQuery{table: "pages", dimensions: []string{"visitor_hll"}}},
+		{"dimension of another table", statsQuery{table: "pages", dimensions: []string{"country"}}},
+		{"injected dimension", statsQuery{table: "pages", dimensions: []string{"path, (SELECT key_hash FROM api_keys)"}}},
+		{"unknown filter", statsQuery{table: "pages", filters: []queryFilter{{column: "site_id", value: 1}}}},
+		{"filter by domain", statsQuery{table: "pages", filters: []queryFilter{{column: "domain", value: "example.com"}}}},
+		{"unknown interval", statsQuery{table: "pages", interval: "year"}},
+		{"injected interval", statsQuery{table: "pages", interval: "day' OR '1'='1"}},
+		{"sort by an unselected column", statsQuery{table: "pages", order: []sortKey{{column: "path"}}}},
+		{"sort by day without interval", statsQuery{table: "pages", dimensions: []string{"path"}, order: []sortKey{{column: "day"}}}},
+		{"injected sort", statsQuery{table: "pages", order: []sortKey{{column: "1; --"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.query.validate(); err == nil {
+				t.Errorf("validate() accepted %+v", tt.query)
+			}
+			if query, args, err := tt.query.sql(); err == nil || query != "" || args != nil {
+				t.Errorf("sql() built %q out of %+v", query, tt.query)
+			}
+			if query, _, err := tt.query.countSQL(); err == nil || query != "" {
+				t.Errorf("countSQL() built %q out of %+v", query, tt.query)
+			}
+		})
+	}
+}
+
+func TestStatsQueryValuesArePlaceholders(t *testing.T) {
+	hostile := []string{
+		"'; DROP TABLE sites; --",
+		`example.com" OR 1=1`,
+		"$1",
+		"/path') OR ('a'='a",
+	}
+	placeholder := regexp.MustCompile(`\$(\d+)`)
+	matches := []filterMatch{matchExact, matchPrefix, matchContains}
+
+	for table, columns := range statsTables {
+		for _, column := range columns {
+			for _, match := range matches {
+				for _, value := range hostile {
+					q := statsQuery{
+						table: table, domain: value, start: queryStart, end: queryEnd,
+						filters:    []queryFilter{{column: column, value: value, match: match}},
+						dimensions: columns,
+						limit:      10,
+					}
+					query, args, err := q.sql()
+					if err != nil {
+						t.Fatalf("sql() refused a filter of %s.%s: %v", table, column, err)
+					}
+					// The placeholders already in a query would be
+					// matched by "$1" itself
+					if value != "$1" && strings.Contains(query, value) {
+						t.Errorf("the value %q of %s.%s was written into the query:\n%s", value, table, column, query)
+					}
+					if !slices.Contains(args, any(value)) {
+						t.Errorf("the value %q of %s.%s isn't passed as an argument: %#v", value, table, column, args)
+					}
+
+					// Every placeholder has an argument, and every argument
+					// a placeholder
+					used := map[int]bool{}
+					for _, m := range placeholder.FindAllStringSubmatch(query, -1) {
+						n, _ := strconv.Atoi(m[1])
+						if n < 1 || n > len(args) {
+							t.Errorf("%s.%s: the placeholder $%d has no argument among %d", table, column, n, len(args))
+						}
+						used[n] = true
+					}
+					if len(used) != len(args) {
+						t.Errorf("%s.%s: %d arguments for %d placeholders", table, column, len(args), len(used))
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"math"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Estimate of the bytes held by a bucket of the in-memory rate limiter,
+// besides its key
+const rateBucketOverhead = 80
+
+// rateLimiter decides whether a client can make another tracking request,
+// with a token bucket per client refilled at TRACK_RATE_LIMIT and holding up
+// to TRACK_RATE_BURST requests.
+type rateLimiter interface {
+	allow(key string, now time.Time) (bool, error)
+}
+
+// newRateLimiter returns the rate limiter of the configuration, nil when
+// tracking isn't limited.
+func newRateLimiter(cfg Config) rateLimiter {
+	if cfg.TrackRateLimit == 0 {
+		return nil
+	}
+	// Tokens per second
+	rate := float64(cfg.TrackRateLimit) / 60
+	if cfg.RateLimitRedisURL != nil {
+		return &redisRateLimiter{redis: newRedisClient(cfg.RateLimitRedisURL), rate: rate, burst: cfg.TrackRateBurst}
+	}
+	return newMemoryRateLimiter(rate, cfg.TrackRateBurst)
+}
+
+// trackRetryAfter returns how many seconds a client limited has to wait
+// for its next tracking request to be accepted.
+func (c Config) trackRetryAfter() int {
+	return int(math.Ceil(60 / float64(c.TrackRateLimit)))
+}
+
+// rateLimitKey returns the key of the bucket of a client address. IPv6
+// clients usually hold a whole /64, so they share its bucket.
+func rateLimitKey(addr netip.Addr) string {
+	addr = addr.Unmap()
+	if addr.Is6() {
+		prefix, _ := addr.Prefix(64)
+		return prefix.String()
+	}
+	return addr.String()
+}
+
+// memoryRateLimiter keeps the buckets of the clients in memory, each
+// instance limiting the requests it receives.
+type memoryRateLimiter struct {
+	rate  float64
+	burst int
+
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newMemoryRateLimiter(rate float64, burst int) *memoryRateLimiter {
+	return &memoryRateLimiter{rate: rate, burst: burst, buckets: map[string]*rateBucket{}}
+}
+
+func (l *memoryRateLimiter) allow(key string, now time.Time) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateBucket{tokens: float64(l.burst), updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.burst), b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+	if b.tokens < 1 {
+		return false, nil
+	}
+	b.tokens--
+	return true, nil
+}
+
+// prune forgets the buckets that are full again, their clients being as
+// new ones.
+func (l *memoryRateLimiter) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	refill := time.Duration(float64(l.burst) / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.updated) >= refill {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// pruneEvery prunes the buckets periodically. It never returns.
+func (l *memoryRateLimiter) pruneEvery(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		l.prune(time.Now())
+	}
+}
+
+func (l *memoryRateLimiter) memoryUsage() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var bytes int64
+	for key := range l.buckets {
+		bytes += int64(rateBucketOverhead + len(key))
+	}
+	return bytes
+}
+
+// evict forgets buckets, in no particular order, which lets their clients
+// start over with a full one.
+func (l *memoryRateLimiter) evict(bytes int64) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var freed int64
+	for key := range l.buckets {
+		if freed >= bytes {
+			break
+		}
+		delete(l.buckets, key)
+		freed += int64(rateBucketOverhead + len(key))
+	}
+	return freed
+}
+
+// The token bucket of a client in Redis, updated atomically. Buckets expire
+// once they'd be full again.
+const rateLimitScript = `
+local rate, burst, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(bucket[1]) or burst
+local updated = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - updated) * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate))
+return allowed
+`
+
+// redisRateLimiter keeps the buckets of the clients in Redis, so that
+// instances behind a load balancer share them.
+type redisRateLimiter struct {
+	redis *redisClient
+	// Tokens per second
+	rate  float64
+	burst int
+}
+
+func (l *redisRateLimiter) allow(key string, now time.Time) (bool, error) {
+	// The script counts in milliseconds
+	reply, err := l.redis.do("EVAL", rateLimitScript, "1", "potato:ratelimit:"+key,
+		strconv.FormatFloat(l.rate/1000, 'g', -1, 64), strconv.Itoa(l.burst), strconv.FormatInt(now.UnixMilli(), 10))
+	if err != nil {
+		return false, err
+	}
+	allowed, _ := reply.(int64)
+	return allowed == 1, nil
+}
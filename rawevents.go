@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// recordRawEvent appends a pageview, or a custom event of its page, to the raw
+// event log. The visitor is the same salted hash the stats are counted with.
+func (s *server) recordRawEvent(pv pageview, event string) error {
+	_, err := s.db.Exec(`
+	INSERT INTO events_raw (domain, path, day, visitor, environment, visitor_type, country, referrer, referrer_path, event)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`, pv.domain, pv.path, pv.day, pv.visitor, pv.environment, pv.visitorType, pv.country, pv.referrer, pv.referrerPath, event)
+	if err != nil {
+		return fmt.Errorf("failed to record raw event: %w", err)
+	}
+	return nil
+}
+
+// pruneRawEvents deletes the raw events older than their retention, all of
+// them once the log is turned off.
+func (s *server) pruneRawEvents(now time.Time) error {
+	cutoff := now.AddDate(0, 0, -s.cfg.RawEventsDays)
+	if _, err := s.db.Exec(`DELETE FROM events_raw WHERE recorded_at < $1`, cutoff); err != nil {
+		return fmt.Errorf("failed to prune raw events: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How long a visitor is considered active after their last pageview
+const realtimeWindow = 5 * time.Minute
+
+// How many minutes of active visitors are kept for the rolling graph
+const realtimeHistoryMinutes = 30
+
+// realtimeTracker keeps the page each visitor was last seen on over the last
+// few minutes, and the minutes of the last half hour they were active in. It
+// only lives in memory and visitors are identified by a hash.
+type realtimeTracker struct {
+	mu sync.Mutex
+	// Visits per domain, keyed by visitor hash
+	visits map[string]map[string]realtimeVisit
+}
+
+type realtimeVisit struct {
+	path string
+	seen time.Time
+	// Bit i is set when the visitor was active i minutes before the minute
+	// they were last seen in
+	minutes uint32
+}
+
+func newRealtimeTracker() *realtimeTracker {
+	return &realtimeTracker{visits: map[string]map[string]realtimeVisit{}}
+}
+
+func (t *realtimeTracker) record(domain string, visitor string, path string, now time.Time) {
+	sum := sha256.Sum256([]byte(visitor))
+	key := hex.EncodeToString(sum[:])
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	visits, ok := t.visits[domain]
+	if !ok {
+		visits = map[string]realtimeVisit{}
+		t.visits[domain] = visits
+	}
+	visit := realtimeVisit{path: path, seen: now, minutes: 1}
+	if previous, ok := visits[key]; ok {
+		elapsed := now.Truncate(time.Minute).Sub(previous.seen.Truncate(time.Minute)) / time.Minute
+		if elapsed >= 0 && elapsed < 32 {
+			visit.minutes |= previous.minutes << elapsed
+		}
+	}
+	visits[key] = visit
+}
+
+type realtimePage struct {
+	Path     string `json:"path"`
+	Visitors int    `json:"visitors"`
+}
+
+// current returns the number of visitors active on the domain and the pages
+// they're on, most visited first.
+func (t *realtimeTracker) current(domain string, now time.Time) (int, []realtimePage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	visitors := 0
+	perPath := map[string]int{}
+	for _, visit := range t.visits[domain] {
+		if now.Sub(visit.seen) > realtimeWindow {
+			continue
+		}
+		visitors++
+		perPath[visit.path]++
+	}
+
+	pages := make([]realtimePage, 0, len(perPath))
+	for path, count := range perPath {
+		pages = append(pages, realtimePage{Path: path, Visitors: count})
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		if pages[i].Visitors != pages[j].Visitors {
+			return pages[i].Visitors > pages[j].Visitors
+		}
+		return pages[i].Path < pages[j].Path
+	})
+
+	return visitors, pages
+}
+
+type realtimeMinute struct {
+	Minute   time.Time `json:"minute"`
+	Visitors int       `json:"visitors"`
+}
+
+// history returns the number of visitors active on the domain in each of the
+// last 30 minutes, the current one last.
+func (t *realtimeTracker) history(domain string, now time.Time) []realtimeMinute {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	current := now.Truncate(time.Minute)
+	minutes := make([]realtimeMinute, realtimeHistoryMinutes)
+	for i := range minutes {
+		minutes[i].Minute = current.Add(-time.Duration(realtimeHistoryMinutes-1-i) * time.Minute)
+	}
+	for _, visit := range t.visits[domain] {
+		last := visit.seen.Truncate(time.Minute)
+		for bit := 0; bit < 32; bit++ {
+			if visit.minutes&(1<<bit) == 0 {
+				continue
+			}
+			ago := int(current.Sub(last)/time.Minute) + bit
+			if ago >= 0 && ago < realtimeHistoryMinutes {
+				minutes[realtimeHistoryMinutes-1-ago].Visitors++
+			}
+		}
+	}
+	return minutes
+}
+
+// prune forgets the visitors who haven't been seen within the rolling graph's
+// half hour.
+func (t *realtimeTracker) prune(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for domain, visits := range t.visits {
+		for key, visit := range visits {
+			if now.Sub(visit.seen) > realtimeHistoryMinutes*time.Minute {
+				delete(visits, key)
+			}
+		}
+		if len(visits) == 0 {
+			delete(t.visits, domain)
+		}
+	}
+}
+
+// Estimated bytes held per domain and per visit, on top of their strings
+const (
+	realtimeDomainOverhead = 64
+	realtimeVisitOverhead  = 64 + sha256.Size*2
+)
+
+func (t *realtimeTracker) memoryUsage() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var bytes int64
+	for domain, visits := range t.visits {
+		bytes += int64(realtimeDomainOverhead + len(domain))
+		for _, visit := range visits {
+			bytes += int64(realtimeVisitOverhead + len(visit.path))
+		}
+	}
+	return bytes
+}
+
+// evict forgets the visitors seen the longest ago until enough is freed.
+func (t *realtimeTracker) evict(bytes int64) int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	type entry struct {
+		domain string
+		key    string
+		seen   time.Time
+	}
+	var entries []entry
+	for domain, visits := range t.visits {
+		for key, visit := range visits {
+			entries = append(entries, entry{domain, key, visit.seen})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seen.Before(entries[j].seen)
+	})
+
+	var freed int64
+	for _, e := range entries {
+		if freed >= bytes {
+			break
+		}
+		visits := t.visits[e.domain]
+		freed += int64(realtimeVisitOverhead + len(visits[e.key].path))
+		delete(visits, e.key)
+		if len(visits) == 0 {
+			freed += int64(realtimeDomainOverhead + len(e.domain))
+			delete(t.visits, e.domain)
+		}
+	}
+	return freed
+}
+
+// pruneEvery prunes the tracker periodically. It never returns.
+func (t *realtimeTracker) pruneEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		t.prune(now)
+	}
+}
+
+func (s *server) handleRealtime(w http.ResponseWriter, r *http.Request) {
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeError(w, http.StatusBadRequest, errMissingParameter, "Missing domain parameter")
+		return
+	}
+
+	now := time.Now()
+	visitors, pages := s.realtime.current(domain, now)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		Visitors int              `json:"visitors"`
+		Pages    []realtimePage   `json:"pages"`
+		Minutes  []realtimeMinute `json:"minutes"`
+	}{
+		Visitors: visitors,
+		Pages:    pages,
+		Minutes:  s.realtime.history(domain, now),
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Settings applied again on SIGHUP or POST /admin/reload, the others being
+// only read at startup
+var reloadableSettings = []string{
+	"ALLOWED_SITES",
+	"EXCLUDED_IPS",
+	"GOALS",
+	"LOG_LEVEL",
+	"PRODUCTION_HOSTS",
+	"RETENTION_DAYS",
+	"SITE_RETENTION_DAYS",
+	"TABLE_RETENTION_DAYS",
+}
+
+// config returns the configuration of the server, with the reloadable
+// settings as they were last reloaded.
+func (s *server) config() *Config {
+	if cfg := s.live.Load(); cfg != nil {
+		return cfg
+	}
+	return &s.cfg
+}
+
+// reloadConfig loads the configuration again, from the same flags, the
+// environment it was started with and the config file as it is now, and
+// applies the reloadable settings. The previous ones are kept when it can't
+// be loaded. The rewrite rules are reloaded along. Reloads triggered by
+// SIGHUP and /admin/reload at once are applied one after the other, so that
+// neither drops the settings of the other.
+func (s *server) reloadConfig() error {
+	s.reloading.Lock()
+	defer s.reloading.Unlock()
+
+	loaded, _, err := loadConfig(os.Args[1:])
+	if err != nil {
+		return err
+	}
+	if s.rewrites != nil && s.cfg.RewriteRulesFile != "" {
+		if _, err := s.rewrites.reload(); err != nil {
+			return err
+		}
+	}
+
+	cfg := *s.config()
+	cfg.AllowedSites = loaded.AllowedSites
+	cfg.ExcludedIPs = loaded.ExcludedIPs
+	cfg.Goals = loaded.Goals
+	cfg.LogLevel = loaded.LogLevel
+	cfg.ProductionHosts = loaded.ProductionHosts
+	cfg.RetentionDays = loaded.RetentionDays
+	cfg.SiteRetentionDays = loaded.SiteRetentionDays
+	cfg.TableRetentionDays = loaded.TableRetentionDays
+	s.live.Store(&cfg)
+	if s.logLevel != nil {
+		s.logLevel.Set(cfg.logLevel())
+	}
+
+	s.logger.Info("Reloaded the configuration", slog.Any("settings", reloadableSettings), slog.String("log_level", cfg.logLevel().String()))
+	return nil
+}
+
+// reloadOnHangup reloads the configuration each time the process receives
+// SIGHUP. It never returns.
+func (s *server) reloadOnHangup() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		if err := s.reloadConfig(); err != nil {
+			s.logger.Error("Failed to reload the configuration", slog.String("error", err.Error()))
+		}
+	}
+}
+
+// handleReload reloads the configuration of the instance serving the
+// request, returning the settings applied.
+func (s *server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := s.reloadConfig(); err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to reload the configuration", slog.String("error", err.Error()))
+		writeError(w, http.StatusInternalServerError, errInvalidConfig, fmt.Sprintf("Failed to reload the configuration: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		Settings []string `json:"settings"`
+		LogLevel string   `json:"log_level"`
+	}{
+		Settings: reloadableSettings,
+		LogLevel: s.config().logLevel().String(),
+	})
+}
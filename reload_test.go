@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestReloadConfig(t *testing.T) {
+	s := newTestServer(t)
+	if !s.config().siteAllowed("other.com") {
+		t.Fatalf("any site isn't allowed without ALLOWED_SITES")
+	}
+
+	args := os.Args
+	t.Cleanup(func() { os.Args = args })
+	os.Args = []string{"potato", "-allowed-sites=example.com, www.example.com", "-excluded-ips=203.0.113.7"}
+
+	// SIGHUP and /admin/reload can reload at the same time
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.reloadConfig(); err != nil {
+				t.Errorf("reloadConfig: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	cfg := s.config()
+	if !cfg.siteAllowed("www.example.com") || cfg.siteAllowed("other.com") {
+		t.Errorf("ALLOWED_SITES wasn't reloaded: %v", cfg.AllowedSites)
+	}
+	if len(cfg.ExcludedIPs) != 1 {
+		t.Errorf("EXCLUDED_IPS wasn't reloaded: %v", cfg.ExcludedIPs)
+	}
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Number of entries in each of the report's top lists
+const reportTopSize = 5
+
+// How long connecting to the SMTP server may take
+const smtpDialTimeout = 10 * time.Second
+
+// reportFrequencies are the periods reports can cover, each sent once the
+// period is over.
+var reportFrequencies = map[string]string{"weekly": "week", "monthly": "month"}
+
+// reportSubscription is a recipient of a domain's email reports. Its token
+// is left out, as only the recipient should be able to unsubscribe with it.
+type reportSubscription struct {
+	ID        int64     `json:"id"`
+	Domain    string    `json:"domain"`
+	Email     string    `json:"email"`
+	Frequency string    `json:"frequency"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// report is the summary of a domain's period emailed to its recipients.
+type report struct {
+	Domain     string
+	Frequency  string
+	Comparison *comparison
+	TopPages   []topEntry
+	TopSources []topEntry
+}
+
+// reportPeriod returns the last period over on today: the previous week,
+// from Monday to Sunday, or the previous month.
+func reportPeriod(frequency string, today time.Time) (time.Time, time.Time) {
+	if frequency == "monthly" {
+		first := today.AddDate(0, 0, 1-today.Day())
+		return first.AddDate(0, -1, 0), first.AddDate(0, 0, -1)
+	}
+	monday := today.AddDate(0, 0, -(int(today.Weekday())+6)%7)
+	return monday.AddDate(0, 0, -7), monday.AddDate(0, 0, -1)
+}
+
+// computeReport returns the report of a domain over a range, compared with
+// the previous period of the same length.
+func (s *server) computeReport(domain string, frequency string, start, end time.Time) (report, error) {
+	r := report{Domain: domain, Frequency: frequency}
+
+	var err error
+	r.Comparison, err = s.compareTotals(statsQuery{table: "pages", domain: domain, start: start, end: end})
+	if err != nil {
+		return r, fmt.Errorf("failed to query totals: %w", err)
+	}
+	if r.TopPages, err = s.topEntries("pages", "path", domain, start, end, reportTopSize); err != nil {
+		return r, err
+	}
+	if r.TopSources, err = s.topEntries("sources", "referrer", domain, start, end, reportTopSize); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+// text returns the body of the report, ending with the link unsubscribing
+// its recipient when it has one.
+func (r report) text(unsubscribeURL string) string {
+	current := r.Comparison.Current
+	period := reportFrequencies[r.Frequency]
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s, %s to %s\n\n", r.Domain, current.Start.Format("Jan 2"), current.End.Format("Jan 2, 2006"))
+	fmt.Fprintf(&b, "Visitors:  %d%s\n", current.Visitors, formatChange(r.Comparison.VisitorsChange, period))
+	fmt.Fprintf(&b, "Pageviews: %d%s\n", current.Pageviews, formatChange(r.Comparison.PageviewsChange, period))
+
+	for _, list := range []struct {
+		title   string
+		entries []topEntry
+	}{{"Top pages", r.TopPages}, {"Top sources", r.TopSources}} {
+		fmt.Fprintf(&b, "\n%s\n", list.title)
+		if len(list.entries) == 0 {
+			b.WriteString("  None\n")
+		}
+		for _, entry := range list.entries {
+			fmt.Fprintf(&b, "  %-40s %d visitors\n", entry.Name, entry.Visitors)
+		}
+	}
+
+	if unsubscribeURL != "" {
+		fmt.Fprintf(&b, "\nTo stop receiving these reports: %s\n", unsubscribeURL)
+	}
+	return b.String()
+}
+
+// formatChange returns a change as a percentage of the previous period, or
+// nothing when there's nothing to compare to.
+func formatChange(c metricChange, period string) string {
+	if c.Percent == nil {
+		return ""
+	}
+	return fmt.Sprintf(" (%+.0f%% vs the previous %s)", *c.Percent, period)
+}
+
+// reportMessage returns the email of a report to a recipient, with the
+// headers letting mail clients unsubscribe in one click.
+func (s *server) reportMessage(to string, r report, unsubscribeURL string, now time.Time) ([]byte, error) {
+	subject := fmt.Sprintf("Your %s report for %s", r.Frequency, r.Domain)
+	return s.emailMessage(to, subject, r.text(unsubscribeURL), now,
+		[2]string{"List-Unsubscribe", "<" + unsubscribeURL + ">"},
+		[2]string{"List-Unsubscribe-Post", "List-Unsubscribe=One-Click"},
+	)
+}
+
+// emailMessage returns a plain text email from REPORTS_FROM, with extra
+// headers.
+func (s *server) emailMessage(to string, subject string, text string, now time.Time, extra ...[2]string) ([]byte, error) {
+	var msg bytes.Buffer
+	headers := [][2]string{
+		{"From", s.cfg.ReportsFrom},
+		{"To", to},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", now.Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+	}
+	for _, header := range append(headers, extra...) {
+		fmt.Fprintf(&msg, "%s: %s\r\n", header[0], header[1])
+	}
+	msg.WriteString("\r\n")
+
+	body := quotedprintable.NewWriter(&msg)
+	if _, err := body.Write([]byte(strings.ReplaceAll(text, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
+
+// sendEmail sends a message through the SMTP server of SMTP_URL, upgrading
+// the connection with STARTTLS when it's offered.
+func (s *server) sendEmail(to string, msg []byte) error {
+	server := s.cfg.SMTPURL
+	host, port := server.Hostname(), server.Port()
+	if port == "" {
+		port = "587"
+		if server.Scheme == "smtps" {
+			port = "465"
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), smtpDialTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the SMTP server: %w", err)
+	}
+	if server.Scheme == "smtps" {
+		conn = tls.Client(conn, &tls.Config{ServerName: host})
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to connect to the SMTP server: %w", err)
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok && server.Scheme == "smtp" {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("failed to start TLS: %w", err)
+		}
+	}
+	if server.User != nil {
+		password, _ := server.User.Password()
+		if err := client.Auth(smtp.PlainAuth("", server.User.Username(), password, host)); err != nil {
+			return fmt.Errorf("failed to authenticate to the SMTP server: %w", err)
+		}
+	}
+
+	from, err := mail.ParseAddress(s.cfg.ReportsFrom)
+	if err != nil {
+		return fmt.Errorf("invalid REPORTS_FROM: %w", err)
+	}
+	if err := client.Mail(from.Address); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	if err := client.Rcpt(to); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	return client.Quit()
+}
+
+// sendDueReports sends the reports of the periods over since they were last
+// sent. Each is claimed before being sent so that a single instance sends
+// it, and released when sending fails so that it's retried.
+func (s *server) sendDueReports(now time.Time) error {
+	origin := s.collectorOrigin()
+	if origin == "" {
+		return errors.New("HOST_DOMAIN is not set")
+	}
+
+	rows, err := s.db.Query(`SELECT id, domain, email, frequency, token, last_period FROM report_subscriptions ORDER BY id`)
+	if err != nil {
+		return fmt.Errorf("failed to query report subscriptions: %w", err)
+	}
+	type due struct {
+		reportSubscription
+		token      string
+		lastPeriod sql.NullTime
+	}
+	var subscriptions []due
+	for rows.Next() {
+		var sub due
+		if err := rows.Scan(&sub.ID, &sub.Domain, &sub.Email, &sub.Frequency, &sub.token, &sub.lastPeriod); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan report subscription: %w", err)
+		}
+		subscriptions = append(subscriptions, sub)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to query report subscriptions: %w", err)
+	}
+
+	for _, sub := range subscriptions {
+		start, end := reportPeriod(sub.Frequency, dayIn(now, s.siteLocation(sub.Domain)))
+		if sub.lastPeriod.Valid && !sub.lastPeriod.Time.Before(start) {
+			continue
+		}
+
+		claimed, err := s.db.Exec(`
+		UPDATE report_subscriptions SET last_period = $2
+		WHERE id = $1 AND (last_period IS NULL OR last_period < $2)
+		`, sub.ID, start)
+		if err != nil {
+			return fmt.Errorf("failed to claim report: %w", err)
+		}
+		if n, _ := claimed.RowsAffected(); n == 0 {
+			continue
+		}
+
+		if err := s.sendReport(sub.reportSubscription, sub.token, start, end, origin, now); err != nil {
+			s.logger.Error("Failed to send report", slog.String("domain", sub.Domain), slog.Int64("subscription", sub.ID), slog.String("error", err.Error()))
+			if _, err := s.db.Exec(`UPDATE report_subscriptions SET last_period = $2 WHERE id = $1`, sub.ID, sub.lastPeriod); err != nil {
+				return fmt.Errorf("failed to release report: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// sendReport emails the report of a range to a recipient.
+func (s *server) sendReport(sub reportSubscription, token string, start, end time.Time, origin string, now time.Time) error {
+	r, err := s.computeReport(sub.Domain, sub.Frequency, start, end)
+	if err != nil {
+		return err
+	}
+	unsubscribeURL := origin + "/reports/unsubscribe?token=" + url.QueryEscape(token)
+	msg, err := s.reportMessage(sub.Email, r, unsubscribeURL, now)
+	if err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return s.sendEmail(sub.Email, msg)
+}
+
+// sendDueChannelReports sends the weekly report of the last week to the
+// notification channels that want it, claiming them as sendDueReports does.
+func (s *server) sendDueChannelReports(now time.Time) error {
+	channels, err := s.listNotificationChannels("", "reports")
+	if err != nil {
+		return err
+	}
+
+	for _, c := range channels {
+		start, end := reportPeriod("weekly", dayIn(now, s.siteLocation(c.Domain)))
+		var previous sql.NullTime
+		err := s.db.QueryRow(`
+		UPDATE notification_channels AS claimed SET last_report = $2
+		FROM notification_channels AS current
+		WHERE claimed.id = $1 AND current.id = claimed.id AND (claimed.last_report IS NULL OR claimed.last_report < $2)
+		RETURNING current.last_report
+		`, c.ID, start).Scan(&previous)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to claim report: %w", err)
+		}
+
+		r, err := s.computeReport(c.Domain, "weekly", start, end)
+		if err == nil {
+			err = s.notifyChannel(c, notification{
+				Domain: c.Domain,
+				Event:  "reports",
+				Title:  fmt.Sprintf("Weekly report for %s", c.Domain),
+				Text:   r.text(""),
+				Time:   now,
+			})
+		}
+		if err != nil {
+			s.logger.Error("Failed to send report", slog.String("domain", c.Domain), slog.Int64("channel", c.ID), slog.String("error", err.Error()))
+			if _, err := s.db.Exec(`UPDATE notification_channels SET last_report = $2 WHERE id = $1`, c.ID, previous); err != nil {
+				return fmt.Errorf("failed to release report: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// sendReportsEvery sends the due reports periodically, by email when SMTP_URL
+// is set and to notification channels. It never returns.
+func (s *server) sendReportsEvery(interval time.Duration) {
+	for {
+		if s.cfg.SMTPURL != nil {
+			if err := s.sendDueReports(time.Now()); err != nil {
+				s.logger.Error("Failed to send reports", slog.String("error", err.Error()))
+			}
+		}
+		if err := s.sendDueChannelReports(time.Now()); err != nil {
+			s.logger.Error("Failed to send reports to notification channels", slog.String("error", err.Error()))
+		}
+		time.Sleep(interval)
+	}
+}
+
+// handleReportSubscriptions lists the recipients of reports (GET), subscribes
+// one to a domain's reports (POST) or unsubscribes one (DELETE).
+func (s *server) handleReportSubscriptions(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := s.db.Query(`
+		SELECT id, domain, email, frequency, created_at FROM report_subscriptions
+		WHERE $1 = '' OR domain = $1
+		ORDER BY domain, email, frequency
+		`, query.Get("domain"))
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to query report subscriptions", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+		defer rows.Close()
+
+		subscriptions := []reportSubscription{}
+		for rows.Next() {
+			var sub reportSubscription
+			if err := rows.Scan(&sub.ID, &sub.Domain, &sub.Email, &sub.Frequency, &sub.CreatedAt); err != nil {
+				s.logger.ErrorContext(r.Context(), "Failed to scan report subscription", slog.String("error", err.Error()))
+				writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+				return
+			}
+			subscriptions = append(subscriptions, sub)
+		}
+		if err := rows.Err(); err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to query report subscriptions", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(subscriptions)
+
+	case http.MethodPost:
+		domain := query.Get("domain")
+		if domain == "" {
+			writeError(w, http.StatusBadRequest, errMissingParameter, "Missing domain parameter")
+			return
+		}
+		if query.Get("email") == "" {
+			writeError(w, http.StatusBadRequest, errMissingParameter, "Missing email parameter")
+			return
+		}
+		email, err := mail.ParseAddress(query.Get("email"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid email parameter, expected an email address")
+			return
+		}
+		frequency := query.Get("frequency")
+		if frequency == "" {
+			frequency = "weekly"
+		}
+		if _, ok := reportFrequencies[frequency]; !ok {
+			writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid frequency parameter, expected weekly or monthly")
+			return
+		}
+
+		token, err := newToken()
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to subscribe to reports", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+
+		// Subscribing a recipient twice returns their subscription
+		sub := reportSubscription{Domain: domain, Email: email.Address, Frequency: frequency}
+		status := http.StatusCreated
+		err = s.db.QueryRow(`
+		INSERT INTO report_subscriptions (domain, email, frequency, token) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (domain, email, frequency) DO NOTHING
+		RETURNING id, created_at
+		`, domain, sub.Email, frequency, token).Scan(&sub.ID, &sub.CreatedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			status = http.StatusOK
+			err = s.db.QueryRow(`
+			SELECT id, created_at FROM report_subscriptions
+			WHERE domain = $1 AND email = $2 AND frequency = $3
+			`, domain, sub.Email, frequency).Scan(&sub.ID, &sub.CreatedAt)
+		}
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to subscribe to reports", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(sub)
+
+	case http.MethodDelete:
+		id, err := strconv.ParseInt(query.Get("id"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid id parameter, expected the id of a subscription")
+			return
+		}
+
+		if _, err := s.db.Exec(`DELETE FROM report_subscriptions WHERE id = $1`, id); err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to unsubscribe from reports", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// handleUnsubscribe unsubscribes the recipient of the reports whose link was
+// followed, or posted to by their mail client. Unknown tokens are answered
+// the same, so that unsubscribing twice is harmless.
+func (s *server) handleUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		writeError(w, http.StatusBadRequest, errMissingParameter, "Missing token parameter")
+		return
+	}
+
+	if _, err := s.db.Exec(`DELETE FROM report_subscriptions WHERE token = $1`, token); err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to unsubscribe from reports", slog.String("error", err.Error()))
+		writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "You won't receive these reports anymore.")
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// How many days visitors are remembered for, to tell returning visitors from
+// new ones.
+const returningWindowDays = 30
+
+// returningStore remembers the last days visitors were seen on. Visitors are
+// stored as a keyed hash of their identifier, so that they can't be recovered
+// from the table, and forgotten once they haven't been seen for the window.
+type returningStore struct {
+	db *sql.DB
+
+	mu  sync.Mutex
+	key []byte
+}
+
+func newReturningStore(db *sql.DB) *returningStore {
+	return &returningStore{db: db}
+}
+
+// hashKey returns the key visitors are hashed with, created on first use and
+// shared by all instances.
+func (rs *returningStore) hashKey() ([]byte, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.key != nil {
+		return rs.key, nil
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	err := rs.db.QueryRow(`
+	WITH inserted AS (
+		INSERT INTO keys (name, key) VALUES ('returning', $1)
+		ON CONFLICT (name) DO NOTHING
+		RETURNING key
+	)
+	SELECT key FROM inserted
+	UNION ALL
+	SELECT key FROM keys WHERE name = 'returning'
+	LIMIT 1
+	`, key).Scan(&key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load key: %w", err)
+	}
+
+	rs.key = key
+	return key, nil
+}
+
+// visitorType records that a visitor was seen on day and returns whether
+// they're "new" or "returning", that is seen on another day of the window.
+func (rs *returningStore) visitorType(domain string, visitor string, day time.Time) (string, error) {
+	key, err := rs.hashKey()
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(domain + "\n" + visitor))
+
+	// The previous day is only moved forward on the first pageview of a day,
+	// so that a visitor keeps the same type all day long
+	var returning bool
+	err = rs.db.QueryRow(`
+	INSERT INTO visitor_days (domain, visitor, last_day)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (domain, visitor)
+	DO UPDATE SET
+		previous_day = CASE WHEN visitor_days.last_day < EXCLUDED.last_day THEN visitor_days.last_day ELSE visitor_days.previous_day END,
+		last_day = GREATEST(visitor_days.last_day, EXCLUDED.last_day)
+	RETURNING COALESCE(previous_day >= $4, false)
+	`, domain, mac.Sum(nil), day, day.AddDate(0, 0, -returningWindowDays)).Scan(&returning)
+	if err != nil {
+		return "", fmt.Errorf("failed to record visitor day: %w", err)
+	}
+
+	if returning {
+		return "returning", nil
+	}
+	return "new", nil
+}
+
+// prune forgets the visitors who haven't been seen for the window.
+func (rs *returningStore) prune(now time.Time) error {
+	// Sites are a day ahead or behind UTC at most
+	cutoff := dayIn(now, time.UTC).AddDate(0, 0, -returningWindowDays-1)
+	_, err := rs.db.Exec(`DELETE FROM visitor_days WHERE last_day < $1`, cutoff)
+	if err != nil {
+		return fmt.Errorf("failed to prune visitor days: %w", err)
+	}
+	return nil
+}
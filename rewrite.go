@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// rewriteRule maps the paths matching a regular expression to another path,
+// which can reference the expression's groups as $1, $2 or ${name}.
+type rewriteRule struct {
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+
+	re *regexp.Regexp
+}
+
+// rewriter holds the per-domain rewrite rules applied to paths before they're
+// tracked. Rules are loaded from a JSON file mapping domains to their rules,
+// and reloaded when the file changes.
+type rewriter struct {
+	file string
+
+	mu      sync.RWMutex
+	modTime time.Time
+	rules   map[string][]rewriteRule
+}
+
+// newRewriter returns a rewriter loading its rules from file. No paths are
+// rewritten when file is empty.
+func newRewriter(file string) (*rewriter, error) {
+	rw := &rewriter{file: file, rules: map[string][]rewriteRule{}}
+	if file == "" {
+		return rw, nil
+	}
+	if _, err := rw.reload(); err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+// reload loads the rules again if the file changed since they were last
+// loaded, and reports whether it did. The current rules are kept if the new
+// ones are invalid.
+func (rw *rewriter) reload() (bool, error) {
+	info, err := os.Stat(rw.file)
+	if err != nil {
+		return false, fmt.Errorf("failed to read rewrite rules: %w", err)
+	}
+
+	rw.mu.RLock()
+	unchanged := info.ModTime().Equal(rw.modTime)
+	rw.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	content, err := os.ReadFile(rw.file)
+	if err != nil {
+		return false, fmt.Errorf("failed to read rewrite rules: %w", err)
+	}
+
+	rules := map[string][]rewriteRule{}
+	if err := json.Unmarshal(content, &rules); err != nil {
+		return false, fmt.Errorf("failed to parse rewrite rules: %w", err)
+	}
+	for domain, domainRules := range rules {
+		for i := range domainRules {
+			domainRules[i].re, err = regexp.Compile(domainRules[i].Match)
+			if err != nil {
+				return false, fmt.Errorf("invalid rewrite rule %d for %s: %w", i, domain, err)
+			}
+		}
+	}
+
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.rules = rules
+	rw.modTime = info.ModTime()
+
+	return true, nil
+}
+
+// reloadEvery checks the file for changes periodically. It never returns.
+func (rw *rewriter) reloadEvery(interval time.Duration, logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		reloaded, err := rw.reload()
+		if err != nil {
+			logger.Error("Failed to reload rewrite rules", slog.String("error", err.Error()))
+		} else if reloaded {
+			logger.Info("Reloaded rewrite rules", slog.String("file", rw.file))
+		}
+	}
+}
+
+// rewrite applies the first of the domain's rules matching path, returning
+// the new path and the index of the rule, or path and -1 if none matches.
+func (rw *rewriter) rewrite(domain string, path string) (string, int) {
+	rw.mu.RLock()
+	defer rw.mu.RUnlock()
+
+	for i, rule := range rw.rules[domain] {
+		if !rule.re.MatchString(path) {
+			continue
+		}
+		rewritten := rule.re.ReplaceAllString(path, rule.Replace)
+		if rewritten == "" {
+			rewritten = "/"
+		}
+		return rewritten, i
+	}
+	return path, -1
+}
+
+// handleRewriteTest shows how a path would be rewritten, without tracking
+// anything, to check rules before relying on them.
+func (s *server) handleRewriteTest(w http.ResponseWriter, r *http.Request) {
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeError(w, http.StatusBadRequest, errMissingParameter, "Missing domain parameter")
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeError(w, http.StatusBadRequest, errMissingParameter, "Missing path parameter")
+		return
+	}
+
+	rewritten, rule := s.rewrites.rewrite(domain, path)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		Path      string `json:"path"`
+		Rewritten string `json:"rewritten"`
+		Rule      *int   `json:"rule"`
+	}{
+		Path:      path,
+		Rewritten: rewritten,
+		Rule:      ruleIndex(rule),
+	})
+}
+
+// ruleIndex returns nil when no rule matched, so that it's encoded as null.
+func ruleIndex(i int) *int {
+	if i < 0 {
+		return nil
+	}
+	return &i
+}
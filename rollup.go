@@ -0,0 +1,352 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// rollupTables are rolled up into monthly rows, in the table of the same
+// name suffixed with _monthly. Queries over whole months that have been
+// rolled up are answered from them, so that the daily rows can be pruned.
+var rollupTables = []string{"pages", "countries", "sources"}
+
+// Key of the advisory lock held while rolling a month up, and shared by the
+// writes into months that may have been, so that their rows are either read
+// by the rollup or counted in its monthly rows too
+const rollupLock = 7108309
+
+// rollupTable returns the table the monthly rows of table are stored in.
+func rollupTable(table string) string {
+	return table + "_monthly"
+}
+
+// monthStart returns the first day of the month day falls in.
+func monthStart(day time.Time) time.Time {
+	return time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// storedColumns returns the columns stored in table's rows, in order: the
+// site, its dimensions, the day and the counts. Monthly rows have those of
+// their daily rows.
+func storedColumns(table string) []string {
+	columns := []string{"site_id"}
+	for _, column := range statsTables[strings.TrimSuffix(table, "_monthly")] {
+		// Channels are computed from referrers
+		if column != "channel" {
+			columns = append(columns, column)
+		}
+	}
+	return append(columns, "day", "visitor_hll", "pageviews")
+}
+
+// monthly returns the row row is counted in once its month is rolled up.
+func (row countedRow) monthly() countedRow {
+	row.table, row.day = rollupTable(row.table), monthStart(row.day)
+	return row
+}
+
+// mayBeRolledUp reports whether the month of row may have been rolled up, as
+// it's over in UTC. Writing it then takes lockRollups, when other rows are
+// written right away.
+func (row countedRow) mayBeRolledUp(now time.Time) bool {
+	return slices.Contains(rollupTables, row.table) && row.day.Before(monthStart(dayIn(now, time.UTC)))
+}
+
+// rolledUpMonths is the set of the months of each table that have been
+// rolled up.
+type rolledUpMonths map[string]bool
+
+// has reports whether the month of row has been rolled up, in which case
+// queries only read its monthly row: backfills, imports and late writes
+// have to be counted in it too.
+func (months rolledUpMonths) has(row countedRow) bool {
+	return months[row.table+" "+monthStart(row.day).Format(time.DateOnly)]
+}
+
+// lockRollups waits for the months being rolled up to be, and keeps others
+// from being until tx ends, returning those that have been.
+func lockRollups(tx *sql.Tx) (rolledUpMonths, error) {
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock_shared($1)`, rollupLock); err != nil {
+		return nil, fmt.Errorf("failed to lock rollups: %w", err)
+	}
+
+	rows, err := tx.Query(`SELECT table_name, month FROM rollups`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query rollups: %w", err)
+	}
+	defer rows.Close()
+
+	months := rolledUpMonths{}
+	for rows.Next() {
+		var table string
+		var month time.Time
+		if err := rows.Scan(&table, &month); err != nil {
+			return nil, fmt.Errorf("failed to scan rollup: %w", err)
+		}
+		months[table+" "+month.Format(time.DateOnly)] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query rollups: %w", err)
+	}
+	return months, nil
+}
+
+// upsert executes the upsert of row built by upsertSQL in db, and of its
+// monthly row too if its month has been rolled up.
+func (months rolledUpMonths) upsert(db execer, row countedRow, upsertSQL func(row countedRow, args *queryArgs) string) error {
+	rows := []countedRow{row}
+	if months.has(row) {
+		rows = append(rows, row.monthly())
+	}
+	for _, row := range rows {
+		var args queryArgs
+		if _, err := db.Exec(upsertSQL(row, &args), args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withRollups returns q answering the whole months of its range that have
+// been rolled up from their monthly rows. Only queries whose days don't have
+// to be told apart within a month can be.
+func (st *postgresStore) withRollups(q statsQuery) (statsQuery, error) {
+	if !slices.Contains(rollupTables, q.table) || (q.interval != "" && q.interval != "month") {
+		return q, nil
+	}
+
+	// The first day of the first whole month, and the day after the last one
+	first := monthStart(q.start)
+	if !first.Equal(q.start) {
+		first = first.AddDate(0, 1, 0)
+	}
+	last := monthStart(q.end.AddDate(0, 0, 1))
+	if !first.Before(last) {
+		return q, nil
+	}
+
+	rows, err := st.reader().Query(`
+	SELECT month FROM rollups
+	WHERE table_name = $1 AND month >= $2 AND month < $3
+	ORDER BY month
+	`, q.table, first, last)
+	if err != nil {
+		return q, fmt.Errorf("failed to query rollups: %w", err)
+	}
+	defer rows.Close()
+
+	q.rolledUp = nil
+	for rows.Next() {
+		var month time.Time
+		if err := rows.Scan(&month); err != nil {
+			return q, fmt.Errorf("failed to scan rollup: %w", err)
+		}
+		q.rolledUp = append(q.rolledUp, month)
+	}
+	if err := rows.Err(); err != nil {
+		return q, fmt.Errorf("failed to query rollups: %w", err)
+	}
+
+	return q, nil
+}
+
+// fromSQL returns what q selects its rows from: its table, or when some of
+// its months are rolled up, their monthly rows along with the daily rows of
+// the rest of its range.
+func (q statsQuery) fromSQL(args *queryArgs) string {
+	if len(q.rolledUp) == 0 {
+		return q.table
+	}
+
+	columns := strings.Join(storedColumns(q.table), ", ")
+
+	// The ranges of days between the rolled up months
+	var ranges []string
+	day := q.start
+	for _, month := range q.rolledUp {
+		if day.Before(month) {
+			ranges = append(ranges, "day BETWEEN "+args.add(day)+" AND "+args.add(month.AddDate(0, 0, -1)))
+		}
+		day = month.AddDate(0, 1, 0)
+	}
+	if !day.After(q.end) {
+		ranges = append(ranges, "day BETWEEN "+args.add(day)+" AND "+args.add(q.end))
+	}
+
+	months := make([]string, len(q.rolledUp))
+	for i, month := range q.rolledUp {
+		months[i] = month.Format(time.DateOnly)
+	}
+	from := "(\n\tSELECT " + columns + " FROM " + rollupTable(q.table) + " WHERE day = ANY(" + args.add(pq.Array(months)) + "::date[])"
+	if len(ranges) > 0 {
+		from += "\n\tUNION ALL\n\tSELECT " + columns + " FROM " + q.table + " WHERE " + strings.Join(ranges, " OR ")
+	}
+	return from + "\n) AS " + q.table
+}
+
+// rollUp rolls up the months that are over in every time zone and haven't
+// been yet, including those before the last one rolled up that only got
+// rows since, from a backfill or a new site. A month is only rolled up once,
+// as its daily rows may be pruned afterwards: the rows written into it later
+// are counted in its monthly rows as they are.
+func (s *server) rollUp(now time.Time) error {
+	// Sites are a day ahead or behind UTC at most
+	end := monthStart(dayIn(now, time.UTC).AddDate(0, 0, -1))
+
+	for _, table := range rollupTables {
+		rows, err := s.db.Query(`
+		SELECT months.month::date FROM generate_series(
+			(SELECT date_trunc('month', MIN(day)::timestamp) FROM `+table+`),
+			$1::timestamp - interval '1 month',
+			interval '1 month'
+		) AS months (month)
+		WHERE NOT EXISTS (SELECT 1 FROM rollups WHERE table_name = $2 AND rollups.month = months.month::date)
+		AND EXISTS (SELECT 1 FROM `+table+` WHERE day >= months.month::date AND day < (months.month + interval '1 month')::date)
+		ORDER BY months.month
+		`, end, table)
+		if err != nil {
+			return fmt.Errorf("failed to query the months of %s: %w", table, err)
+		}
+		var months []time.Time
+		for rows.Next() {
+			var month time.Time
+			if err := rows.Scan(&month); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan month: %w", err)
+			}
+			months = append(months, month)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to query the months of %s: %w", table, err)
+		}
+
+		for _, month := range months {
+			if err := s.rollUpMonth(table, month); err != nil {
+				return err
+			}
+			s.logger.Info("Rolled up month", slog.String("table", table), slog.String("month", month.Format("2006-01")))
+		}
+	}
+	return nil
+}
+
+// rollUpMonth stores the monthly rows of table for a month, and records that
+// it's been rolled up.
+func (s *server) rollUpMonth(table string, month time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin rollup: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The rows being written into the month are waited for
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, rollupLock); err != nil {
+		return fmt.Errorf("failed to lock rollups: %w", err)
+	}
+
+	// Another instance may have rolled the month up already
+	var inserted bool
+	err = tx.QueryRow(`
+	INSERT INTO rollups (table_name, month) VALUES ($1, $2)
+	ON CONFLICT DO NOTHING
+	RETURNING true
+	`, table, month).Scan(&inserted)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record rollup: %w", err)
+	}
+
+	columns := storedColumns(table)
+	dimensions := strings.Join(columns[:len(columns)-3], ", ")
+	if s.sketches.goHLL {
+		err = rollUpMonthInGo(tx, table, dimensions, month)
+	} else {
+		_, err = tx.Exec(`
+		INSERT INTO `+rollupTable(table)+` (`+strings.Join(columns, ", ")+`)
+		SELECT `+dimensions+`, $1, hll_union_agg(visitor_hll), SUM(pageviews) FROM `+table+`
+		WHERE day >= $1 AND day < $2
+		GROUP BY `+dimensions, month, month.AddDate(0, 1, 0))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to roll up %s: %w", table, err)
+	}
+
+	return tx.Commit()
+}
+
+// rollUpMonthInGo stores the monthly rows of table when sketches are
+// computed by Potato, merging them here.
+func rollUpMonthInGo(tx *sql.Tx, table string, dimensions string, month time.Time) error {
+	rows, err := tx.Query(`
+	SELECT `+dimensions+`, array_agg(visitor_hll), SUM(pageviews) FROM `+table+`
+	WHERE day >= $1 AND day < $2
+	GROUP BY `+dimensions, month, month.AddDate(0, 1, 0))
+	if err != nil {
+		return err
+	}
+
+	type monthlyRow struct {
+		values    []string
+		sketch    []byte
+		pageviews int
+	}
+	var monthly []monthlyRow
+	count := len(strings.Split(dimensions, ", "))
+	for rows.Next() {
+		row := monthlyRow{values: make([]string, count), sketch: make([]byte, hllRegisters)}
+		var sketches pq.ByteaArray
+		dest := make([]any, 0, count+2)
+		for i := range row.values {
+			dest = append(dest, &row.values[i])
+		}
+		if err := rows.Scan(append(dest, &sketches, &row.pageviews)...); err != nil {
+			rows.Close()
+			return err
+		}
+		for _, sketch := range sketches {
+			hllUnion(row.sketch, sketch)
+		}
+		monthly = append(monthly, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	placeholders := make([]string, count+3)
+	for i := range placeholders {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+	insert := `INSERT INTO ` + rollupTable(table) + ` (` + dimensions + `, day, visitor_hll, pageviews) VALUES (` + strings.Join(placeholders, ", ") + `)`
+	for _, row := range monthly {
+		args := make([]any, 0, count+3)
+		for _, value := range row.values {
+			args = append(args, value)
+		}
+		args = append(args, month, row.sketch, row.pageviews)
+		if _, err := tx.Exec(insert, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollUpEvery rolls up the months that are over periodically. It never
+// returns.
+func (s *server) rollUpEvery(interval time.Duration) {
+	for {
+		if err := s.rollUp(time.Now()); err != nil {
+			s.logger.Error("Failed to roll up stats", slog.String("error", err.Error()))
+		}
+		time.Sleep(interval)
+	}
+}
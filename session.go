@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Browsers log in once with the API key as their password and are then
+// authenticated by a session cookie, so that the key isn't carried in the
+// URLs of their requests. Sessions are signed rather than stored: logging out
+// clears the cookie and revokes the session until it would have expired, and
+// rotating SIGNING_KEY ends every session.
+const (
+	sessionCookie = "potato_session"
+	sessionTTL    = 7 * 24 * time.Hour
+
+	// The header carrying the CSRF token of the session, required by the
+	// requests authenticated by the cookie that aren't reads
+	csrfHeader = "X-CSRF-Token"
+)
+
+// signSession returns the signature of a session expiring at expiresAt.
+func (s *server) signSession(expiresAt int64) string {
+	mac := hmac.New(sha256.New, s.signingKey("session"))
+	mac.Write([]byte("session\n" + strconv.FormatInt(expiresAt, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// csrfToken returns the CSRF token of a session, derived from its cookie so
+// that it doesn't have to be stored either.
+func (s *server) csrfToken(session string) string {
+	mac := hmac.New(sha256.New, s.signingKey("session"))
+	mac.Write([]byte("csrf\n" + session))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validSession returns the session of the request's cookie, if it has a
+// valid, unexpired one that wasn't revoked.
+func (s *server) validSession(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || s.cfg.SigningKey == "" {
+		return "", false
+	}
+
+	expiry, sig, ok := strings.Cut(cookie.Value, ".")
+	expiresAt, err := strconv.ParseInt(expiry, 10, 64)
+	if !ok || err != nil || time.Now().Unix() > expiresAt {
+		return "", false
+	}
+	if !hmac.Equal([]byte(sig), []byte(s.signSession(expiresAt))) {
+		return "", false
+	}
+
+	err = s.db.QueryRowContext(r.Context(), `SELECT 1 FROM revoked_sessions WHERE signature = $1`, sig).Scan(new(int))
+	if err == nil {
+		return "", false
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		s.logger.ErrorContext(r.Context(), "Failed to check session revocation", slog.String("error", err.Error()))
+		return "", false
+	}
+	return cookie.Value, true
+}
+
+// authenticatedBySession reports whether the request is authenticated by a
+// session, checking its CSRF token unless it's a read.
+func (s *server) authenticatedBySession(r *http.Request) bool {
+	session, ok := s.validSession(r)
+	if !ok {
+		return false
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return true
+	}
+	return hmac.Equal([]byte(r.Header.Get(csrfHeader)), []byte(s.csrfToken(session)))
+}
+
+// setSessionCookie sets the session cookie to value, to expire with it. It's
+// only sent over HTTPS, except on localhost.
+func (s *server) setSessionCookie(w http.ResponseWriter, value string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   s.cfg.HostDomain != "localhost",
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// writeSession replies with the CSRF token of a session and its expiry.
+func writeSession(w http.ResponseWriter, status int, csrf string, expiresAt time.Time) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		CSRFToken string    `json:"csrf_token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{csrf, expiresAt.UTC()})
+}
+
+// handleLogin starts a session when the password posted is the API key.
+func (s *server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if s.cfg.APIKey == "" || s.cfg.SigningKey == "" {
+		writeError(w, http.StatusInternalServerError, errNotConfigured, "API_KEY is not set")
+		return
+	}
+
+	password := r.PostFormValue("password")
+	if subtle.ConstantTimeCompare([]byte(password), []byte(s.cfg.APIKey)) != 1 {
+		writeError(w, http.StatusUnauthorized, errUnauthorized, "Unauthorized")
+		return
+	}
+
+	expires := time.Unix(time.Now().Add(sessionTTL).Unix(), 0)
+	session := strconv.FormatInt(expires.Unix(), 10) + "." + s.signSession(expires.Unix())
+	s.setSessionCookie(w, session, expires)
+	writeSession(w, http.StatusCreated, s.csrfToken(session), expires)
+}
+
+// handleLogout revokes the session, if the request has one, and clears its
+// cookie.
+func (s *server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if session, ok := s.validSession(r); ok {
+		expiry, sig, _ := strings.Cut(session, ".")
+		expiresAt, _ := strconv.ParseInt(expiry, 10, 64)
+		if _, err := s.db.ExecContext(r.Context(), `
+		INSERT INTO revoked_sessions (signature, expires_at) VALUES ($1, $2)
+		ON CONFLICT (signature) DO NOTHING
+		`, sig, time.Unix(expiresAt, 0)); err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to revoke session", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+	}
+	s.setSessionCookie(w, "", time.Unix(0, 0))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSession returns the CSRF token of the current session, for pages
+// loaded after logging in.
+func (s *server) handleSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.validSession(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, errUnauthorized, "Unauthorized")
+		return
+	}
+	expiry, _, _ := strings.Cut(session, ".")
+	expiresAt, _ := strconv.ParseInt(expiry, 10, 64)
+	writeSession(w, http.StatusOK, s.csrfToken(session), time.Unix(expiresAt, 0))
+}
+
+// pruneRevokedSessions forgets the revoked sessions that have expired since.
+func (s *server) pruneRevokedSessions(now time.Time) error {
+	if _, err := s.db.Exec(`DELETE FROM revoked_sessions WHERE expires_at < $1`, now); err != nil {
+		return fmt.Errorf("failed to prune revoked sessions: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestLogoutRevokesSession checks that a session can't be used once logged
+// out, even by a copy of its cookie.
+func TestLogoutRevokesSession(t *testing.T) {
+	s := newTestServer(t, "-api-key=secret")
+	var rec *recordingDB
+	s.db, rec = newRecordingDB(t)
+
+	login := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader("password=secret"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	s.handleLogin(login, r)
+	if login.Code != http.StatusCreated {
+		t.Fatalf("/login = %d %s", login.Code, login.Body)
+	}
+	cookie := login.Result().Cookies()[0]
+
+	request := func(method, target string) *http.Request {
+		r := httptest.NewRequest(method, target, nil)
+		r.AddCookie(cookie)
+		return r
+	}
+	if _, ok := s.validSession(request(http.MethodGet, "/session")); !ok {
+		t.Fatalf("the session isn't valid after logging in")
+	}
+
+	logout := httptest.NewRecorder()
+	s.handleLogout(logout, request(http.MethodPost, "/logout"))
+	if logout.Code != http.StatusNoContent {
+		t.Fatalf("/logout = %d %s", logout.Code, logout.Body)
+	}
+
+	_, sig, _ := strings.Cut(cookie.Value, ".")
+	var revoked bool
+	for _, statement := range rec.recorded() {
+		if strings.HasPrefix(statement.query, "INSERT INTO revoked_sessions") && statement.args[0] == sig {
+			revoked = true
+		}
+	}
+	if !revoked {
+		t.Fatalf("logging out didn't revoke the session: %v", rec.recorded())
+	}
+
+	rec.answer("FROM revoked_sessions", []string{"?column?"}, []driver.Value{int64(1)})
+	if _, ok := s.validSession(request(http.MethodGet, "/session")); ok {
+		t.Errorf("the session is still valid after logging out")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// settings are the raw values of the configSettings, looked up in the flags
+// first, then in the environment and in the config file.
+type settings struct {
+	flags map[string]string
+	file  map[string]string
+}
+
+func (s settings) get(name string) string {
+	if value, ok := s.flags[name]; ok {
+		return value
+	}
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return s.file[name]
+}
+
+// loadSettings parses the flags of args and reads the config file, given
+// with -config or CONFIG_FILE, or potato.yaml if it exists. It returns the
+// arguments left after the flags.
+func loadSettings(args []string) (settings, []string, error) {
+	s := settings{flags: map[string]string{}}
+
+	flags := flag.NewFlagSet("potato", flag.ExitOnError)
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "the YAML config file to read, "+defaultConfigFile+" by default")
+	for _, name := range configSettings {
+		flags.Func(strings.ReplaceAll(strings.ToLower(name), "_", "-"), "overrides "+name, func(value string) error {
+			s.flags[name] = value
+			return nil
+		})
+	}
+	flags.Parse(args)
+
+	path, required := *configFile, true
+	if path == "" {
+		path, required = defaultConfigFile, false
+	}
+	file, err := readConfigFile(path)
+	if errors.Is(err, fs.ErrNotExist) && !required {
+		return s, flags.Args(), nil
+	}
+	if err != nil {
+		return settings{}, nil, fmt.Errorf("failed to read the config file: %w", err)
+	}
+	s.file = file
+	return s, flags.Args(), nil
+}
+
+// readConfigFile returns the settings of a YAML config file, written as they
+// would be in the environment.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]configValue
+	if err := yaml.UnmarshalStrict(data, &values); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	file := make(map[string]string, len(values))
+	for key, value := range values {
+		name := strings.ToUpper(key)
+		if !slices.Contains(configSettings, name) {
+			return nil, fmt.Errorf("unknown setting %q in %s", key, path)
+		}
+		file[name] = string(value)
+	}
+	return file, nil
+}
+
+// configValue is a setting of the config file: a value, a list of values
+// or a map of values or lists. Lists are comma-separated in the
+// environment, such as EXCLUDED_IPS, and maps are lists of key=value, such
+// as SITE_TIMEZONES, a key being repeated for each value of its list, as
+// with GOALS.
+type configValue string
+
+func (v *configValue) UnmarshalYAML(unmarshal func(any) error) error {
+	// Scalars are taken as they're written, so that 0660 isn't read as an
+	// octal number or 1e3 as a float
+	var value string
+	if err := unmarshal(&value); err == nil {
+		*v = configValue(value)
+		return nil
+	}
+
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		*v = configValue(strings.Join(list, ","))
+		return nil
+	}
+
+	var values map[string]configList
+	if err := unmarshal(&values); err != nil {
+		return errors.New("expected a value, a list or a map")
+	}
+	var pairs []string
+	for _, key := range slices.Sorted(maps.Keys(values)) {
+		for _, value := range values[key] {
+			pairs = append(pairs, key+"="+value)
+		}
+	}
+	*v = configValue(strings.Join(pairs, ","))
+	return nil
+}
+
+// configList is a value of a map of the config file, or a list of them.
+type configList []string
+
+func (l *configList) UnmarshalYAML(unmarshal func(any) error) error {
+	var value string
+	if err := unmarshal(&value); err == nil {
+		*l = configList{value}
+		return nil
+	}
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return errors.New("expected a value or a list")
+	}
+	*l = list
+	return nil
+}
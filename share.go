@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// share is a link granting read-only access to the stats of a domain.
+type share struct {
+	Token     string    `json:"token"`
+	Domain    string    `json:"domain"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// newToken returns a random token, unguessable and safe in URLs.
+func newToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// lookupShare returns the share a token belongs to, or nil if it doesn't
+// exist or was revoked.
+func (s *server) lookupShare(token string) (*share, error) {
+	sh := share{Token: token}
+	err := s.db.QueryRow(`SELECT domain, created_at FROM shares WHERE token = $1`, token).Scan(&sh.Domain, &sh.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load share: %w", err)
+	}
+	return &sh, nil
+}
+
+// requireShare serves next for the domain of the share link the request is
+// made through, whatever domain the query asks for.
+func (s *server) requireShare(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sh, err := s.lookupShare(r.PathValue("token"))
+		if err != nil {
+			s.logger.Error("Failed to load share", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+		if sh == nil {
+			writeError(w, http.StatusUnauthorized, errInvalidShare, "Invalid or revoked share link")
+			return
+		}
+
+		next(w, scopedToDomain(r, sh.Domain))
+	}
+}
+
+// scopedToDomain returns the request querying domain, whatever its query
+// asks for, and stripped of its credentials.
+func scopedToDomain(r *http.Request, domain string) *http.Request {
+	query := r.URL.Query()
+	query.Set("domain", domain)
+	query.Del("api_key")
+	query.Del("sig")
+	r = r.Clone(r.Context())
+	r.URL.RawQuery = query.Encode()
+	return r
+}
+
+// handleShare describes the share link the request is made through, so that
+// pages embedding it know which domain they show.
+func (s *server) handleShare(w http.ResponseWriter, r *http.Request) {
+	sh, err := s.lookupShare(r.PathValue("token"))
+	if err != nil || sh == nil {
+		// requireShare already checked it
+		writeError(w, http.StatusUnauthorized, errInvalidShare, "Invalid or revoked share link")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		Domain    string    `json:"domain"`
+		CreatedAt time.Time `json:"created_at"`
+	}{
+		Domain:    sh.Domain,
+		CreatedAt: sh.CreatedAt,
+	})
+}
+
+// handleShares lists the share links (GET), creates one for a domain (POST)
+// or revokes one (DELETE).
+func (s *server) handleShares(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := s.db.Query(`
+		SELECT token, domain, created_at FROM shares
+		WHERE $1 = '' OR domain = $1
+		ORDER BY created_at DESC
+		`, query.Get("domain"))
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to query shares", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+		defer rows.Close()
+
+		shares := []share{}
+		for rows.Next() {
+			var sh share
+			if err := rows.Scan(&sh.Token, &sh.Domain, &sh.CreatedAt); err != nil {
+				s.logger.ErrorContext(r.Context(), "Failed to scan share", slog.String("error", err.Error()))
+				writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+				return
+			}
+			shares = append(shares, sh)
+		}
+		if err := rows.Err(); err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to query shares", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(shares)
+
+	case http.MethodPost:
+		domain := query.Get("domain")
+		if domain == "" {
+			writeError(w, http.StatusBadRequest, errMissingParameter, "Missing domain parameter")
+			return
+		}
+
+		token, err := newToken()
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to create share", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+		sh := share{Token: token, Domain: domain}
+		err = s.db.QueryRow(`INSERT INTO shares (token, domain) VALUES ($1, $2) RETURNING created_at`, token, domain).Scan(&sh.CreatedAt)
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to create share", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(struct {
+			share
+			Path string `json:"path"`
+		}{
+			share: sh,
+			Path:  "/share/" + token,
+		})
+
+	case http.MethodDelete:
+		token := query.Get("token")
+		if token == "" {
+			writeError(w, http.StatusBadRequest, errMissingParameter, "Missing token parameter")
+			return
+		}
+
+		if _, err := s.db.Exec(`DELETE FROM shares WHERE token = $1`, token); err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to revoke share", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Method not allowed")
+	}
+}
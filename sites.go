@@ -0,0 +1,409 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// site is a domain stats are recorded for. Its settings are stored as JSON,
+// those set overriding SITE_TIMEZONES, SITE_RETENTION_DAYS and GOALS.
+type site struct {
+	ID            int64     `json:"id"`
+	Domain        string    `json:"domain"`
+	Owner         string    `json:"owner,omitempty"`
+	Public        bool      `json:"public"`
+	Timezone      string    `json:"timezone,omitempty"`
+	RetentionDays *int      `json:"retention_days,omitempty"`
+	Goals         []goal    `json:"goals,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// The columns of a site, its settings decoded into its fields
+const siteColumns = `id, domain, COALESCE(owner, ''), settings, created_at`
+
+// scanSite scans the columns of a site.
+func scanSite(row interface{ Scan(...any) error }) (site, error) {
+	var st site
+	var settings []byte
+	if err := row.Scan(&st.ID, &st.Domain, &st.Owner, &settings, &st.CreatedAt); err != nil {
+		return site{}, err
+	}
+	if err := json.Unmarshal(settings, &st); err != nil {
+		return site{}, fmt.Errorf("failed to decode the settings of %s: %w", st.Domain, err)
+	}
+	return st, nil
+}
+
+// siteRegistry hands out the ID of each domain's site, creating the site on
+// its first pageview. IDs never change, so they're cached once known.
+type siteRegistry struct {
+	db *sql.DB
+
+	mu  sync.Mutex
+	ids map[string]int64
+}
+
+func newSiteRegistry(db *sql.DB) *siteRegistry {
+	return &siteRegistry{db: db, ids: map[string]int64{}}
+}
+
+func (r *siteRegistry) id(domain string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id, ok := r.ids[domain]; ok {
+		return id, nil
+	}
+
+	// Updating the existing site rather than doing nothing returns its ID
+	// when another instance created it first
+	var id int64
+	err := r.db.QueryRow(`
+	INSERT INTO sites (domain) VALUES ($1)
+	ON CONFLICT (domain) DO UPDATE SET domain = EXCLUDED.domain
+	RETURNING id
+	`, domain).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load site: %w", err)
+	}
+	r.ids[domain] = id
+	return id, nil
+}
+
+// siteCondition returns the condition restricting a stats table to the rows
+// of a domain's site, given as a placeholder.
+func siteCondition(domain string) string {
+	return "site_id = (SELECT id FROM sites WHERE domain = " + domain + ")"
+}
+
+// handleSites lists the sites (GET), adds one (POST), replying with the
+// snippet to install on it, or changes its owner and settings (PATCH).
+// Adding a site that already exists returns it.
+func (s *server) handleSites(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := s.db.Query(`SELECT ` + siteColumns + ` FROM sites ORDER BY domain`)
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to query sites", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+		defer rows.Close()
+
+		sites := []site{}
+		for rows.Next() {
+			st, err := scanSite(rows)
+			if err != nil {
+				s.logger.ErrorContext(r.Context(), "Failed to scan site", slog.String("error", err.Error()))
+				writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+				return
+			}
+			sites = append(sites, st)
+		}
+		if err := rows.Err(); err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to query sites", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(struct {
+			Sites []site `json:"sites"`
+		}{sites})
+
+	case http.MethodPost:
+		query := r.URL.Query()
+		// Pageviews are recorded under the host of their URL
+		domain := strings.ToLower(query.Get("domain"))
+		if domain == "" {
+			writeError(w, http.StatusBadRequest, errMissingParameter, "Missing domain parameter")
+			return
+		}
+		origin := s.collectorOrigin()
+		if origin == "" {
+			writeError(w, http.StatusInternalServerError, errNotConfigured, "HOST_DOMAIN is not set")
+			return
+		}
+
+		st, created, err := s.addSite(domain, query.Get("owner"))
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to add site", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+
+		status := http.StatusOK
+		if created {
+			status = http.StatusCreated
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(struct {
+			site
+			Snippet snippet `json:"snippet"`
+		}{st, newSnippet(origin)})
+
+	case http.MethodPatch:
+		query := r.URL.Query()
+		domain := strings.ToLower(query.Get("domain"))
+		if domain == "" {
+			writeError(w, http.StatusBadRequest, errMissingParameter, "Missing domain parameter")
+			return
+		}
+		set, unset, ok := s.parseSiteSettings(w, query)
+		if !ok {
+			return
+		}
+		if len(set) == 0 && len(unset) == 0 && !query.Has("owner") {
+			writeError(w, http.StatusBadRequest, errMissingParameter, "Missing owner, public, timezone, retention_days or goals parameter")
+			return
+		}
+		patch, err := json.Marshal(set)
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to encode site settings", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+
+		st, err := scanSite(s.db.QueryRow(`
+		UPDATE sites SET settings = (settings || $2::jsonb) - $3::text[],
+			owner = CASE WHEN $4 THEN NULLIF($5, '') ELSE owner END
+		WHERE domain = $1
+		RETURNING `+siteColumns, domain, string(patch), pq.Array(unset), query.Has("owner"), query.Get("owner")))
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errNotFound, "No site for this domain")
+			return
+		}
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to update site", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+		// The other instances apply the settings once they load them again
+		if err := s.siteSettings.reload(); err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to load site settings", slog.String("error", err.Error()))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(st)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, PATCH")
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// addSite creates the site of a domain, reporting whether it didn't exist
+// yet. An existing site is returned as it is, its owner unchanged.
+func (s *server) addSite(domain string, owner string) (site, bool, error) {
+	st, err := scanSite(s.db.QueryRow(`
+	INSERT INTO sites (domain, owner) VALUES ($1, NULLIF($2, ''))
+	ON CONFLICT (domain) DO NOTHING
+	RETURNING `+siteColumns, domain, owner))
+	if err == nil {
+		return st, true, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return site{}, false, fmt.Errorf("failed to create site: %w", err)
+	}
+
+	st, err = scanSite(s.db.QueryRow(`SELECT `+siteColumns+` FROM sites WHERE domain = $1`, domain))
+	if err != nil {
+		return site{}, false, fmt.Errorf("failed to load site: %w", err)
+	}
+	return st, false, nil
+}
+
+// parseSiteSettings returns the settings of a site to set and those to unset,
+// given empty, from the query parameters, replying with an error and
+// returning false when they're invalid.
+func (s *server) parseSiteSettings(w http.ResponseWriter, query url.Values) (map[string]any, []string, bool) {
+	set := map[string]any{}
+	unset := []string{}
+
+	if query.Has("public") {
+		public, err := strconv.ParseBool(query.Get("public"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid public parameter, expected true or false")
+			return nil, nil, false
+		}
+		set["public"] = public
+	}
+
+	if value := query.Get("timezone"); value != "" {
+		if _, err := time.LoadLocation(value); err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid timezone parameter, expected an IANA time zone such as Europe/Paris")
+			return nil, nil, false
+		}
+		set["timezone"] = value
+	} else if query.Has("timezone") {
+		unset = append(unset, "timezone")
+	}
+
+	if value := query.Get("retention_days"); value != "" {
+		days, err := strconv.Atoi(value)
+		if err != nil || days < 0 {
+			writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid retention_days parameter, expected a number of days, 0 to keep the stats forever")
+			return nil, nil, false
+		}
+		set["retention_days"] = days
+	} else if query.Has("retention_days") {
+		unset = append(unset, "retention_days")
+	}
+
+	if value := query.Get("goals"); value != "" {
+		goals := []goal{}
+		for _, definition := range strings.Split(value, ",") {
+			g, err := parseGoal(definition)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, errInvalidParameter, fmt.Sprintf("Invalid goals parameter: %v", err))
+				return nil, nil, false
+			}
+			if g.Event != "" && s.cfg.RawEventsDays == 0 {
+				writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid goals parameter: goals with an event need RAW_EVENTS_DAYS")
+				return nil, nil, false
+			}
+			goals = append(goals, g)
+		}
+		set["goals"] = goals
+	} else if query.Has("goals") {
+		unset = append(unset, "goals")
+	}
+
+	return set, unset, true
+}
+
+// siteSettingsStore holds the settings of the sites that have any, loaded
+// again periodically so that every instance applies those set through
+// /admin/sites. A nil store holds none.
+type siteSettingsStore struct {
+	db    *sql.DB
+	sites atomic.Pointer[map[string]site]
+	// The time zones of the sites, parsed as they're loaded
+	locations atomic.Pointer[map[string]*time.Location]
+}
+
+func newSiteSettingsStore(db *sql.DB) *siteSettingsStore {
+	return &siteSettingsStore{db: db}
+}
+
+// get returns the site of a domain, if it has settings.
+func (st *siteSettingsStore) get(domain string) (site, bool) {
+	if st == nil {
+		return site{}, false
+	}
+	sites := st.sites.Load()
+	if sites == nil {
+		return site{}, false
+	}
+	s, ok := (*sites)[domain]
+	return s, ok
+}
+
+// location returns the time zone of a domain's site, if it has one.
+func (st *siteSettingsStore) location(domain string) (*time.Location, bool) {
+	if st == nil {
+		return nil, false
+	}
+	locations := st.locations.Load()
+	if locations == nil {
+		return nil, false
+	}
+	loc, ok := (*locations)[domain]
+	return loc, ok
+}
+
+// all returns the sites with settings.
+func (st *siteSettingsStore) all() map[string]site {
+	if st == nil || st.sites.Load() == nil {
+		return nil
+	}
+	return *st.sites.Load()
+}
+
+func (st *siteSettingsStore) reload() error {
+	if st == nil {
+		return nil
+	}
+	rows, err := st.db.Query(`SELECT ` + siteColumns + ` FROM sites WHERE settings - 'public' <> '{}'`)
+	if err != nil {
+		return fmt.Errorf("failed to query site settings: %w", err)
+	}
+	defer rows.Close()
+
+	sites := map[string]site{}
+	locations := map[string]*time.Location{}
+	for rows.Next() {
+		s, err := scanSite(rows)
+		if err != nil {
+			return err
+		}
+		sites[s.Domain] = s
+		if s.Timezone != "" {
+			loc, err := time.LoadLocation(s.Timezone)
+			if err != nil {
+				return fmt.Errorf("invalid time zone of %s: %w", s.Domain, err)
+			}
+			locations[s.Domain] = loc
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to query site settings: %w", err)
+	}
+	st.sites.Store(&sites)
+	st.locations.Store(&locations)
+	return nil
+}
+
+// reloadEvery loads the settings again periodically. It never returns.
+func (st *siteSettingsStore) reloadEvery(interval time.Duration, logger *slog.Logger) {
+	for {
+		time.Sleep(interval)
+		if err := st.reload(); err != nil {
+			logger.Error("Failed to load site settings", slog.String("error", err.Error()))
+		}
+	}
+}
+
+// siteLocation returns the time zone days are bucketed in for a domain.
+func (s *server) siteLocation(domain string) *time.Location {
+	if loc, ok := s.siteSettings.location(domain); ok {
+		return loc
+	}
+	return s.config().siteLocation(domain)
+}
+
+// goals returns the goals of a domain, in order.
+func (s *server) goals(domain string) []goal {
+	if st, ok := s.siteSettings.get(domain); ok && st.Goals != nil {
+		return st.Goals
+	}
+	return s.config().Goals[domain]
+}
+
+// retentionDays returns how many days the stats of a domain are kept for in
+// table, 0 meaning forever.
+func (s *server) retentionDays(domain string, table string) int {
+	cfg := s.config()
+	if st, ok := s.siteSettings.get(domain); ok && st.RetentionDays != nil {
+		return shortestRetention(cfg.privacyProfile(domain).RetentionDays, *st.RetentionDays, cfg.TableRetentionDays[table])
+	}
+	return cfg.retentionDays(domain, table)
+}
@@ -0,0 +1,787 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statsParams are the parameters shared by all the stats endpoints.
+type statsParams struct {
+	domain    string
+	startTime time.Time
+	endTime   time.Time
+	limit     int
+	offset    int
+	compare   bool
+
+	// The interval days are grouped by in time series
+	interval string
+
+	// The context of the request, tracing its queries
+	ctx context.Context
+}
+
+// parseStatsParams reads the parameters shared by all the stats endpoints,
+// writing a 400 response and returning false if one of them is invalid.
+func (s *server) parseStatsParams(w http.ResponseWriter, r *http.Request) (statsParams, bool) {
+	query := r.URL.Query()
+
+	params := statsParams{ctx: r.Context()}
+	params.domain = query.Get("domain")
+	if params.domain == "" {
+		writeError(w, http.StatusBadRequest, errMissingParameter, "Missing domain parameter")
+		return params, false
+	}
+
+	var err error
+	params.startTime, params.endTime, err = s.parseDateRange(query)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidParameter, err.Error())
+		return params, false
+	}
+
+	params.limit, params.offset, err = parsePagination(query)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidParameter, err.Error())
+		return params, false
+	}
+	// CSV downloads have every row rather than a page of them
+	if wantsCSV(r) {
+		params.limit, params.offset = 0, 0
+	}
+
+	params.compare, err = wantsComparison(query, params.startTime)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidParameter, err.Error())
+		return params, false
+	}
+
+	params.interval, err = parseInterval(query)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidParameter, err.Error())
+		return params, false
+	}
+
+	return params, true
+}
+
+// statsQuery returns the query of the stats of table over the requested
+// range and page.
+func (p statsParams) statsQuery(table string, filters ...queryFilter) statsQuery {
+	return statsQuery{
+		table:   table,
+		domain:  p.domain,
+		filters: filters,
+		start:   p.startTime,
+		end:     p.endTime,
+		limit:   p.limit,
+		offset:  p.offset,
+		ctx:     p.ctx,
+	}
+}
+
+// statsView is what a stats endpoint answers a request with: the query it
+// runs, the columns its rows can be sorted by, in the default order, and the
+// results they're scanned into.
+type statsView struct {
+	query   statsQuery
+	keys    []string
+	scan    func(row statsRow)
+	results any
+
+	// Completes the results once they're scanned, such as with the trends of
+	// a time series, when it's set
+	complete func() error
+}
+
+// missingParameter is the error of a required parameter left out, replied
+// with missing_parameter rather than invalid_parameter.
+type missingParameter string
+
+func (p missingParameter) Error() string {
+	return fmt.Sprintf("Missing %s parameter", string(p))
+}
+
+// serveStats returns the handler of a stats endpoint: it reads the
+// parameters shared by the stats endpoints, builds the view of the request,
+// and sorts, paginates and queries its rows before responding with them.
+// The errors build returns are invalid parameters of the request.
+func (s *server) serveStats(name string, build func(params statsParams, query url.Values) (statsView, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params, ok := s.parseStatsParams(w, r)
+		if !ok {
+			return
+		}
+
+		view, err := build(params, r.URL.Query())
+		if err == nil {
+			view.query.order, err = parseSort(r.URL.Query(), view.keys...)
+		}
+		var missing missingParameter
+		if errors.As(err, &missing) {
+			writeError(w, http.StatusBadRequest, errMissingParameter, err.Error())
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errInvalidParameter, err.Error())
+			return
+		}
+
+		total, err := s.queryStats(view.query, view.scan)
+		if err == nil && view.complete != nil {
+			err = view.complete()
+		}
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to query stats", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Failed to fetch stats")
+			return
+		}
+
+		s.respondStats(w, r, name, params, total, view.results, view.query)
+	}
+}
+
+// pagesView returns the stats of the pages, per day or over the range, or of
+// the whole domain per day with aggregate=true.
+func (s *server) pagesView(params statsParams, query url.Values) (statsView, error) {
+	table, filters, err := parseCrossFilter(query, "pages",
+		crossFilter{param: "country", table: "page_countries", column: "country"},
+		crossFilter{param: "source", table: "page_sources", column: "referrer"},
+	)
+	if err != nil {
+		return statsView{}, err
+	}
+
+	// Pages can be narrowed down to one of them or to a section of the site
+	if path := query.Get("path"); path != "" {
+		filters = append(filters, queryFilter{column: "path", value: path})
+	}
+	if prefix := query.Get("path_prefix"); prefix != "" {
+		filters = append(filters, queryFilter{column: "path", value: prefix, match: matchPrefix})
+	}
+
+	type PageStat struct {
+		Path      string    `json:"path,omitempty"`
+		Day       time.Time `json:"day"`
+		Visitors  int       `json:"visitors"`
+		Pageviews int       `json:"pageviews"`
+	}
+
+	type PageTotal struct {
+		Path      string `json:"path"`
+		Visitors  int    `json:"visitors"`
+		Pageviews int    `json:"pageviews"`
+	}
+
+	view := statsView{query: params.statsQuery(table, filters...)}
+	switch query.Get("aggregate") {
+	case "true":
+		// Domain-level stats per day
+		stats := []dayStat{}
+		view.query.interval = params.interval
+		view.keys = []string{"day", "visitors", "pageviews"}
+		view.scan = func(row statsRow) {
+			stats = append(stats, dayStat{Day: row.day, Visitors: row.visitors, Pageviews: row.pageviews})
+		}
+		view.results = &stats
+		view.complete = func() error { return s.addTrends(view.query, stats) }
+	case "range":
+		// Top pages over the whole range
+		stats := []PageTotal{}
+		view.query.dimensions = []string{"path"}
+		view.keys = []string{"visitors", "pageviews", "path"}
+		view.scan = func(row statsRow) {
+			stats = append(stats, PageTotal{Path: row.dimensions[0], Visitors: row.visitors, Pageviews: row.pageviews})
+		}
+		view.results = &stats
+	case "", "false":
+		stats := []PageStat{}
+		view.query.dimensions = []string{"path"}
+		view.query.interval = params.interval
+		view.keys = []string{"day", "visitors", "pageviews", "path"}
+		view.scan = func(row statsRow) {
+			stats = append(stats, PageStat{Path: row.dimensions[0], Day: row.day, Visitors: row.visitors, Pageviews: row.pageviews})
+		}
+		view.results = &stats
+	default:
+		return statsView{}, errors.New("invalid aggregate parameter, expected true or range")
+	}
+	return view, nil
+}
+
+// sourcesView returns the stats of the referring hosts, per day or over the
+// range.
+func (s *server) sourcesView(params statsParams, query url.Values) (statsView, error) {
+	table, filters, err := parseCrossFilter(query, "sources",
+		crossFilter{param: "page", table: "page_sources", column: "path"},
+	)
+	if err != nil {
+		return statsView{}, err
+	}
+
+	// Sources can be narrowed down to a referring host or searched
+	if referrer := query.Get("referrer"); referrer != "" {
+		filters = append(filters, queryFilter{column: "referrer", value: referrer})
+	}
+	if search := query.Get("search"); search != "" {
+		filters = append(filters, queryFilter{column: "referrer", value: search, match: matchContains})
+	}
+
+	type SourceStat struct {
+		Referrer  string    `json:"referrer"`
+		Day       time.Time `json:"day"`
+		Visitors  int       `json:"visitors"`
+		Pageviews int       `json:"pageviews"`
+	}
+
+	type SourceTotal struct {
+		Referrer  string `json:"referrer"`
+		Visitors  int    `json:"visitors"`
+		Pageviews int    `json:"pageviews"`
+	}
+
+	view := statsView{query: params.statsQuery(table, filters...)}
+	view.query.dimensions = []string{"referrer"}
+	switch query.Get("aggregate") {
+	case "range":
+		// Top sources over the whole range
+		stats := []SourceTotal{}
+		view.keys = []string{"visitors", "pageviews", "referrer"}
+		view.scan = func(row statsRow) {
+			stats = append(stats, SourceTotal{Referrer: row.dimensions[0], Visitors: row.visitors, Pageviews: row.pageviews})
+		}
+		view.results = &stats
+	case "":
+		stats := []SourceStat{}
+		view.query.interval = params.interval
+		view.keys = []string{"day", "visitors", "pageviews", "referrer"}
+		view.scan = func(row statsRow) {
+			stats = append(stats, SourceStat{Referrer: row.dimensions[0], Day: row.day, Visitors: row.visitors, Pageviews: row.pageviews})
+		}
+		view.results = &stats
+	default:
+		return statsView{}, errors.New("invalid aggregate parameter, expected range")
+	}
+	return view, nil
+}
+
+// countriesView returns the stats of the countries, per day or over the
+// range, or the share of visitors of each of them with aggregate=true.
+func (s *server) countriesView(params statsParams, query url.Values) (statsView, error) {
+	table, filters, err := parseCrossFilter(query, "countries",
+		crossFilter{param: "page", table: "page_countries", column: "path"},
+	)
+	if err != nil {
+		return statsView{}, err
+	}
+
+	type CountryStat struct {
+		Country   string    `json:"country"`
+		Day       time.Time `json:"day"`
+		Visitors  int       `json:"visitors"`
+		Pageviews int       `json:"pageviews"`
+	}
+
+	type CountryTotal struct {
+		Country   string `json:"country"`
+		Visitors  int    `json:"visitors"`
+		Pageviews int    `json:"pageviews"`
+	}
+
+	type CountryShare struct {
+		Country   string  `json:"country"`
+		Visitors  int     `json:"visitors"`
+		Pageviews int     `json:"pageviews"`
+		Share     float64 `json:"share"`
+	}
+
+	view := statsView{query: params.statsQuery(table, filters...)}
+	view.query.dimensions = []string{"country"}
+	switch query.Get("aggregate") {
+	case "true":
+		// Every country over the whole range, on a single page so that a map
+		// can be filled in with them
+		stats := []CountryShare{}
+		view.query.limit, view.query.offset = maxLimit, 0
+		view.keys = []string{"visitors", "pageviews", "country"}
+		view.scan = func(row statsRow) {
+			stats = append(stats, CountryShare{Country: row.dimensions[0], Visitors: row.visitors, Pageviews: row.pageviews})
+		}
+		view.results = &stats
+		view.complete = func() error {
+			// Visitors are counted in a single country, so they add up
+			visitors := 0
+			for _, stat := range stats {
+				visitors += stat.Visitors
+			}
+			for i := range stats {
+				if visitors > 0 {
+					stats[i].Share = float64(stats[i].Visitors) / float64(visitors)
+				}
+			}
+			return nil
+		}
+	case "range":
+		// Top countries over the whole range
+		stats := []CountryTotal{}
+		view.keys = []string{"visitors", "pageviews", "country"}
+		view.scan = func(row statsRow) {
+			stats = append(stats, CountryTotal{Country: row.dimensions[0], Visitors: row.visitors, Pageviews: row.pageviews})
+		}
+		view.results = &stats
+	case "", "false":
+		stats := []CountryStat{}
+		view.query.interval = params.interval
+		view.keys = []string{"day", "visitors", "pageviews", "country"}
+		view.scan = func(row statsRow) {
+			stats = append(stats, CountryStat{Country: row.dimensions[0], Day: row.day, Visitors: row.visitors, Pageviews: row.pageviews})
+		}
+		view.results = &stats
+	default:
+		return statsView{}, errors.New("invalid aggregate parameter, expected true or range")
+	}
+	return view, nil
+}
+
+// environmentsView returns the stats of the environments pageviews are
+// tracked in, per day or over the range.
+func (s *server) environmentsView(params statsParams, query url.Values) (statsView, error) {
+	type EnvironmentStat struct {
+		Environment string    `json:"environment"`
+		Day         time.Time `json:"day"`
+		Visitors    int       `json:"visitors"`
+		Pageviews   int       `json:"pageviews"`
+	}
+
+	type EnvironmentTotal struct {
+		Environment string `json:"environment"`
+		Visitors    int    `json:"visitors"`
+		Pageviews   int    `json:"pageviews"`
+	}
+
+	view := statsView{query: params.statsQuery("environments")}
+	view.query.dimensions = []string{"environment"}
+	switch query.Get("aggregate") {
+	case "range":
+		// Environments over the whole range
+		stats := []EnvironmentTotal{}
+		view.keys = []string{"visitors", "pageviews", "environment"}
+		view.scan = func(row statsRow) {
+			stats = append(stats, EnvironmentTotal{Environment: row.dimensions[0], Visitors: row.visitors, Pageviews: row.pageviews})
+		}
+		view.results = &stats
+	case "":
+		stats := []EnvironmentStat{}
+		view.query.interval = params.interval
+		view.keys = []string{"day", "visitors", "pageviews", "environment"}
+		view.scan = func(row statsRow) {
+			stats = append(stats, EnvironmentStat{Environment: row.dimensions[0], Day: row.day, Visitors: row.visitors, Pageviews: row.pageviews})
+		}
+		view.results = &stats
+	default:
+		return statsView{}, errors.New("invalid aggregate parameter, expected range")
+	}
+	return view, nil
+}
+
+// returningView returns the stats of new and returning visitors, per day or
+// over the range.
+func (s *server) returningView(params statsParams, query url.Values) (statsView, error) {
+	type VisitorTypeStat struct {
+		VisitorType string    `json:"visitor_type"`
+		Day         time.Time `json:"day"`
+		Visitors    int       `json:"visitors"`
+		Pageviews   int       `json:"pageviews"`
+	}
+
+	type VisitorTypeTotal struct {
+		VisitorType string `json:"visitor_type"`
+		Visitors    int    `json:"visitors"`
+		Pageviews   int    `json:"pageviews"`
+	}
+
+	view := statsView{query: params.statsQuery("visitor_types")}
+	view.query.dimensions = []string{"visitor_type"}
+	switch query.Get("aggregate") {
+	case "range":
+		// New and returning visitors over the whole range
+		stats := []VisitorTypeTotal{}
+		view.keys = []string{"visitors", "pageviews", "visitor_type"}
+		view.scan = func(row statsRow) {
+			stats = append(stats, VisitorTypeTotal{VisitorType: row.dimensions[0], Visitors: row.visitors, Pageviews: row.pageviews})
+		}
+		view.results = &stats
+	case "":
+		stats := []VisitorTypeStat{}
+		view.query.interval = params.interval
+		view.keys = []string{"day", "visitors", "pageviews", "visitor_type"}
+		view.scan = func(row statsRow) {
+			stats = append(stats, VisitorTypeStat{VisitorType: row.dimensions[0], Day: row.day, Visitors: row.visitors, Pageviews: row.pageviews})
+		}
+		view.results = &stats
+	default:
+		return statsView{}, errors.New("invalid aggregate parameter, expected range")
+	}
+	return view, nil
+}
+
+// pageView returns the stats of a single page per day.
+func (s *server) pageView(params statsParams, query url.Values) (statsView, error) {
+	path := query.Get("path")
+	if path == "" {
+		return statsView{}, missingParameter("path")
+	}
+
+	stats := []dayStat{}
+	view := statsView{
+		query: params.statsQuery("pages", queryFilter{column: "path", value: path}),
+		keys:  []string{"day", "visitors", "pageviews"},
+		scan: func(row statsRow) {
+			stats = append(stats, dayStat{Day: row.day, Visitors: row.visitors, Pageviews: row.pageviews})
+		},
+		results: &stats,
+	}
+	view.query.interval = params.interval
+	view.complete = func() error { return s.addTrends(view.query, stats) }
+	return view, nil
+}
+
+// crossFilter filters the stats of a dimension by another one, such as the
+// pages visited from a country. It's answered from the table counting
+// visitors for both dimensions.
+type crossFilter struct {
+	param  string
+	table  string
+	column string
+}
+
+// parseCrossFilter returns the table to query and the filter to apply for
+// the cross-dimension filter set in the query, if any.
+func parseCrossFilter(query url.Values, table string, filters ...crossFilter) (string, []queryFilter, error) {
+	var set []crossFilter
+	for _, f := range filters {
+		if query.Get(f.param) != "" {
+			set = append(set, f)
+		}
+	}
+
+	switch len(set) {
+	case 0:
+		return table, nil, nil
+	case 1:
+		return set[0].table, []queryFilter{{column: set[0].column, value: query.Get(set[0].param)}}, nil
+	}
+	return "", nil, fmt.Errorf("the %s and %s parameters can't be combined", set[0].param, set[1].param)
+}
+
+func (s *server) handleSign(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	domain := query.Get("domain")
+	if domain == "" {
+		writeError(w, http.StatusBadRequest, errMissingParameter, "Missing domain parameter")
+		return
+	}
+
+	if s.cfg.SigningKey == "" {
+		writeError(w, http.StatusInternalServerError, errNotConfigured, "SIGNING_KEY or API_KEY must be set to sign URLs")
+		return
+	}
+
+	// A signature only grants access to the stats endpoint it's made for
+	endpoint := query.Get("endpoint")
+	if endpoint == "" {
+		writeError(w, http.StatusBadRequest, errMissingParameter, "Missing endpoint parameter")
+		return
+	}
+	if !s.statsEndpoint(endpoint) {
+		writeError(w, http.StatusBadRequest, errInvalidParameter, fmt.Sprintf("Invalid endpoint parameter %q, expected the path of a stats endpoint such as /stats/pages", endpoint))
+		return
+	}
+
+	// Make sure the range is valid before signing it
+	if _, _, err := s.parseDateRange(query); err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidParameter, err.Error())
+		return
+	}
+
+	ttl := time.Hour
+	if value := query.Get("ttl"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 || seconds > maxSignatureTTL {
+			writeError(w, http.StatusBadRequest, errInvalidParameter, fmt.Sprintf("Invalid ttl parameter, expected a number of seconds up to %d", maxSignatureTTL))
+			return
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+
+	expiresAt := time.Now().Add(ttl).Unix()
+
+	signed := url.Values{}
+	for _, key := range []string{"domain", "start", "end", "period", "tz"} {
+		if value := query.Get(key); value != "" {
+			signed.Set(key, value)
+		}
+	}
+	signed.Set("exp", strconv.FormatInt(expiresAt, 10))
+	signed.Set("sig", s.signStatsQuery(endpoint, signed))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		Path      string    `json:"path"`
+		Query     string    `json:"query"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{
+		Path:      endpoint,
+		Query:     signed.Encode(),
+		ExpiresAt: time.Unix(expiresAt, 0).UTC(),
+	})
+}
+
+// statsEndpoint reports whether path is one of the stats endpoints signed
+// URLs can be made for.
+func (s *server) statsEndpoint(path string) bool {
+	for _, route := range s.apiRoutes() {
+		if route.auth == authStats && route.path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// Default and maximum number of rows returned by the stats endpoints
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+// statsResponse is the envelope the stats endpoints respond with. Total is
+// the number of rows matching the query, regardless of the page returned.
+type statsResponse struct {
+	Total   int `json:"total"`
+	Limit   int `json:"limit"`
+	Offset  int `json:"offset"`
+	Results any `json:"results"`
+
+	// Set when the previous period is requested through compare
+	Comparison *comparison `json:"comparison,omitempty"`
+
+	// The domain's annotations overlapping the range
+	Annotations []annotation `json:"annotations"`
+}
+
+// writeStats writes the response as JSON, or its results as CSV when asked
+// for through the format parameter or the Accept header. CSV downloads
+// aren't paginated.
+func (s *server) writeStats(w http.ResponseWriter, r *http.Request, name string, response statsResponse) {
+	if wantsCSV(r) {
+		filename := fmt.Sprintf("%s-%s.csv", r.URL.Query().Get("domain"), name)
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+		w.Header().Set("X-Total-Count", strconv.Itoa(response.Total))
+		w.WriteHeader(http.StatusOK)
+		// The status is sent by now, so the download is cut short
+		if err := writeCSV(w, response.Results); err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to write CSV", slog.String("error", err.Error()))
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+func wantsCSV(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "csv"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/csv")
+}
+
+// writeCSV writes a slice of structs as CSV, with a header row made of the
+// fields' JSON names. Days are written as YYYY-MM-DD.
+func writeCSV(w io.Writer, results any) error {
+	writer := csv.NewWriter(w)
+
+	rows := reflect.Indirect(reflect.ValueOf(results))
+	fields := rows.Type().Elem()
+
+	header := make([]string, fields.NumField())
+	for i := range header {
+		name, _, _ := strings.Cut(fields.Field(i).Tag.Get("json"), ",")
+		header[i] = name
+	}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+
+	record := make([]string, len(header))
+	for i := 0; i < rows.Len(); i++ {
+		row := rows.Index(i)
+		for j := range record {
+			field := row.Field(j)
+			if field.Kind() == reflect.Pointer {
+				if field.IsNil() {
+					record[j] = ""
+					continue
+				}
+				field = field.Elem()
+			}
+			switch value := field.Interface().(type) {
+			case time.Time:
+				record[j] = value.Format(time.DateOnly)
+			default:
+				record[j] = fmt.Sprint(value)
+			}
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// parsePagination returns the limit and offset query parameters.
+func parsePagination(query url.Values) (int, int, error) {
+	limit := defaultLimit
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxLimit {
+			return 0, 0, fmt.Errorf("invalid limit parameter, expected a number between 1 and %d", maxLimit)
+		}
+		limit = n
+	}
+
+	offset := 0
+	if value := query.Get("offset"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return 0, 0, errors.New("invalid offset parameter, expected a positive number")
+		}
+		offset = n
+	}
+
+	return limit, offset, nil
+}
+
+// Columns sorted in descending order unless asked otherwise, and when
+// breaking ties
+var descendingByDefault = map[string]bool{"day": true, "visitors": true, "pageviews": true}
+
+// parseSort returns the order for the sort and order query parameters. keys
+// lists the columns that can be sorted by, in the default order: the first
+// one is used when sort isn't set and the others break ties so that
+// pagination is stable.
+func parseSort(query url.Values, keys ...string) ([]sortKey, error) {
+	field := query.Get("sort")
+	if field == "" {
+		field = keys[0]
+	} else if !slices.Contains(keys, field) {
+		sorted := slices.Clone(keys)
+		slices.Sort(sorted)
+		return nil, fmt.Errorf("invalid sort parameter, expected one of %s", strings.Join(sorted, ", "))
+	}
+
+	desc := descendingByDefault[field]
+	switch strings.ToUpper(query.Get("order")) {
+	case "":
+	case "ASC":
+		desc = false
+	case "DESC":
+		desc = true
+	default:
+		return nil, errors.New("invalid order parameter, expected asc or desc")
+	}
+
+	order := []sortKey{{column: field, desc: desc}}
+	for _, key := range keys {
+		if key != field {
+			order = append(order, sortKey{column: key, desc: descendingByDefault[key]})
+		}
+	}
+
+	return order, nil
+}
+
+// queryStats runs a stats query for the requested page, calling scan for
+// each row, and returns the total number of rows the query matches.
+func (s *server) queryStats(q statsQuery, scan func(row statsRow)) (int, error) {
+	total, err := s.countRows(q)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := s.queryRows(q)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, row := range rows {
+		scan(row)
+	}
+
+	return total, nil
+}
+
+// respondStats writes the results of a stats query, along with the totals
+// of the previous period when they're requested and the annotations of
+// the range.
+func (s *server) respondStats(w http.ResponseWriter, r *http.Request, name string, params statsParams, total int, results any, q statsQuery) {
+	response := statsResponse{Total: total, Limit: q.limit, Offset: q.offset, Results: results}
+
+	var err error
+	response.Annotations, err = s.listAnnotations(q.domain, q.start, q.end)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to query annotations", slog.String("error", err.Error()))
+		writeError(w, http.StatusInternalServerError, errInternal, "Failed to fetch stats")
+		return
+	}
+
+	if params.compare {
+		response.Comparison, err = s.compareTotals(q)
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to compare stats", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Failed to fetch stats")
+			return
+		}
+	}
+
+	s.writeStats(w, r, name, response)
+}
+
+// parseInterval returns the interval days are grouped by in time series, one
+// day by default.
+func parseInterval(query url.Values) (string, error) {
+	interval := query.Get("interval")
+	if interval == "" {
+		interval = "day"
+	}
+
+	if _, ok := intervalBuckets[interval]; !ok {
+		return "", errors.New("invalid interval parameter, expected day, week or month")
+	}
+	return interval, nil
+}
+
+// dayIn returns the day t falls on in loc, as midnight UTC so that it's
+// stored unchanged in DATE columns.
+func dayIn(t time.Time, loc *time.Location) time.Time {
+	year, month, day := t.In(loc).Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestCSVIgnoresPagination checks that CSV downloads have every row, as
+// their rows would otherwise be the first page of the JSON results.
+func TestCSVIgnoresPagination(t *testing.T) {
+	s := newTestServer(t)
+
+	tests := []struct {
+		target    string
+		accept    string
+		wantLimit int
+	}{
+		{"/stats/pages?domain=example.com&limit=10&offset=20", "", 10},
+		{"/stats/pages?domain=example.com&limit=10&offset=20&format=csv", "", 0},
+		{"/stats/pages?domain=example.com", "text/csv", 0},
+		{"/stats/pages?domain=example.com&format=json", "text/csv", defaultLimit},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		params, ok := s.parseStatsParams(httptest.NewRecorder(), r)
+		if !ok {
+			t.Fatalf("parseStatsParams(%s) failed", tt.target)
+		}
+		if params.limit != tt.wantLimit {
+			t.Errorf("%s (Accept: %q): limit = %d, want %d", tt.target, tt.accept, params.limit, tt.wantLimit)
+		}
+		if query, _, _ := params.statsQuery("pages").sql(); tt.wantLimit == 0 && strings.Contains(query, "LIMIT") {
+			t.Errorf("%s: the CSV query is paginated: %s", tt.target, query)
+		}
+	}
+}
+
+func TestServeStatsInvalidParameters(t *testing.T) {
+	s := newTestServer(t)
+
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		target   string
+		wantCode string
+	}{
+		{"pages aggregate", s.serveStats("pages", s.pagesView), "/stats/pages?domain=example.com&aggregate=week", errInvalidParameter},
+		{"pages cross filters", s.serveStats("pages", s.pagesView), "/stats/pages?domain=example.com&country=FR&source=google.com", errInvalidParameter},
+		{"sources aggregate", s.serveStats("sources", s.sourcesView), "/stats/sources?domain=example.com&aggregate=true", errInvalidParameter},
+		{"countries sort", s.serveStats("countries", s.countriesView), "/stats/countries?domain=example.com&sort=path", errInvalidParameter},
+		{"environments aggregate", s.serveStats("environments", s.environmentsView), "/stats/environments?domain=example.com&aggregate=true", errInvalidParameter},
+		{"returning order", s.serveStats("returning", s.returningView), "/stats/returning?domain=example.com&order=up", errInvalidParameter},
+		{"page without path", s.serveStats("page", s.pageView), "/stats/page?domain=example.com", errMissingParameter},
+		{"without domain", s.serveStats("page", s.pageView), "/stats/page?path=/", errMissingParameter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := serveGet(t, tt.handler, tt.target)
+			if status != http.StatusBadRequest || !strings.Contains(body, `"code":"`+tt.wantCode+`"`) {
+				t.Errorf("%s = %d %s, want 400 %s", tt.target, status, body, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// statsStore is where pageviews are counted and stats are queried from:
+// PostgreSQL, or ClickHouse for sites too busy for an upsert per pageview.
+// Everything else, from salts to share links, is kept in PostgreSQL.
+type statsStore interface {
+	// record counts a pageview in the stats tables it belongs to
+	record(pv pageview) error
+
+	queryRows(q statsQuery) ([]statsRow, error)
+
+	// countRows returns the number of rows q matches regardless of
+	// pagination
+	countRows(q statsQuery) (int, error)
+
+	// firstDay returns the first day table has rows for domain, false when
+	// it has none
+	firstDay(table string, domain string) (time.Time, bool, error)
+
+	// domainDays returns the domains that have recorded pageviews in
+	// alphabetical order, with their first and last days
+	domainDays() ([]domainStats, error)
+
+	// prune deletes the rows of table older than cutoff, of domain or when
+	// it's empty, of every domain but the excluded ones
+	prune(table string, cutoff time.Time, domain string, excluded []string) error
+}
+
+// pageview is a pageview to count, once its visitor has been identified.
+type pageview struct {
+	domain      string
+	path        string
+	day         time.Time
+	visitor     string
+	environment string
+
+	// Empty when visitors can't be told apart from one day to the next
+	visitorType string
+
+	// Empty when unknown or not tracked
+	country string
+
+	referrer     string
+	referrerPath string
+}
+
+// postgresStore keeps the stats in PostgreSQL, as a row per day and
+// dimension whose sketch and pageviews are updated by every pageview.
+type postgresStore struct {
+	db     *sql.DB
+	logger *slog.Logger
+
+	// When set, stats are queried from this read replica rather than from db
+	replica *sql.DB
+
+	// When set, pageviews are buffered and written periodically
+	buffer *writeBuffer
+
+	sites *siteRegistry
+
+	sketches sketchFormat
+}
+
+func newPostgresStore(db *sql.DB, logger *slog.Logger, sketches sketchFormat) *postgresStore {
+	return &postgresStore{db: db, logger: logger, sites: newSiteRegistry(db), sketches: sketches}
+}
+
+// reader returns the database stats are queried from.
+func (st *postgresStore) reader() *sql.DB {
+	if st.replica != nil {
+		return st.replica
+	}
+	return st.db
+}
+
+// execer is a database or a transaction that statements are executed in.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// countedRow is a row of a stats table a pageview is counted in, with the
+// values of its dimensions in the order they're stored in.
+type countedRow struct {
+	table  string
+	domain string
+	values []string
+	day    time.Time
+}
+
+// countedRows returns the rows pv is counted in. Preview deployments are only counted in the environments, to keep them out
+// of the site's stats.
+func (pv pageview) countedRows() []countedRow {
+	if pv.environment == "preview" {
+		return []countedRow{{table: "environments", domain: pv.domain, values: []string{pv.environment}, day: pv.day}}
+	}
+
+	rows := []countedRow{
+		{table: "environments", values: []string{pv.environment}},
+		{table: "pages", values: []string{pv.path}},
+	}
+	if pv.visitorType != "" {
+		rows = append(rows, countedRow{table: "visitor_types", values: []string{pv.visitorType}})
+	}
+	if pv.country != "" {
+		rows = append(rows,
+			countedRow{table: "countries", values: []string{pv.country}},
+			countedRow{table: "page_countries", values: []string{pv.path, pv.country}},
+		)
+	}
+	rows = append(rows,
+		countedRow{table: "sources", values: []string{pv.referrer}},
+		countedRow{table: "page_sources", values: []string{pv.path, pv.referrer}},
+	)
+	if pv.referrerPath != "" {
+		rows = append(rows, countedRow{table: "referrer_paths", values: []string{pv.referrer, pv.referrerPath}})
+	}
+
+	for i := range rows {
+		rows[i].domain, rows[i].day = pv.domain, pv.day
+	}
+	return rows
+}
+
+// upsertSQL returns the statement inserting row, of the site of its domain,
+// with the given sketch and pageviews expressions, or updating its existing
+// sketch and pageviews, adding the values of its columns to args.
+func (row countedRow) upsertSQL(args *queryArgs, site int64, sketch string, update string, pageviews string) string {
+	columns := storedColumns(row.table)
+	keys := columns[:len(columns)-2]
+
+	values := []string{args.add(site)}
+	for _, value := range row.values {
+		values = append(values, args.add(value))
+	}
+	values = append(values, args.add(row.day), sketch, pageviews)
+
+	return `INSERT INTO ` + row.table + ` (` + strings.Join(columns, ", ") + `)
+	VALUES (` + strings.Join(values, ", ") + `)
+	ON CONFLICT (` + strings.Join(keys, ", ") + `)
+	DO UPDATE SET visitor_hll = ` + update + `, pageviews = ` + row.table + `.pageviews + EXCLUDED.pageviews`
+}
+
+// record counts a pageview in all its rows at once, with a single statement
+// so that it takes one round trip, but for late pageviews of months that may
+// have been rolled up. When writes are buffered, it's only counted once the
+// buffer is flushed.
+func (st *postgresStore) record(pv pageview) error {
+	rows := pv.countedRows()
+	if st.buffer != nil {
+		for _, row := range rows {
+			st.buffer.add(row, pv.visitor)
+		}
+		return nil
+	}
+
+	site, err := st.sites.id(pv.domain)
+	if err != nil {
+		return err
+	}
+
+	// Pageviews of months that may have been rolled up, as late as they
+	// are, are counted in their monthly rows too
+	var db execer = st.db
+	var tx *sql.Tx
+	var rolledUp rolledUpMonths
+	if slices.ContainsFunc(rows, func(row countedRow) bool { return row.mayBeRolledUp(time.Now()) }) {
+		if tx, err = st.db.Begin(); err != nil {
+			return fmt.Errorf("failed to begin query: %w", err)
+		}
+		defer tx.Rollback()
+		if rolledUp, err = lockRollups(tx); err != nil {
+			return err
+		}
+		db = tx
+	}
+
+	var args queryArgs
+	var upserts []string
+	for _, row := range rows {
+		if rolledUp.has(row) {
+			rows = append(rows, row.monthly())
+		}
+	}
+	for i, row := range rows {
+		sketch, update := st.sketches.addExprs(row.table, &args, pv.visitor)
+		upserts = append(upserts, fmt.Sprintf("upsert%d AS (\n\t%s\n\t)", i+1, row.upsertSQL(&args, site, sketch, update, "1")))
+	}
+
+	query := "WITH " + strings.Join(upserts, ", ") + "\nSELECT 1"
+	if _, err := db.Exec(query, args...); err != nil {
+		return fmt.Errorf("failed to execute query: %w", err)
+	}
+	if tx != nil {
+		return tx.Commit()
+	}
+	return nil
+}
+
+func (st *postgresStore) firstDay(table string, domain string) (time.Time, bool, error) {
+	var first sql.NullTime
+	err := st.reader().QueryRow(`SELECT MIN(day) FROM `+table+` WHERE `+siteCondition("$1"), domain).Scan(&first)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to query the first day of %s: %w", table, err)
+	}
+	return first.Time, first.Valid, nil
+}
+
+func (st *postgresStore) domainDays() ([]domainStats, error) {
+	rows, err := st.reader().Query(`SELECT domain, MIN(day), MAX(day) FROM pages JOIN sites ON sites.id = pages.site_id GROUP BY domain ORDER BY domain`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query domains: %w", err)
+	}
+	defer rows.Close()
+
+	domains := []domainStats{}
+	for rows.Next() {
+		var d domainStats
+		if err := rows.Scan(&d.Domain, &d.FirstSeen, &d.LastSeen); err != nil {
+			return nil, fmt.Errorf("failed to scan domain: %w", err)
+		}
+		domains = append(domains, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query domains: %w", err)
+	}
+	return domains, nil
+}
+
+func (st *postgresStore) prune(table string, cutoff time.Time, domain string, excluded []string) error {
+	// Digests are still keyed by domain
+	site, sites := siteCondition("$2"), "site_id IN (SELECT id FROM sites WHERE domain = ANY($2))"
+	if table == "digests" {
+		site, sites = "domain = $2", "domain = ANY($2)"
+	}
+
+	var err error
+	if domain == "" {
+		_, err = st.db.Exec(`DELETE FROM `+table+` WHERE `+lastDayExpr(table)+` < $1 AND NOT `+sites, cutoff, pq.Array(excluded))
+	} else {
+		_, err = st.db.Exec(`DELETE FROM `+table+` WHERE `+lastDayExpr(table)+` < $1 AND `+site, cutoff, domain)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to prune %s: %w", table, err)
+	}
+	return nil
+}
+
+func (st *postgresStore) queryRows(q statsQuery) ([]statsRow, error) {
+	q.goHLL = st.sketches.goHLL
+	q, err := st.withRollups(q)
+	if err != nil {
+		return nil, err
+	}
+	if q.goHLL {
+		return st.queryRowsInGo(q)
+	}
+
+	query, args, err := q.sql()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := st.reader().Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query rows: %w", err)
+	}
+	defer rows.Close()
+
+	results := []statsRow{}
+	for rows.Next() {
+		row := statsRow{dimensions: make([]string, len(q.dimensions))}
+		if err := rows.Scan(q.scanDest(&row, &row.visitors)...); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		results = append(results, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query rows: %w", err)
+	}
+
+	return results, nil
+}
+
+// queryRowsInGo runs q when sketches are computed by Potato: rows are
+// grouped in SQL, but their sketches are merged and counted here, before
+// being sorted and paginated.
+func (st *postgresStore) queryRowsInGo(q statsQuery) ([]statsRow, error) {
+	query, args, err := q.unpaginated()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := st.reader().Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query rows: %w", err)
+	}
+	defer rows.Close()
+
+	results := []statsRow{}
+	for rows.Next() {
+		row := statsRow{dimensions: make([]string, len(q.dimensions))}
+		var sketches pq.ByteaArray
+		if err := rows.Scan(q.scanDest(&row, &sketches)...); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		union := make([]byte, hllRegisters)
+		for _, sketch := range sketches {
+			hllUnion(union, sketch)
+		}
+		row.visitors = hllCardinality(union)
+		results = append(results, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query rows: %w", err)
+	}
+
+	slices.SortStableFunc(results, q.compare)
+
+	if q.limit > 0 {
+		start := min(q.offset, len(results))
+		results = results[start:min(start+q.limit, len(results))]
+	}
+	return results, nil
+}
+
+func (st *postgresStore) countRows(q statsQuery) (int, error) {
+	q.goHLL = st.sketches.goHLL
+	q, err := st.withRollups(q)
+	if err != nil {
+		return 0, err
+	}
+	query, args, err := q.countSQL()
+	if err != nil {
+		return 0, err
+	}
+
+	var total int
+	if err := st.reader().QueryRow(query, args...).Scan(&total); err != nil {
+		return 0, fmt.Errorf("failed to count rows: %w", err)
+	}
+	return total, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Events queued per subscriber, beyond which a slow subscriber misses events
+// rather than slowing down tracking
+const streamBuffer = 64
+
+// How often an idle stream gets a comment, so that proxies keep it open
+const streamKeepAlive = 30 * time.Second
+
+// pageviewEvent is what's streamed of a pageview: nothing identifying the
+// visitor is included.
+type pageviewEvent struct {
+	Domain   string    `json:"domain"`
+	Path     string    `json:"path"`
+	Referrer string    `json:"referrer"`
+	Country  string    `json:"country,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// eventStream hands the pageviews out to the clients following a domain.
+type eventStream struct {
+	mu sync.Mutex
+	// Subscribers per domain
+	subscribers map[string]map[chan pageviewEvent]bool
+	// Set once the stream is closed, ending new subscriptions right away
+	closed bool
+}
+
+func newEventStream() *eventStream {
+	return &eventStream{subscribers: map[string]map[chan pageviewEvent]bool{}}
+}
+
+func (es *eventStream) subscribe(domain string) chan pageviewEvent {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	events := make(chan pageviewEvent, streamBuffer)
+	if es.closed {
+		close(events)
+		return events
+	}
+	if es.subscribers[domain] == nil {
+		es.subscribers[domain] = map[chan pageviewEvent]bool{}
+	}
+	es.subscribers[domain][events] = true
+	return events
+}
+
+func (es *eventStream) unsubscribe(domain string, events chan pageviewEvent) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	delete(es.subscribers[domain], events)
+	if len(es.subscribers[domain]) == 0 {
+		delete(es.subscribers, domain)
+	}
+}
+
+// close ends every subscription, closing their channels, for the server to
+// shut down.
+func (es *eventStream) close() {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	for _, subscribers := range es.subscribers {
+		for events := range subscribers {
+			close(events)
+		}
+	}
+	clear(es.subscribers)
+	es.closed = true
+}
+
+// publish sends an event to the domain's subscribers without ever blocking.
+func (es *eventStream) publish(event pageviewEvent) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	for events := range es.subscribers[event.Domain] {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// handleStream streams a domain's pageviews as Server-Sent Events as they're
+// tracked.
+func (s *server) handleStream(w http.ResponseWriter, r *http.Request) {
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeError(w, http.StatusBadRequest, errMissingParameter, "Missing domain parameter")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errInternal, "Streaming isn't supported")
+		return
+	}
+
+	events := s.stream.subscribe(domain)
+	defer s.stream.unsubscribe(domain, events)
+	liftWriteDeadline(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: pageview\ndata: %s\n\n", data)
+		}
+		flusher.Flush()
+	}
+}
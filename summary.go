@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// summary holds the headline numbers of a domain over a range.
+type summary struct {
+	Domain    string    `json:"domain"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Visitors  int       `json:"visitors"`
+	Pageviews int       `json:"pageviews"`
+	TopPage   *topEntry `json:"top_page"`
+	TopSource *topEntry `json:"top_source"`
+
+	// Set when the previous period is requested through compare
+	Comparison *comparison `json:"comparison,omitempty"`
+}
+
+func (s *server) handleSummary(w http.ResponseWriter, r *http.Request) {
+	params, ok := s.parseStatsParams(w, r)
+	if !ok {
+		return
+	}
+
+	sum := summary{Domain: params.domain, Start: params.startTime, End: params.endTime}
+
+	totals, err := s.queryTotals(params.statsQuery("pages"))
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to query summary", slog.String("error", err.Error()))
+		writeError(w, http.StatusInternalServerError, errInternal, "Failed to fetch stats")
+		return
+	}
+	sum.Visitors = totals.Visitors
+	sum.Pageviews = totals.Pageviews
+
+	pages, err := s.topEntries("pages", "path", params.domain, params.startTime, params.endTime, 1)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to query summary", slog.String("error", err.Error()))
+		writeError(w, http.StatusInternalServerError, errInternal, "Failed to fetch stats")
+		return
+	}
+	if len(pages) > 0 {
+		sum.TopPage = &pages[0]
+	}
+
+	sources, err := s.topEntries("sources", "referrer", params.domain, params.startTime, params.endTime, 1)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to query summary", slog.String("error", err.Error()))
+		writeError(w, http.StatusInternalServerError, errInternal, "Failed to fetch stats")
+		return
+	}
+	if len(sources) > 0 {
+		sum.TopSource = &sources[0]
+	}
+
+	if params.compare {
+		sum.Comparison, err = s.compareTotals(params.statsQuery("pages"))
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to compare stats", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Failed to fetch stats")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(sum)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// hypertables are the tables turned into TimescaleDB hypertables: the daily
+// stats tables, the monthly rollups being small enough as they are.
+var hypertables = []string{"pages", "countries", "sources", "page_countries", "page_sources", "referrer_paths", "environments", "visitor_types"}
+
+// Each chunk of a hypertable holds about a month of days, as the partitions
+// did
+const hypertableChunkInterval = "30 days"
+
+// setUpTimescale creates the TimescaleDB extension and turns the daily tables
+// into hypertables, compressing their chunks once all their days are older
+// than compressDays, 0 never compressing them. Tables that already are
+// hypertables only have their compression policy updated.
+func setUpTimescale(db *sql.DB, logger *slog.Logger, compressDays int) error {
+	if _, err := db.Exec(`CREATE EXTENSION IF NOT EXISTS timescaledb`); err != nil {
+		return fmt.Errorf("failed to create the timescaledb extension: %w", err)
+	}
+
+	for _, table := range hypertables {
+		converted, err := convertToHypertable(db, table)
+		if err != nil {
+			return err
+		}
+		if converted {
+			logger.Info("Converted table to a hypertable", slog.String("table", table))
+		}
+
+		// The policy is replaced so that a change of compressDays applies
+		if _, err := db.Exec(`SELECT remove_compression_policy($1, if_exists => true)`, table); err != nil {
+			return fmt.Errorf("failed to remove the compression policy of %s: %w", table, err)
+		}
+		if compressDays > 0 {
+			_, err := db.Exec(`SELECT add_compression_policy($1, INTERVAL '`+strconv.Itoa(compressDays)+` days')`, table)
+			if err != nil {
+				return fmt.Errorf("failed to add a compression policy to %s: %w", table, err)
+			}
+		}
+	}
+	return nil
+}
+
+// convertToHypertable turns table into a hypertable partitioned by day,
+// reporting whether it wasn't one already. A table partitioned by month can't
+// be converted in place, so its rows are copied into a new hypertable
+// replacing it.
+func convertToHypertable(db *sql.DB, table string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin converting %s: %w", table, err)
+	}
+	defer tx.Rollback()
+
+	// Instances starting together convert the tables one at a time, as they
+	// migrate them
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, migrationLock); err != nil {
+		return false, fmt.Errorf("failed to lock migrations: %w", err)
+	}
+
+	var converted, partitioned bool
+	err = tx.QueryRow(`
+	SELECT EXISTS (
+		SELECT 1 FROM timescaledb_information.hypertables
+		WHERE hypertable_schema = current_schema() AND hypertable_name = $1
+	), (SELECT relkind = 'p' FROM pg_class WHERE oid = to_regclass($1))
+	`, table).Scan(&converted, &partitioned)
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect %s: %w", table, err)
+	}
+	if converted {
+		return false, nil
+	}
+
+	if partitioned {
+		// Rows are only unique within a day, so the uniqueness constraint
+		// includes it as hypertables require
+		columns := storedColumns(table)
+		keys := append([]string{"site_id", "day"}, columns[1:len(columns)-3]...)
+		statements := []string{
+			`CREATE TABLE ` + table + `_hypertable (LIKE ` + table + ` INCLUDING DEFAULTS)`,
+			`SELECT create_hypertable('` + table + `_hypertable', 'day', chunk_time_interval => INTERVAL '` + hypertableChunkInterval + `')`,
+			`INSERT INTO ` + table + `_hypertable SELECT * FROM ` + table,
+			`DROP TABLE ` + table,
+			`ALTER TABLE ` + table + `_hypertable RENAME TO ` + table,
+			`ALTER TABLE ` + table + ` ADD UNIQUE (` + strings.Join(keys, ", ") + `)`,
+		}
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement); err != nil {
+				return false, fmt.Errorf("failed to convert %s: %w", table, err)
+			}
+		}
+	} else {
+		_, err := tx.Exec(`SELECT create_hypertable($1, 'day', chunk_time_interval => INTERVAL '`+hypertableChunkInterval+`', migrate_data => true)`, table)
+		if err != nil {
+			return false, fmt.Errorf("failed to convert %s: %w", table, err)
+		}
+	}
+
+	// Rows are compressed by site, as they're always queried for one
+	_, err = tx.Exec(`ALTER TABLE ` + table + ` SET (timescaledb.compress, timescaledb.compress_segmentby = 'site_id', timescaledb.compress_orderby = 'day DESC')`)
+	if err != nil {
+		return false, fmt.Errorf("failed to enable the compression of %s: %w", table, err)
+	}
+	return true, tx.Commit()
+}
+
+// detectHypertables reports whether the daily tables are hypertables, which
+// are partitioned by TimescaleDB rather than by the server.
+func detectHypertables(db *sql.DB) (bool, error) {
+	var found bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb')`).Scan(&found)
+	if err != nil {
+		return false, fmt.Errorf("failed to list extensions: %w", err)
+	}
+	if !found {
+		return false, nil
+	}
+
+	err = db.QueryRow(`
+	SELECT EXISTS (
+		SELECT 1 FROM timescaledb_information.hypertables
+		WHERE hypertable_schema = current_schema() AND hypertable_name = 'pages'
+	)`).Scan(&found)
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect the pages table: %w", err)
+	}
+	return found, nil
+}
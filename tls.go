@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Key of the advisory lock held while obtaining a certificate, so that a
+// single instance orders it
+const acmeLock = 7108308
+
+const (
+	// How long before it expires a certificate obtained from ACME is renewed
+	certificateRenewBefore = 30 * 24 * time.Hour
+	// How often the certificate is looked for while there's none yet
+	certificateRetryInterval = time.Minute
+	// How often the certificate files are checked for a new certificate
+	certificateReloadInterval = time.Minute
+)
+
+// certificateStore holds the certificate HTTPS is served with, loaded from
+// TLS_CERT_FILE and TLS_KEY_FILE or obtained from ACME.
+type certificateStore struct {
+	current atomic.Pointer[tls.Certificate]
+
+	// The files the certificate is loaded from, reloaded when they change,
+	// none when it's obtained from ACME
+	certFile string
+	keyFile  string
+	logger   *slog.Logger
+
+	mu      sync.Mutex
+	modTime time.Time
+	checked time.Time
+}
+
+// newCertificateStore returns the certificate store of the configuration,
+// or nil if HTTPS isn't served.
+func newCertificateStore(cfg Config, logger *slog.Logger) (*certificateStore, error) {
+	if cfg.TLSCertFile == "" && !cfg.TLSAutocert {
+		return nil, nil
+	}
+	c := &certificateStore{certFile: cfg.TLSCertFile, keyFile: cfg.TLSKeyFile, logger: logger}
+	if c.certFile != "" {
+		if err := c.reload(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// tlsConfig returns the TLS configuration of the servers.
+func (c *certificateStore) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.getCertificate,
+	}
+}
+
+func (c *certificateStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if c.certFile != "" {
+		c.reloadIfChanged()
+	}
+	cert := c.current.Load()
+	if cert == nil {
+		return nil, errors.New("no certificate has been obtained yet")
+	}
+	return cert, nil
+}
+
+// reloadIfChanged loads the certificate files again if they were modified
+// since they were last loaded, checking at most once a minute. The previous
+// certificate is kept when the new one can't be loaded.
+func (c *certificateStore) reloadIfChanged() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) < certificateReloadInterval {
+		return
+	}
+	c.checked = time.Now()
+
+	modTime, err := c.filesModTime()
+	if err != nil || modTime.Equal(c.modTime) {
+		return
+	}
+	if err := c.load(modTime); err != nil {
+		c.logger.Error("Failed to reload the TLS certificate", slog.String("error", err.Error()))
+		return
+	}
+	c.logger.Info("Reloaded the TLS certificate")
+}
+
+func (c *certificateStore) reload() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checked = time.Now()
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return err
+	}
+	return c.load(modTime)
+}
+
+func (c *certificateStore) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load the TLS certificate: %w", err)
+	}
+	c.current.Store(&cert)
+	c.modTime = modTime
+	return nil
+}
+
+// filesModTime returns when the certificate files were last modified.
+func (c *certificateStore) filesModTime() (time.Time, error) {
+	var modTime time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to read the TLS certificate: %w", err)
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return modTime, nil
+}
+
+// loadCertificate loads the certificate of HOST_DOMAIN obtained from ACME,
+// returning when it expires, or the zero time when there's none yet.
+func (s *server) loadCertificate() (time.Time, error) {
+	var certificate, key string
+	var expiresAt time.Time
+	err := s.db.QueryRow(`SELECT certificate, private_key, expires_at FROM tls_certificates WHERE domain = $1`, s.cfg.HostDomain).Scan(&certificate, &key, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to query the TLS certificate: %w", err)
+	}
+
+	cert, err := tls.X509KeyPair([]byte(certificate), []byte(key))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse the TLS certificate: %w", err)
+	}
+	s.certificates.current.Store(&cert)
+	return expiresAt, nil
+}
+
+// obtainCertificate orders a certificate of HOST_DOMAIN from the ACME
+// server and stores it for every instance to load. It does nothing when
+// another instance is already at it.
+func (s *server) obtainCertificate() error {
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get a connection: %w", err)
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, acmeLock).Scan(&locked); err != nil {
+		return fmt.Errorf("failed to lock certificates: %w", err)
+	}
+	if !locked {
+		return nil
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, acmeLock)
+
+	key, err := s.acmeAccountKey()
+	if err != nil {
+		return err
+	}
+	client := newACMEClient(s.cfg.ACMEDirectoryURL, key)
+	if err := client.register(s.cfg.ACMEEmail); err != nil {
+		return err
+	}
+
+	// The challenges are answered by whichever instance the ACME server
+	// reaches, so they're shared through the database
+	var tokens []string
+	defer func() {
+		for _, token := range tokens {
+			s.db.Exec(`DELETE FROM acme_challenges WHERE token = $1`, token)
+		}
+	}()
+	chain, certKey, err := client.obtain(s.cfg.HostDomain, func(token string, keyAuthorization string) error {
+		tokens = append(tokens, token)
+		if _, err := s.db.Exec(`
+		INSERT INTO acme_challenges (token, key_authorization) VALUES ($1, $2)
+		ON CONFLICT (token) DO UPDATE SET key_authorization = EXCLUDED.key_authorization
+		`, token, keyAuthorization); err != nil {
+			return fmt.Errorf("failed to store the challenge: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to obtain a certificate of %s: %w", s.cfg.HostDomain, err)
+	}
+
+	cert, err := tls.X509KeyPair(chain, certKey)
+	if err != nil {
+		return fmt.Errorf("failed to parse the obtained certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse the obtained certificate: %w", err)
+	}
+	if _, err := s.db.Exec(`
+	INSERT INTO tls_certificates (domain, certificate, private_key, expires_at) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (domain) DO UPDATE SET certificate = EXCLUDED.certificate, private_key = EXCLUDED.private_key,
+		expires_at = EXCLUDED.expires_at, updated_at = NOW()
+	`, s.cfg.HostDomain, string(chain), string(certKey), leaf.NotAfter); err != nil {
+		return fmt.Errorf("failed to store the certificate: %w", err)
+	}
+	s.logger.Info("Obtained a TLS certificate", slog.String("domain", s.cfg.HostDomain), slog.Time("expires_at", leaf.NotAfter))
+	return nil
+}
+
+// acmeAccountKey returns the key of the account at the ACME server,
+// generating it the first time.
+func (s *server) acmeAccountKey() (*ecdsa.PrivateKey, error) {
+	var encoded string
+	err := s.db.QueryRow(`SELECT private_key FROM acme_accounts WHERE directory_url = $1`, s.cfg.ACMEDirectoryURL).Scan(&encoded)
+	if err == nil {
+		return parseECKey(encoded)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to query the ACME account: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate the ACME account key: %w", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	encoded = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	if _, err := s.db.Exec(`INSERT INTO acme_accounts (directory_url, private_key) VALUES ($1, $2)`, s.cfg.ACMEDirectoryURL, encoded); err != nil {
+		return nil, fmt.Errorf("failed to store the ACME account: %w", err)
+	}
+	return key, nil
+}
+
+// renewCertificatesEvery loads the certificate of HOST_DOMAIN periodically,
+// obtaining it first when there's none or it expires in less than 30 days.
+// While there's none, it's looked for every minute. It never returns.
+func (s *server) renewCertificatesEvery(interval time.Duration) {
+	for {
+		expiresAt, err := s.loadCertificate()
+		if err == nil && time.Until(expiresAt) < certificateRenewBefore {
+			if err = s.obtainCertificate(); err == nil {
+				expiresAt, err = s.loadCertificate()
+			}
+		}
+		if err != nil {
+			s.logger.Error("Failed to renew the TLS certificate", slog.String("error", err.Error()))
+		}
+
+		if expiresAt.IsZero() {
+			time.Sleep(certificateRetryInterval)
+		} else {
+			time.Sleep(interval)
+		}
+	}
+}
+
+// handleACMEChallenge answers the HTTP-01 challenges of the ACME server.
+func (s *server) handleACMEChallenge(w http.ResponseWriter, r *http.Request) {
+	var keyAuthorization string
+	err := s.db.QueryRow(`SELECT key_authorization FROM acme_challenges WHERE token = $1`, r.PathValue("token")).Scan(&keyAuthorization)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to query ACME challenge", slog.String("error", err.Error()))
+		writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(keyAuthorization))
+}
+
+// redirectRoutes returns the handler of the plain HTTP server of
+// REDIRECT_ADDR, answering ACME challenges and redirecting everything else
+// to HTTPS.
+func (s *server) redirectRoutes() http.Handler {
+	// The port HTTPS is served on, left out of the URLs when it's the default
+	var port string
+	for _, addr := range s.cfg.ListenAddrs {
+		if _, p, err := net.SplitHostPort(addr); err == nil && p != "" {
+			port = p
+			break
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/acme-challenge/{token}", s.handleACMEChallenge)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" {
+			host = s.cfg.HostDomain
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+	return mux
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	mathrand "math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Traces are exported to an OpenTelemetry collector as OTLP/HTTP JSON, which
+// needs none of the OpenTelemetry libraries: spans are only timed, tagged
+// and queued here, then posted in batches.
+const (
+	// How many finished spans can wait to be exported before new ones are
+	// dropped
+	spanQueueSize = 2048
+	// How often the queued spans are exported
+	spanExportInterval = 5 * time.Second
+)
+
+// The kinds of spans, as OTLP numbers them
+const (
+	spanServer = 2
+	spanClient = 3
+)
+
+// span is an operation of a trace. A nil span records nothing, so that
+// callers don't have to check whether tracing is enabled.
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	// Whether the trace is recorded, as decided at its root
+	sampled bool
+
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]any
+	err        error
+}
+
+// set adds an attribute to the span: a string, an int, a float64 or a bool.
+func (sp *span) set(key string, value any) {
+	if sp == nil {
+		return
+	}
+	sp.attributes[key] = value
+}
+
+// fail marks the span as failed with err, if there's one.
+func (sp *span) fail(err error) {
+	if sp == nil || err == nil {
+		return
+	}
+	sp.err = err
+}
+
+// finish ends the span, queuing it for export if its trace is recorded.
+func (sp *span) finish() {
+	if sp == nil || !sp.sampled {
+		return
+	}
+	sp.end = time.Now()
+	sp.tracer.queue(sp)
+}
+
+type spanContextKey struct{}
+
+// spanFrom returns the span of ctx, nil if there's none.
+func spanFrom(ctx context.Context) *span {
+	if ctx == nil {
+		return nil
+	}
+	sp, _ := ctx.Value(spanContextKey{}).(*span)
+	return sp
+}
+
+// tracer starts spans and exports them to OTEL_EXPORTER_OTLP_ENDPOINT. A nil
+// tracer starts nil spans.
+type tracer struct {
+	endpoint string
+	headers  map[string]string
+	service  string
+	ratio    float64
+	logger   *slog.Logger
+	client   *http.Client
+
+	mu      sync.Mutex
+	spans   []*span
+	dropped int
+}
+
+// newTracer returns the tracer of the configured collector, or nil if traces
+// aren't exported.
+func newTracer(cfg Config, logger *slog.Logger) *tracer {
+	if cfg.OTLPEndpoint == "" {
+		return nil
+	}
+	return &tracer{
+		endpoint: cfg.OTLPEndpoint + "/v1/traces",
+		headers:  cfg.OTLPHeaders,
+		service:  cfg.ServiceName,
+		ratio:    cfg.TraceSampleRatio,
+		logger:   logger,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// start starts a span, the child of ctx's span or the root of a new trace,
+// returning the context carrying it.
+func (t *tracer) start(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if t == nil {
+		return ctx, nil
+	}
+
+	sp := &span{tracer: t, name: name, kind: kind, start: time.Now(), attributes: map[string]any{}}
+	if parent := spanFrom(ctx); parent != nil {
+		sp.traceID, sp.parentID, sp.sampled = parent.traceID, parent.spanID, parent.sampled
+	} else {
+		rand.Read(sp.traceID[:])
+		sp.sampled = mathrand.Float64() < t.ratio
+	}
+	rand.Read(sp.spanID[:])
+	return context.WithValue(ctx, spanContextKey{}, sp), sp
+}
+
+// startRemote starts the server span of a request, continuing the trace of
+// its traceparent header when it has a valid one.
+func (t *tracer) startRemote(r *http.Request, name string) (context.Context, *span) {
+	ctx := r.Context()
+	if t == nil {
+		return ctx, nil
+	}
+	if parent, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		parent.tracer = t
+		ctx = context.WithValue(ctx, spanContextKey{}, parent)
+	}
+	return t.start(ctx, name, spanServer)
+}
+
+// parseTraceparent returns the remote span of a W3C traceparent header, such
+// as 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func parseTraceparent(header string) (*span, bool) {
+	if len(header) != 55 || header[:3] != "00-" || header[35] != '-' || header[52] != '-' {
+		return nil, false
+	}
+	sp := &span{}
+	if _, err := hex.Decode(sp.traceID[:], []byte(header[3:35])); err != nil || sp.traceID == [16]byte{} {
+		return nil, false
+	}
+	if _, err := hex.Decode(sp.spanID[:], []byte(header[36:52])); err != nil || sp.spanID == [8]byte{} {
+		return nil, false
+	}
+	flags, err := strconv.ParseUint(header[53:], 16, 8)
+	if err != nil {
+		return nil, false
+	}
+	sp.sampled = flags&1 == 1
+	return sp, true
+}
+
+// queue adds a finished span to those to export, dropping it when the queue
+// is full rather than holding on to ever more spans while the collector is
+// down.
+func (t *tracer) queue(sp *span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.spans) >= spanQueueSize {
+		t.dropped++
+		return
+	}
+	t.spans = append(t.spans, sp)
+}
+
+// exportEvery exports the queued spans periodically. It never returns.
+func (t *tracer) exportEvery(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := t.export(); err != nil {
+			t.logger.Error("Failed to export traces", slog.String("error", err.Error()))
+		}
+	}
+}
+
+// export posts the queued spans to the collector. Spans failing to be
+// exported are dropped.
+func (t *tracer) export() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	spans, dropped := t.spans, t.dropped
+	t.spans, t.dropped = nil, 0
+	t.mu.Unlock()
+
+	if dropped > 0 {
+		t.logger.Warn("Dropped spans, the export queue is full", slog.Int("spans", dropped))
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(otlpTraces(t.service, spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range t.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post %d spans: %w", len(spans), err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded to %d spans with %s", len(spans), resp.Status)
+	}
+	return nil
+}
+
+// otlpTraces returns the ExportTraceServiceRequest of spans in the JSON
+// encoding of OTLP, where ids are hex and 64-bit integers are strings.
+func otlpTraces(service string, spans []*span) map[string]any {
+	encoded := make([]map[string]any, len(spans))
+	for i, sp := range spans {
+		s := map[string]any{
+			"traceId":           hex.EncodeToString(sp.traceID[:]),
+			"spanId":            hex.EncodeToString(sp.spanID[:]),
+			"name":              sp.name,
+			"kind":              sp.kind,
+			"startTimeUnixNano": strconv.FormatInt(sp.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(sp.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(sp.attributes),
+		}
+		if sp.parentID != [8]byte{} {
+			s["parentSpanId"] = hex.EncodeToString(sp.parentID[:])
+		}
+		if sp.err != nil {
+			s["status"] = map[string]any{"code": 2, "message": sp.err.Error()}
+		}
+		encoded[i] = s
+	}
+
+	return map[string]any{
+		"resourceSpans": []map[string]any{{
+			"resource": map[string]any{"attributes": otlpAttributes(map[string]any{"service.name": service})},
+			"scopeSpans": []map[string]any{{
+				"scope": map[string]any{"name": "potato-analytics"},
+				"spans": encoded,
+			}},
+		}},
+	}
+}
+
+// otlpAttributes returns attributes as OTLP key-values.
+func otlpAttributes(attributes map[string]any) []map[string]any {
+	encoded := make([]map[string]any, 0, len(attributes))
+	for key, value := range attributes {
+		var v map[string]any
+		switch value := value.(type) {
+		case string:
+			v = map[string]any{"stringValue": value}
+		case int:
+			v = map[string]any{"intValue": strconv.Itoa(value)}
+		case float64:
+			v = map[string]any{"doubleValue": value}
+		case bool:
+			v = map[string]any{"boolValue": value}
+		default:
+			v = map[string]any{"stringValue": fmt.Sprint(value)}
+		}
+		encoded = append(encoded, map[string]any{"key": key, "value": v})
+	}
+	return encoded
+}
+
+// traced starts the server span of each request next serves, named after
+// the route it matched once it's known.
+func (s *server) traced(next http.Handler) http.Handler {
+	if s.tracer == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, sp := s.tracer.startRemote(r, r.Method)
+		r = r.WithContext(ctx)
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+		if r.Pattern != "" {
+			sp.name = r.Method + " " + r.Pattern
+			sp.set("http.route", r.Pattern)
+		}
+		sp.set("http.request.method", r.Method)
+		sp.set("url.path", r.URL.Path)
+		sp.set("http.response.status_code", rec.code)
+		if rec.code >= 500 {
+			sp.fail(fmt.Errorf("responded with %d", rec.code))
+		}
+		sp.finish()
+	})
+}
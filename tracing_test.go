@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		ok       bool
+		sampled  bool
+		traceID  string
+		parentID string
+	}{
+		{"sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true, "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"},
+		{"not sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false, "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"},
+		{"empty", "", false, false, "", ""},
+		{"unknown version", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false, "", ""},
+		{"zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false, "", ""},
+		{"zero span id", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false, "", ""},
+		{"invalid hex", "00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01", false, false, "", ""},
+		{"too long", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp, ok := parseTraceparent(tt.header)
+			if ok != tt.ok {
+				t.Fatalf("parseTraceparent(%q) ok = %v, want %v", tt.header, ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if sp.sampled != tt.sampled {
+				t.Errorf("sampled = %v, want %v", sp.sampled, tt.sampled)
+			}
+			if got := hex.EncodeToString(sp.traceID[:]); got != tt.traceID {
+				t.Errorf("trace id = %s, want %s", got, tt.traceID)
+			}
+			if got := hex.EncodeToString(sp.spanID[:]); got != tt.parentID {
+				t.Errorf("span id = %s, want %s", got, tt.parentID)
+			}
+		})
+	}
+}
+
+// TestOTLPTraces checks the encoding of spans against what a collector
+// expects of OTLP/JSON: hex ids, 64-bit integers as strings and typed
+// attribute values.
+func TestOTLPTraces(t *testing.T) {
+	sp := &span{
+		name:       "GET /stats/pages",
+		kind:       spanServer,
+		start:      time.Unix(1700000000, 5),
+		end:        time.Unix(1700000001, 0),
+		attributes: map[string]any{"http.response.status_code": 500},
+		err:        errors.New("responded with 500"),
+	}
+	copy(sp.traceID[:], []byte{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36})
+	copy(sp.spanID[:], []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	copy(sp.parentID[:], []byte{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7})
+
+	want := `{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"potato"}}]},` +
+		`"scopeSpans":[{"scope":{"name":"potato-analytics"},"spans":[{"attributes":[{"key":"http.response.status_code","value":{"intValue":"500"}}],` +
+		`"endTimeUnixNano":"1700000001000000000","kind":2,"name":"GET /stats/pages","parentSpanId":"00f067aa0ba902b7","spanId":"0102030405060708",` +
+		`"startTimeUnixNano":"1700000000000000005","status":{"code":2,"message":"responded with 500"},"traceId":"4bf92f3577b34da6a3ce929d0e0e4736"}]}]}]}`
+	if got := string(mustJSON(t, otlpTraces("potato", []*span{sp}))); got != want {
+		t.Errorf("otlpTraces() = %s\nwant %s", got, want)
+	}
+
+	attributes := otlpAttributes(map[string]any{"s": "a", "i": 3, "f": 1.5, "b": true, "d": time.Second})
+	values := map[string]string{}
+	for _, attribute := range attributes {
+		values[attribute["key"].(string)] = string(mustJSON(t, attribute["value"]))
+	}
+	wantValues := map[string]string{"s": `{"stringValue":"a"}`, "i": `{"intValue":"3"}`, "f": `{"doubleValue":1.5}`, "b": `{"boolValue":true}`, "d": `{"stringValue":"1s"}`}
+	for key, value := range wantValues {
+		if values[key] != value {
+			t.Errorf("attribute %s = %s, want %s", key, values[key], value)
+		}
+	}
+}
+
+// TestTracerExport checks that the spans of a request continuing a remote
+// trace are posted to the collector.
+func TestTracerExport(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []*http.Request
+		bodies   [][]byte
+	)
+	status := http.StatusOK
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		requests, bodies = append(requests, r), append(bodies, body)
+		w.WriteHeader(status)
+	}))
+	defer collector.Close()
+
+	s := newTestServer(t)
+	s.tracer = newTracer(Config{OTLPEndpoint: collector.URL, OTLPHeaders: map[string]string{"Authorization": "Bearer token"}, ServiceName: "potato", TraceSampleRatio: 1}, s.logger)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /stats/{name}", func(w http.ResponseWriter, r *http.Request) {
+		_, sp := s.tracer.start(r.Context(), "stats.query", spanClient)
+		sp.set("db.system", "postgresql")
+		sp.finish()
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	r := httptest.NewRequest(http.MethodGet, "/stats/pages", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	s.traced(mux).ServeHTTP(httptest.NewRecorder(), r)
+
+	if err := s.tracer.export(); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("the collector got %d requests, want 1", len(requests))
+	}
+	if requests[0].URL.Path != "/v1/traces" || requests[0].Header.Get("Content-Type") != "application/json" || requests[0].Header.Get("Authorization") != "Bearer token" {
+		t.Errorf("the spans were posted to %s with %v", requests[0].URL, requests[0].Header)
+	}
+
+	var payload struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string `json:"traceId"`
+					SpanID       string `json:"spanId"`
+					ParentSpanID string `json:"parentSpanId"`
+					Name         string `json:"name"`
+					Kind         int    `json:"kind"`
+					Status       *struct {
+						Code int `json:"code"`
+					} `json:"status"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(bodies[0], &payload); err != nil {
+		t.Fatalf("invalid OTLP/JSON: %v", err)
+	}
+	spans := payload.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want 2: %s", len(spans), bodies[0])
+	}
+	query, request := spans[0], spans[1]
+	if request.Name != "GET GET /stats/{name}" || request.Kind != spanServer || request.ParentSpanID != "00f067aa0ba902b7" || request.Status == nil || request.Status.Code != 2 {
+		t.Errorf("the request span is %+v", request)
+	}
+	if query.Kind != spanClient || query.ParentSpanID != request.SpanID {
+		t.Errorf("the query span %+v isn't the child of the request span %s", query, request.SpanID)
+	}
+	for _, sp := range spans {
+		if sp.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("span %s doesn't continue the remote trace: %s", sp.Name, sp.TraceID)
+		}
+	}
+
+	// Traces not sampled upstream aren't exported, and neither are spans
+	// the collector refuses
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	s.traced(mux).ServeHTTP(httptest.NewRecorder(), r)
+	if err := s.tracer.export(); err != nil || len(requests) != 1 {
+		t.Errorf("export() = %v after %d requests, want the unsampled trace to be left out", err, len(requests))
+	}
+	status = http.StatusServiceUnavailable
+	_, sp := s.tracer.start(context.Background(), "job", spanClient)
+	sp.finish()
+	if err := s.tracer.export(); err == nil {
+		t.Errorf("export() didn't fail when the collector refused the spans")
+	}
+}
+
+func TestTracerQueueOverflow(t *testing.T) {
+	tr := newTracer(Config{OTLPEndpoint: "http://collector.invalid", TraceSampleRatio: 1}, newTestServer(t).logger)
+	for range spanQueueSize + 3 {
+		tr.queue(&span{})
+	}
+	if len(tr.spans) != spanQueueSize || tr.dropped != 3 {
+		t.Errorf("queued %d spans and dropped %d, want %d and 3", len(tr.spans), tr.dropped, spanQueueSize)
+	}
+}
+
+func mustJSON(t *testing.T, v any) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
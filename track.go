@@ -0,0 +1,345 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// The largest tracking requests accepted. Browsers send much less, so
+// anything longer is garbage that would only clutter the stats tables.
+const (
+	trackMaxBodyBytes      = 8 << 10
+	trackMaxURLLength      = 2048
+	trackMaxReferrerLength = 2048
+	trackMaxEventLength    = 64
+)
+
+// The eventType of pageviews. Other events are the custom events sites send,
+// only recorded in the raw event log.
+const pageviewEventName = "pageview"
+
+// validEventName reports whether a custom event can be named name: a
+// printable name without spaces, other than pageview.
+func validEventName(name string) bool {
+	if name == "" || name == pageviewEventName || len(name) > trackMaxEventLength {
+		return false
+	}
+	for _, r := range name {
+		if r <= ' ' || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *server) handleTrack(w http.ResponseWriter, r *http.Request) {
+	defer s.metrics.observeIngestion(time.Now())
+
+	r.Body = http.MaxBytesReader(w, r.Body, trackMaxBodyBytes)
+	if err := r.ParseForm(); err != nil {
+		s.metrics.countDropped("invalid")
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, errTooLarge, fmt.Sprintf("Request body too large, expected at most %d bytes", trackMaxBodyBytes))
+			return
+		}
+		writeError(w, http.StatusBadRequest, errInvalidBody, "Invalid request body, expected a form")
+		return
+	}
+
+	visitedURL := r.FormValue("url")
+	if len(visitedURL) > trackMaxURLLength {
+		s.metrics.countDropped("invalid")
+		writeError(w, http.StatusBadRequest, errInvalidParameter, fmt.Sprintf("Invalid 'url' parameter, expected at most %d characters", trackMaxURLLength))
+		return
+	}
+	if len(r.Header.Get("Referer")) > trackMaxReferrerLength {
+		s.metrics.countDropped("invalid")
+		writeError(w, http.StatusBadRequest, errInvalidParameter, fmt.Sprintf("Invalid Referer header, expected at most %d characters", trackMaxReferrerLength))
+		return
+	}
+	if visitedURL == "" {
+		s.metrics.countDropped("invalid")
+		s.logger.Warn("Missing 'url' parameter in request", slog.String("remote_addr", r.RemoteAddr))
+		writeError(w, http.StatusBadRequest, errMissingParameter, "Missing 'url' parameter")
+		return
+	}
+	event := r.FormValue("eventType")
+	if event == "" {
+		event = pageviewEventName
+	}
+	if event != pageviewEventName && !validEventName(event) {
+		s.metrics.countDropped("invalid")
+		writeError(w, http.StatusBadRequest, errInvalidParameter, fmt.Sprintf("Invalid 'eventType' parameter, expected a name of at most %d characters without spaces", trackMaxEventLength))
+		return
+	}
+
+	ua := r.Header.Get("User-Agent")
+	visitorIP := s.clientIP(r)
+
+	// Backends track their visitors' pageviews with a key allowed to write
+	// the events of the domain, passing the visitor's address and user agent
+	if key := r.FormValue("api_key"); key != "" {
+		allowed, err := s.allowedToTrack(key, visitedURL)
+		if err != nil {
+			s.metrics.countDropped("failed")
+			s.logger.ErrorContext(r.Context(), "Failed to load API key", slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, errInternal, "Internal server error")
+			return
+		}
+		if !allowed {
+			s.metrics.countDropped("invalid")
+			writeError(w, http.StatusForbidden, errForbidden, "The API key isn't allowed to write-events here")
+			return
+		}
+		if value := r.FormValue("ip"); value != "" {
+			if _, err := netip.ParseAddr(value); err != nil {
+				s.metrics.countDropped("invalid")
+				writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid 'ip' parameter, expected an IP address")
+				return
+			}
+			visitorIP = value
+		}
+		if value := r.FormValue("user_agent"); value != "" {
+			ua = value
+		}
+	}
+
+	if s.nonHuman(ua) {
+		s.metrics.countDropped("bot")
+		s.logger.Debug("Ignored non-human pageview", slog.String("url", visitedURL), slog.String("user_agent", ua), slog.String("remote_addr", r.RemoteAddr))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if addr, err := netip.ParseAddr(hostOnly(visitorIP)); err == nil && s.limiter != nil {
+		allowed, err := s.limiter.allow(rateLimitKey(addr), time.Now())
+		if err != nil {
+			// Tracking goes on without the limit rather than failing
+			s.logger.ErrorContext(r.Context(), "Failed to check rate limit", slog.String("error", err.Error()))
+		} else if !allowed {
+			s.metrics.countDropped("rate_limited")
+			w.Header().Set("Retry-After", strconv.Itoa(s.cfg.trackRetryAfter()))
+			writeError(w, http.StatusTooManyRequests, errRateLimited, "Too many requests")
+			return
+		}
+	}
+
+	if addr, err := netip.ParseAddr(hostOnly(visitorIP)); err == nil && s.config().excluded(addr) {
+		s.metrics.countDropped("excluded")
+		s.logger.Debug("Ignored pageview from excluded address", slog.String("url", visitedURL), slog.String("remote_addr", r.RemoteAddr))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Parse the URL to extract domain and path
+	parsedURL, err := url.Parse(visitedURL)
+	if err != nil {
+		s.metrics.countDropped("invalid")
+		s.logger.ErrorContext(r.Context(), "Failed to parse URL", slog.String("url", visitedURL), slog.String("error", err.Error()))
+		writeError(w, http.StatusBadRequest, errInvalidParameter, "Invalid URL")
+		return
+	}
+
+	if !s.config().siteAllowed(parsedURL.Host) {
+		s.metrics.countDropped("not_allowed")
+		s.logger.Debug("Ignored pageview of a site not allowed", slog.String("url", visitedURL))
+		writeError(w, http.StatusForbidden, errForbidden, "The site isn't in ALLOWED_SITES")
+		return
+	}
+
+	path := parsedURL.Path
+	if path == "" {
+		path = "/"
+	}
+
+	// Paths are rewritten before anything is tracked, so that renamed pages
+	// keep adding up with their history
+	if rewritten, rule := s.rewrites.rewrite(parsedURL.Host, path); rule >= 0 {
+		s.logger.Debug("Rewrote path", slog.String("path", path), slog.String("rewritten", rewritten), slog.Int("rule", rule))
+		path = rewritten
+	}
+
+	// Days are bucketed in the site's time zone
+	day := dayIn(time.Now(), s.siteLocation(parsedURL.Host))
+
+	visitor, err := s.visitorID(parsedURL.Host, visitorIP, day)
+	if err != nil {
+		s.metrics.countDropped("failed")
+		s.logger.ErrorContext(r.Context(), "Failed to identify visitor", slog.String("error", err.Error()))
+		writeError(w, http.StatusInternalServerError, errInternal, fmt.Sprintf("Failed to track pageview: %v", err))
+		return
+	}
+
+	pv := pageview{
+		domain:      parsedURL.Host,
+		path:        path,
+		day:         day,
+		visitor:     visitor,
+		environment: s.config().environment(parsedURL.Host),
+	}
+
+	if s.cfg.privacyProfile(parsedURL.Host).TrackCountries {
+		pv.country = r.Header.Get("CF-IPCountry")
+	}
+
+	referrer, referrerPath := referrerOf(r.Header.Get("Referer"), parsedURL.Host)
+	pv.referrer, pv.referrerPath = referrer, referrerPath
+
+	if event != pageviewEventName {
+		s.trackEvent(w, r, pv, event)
+		return
+	}
+
+	// Visitors can only be recognized from one day to the next without a
+	// daily salt, and preview pageviews aren't counted as visits
+	if pv.environment != "preview" && !s.cfg.privacyProfile(parsedURL.Host).DailySalt {
+		pv.visitorType, err = s.returning.visitorType(parsedURL.Host, visitor, day)
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to recognize returning visitor", slog.String("error", err.Error()))
+		}
+	}
+
+	recordStart := time.Now()
+	_, sp := s.tracer.start(r.Context(), "stats.record", spanClient)
+	sp.set("db.system", s.storeSystem())
+	sp.set("potato.domain", pv.domain)
+	err = s.store.record(pv)
+	sp.fail(err)
+	sp.finish()
+	s.metrics.observeQuery("record", recordStart)
+	if err != nil {
+		s.metrics.countDropped("failed")
+		s.logger.ErrorContext(r.Context(), "Failed to track pageview", slog.String("url", visitedURL), slog.String("visitor_ip", visitorIP), slog.String("error", err.Error()))
+		writeError(w, http.StatusInternalServerError, errInternal, fmt.Sprintf("Failed to track pageview: %v", err))
+		return
+	}
+	if s.cfg.RawEventsDays > 0 {
+		if err := s.recordRawEvent(pv, event); err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to record raw event", slog.String("error", err.Error()))
+		}
+	}
+	if pv.environment == "preview" {
+		s.logger.Debug("Tracked preview pageview", slog.String("url", visitedURL))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	s.realtime.record(parsedURL.Host, visitor, path, time.Now())
+
+	s.stream.publish(pageviewEvent{Domain: parsedURL.Host, Path: path, Referrer: referrer, Country: pv.country, Time: time.Now().UTC()})
+	s.notifyGoalCompletions(pv, event, time.Now())
+
+	s.logger.Debug("Pageview tracked", slog.String("url", visitedURL), slog.String("visitor_ip", visitorIP), slog.String("user_agent", ua))
+
+	if r.URL.Query().Get("url") != "" {
+		w.Header().Set("Cache-Control", "public, max-age=3600, s-maxage=3600, must-revalidate")
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// trackEvent records a custom event of the page viewed in pv, which the
+// stats don't count: it's only recorded in the raw event log, for goals, and
+// ignored when the log is off.
+func (s *server) trackEvent(w http.ResponseWriter, r *http.Request, pv pageview, event string) {
+	if s.cfg.RawEventsDays == 0 {
+		s.logger.Debug("Ignored custom event, RAW_EVENTS_DAYS isn't set", slog.String("event", event))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err := s.recordRawEvent(pv, event); err != nil {
+		s.metrics.countDropped("failed")
+		s.logger.ErrorContext(r.Context(), "Failed to track event", slog.String("event", event), slog.String("error", err.Error()))
+		writeError(w, http.StatusInternalServerError, errInternal, fmt.Sprintf("Failed to track event: %v", err))
+		return
+	}
+	if pv.environment != "preview" {
+		s.notifyGoalCompletions(pv, event, time.Now())
+	}
+	s.logger.Debug("Event tracked", slog.String("event", event), slog.String("domain", pv.domain), slog.String("path", pv.path))
+	w.WriteHeader(http.StatusOK)
+}
+
+// nonHuman reports whether a User-Agent is a crawler's or a bot's.
+func (s *server) nonHuman(ua string) bool {
+	client := s.parser.Parse(ua)
+	return client.Device.Family == "Spider" || client.UserAgent.Family == "Bot"
+}
+
+// referrerOf returns the host and path of the referrer of a pageview of
+// domain, counted as "Direct / None" when it's missing or the domain itself.
+func referrerOf(referer string, domain string) (string, string) {
+	referrer := referer
+	referrerPath := ""
+	if referrer == "" {
+		referrer = "Direct / None"
+	} else {
+		// Parse referrer to get domain only, keeping the path aside
+		if refURL, err := url.Parse(referrer); err == nil {
+			referrer = refURL.Host
+			referrerPath = refURL.Path
+			if referrerPath == "" {
+				referrerPath = "/"
+			}
+		}
+	}
+
+	// If the referrer is the same as the domain, set it to "Direct / None"
+	if referrer == domain {
+		referrer = "Direct / None"
+		referrerPath = ""
+	}
+	return referrer, referrerPath
+}
+
+// hostOnly strips the port from an address if it has one.
+func hostOnly(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// clientIP returns the address a request comes from: its CF-Connecting-IP
+// header when it's sent by one of the TRUSTED_PROXIES, and its remote address
+// without the port otherwise, as any client can set the header.
+func (s *server) clientIP(r *http.Request) string {
+	remoteIP := hostOnly(r.RemoteAddr)
+	if header := r.Header.Get("CF-Connecting-IP"); header != "" {
+		if proxy, err := netip.ParseAddr(remoteIP); err == nil && s.cfg.trustedProxy(proxy) {
+			return header
+		}
+		// Deployments behind Cloudflare that haven't set TRUSTED_PROXIES
+		// count every edge connection as a visitor, which is worth a warning
+		s.untrustedProxy.Do(func() {
+			s.logger.Warn("Ignored the CF-Connecting-IP header of a request from an untrusted address, set TRUSTED_PROXIES=cloudflare if Potato is behind Cloudflare",
+				slog.String("remote_addr", remoteIP))
+		})
+	}
+	return remoteIP
+}
+
+// allowedToTrack reports whether a key can track the pageviews of the
+// domain of a URL on behalf of its visitors: the API key, or a key issued
+// with write-events over the domain.
+func (s *server) allowedToTrack(key string, visitedURL string) (bool, error) {
+	if s.cfg.APIKey != "" && key == s.cfg.APIKey {
+		return true, nil
+	}
+	issued, err := s.lookupAPIKey(key)
+	if err != nil || issued == nil {
+		return false, err
+	}
+	parsedURL, err := url.Parse(visitedURL)
+	if err != nil {
+		return false, nil
+	}
+	return issued.allows(scopeWriteEvents, parsedURL.Host), nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	s := newTestServer(t, "-trusted-proxies=173.245.48.0/20, 2400:cb00::/32")
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		want       string
+	}{
+		{"trusted proxy", "173.245.48.1:443", "203.0.113.7", "203.0.113.7"},
+		{"trusted IPv6 proxy", "[2400:cb00::1]:443", "2001:db8::7", "2001:db8::7"},
+		{"spoofed header", "198.51.100.1:5000", "203.0.113.7", "198.51.100.1"},
+		{"without header", "173.245.48.1:443", "", "173.245.48.1"},
+		{"IPv6 without header", "[2001:db8::7]:5000", "", "2001:db8::7"},
+		{"unix socket", "@", "203.0.113.7", "@"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/track", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.header != "" {
+				r.Header.Set("CF-Connecting-IP", tt.header)
+			}
+			if got := s.clientIP(r); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	cloudflare := newTestServer(t, "-trusted-proxies=cloudflare")
+	for _, addr := range []string{"104.16.0.1", "2606:4700::1"} {
+		if !cloudflare.cfg.trustedProxy(netip.MustParseAddr(addr)) {
+			t.Errorf("TRUSTED_PROXIES=cloudflare doesn't trust %s", addr)
+		}
+	}
+	if cloudflare.cfg.trustedProxy(netip.MustParseAddr("198.51.100.1")) {
+		t.Errorf("TRUSTED_PROXIES=cloudflare trusts 198.51.100.1")
+	}
+
+	if _, _, err := loadConfig([]string{"-trusted-proxies=cloudfare"}); err == nil {
+		t.Errorf("loadConfig accepted an invalid TRUSTED_PROXIES")
+	}
+}
+
+// TestClientIPVisitorID checks that visitors are identified by their address
+// without the port, which changes with every connection.
+func TestClientIPVisitorID(t *testing.T) {
+	s := newTestServer(t)
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	var ids []string
+	for _, remoteAddr := range []string{"198.51.100.1:5000", "198.51.100.1:5001"} {
+		r := httptest.NewRequest(http.MethodPost, "/track", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("CF-Connecting-IP", "203.0.113.7")
+		id, err := s.visitorID("example.com", s.clientIP(r), day)
+		if err != nil {
+			t.Fatalf("visitorID: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	if want := fmt.Sprintf("%x", "198.51.100.1"); ids[0] != want || ids[1] != want {
+		t.Errorf("visitorID() = %q, want %q for both connections", ids, want)
+	}
+}
+
+func TestValidEventName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"signup":                true,
+		"checkout.completed":    true,
+		"":                      false,
+		"pageview":              false,
+		"sign up":               false,
+		"signup\n":              false,
+		strings.Repeat("a", 64): true,
+		strings.Repeat("a", 65): false,
+	} {
+		if got := validEventName(name); got != want {
+			t.Errorf("validEventName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
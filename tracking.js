@@ -1,4 +1,6 @@
 (function () {
+  // In strict compliance mode nothing is ever stored in the browser
+  var useStorage = %[2]t;
   var currentPath = null;
   var dbPromise = null;
 
@@ -95,7 +97,21 @@
     });
   }
 
+  function sendEvent(eventType) {
+    navigator.sendBeacon('%[1]s', new URLSearchParams({
+      url: window.location.href,
+      eventType: eventType // Add eventType to the tracked data
+    }));
+  }
+
   var trackEvent = function (eventType) {
+    if (!useStorage) {
+      try {
+        sendEvent(eventType);
+      } catch (e) { }
+      return;
+    }
+
     // Run cleanup roughly every 100 pageviews (random check)
     if (Math.random() < 0.01) {
       cleanOldEntries().catch(function (error) {
@@ -106,10 +122,7 @@
     shouldTrackUrl(window.location.pathname).then(function (shouldTrack) {
       if (shouldTrack) {
         try {
-          navigator.sendBeacon('%s', new URLSearchParams({
-            url: window.location.href,
-            eventType: eventType // Add eventType to the tracked data
-          }));
+          sendEvent(eventType);
           saveUrl(window.location.pathname);
         } catch (e) { }
       }
@@ -149,4 +162,12 @@
   };
 
   window.addEventListener('popstate', trackPageview);
+
+  // Custom events of the current page, like potato.track('signup')
+  window.potato = window.potato || {};
+  window.potato.track = function (name) {
+    try {
+      sendEvent(name);
+    } catch (e) { }
+  };
 })();
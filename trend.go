@@ -0,0 +1,63 @@
+package main
+
+import (
+	"time"
+)
+
+// dayStat is a day of a time series. When the series is daily, it comes with
+// its trend: the averages of the 7 days ending with it, and the percentage
+// changes since the same weekday of the previous week, null when there was
+// nothing that day.
+type dayStat struct {
+	Day       time.Time `json:"day"`
+	Visitors  int       `json:"visitors"`
+	Pageviews int       `json:"pageviews"`
+
+	VisitorsAverage     *float64 `json:"visitors_7d_average,omitempty"`
+	PageviewsAverage    *float64 `json:"pageviews_7d_average,omitempty"`
+	VisitorsWeekChange  *float64 `json:"visitors_week_change,omitempty"`
+	PageviewsWeekChange *float64 `json:"pageviews_week_change,omitempty"`
+}
+
+// addTrends sets the trend of the days of a daily series, computed from the
+// daily totals of the rows q matches, starting a week before its range so
+// that its first days have one.
+func (s *server) addTrends(q statsQuery, stats []dayStat) error {
+	if q.interval != "day" || len(stats) == 0 {
+		return nil
+	}
+
+	if !q.start.IsZero() {
+		q.start = q.start.AddDate(0, 0, -7)
+	}
+	q.dimensions, q.interval, q.order, q.limit, q.offset = nil, "day", nil, 0, 0
+	rows, err := s.queryRows(q)
+	if err != nil {
+		return err
+	}
+
+	// Days without pageviews have no row
+	totals := map[string]statsRow{}
+	for _, row := range rows {
+		totals[row.day.Format(time.DateOnly)] = row
+	}
+	total := func(day time.Time, daysBefore int) statsRow {
+		return totals[day.AddDate(0, 0, -daysBefore).Format(time.DateOnly)]
+	}
+
+	for i := range stats {
+		var visitors, pageviews int
+		for daysBefore := range 7 {
+			visitors += total(stats[i].Day, daysBefore).visitors
+			pageviews += total(stats[i].Day, daysBefore).pageviews
+		}
+		visitorsAverage, pageviewsAverage := float64(visitors)/7, float64(pageviews)/7
+		stats[i].VisitorsAverage, stats[i].PageviewsAverage = &visitorsAverage, &pageviewsAverage
+
+		lastWeek := total(stats[i].Day, 7)
+		stats[i].VisitorsWeekChange = change(stats[i].Visitors, lastWeek.visitors).Percent
+		stats[i].PageviewsWeekChange = change(stats[i].Pageviews, lastWeek.pageviews).Percent
+	}
+
+	return nil
+}
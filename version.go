@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// The build of the server, set when it's compiled with
+// -ldflags "-X main.version=v1.2.0 -X main.commit=abc1234 -X main.buildDate=2024-10-01T12:00:00Z"
+var (
+	version   = ""
+	commit    = ""
+	buildDate = ""
+)
+
+// build is the version of the server running.
+type build struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// currentBuild returns the build of the server, falling back on what the Go
+// toolchain recorded when it wasn't given with -ldflags: the module's
+// version when installed with go install, and the commit when built from a
+// git checkout.
+var currentBuild = sync.OnceValue(func() build {
+	b := build{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if b.Version == "" && info.Main.Version != "(devel)" {
+			b.Version = info.Main.Version
+		}
+		modified := false
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if b.Commit == "" {
+					b.Commit = setting.Value
+				}
+			case "vcs.time":
+				if b.BuildDate == "" {
+					b.BuildDate = setting.Value
+				}
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+		// Local changes make the commit a lie
+		if modified && commit == "" && b.Commit != "" {
+			b.Commit += "-dirty"
+		}
+	}
+	if b.Version == "" {
+		b.Version = "dev"
+	}
+	return b
+})
+
+func (s *server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(currentBuild())
+}